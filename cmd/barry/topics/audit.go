@@ -0,0 +1,93 @@
+package topics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/OnitiFR/barry/cmd/barry/client"
+	"github.com/OnitiFR/barry/common"
+	"github.com/c2h5oh/datasize"
+	"github.com/fatih/color"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+// auditCmd represents the "audit" command
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Show last remote audit report",
+	Long: `Show the result of the last remote audit: every file of the database
+is checked against the storage listing (existence and size), and any
+unknown remote object is reported.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		call := client.GlobalAPI.NewCall("GET", "/audit", map[string]string{})
+		call.JSONCallback = auditDisplay
+		call.Do()
+	},
+}
+
+func auditDisplay(reader io.Reader, headers http.Header) {
+	var data common.APIAuditReport
+	dec := json.NewDecoder(reader)
+	err := dec.Decode(&data)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if data.StartedAt.IsZero() {
+		fmt.Println("No audit was done yet.")
+		return
+	}
+
+	red := color.New(color.FgHiRed).SprintFunc()
+	green := color.New(color.FgHiGreen).SprintFunc()
+
+	fmt.Printf("Date: %s (%s)\n", data.StartedAt.Format("2006-01-02 15:04"), data.Duration.Round(time.Second))
+	fmt.Printf("Containers: %d\n", data.Containers)
+	fmt.Printf("Remote objects: %d\n", data.Objects)
+	fmt.Printf("Checked files: %d\n", data.Files)
+
+	for _, msg := range data.Errors {
+		fmt.Printf("%s %s\n", red("error:"), msg)
+	}
+
+	if len(data.Problems) == 0 {
+		fmt.Println(green("No problem found."))
+		return
+	}
+
+	strData := [][]string{}
+	for _, problem := range data.Problems {
+		expected := ""
+		remote := ""
+		if problem.Type != common.AuditProblemUnexpected {
+			expected = datasize.ByteSize(problem.ExpectedSize).HR()
+		}
+		if problem.Type != common.AuditProblemMissing {
+			remote = datasize.ByteSize(problem.RemoteSize).HR()
+		}
+		strData = append(strData, []string{
+			red(problem.Type),
+			problem.Container,
+			problem.Path,
+			expected,
+			remote,
+		})
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Problem", "Container", "Path", "Expected", "Remote"})
+	table.SetBorders(tablewriter.Border{Left: true, Top: false, Right: true, Bottom: false})
+	table.SetCenterSeparator("|")
+	table.AppendBulk(strData)
+	table.Render()
+}
+
+func init() {
+	rootCmd.AddCommand(auditCmd)
+}
@@ -53,6 +53,15 @@ __internal_file_download() {
     fi
 }
 
+__internal_file_retrieve() {
+	local prev_prev=${COMP_WORDS[COMP_CWORD-2]}
+    if [ "$prev" = "retrieve" ]; then
+		__internal_list_projects
+    elif [ "$prev_prev" =  "retrieve" ]; then
+        __internal_list_files $prev
+    fi
+}
+
 __internal_file_push() {
 	local prev_prev=${COMP_WORDS[COMP_CWORD-2]}
 	local prev3=${COMP_WORDS[COMP_CWORD-3]}
@@ -78,6 +87,10 @@ __barry_custom_func() {
 		barry_file_download)
 			__internal_file_download
             return
+            ;;
+		barry_file_retrieve)
+			__internal_file_retrieve
+            return
             ;;
 		barry_file_push)
 			__internal_file_push
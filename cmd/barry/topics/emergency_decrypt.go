@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/OnitiFR/barry/common"
 	"github.com/spf13/cobra"
@@ -12,10 +13,20 @@ import (
 
 // emergencyDecryptCmd represents the file command
 var emergencyDecryptCmd = &cobra.Command{
-	Use:   "decrypt <encrypted-file> <output-file> <base64-key-file>",
+	Use:   "decrypt <encrypted-file> <output-file> [base64-key-file]",
 	Short: "Decrypt a file locally using a key file (base64-encoded)",
-	Args:  cobra.ExactArgs(3),
+	Long: `Decrypt a file locally using a symmetric key file, or an X25519
+identity file (--identity) for files encrypted with a public key.`,
+	Args: cobra.RangeArgs(2, 3),
 	Run: func(cmd *cobra.Command, args []string) {
+		identity, _ := cmd.Flags().GetString("identity")
+		if (len(args) == 3) == (identity != "") {
+			log.Fatal("give a key file or an --identity file")
+		}
+		if identity != "" {
+			args = append(args, identity)
+		}
+
 		err := emergencyDecrypt(args)
 		if err != nil {
 			log.Fatal(err.Error())
@@ -48,13 +59,13 @@ func emergencyDecrypt(args []string) error {
 	if err != nil {
 		return fmt.Errorf("failed to read key file: %w", err)
 	}
-	key, err := base64.StdEncoding.DecodeString(string(keyFileData))
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(keyFileData)))
 	if err != nil {
 		return fmt.Errorf("failed to decode base64 key: %w", err)
 	}
 
 	err = common.DecryptFile(infile, outfile, func(keyName string) ([]byte, error) {
-		fmt.Printf("Info: file was encrypted with key '%s'\n", keyName)
+		fmt.Printf("Info: trying key '%s'\n", keyName)
 		return key, nil
 	})
 
@@ -69,4 +80,5 @@ func emergencyDecrypt(args []string) error {
 
 func init() {
 	emergencyCmd.AddCommand(emergencyDecryptCmd)
+	emergencyDecryptCmd.Flags().StringP("identity", "i", "", "X25519 identity file (base64-encoded)")
 }
@@ -0,0 +1,57 @@
+package topics
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/OnitiFR/barry/common"
+	"github.com/spf13/cobra"
+)
+
+// emergencyKeygenCmd represents the "emergency keygen" command
+var emergencyKeygenCmd = &cobra.Command{
+	Use:   "keygen <identity-file> <public-key-file>",
+	Short: "Generate an X25519 identity and its public key",
+	Long: `Generate an X25519 identity (private key) and its public key, for an
+[[encryption]] key of type "x25519". Only the public key (.pub) must be
+copied to barryd configuration path: the identity is needed to decrypt
+files, keep it offline.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := emergencyKeygen(args[0], args[1])
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+	},
+}
+
+func emergencyKeygen(identityFile string, publicFile string) error {
+	identity, public, err := common.GenerateX25519Identity()
+	if err != nil {
+		return err
+	}
+
+	if common.PathExist(identityFile) || common.PathExist(publicFile) {
+		return fmt.Errorf("'%s' or '%s' already exists", identityFile, publicFile)
+	}
+
+	err = os.WriteFile(identityFile, []byte(base64.StdEncoding.EncodeToString(identity)), 0600)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(publicFile, []byte(base64.StdEncoding.EncodeToString(public)), 0644)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Identity written to '%s' (keep it safe and offline)\n", identityFile)
+	fmt.Printf("Public key written to '%s'\n", publicFile)
+	return nil
+}
+
+func init() {
+	emergencyCmd.AddCommand(emergencyKeygenCmd)
+}
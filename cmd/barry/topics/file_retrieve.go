@@ -0,0 +1,97 @@
+package topics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/OnitiFR/barry/cmd/barry/client"
+	"github.com/OnitiFR/barry/common"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// fileRetrieveCmd represents the file retrieve command
+var fileRetrieveCmd = &cobra.Command{
+	Use:   "retrieve [<project> <file>]",
+	Short: "Ask barryd to make a file available, in the background",
+	Long: `Queue a file for retrieval: barryd unseals and downloads it by itself,
+then sends an alert when the file is ready to be downloaded (unsealing
+can take hours with some storages, there's no need to keep a "file
+download" running). Files are decrypted on the fly when downloaded.
+
+Without arguments, the retrieval queue is listed.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 0 && len(args) != 2 {
+			return fmt.Errorf("accepts 0 or 2 arg(s), received %d", len(args))
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			call := client.GlobalAPI.NewCall("GET", "/file/retrieve", map[string]string{})
+			call.JSONCallback = fileRetrieveListCB
+			call.Do()
+			return
+		}
+
+		call := client.GlobalAPI.NewCall("POST", "/file/retrieve", map[string]string{
+			"file": args[0] + "/" + args[1],
+		})
+		call.JSONCallback = fileRetrieveCB
+		call.Do()
+	},
+}
+
+func fileRetrieveCB(reader io.Reader, headers http.Header) {
+	var data common.APIRetrieval
+	dec := json.NewDecoder(reader)
+	err := dec.Decode(&data)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if data.Status == common.APIFileStatusAvailable {
+		fmt.Printf("%s is available\n", data.Path)
+		return
+	}
+
+	end := time.Now().Add(data.ETA).Format("2006-01-02 15:04")
+	fmt.Printf("%s is queued (%s: %s, %s), an alert will be sent when it's available\n", data.Path, data.Status, data.ETA, end)
+}
+
+func fileRetrieveListCB(reader io.Reader, headers http.Header) {
+	var data []common.APIRetrieval
+	dec := json.NewDecoder(reader)
+	err := dec.Decode(&data)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if len(data) == 0 {
+		fmt.Println("No retrieval in progress.")
+		return
+	}
+
+	red := color.New(color.FgHiRed).SprintFunc()
+
+	for _, retrieval := range data {
+		end := time.Now().Add(retrieval.ETA).Format("2006-01-02 15:04")
+		fmt.Printf("%s: %s (%s), requested by %s on %s\n",
+			retrieval.Path,
+			retrieval.Status,
+			end,
+			retrieval.RequestedBy,
+			retrieval.RequestedAt.Format("2006-01-02 15:04"))
+		if retrieval.Error != "" {
+			fmt.Printf("  %s %s\n", red("error:"), retrieval.Error)
+		}
+	}
+}
+
+func init() {
+	fileCmd.AddCommand(fileRetrieveCmd)
+}
@@ -0,0 +1,111 @@
+package topics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/OnitiFR/barry/cmd/barry/client"
+	"github.com/OnitiFR/barry/common"
+	"github.com/c2h5oh/datasize"
+	"github.com/fatih/color"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+// gcCmd represents the gc command
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Garbage collection of unreferenced remote objects",
+	Long: `Find remote objects referenced by no file (ex: upload failure) and
+upload leftovers (orphan segments, incomplete multipart uploads, temporary
+files), then delete them.
+
+A scan is always a dry-run: nothing is deleted until you confirm its
+report using 'gc delete <report-id>'.`,
+}
+
+// gcReport is the last report received by gcWait
+var gcReport common.APIGCReport
+
+func gcReportCB(reader io.Reader, headers http.Header) {
+	dec := json.NewDecoder(reader)
+	err := dec.Decode(&gcReport)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+}
+
+// gcWait polls the server until the current report is no more in the
+// given status
+func gcWait(status string) {
+	call := client.GlobalAPI.NewCall("GET", "/gc", map[string]string{})
+	call.JSONCallback = gcReportCB
+	for gcReport.Status == status {
+		time.Sleep(3 * time.Second)
+		call.Do()
+	}
+}
+
+func gcDisplay(report *common.APIGCReport) {
+	if report.ID == "" {
+		fmt.Println("No GC scan was done yet (see 'gc scan').")
+		return
+	}
+
+	red := color.New(color.FgHiRed).SprintFunc()
+	green := color.New(color.FgHiGreen).SprintFunc()
+
+	var total int64
+	for _, item := range report.Items {
+		total += item.Size
+	}
+
+	fmt.Printf("Report: %s (%s)\n", report.ID, report.Status)
+	fmt.Printf("Date: %s (%s)\n", report.StartedAt.Format("2006-01-02 15:04"), report.Duration.Round(time.Second))
+	fmt.Printf("Items: %d (%s)\n", len(report.Items), datasize.ByteSize(total).HR())
+	fmt.Printf("Too recent (less than %s): %d\n", report.MinAge, report.TooRecent)
+	if report.Status == common.GCStatusDone {
+		fmt.Printf("Deleted: %d\n", report.Deleted)
+	}
+	for _, msg := range report.Errors {
+		fmt.Printf("%s %s\n", red("error:"), msg)
+	}
+
+	if report.Status != common.GCStatusReady {
+		return
+	}
+
+	if len(report.Items) == 0 {
+		fmt.Println(green("Nothing to delete."))
+		return
+	}
+
+	strData := [][]string{}
+	for _, item := range report.Items {
+		strData = append(strData, []string{
+			item.Type,
+			item.Container,
+			item.Path,
+			fmt.Sprintf("%d", item.Objects),
+			datasize.ByteSize(item.Size).HR(),
+			item.ModTime.Format("2006-01-02 15:04"),
+		})
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Type", "Container", "Path", "Objects", "Size", "mtime"})
+	table.SetBorders(tablewriter.Border{Left: true, Top: false, Right: true, Bottom: false})
+	table.SetCenterSeparator("|")
+	table.AppendBulk(strData)
+	table.Render()
+
+	fmt.Printf("Nothing was deleted. To confirm, run: gc delete %s\n", report.ID)
+}
+
+func init() {
+	rootCmd.AddCommand(gcCmd)
+}
@@ -0,0 +1,33 @@
+package topics
+
+import (
+	"fmt"
+
+	"github.com/OnitiFR/barry/cmd/barry/client"
+	"github.com/OnitiFR/barry/common"
+	"github.com/spf13/cobra"
+)
+
+// gcDeleteCmd represents the "gc delete" command
+var gcDeleteCmd = &cobra.Command{
+	Use:   "delete <report-id>",
+	Short: "Delete every item of a GC report",
+	Long: `Delete every item listed by a GC scan report. The report must be the
+last one, and recent enough.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		call := client.GlobalAPI.NewCall("POST", "/gc/delete", map[string]string{
+			"id": args[0],
+		})
+		call.JSONCallback = gcReportCB
+		call.Do()
+
+		fmt.Printf("deleting %d item(s)…\n", len(gcReport.Items))
+		gcWait(common.GCStatusDeleting)
+		gcDisplay(&gcReport)
+	},
+}
+
+func init() {
+	gcCmd.AddCommand(gcDeleteCmd)
+}
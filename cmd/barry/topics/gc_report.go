@@ -0,0 +1,23 @@
+package topics
+
+import (
+	"github.com/OnitiFR/barry/cmd/barry/client"
+	"github.com/spf13/cobra"
+)
+
+// gcReportCmd represents the "gc report" command
+var gcReportCmd = &cobra.Command{
+	Use:   "report",
+	Short: "Show current GC report",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		call := client.GlobalAPI.NewCall("GET", "/gc", map[string]string{})
+		call.JSONCallback = gcReportCB
+		call.Do()
+		gcDisplay(&gcReport)
+	},
+}
+
+func init() {
+	gcCmd.AddCommand(gcReportCmd)
+}
@@ -0,0 +1,29 @@
+package topics
+
+import (
+	"fmt"
+
+	"github.com/OnitiFR/barry/cmd/barry/client"
+	"github.com/OnitiFR/barry/common"
+	"github.com/spf13/cobra"
+)
+
+// gcScanCmd represents the "gc scan" command
+var gcScanCmd = &cobra.Command{
+	Use:   "scan",
+	Short: "Scan storages for unreferenced objects (dry-run)",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		call := client.GlobalAPI.NewCall("POST", "/gc/scan", map[string]string{})
+		call.JSONCallback = gcReportCB
+		call.Do()
+
+		fmt.Printf("scanning (report %s), this may take a while…\n", gcReport.ID)
+		gcWait(common.GCStatusScanning)
+		gcDisplay(&gcReport)
+	},
+}
+
+func init() {
+	gcCmd.AddCommand(gcScanCmd)
+}
@@ -7,8 +7,8 @@ import (
 // keyCmd represents the key command
 var keyCmd = &cobra.Command{
 	Use:   "key",
-	Short: "API keys management",
-	Long:  `Manage API keys.`,
+	Short: "API and encryption keys management",
+	Long:  `Manage API keys, and unlock/lock public encryption keys.`,
 }
 
 func init() {
@@ -0,0 +1,74 @@
+package topics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/OnitiFR/barry/cmd/barry/client"
+	"github.com/OnitiFR/barry/common"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+// keyEncryptionsCmd represents the "key encryptions" command
+var keyEncryptionsCmd = &cobra.Command{
+	Use:   "encryptions",
+	Short: "List encryption keys",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		call := client.GlobalAPI.NewCall("GET", "/encryption", map[string]string{})
+		call.JSONCallback = keyEncryptionsCB
+		call.Do()
+	},
+}
+
+func keyEncryptionsCB(reader io.Reader, headers http.Header) {
+	var data []common.APIEncryption
+	dec := json.NewDecoder(reader)
+	err := dec.Decode(&data)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if len(data) == 0 {
+		fmt.Println("No encryption key, backups are unencrypted.")
+		return
+	}
+
+	strData := [][]string{}
+	for _, encryption := range data {
+		usage := ""
+		if encryption.Default {
+			usage = "default"
+		}
+		if encryption.Escrow {
+			usage = "escrow"
+		}
+
+		unlocked := ""
+		if !encryption.UnlockedUntil.IsZero() {
+			unlocked = "until " + encryption.UnlockedUntil.Format("2006-01-02 15:04")
+		}
+
+		strData = append(strData, []string{
+			encryption.Name,
+			encryption.Type,
+			usage,
+			unlocked,
+		})
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Name", "Type", "Usage", "Unlocked"})
+	table.SetBorders(tablewriter.Border{Left: true, Top: false, Right: true, Bottom: false})
+	table.SetCenterSeparator("|")
+	table.AppendBulk(strData)
+	table.Render()
+}
+
+func init() {
+	keyCmd.AddCommand(keyEncryptionsCmd)
+}
@@ -0,0 +1,23 @@
+package topics
+
+import (
+	"github.com/OnitiFR/barry/cmd/barry/client"
+	"github.com/spf13/cobra"
+)
+
+// keyLockCmd represents the "key lock" command
+var keyLockCmd = &cobra.Command{
+	Use:   "lock <encryption-key>",
+	Short: "Make barryd forget the identity of a public encryption key",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		call := client.GlobalAPI.NewCall("POST", "/encryption/lock", map[string]string{
+			"name": args[0],
+		})
+		call.Do()
+	},
+}
+
+func init() {
+	keyCmd.AddCommand(keyLockCmd)
+}
@@ -0,0 +1,49 @@
+package topics
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/OnitiFR/barry/cmd/barry/client"
+	"github.com/spf13/cobra"
+)
+
+// keyRotateCmd represents the "key rotate" command
+var keyRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Rotate files from an encryption key to another",
+	Long: `Rekey every file using an encryption key with another one. Local copies
+are rekeyed by barryd encrypter workers, and with --remote, remote objects
+are rewritten too (sealed ones are unsealed first). With per-file data
+keys (BARRY3), only the key slots are rewritten, the data is left as is.
+
+The rotation runs in the background (throttled) and resumes after a
+barryd restart, see 'key rotation' for progress. Once finished, it tells
+if the old key is still used by some files: remove it from the
+configuration only when it's not.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		from, _ := cmd.Flags().GetString("from")
+		to, _ := cmd.Flags().GetString("to")
+		remote, _ := cmd.Flags().GetBool("remote")
+
+		call := client.GlobalAPI.NewCall("POST", "/encryption/rotate", map[string]string{
+			"from":   from,
+			"to":     to,
+			"remote": strconv.FormatBool(remote),
+		})
+		call.JSONCallback = keyRotationCB
+		call.Do()
+
+		fmt.Println("Key rotation started, see 'key rotation' for progress.")
+	},
+}
+
+func init() {
+	keyCmd.AddCommand(keyRotateCmd)
+	keyRotateCmd.Flags().String("from", "", "old encryption key")
+	keyRotateCmd.Flags().String("to", "", "new encryption key")
+	keyRotateCmd.Flags().Bool("remote", false, "rewrite remote objects too")
+	keyRotateCmd.MarkFlagRequired("from")
+	keyRotateCmd.MarkFlagRequired("to")
+}
@@ -0,0 +1,78 @@
+package topics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/OnitiFR/barry/cmd/barry/client"
+	"github.com/OnitiFR/barry/common"
+	"github.com/c2h5oh/datasize"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// keyRotationCmd represents the "key rotation" command
+var keyRotationCmd = &cobra.Command{
+	Use:   "rotation",
+	Short: "Show key rotation progress",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		call := client.GlobalAPI.NewCall("GET", "/encryption/rotation", map[string]string{})
+		call.JSONCallback = keyRotationCB
+		call.Do()
+	},
+}
+
+func keyRotationCB(reader io.Reader, headers http.Header) {
+	var data common.APIKeyRotationStatus
+	dec := json.NewDecoder(reader)
+	err := dec.Decode(&data)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if data.ID == "" {
+		fmt.Println("No key rotation was done yet.")
+		return
+	}
+
+	red := color.New(color.FgHiRed).SprintFunc()
+	green := color.New(color.FgHiGreen).SprintFunc()
+
+	fmt.Printf("Rotation: %s\n", data.ID)
+	fmt.Printf("From: %s\n", data.From)
+	fmt.Printf("To: %s\n", data.To)
+	fmt.Printf("Remote: %t\n", data.Remote)
+	fmt.Printf("Created: %s\n", data.CreatedAt.Format("2006-01-02 15:04"))
+	if data.FinishedAt.IsZero() {
+		fmt.Printf("Status: running\n")
+	} else {
+		fmt.Printf("Status: %s (%s)\n", green("finished"), data.FinishedAt.Format("2006-01-02 15:04"))
+	}
+	fmt.Printf("Files: %d/%d rotated, %d skipped, %d failed, %d unsealing\n",
+		data.FilesDone, data.FilesTotal, data.FilesSkipped, data.FilesFailed, data.FilesUnsealing)
+	fmt.Printf("Size: %s/%s\n", datasize.ByteSize(data.BytesDone).HR(), datasize.ByteSize(data.BytesTotal).HR())
+
+	if data.Current != "" {
+		fmt.Printf("Current: %s\n", data.Current)
+	}
+
+	if !data.FinishedAt.IsZero() {
+		if data.References == 0 {
+			fmt.Printf("Key '%s': %s\n", data.From, green("not used anymore, it can be removed"))
+		} else {
+			fmt.Printf("Key '%s': %s\n", data.From, red(fmt.Sprintf("still used by %d file(s)", data.References)))
+		}
+	}
+
+	for _, msg := range data.Errors {
+		fmt.Printf("%s %s\n", red("error:"), msg)
+	}
+}
+
+func init() {
+	keyCmd.AddCommand(keyRotationCmd)
+}
@@ -0,0 +1,41 @@
+package topics
+
+import (
+	"log"
+	"os"
+	"strings"
+
+	"github.com/OnitiFR/barry/cmd/barry/client"
+	"github.com/spf13/cobra"
+)
+
+// keyUnlockCmd represents the "key unlock" command
+var keyUnlockCmd = &cobra.Command{
+	Use:   "unlock <encryption-key> <identity-file>",
+	Short: "Supply the identity of a public encryption key to barryd",
+	Long: `Supply the identity (private key) of a public encryption key, so
+barryd can decrypt files encrypted with it (retrieval, download, …). The
+identity is only kept in memory, and forgotten after --duration or with
+the "key lock" command.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		duration, _ := cmd.Flags().GetString("duration")
+
+		identity, err := os.ReadFile(args[1])
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		call := client.GlobalAPI.NewCall("POST", "/encryption/unlock", map[string]string{
+			"name":     args[0],
+			"identity": strings.TrimSpace(string(identity)),
+			"duration": duration,
+		})
+		call.Do()
+	},
+}
+
+func init() {
+	keyCmd.AddCommand(keyUnlockCmd)
+	keyUnlockCmd.Flags().StringP("duration", "d", "1h", "unlock duration (24h max)")
+}
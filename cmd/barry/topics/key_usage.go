@@ -0,0 +1,78 @@
+package topics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/OnitiFR/barry/cmd/barry/client"
+	"github.com/OnitiFR/barry/common"
+	"github.com/c2h5oh/datasize"
+	"github.com/fatih/color"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+// keyUsageCmd represents the "key usage" command
+var keyUsageCmd = &cobra.Command{
+	Use:   "usage",
+	Short: "List stored files count and size by encryption key",
+	Long: `List, for each encryption key, how many stored files (local copies and
+remote objects) are using it. A key can be removed from the configuration
+only when no file is using it anymore (see 'key rotate').`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		call := client.GlobalAPI.NewCall("GET", "/encryption/usage", map[string]string{})
+		call.JSONCallback = keyUsageCB
+		call.Do()
+	},
+}
+
+func keyUsageCB(reader io.Reader, headers http.Header) {
+	var data []common.APIEncryptionUsage
+	dec := json.NewDecoder(reader)
+	err := dec.Decode(&data)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if len(data) == 0 {
+		fmt.Println("No encryption key, backups are unencrypted.")
+		return
+	}
+
+	red := color.New(color.FgHiRed).SprintFunc()
+	yellow := color.New(color.FgHiYellow).SprintFunc()
+
+	strData := [][]string{}
+	for _, usage := range data {
+		name := usage.Name
+		switch {
+		case name == "":
+			name = yellow("(unknown key)")
+		case !usage.Configured:
+			name = red(name + " (removed)")
+		}
+
+		strData = append(strData, []string{
+			name,
+			fmt.Sprintf("%d", usage.LocalFiles),
+			datasize.ByteSize(usage.LocalSize).HR(),
+			fmt.Sprintf("%d", usage.RemoteFiles),
+			datasize.ByteSize(usage.RemoteSize).HR(),
+		})
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Name", "Local files", "Local size", "Remote files", "Remote size"})
+	table.SetBorders(tablewriter.Border{Left: true, Top: false, Right: true, Bottom: false})
+	table.SetCenterSeparator("|")
+	table.AppendBulk(strData)
+	table.Render()
+}
+
+func init() {
+	keyCmd.AddCommand(keyUsageCmd)
+}
@@ -140,10 +140,14 @@ func projectFileListCB(reader io.Reader, headers http.Header) {
 			if line.Retrieved {
 				container = "(retrieved)"
 			}
+			size := datasize.ByteSize(line.Size).HR()
+			if line.Compression != "" {
+				size = fmt.Sprintf("%s (%s, %s)", size, line.Compression, datasize.ByteSize(line.OriginalSize).HR())
+			}
 			strData = append(strData, []string{
 				name,
 				line.ModTime.Format("2006-01-02 15:04"),
-				datasize.ByteSize(line.Size).HR(),
+				size,
 				expire,
 				container,
 			})
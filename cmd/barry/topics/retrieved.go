@@ -0,0 +1,18 @@
+package topics
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// retrievedCmd represents the retrieved command
+var retrievedCmd = &cobra.Command{
+	Use:   "retrieved",
+	Short: "Retrieved files cache management",
+	Long: `Files only stored remotely are downloaded (retrieved) by barryd when
+requested, and kept for a while (see retrieved_ttl and retrieved_max_size
+settings). This cache can be listed and purged.`,
+}
+
+func init() {
+	rootCmd.AddCommand(retrievedCmd)
+}
@@ -0,0 +1,67 @@
+package topics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/OnitiFR/barry/cmd/barry/client"
+	"github.com/OnitiFR/barry/common"
+	"github.com/c2h5oh/datasize"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+// retrievedListCmd represents the "retrieved list" command
+var retrievedListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List retrieved files, least recently used first",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		call := client.GlobalAPI.NewCall("GET", "/retrieved", map[string]string{})
+		call.JSONCallback = retrievedListCB
+		call.Do()
+	},
+}
+
+func retrievedListCB(reader io.Reader, headers http.Header) {
+	var data []common.APIRetrievedFile
+	dec := json.NewDecoder(reader)
+	err := dec.Decode(&data)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if len(data) == 0 {
+		fmt.Println("No retrieved file.")
+		return
+	}
+
+	var total int64
+	strData := [][]string{}
+	for _, file := range data {
+		total += file.Size
+		strData = append(strData, []string{
+			file.Path,
+			datasize.ByteSize(file.Size).HR(),
+			file.RetrievedAt.Format("2006-01-02 15:04"),
+			file.UsedAt.Format("2006-01-02 15:04"),
+			file.ExpireAt.Format("2006-01-02 15:04"),
+		})
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"File", "Size", "Retrieved", "Used", "Expire"})
+	table.SetBorders(tablewriter.Border{Left: true, Top: false, Right: true, Bottom: false})
+	table.SetCenterSeparator("|")
+	table.AppendBulk(strData)
+	table.Render()
+
+	fmt.Printf("Total: %d file(s), %s\n", len(data), datasize.ByteSize(total).HR())
+}
+
+func init() {
+	retrievedCmd.AddCommand(retrievedListCmd)
+}
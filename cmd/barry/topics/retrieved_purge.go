@@ -0,0 +1,40 @@
+package topics
+
+import (
+	"log"
+
+	"github.com/OnitiFR/barry/cmd/barry/client"
+	"github.com/spf13/cobra"
+)
+
+// retrievedPurgeCmd represents the "retrieved purge" command
+var retrievedPurgeCmd = &cobra.Command{
+	Use:   "purge [<project> [file]]",
+	Short: "Delete retrieved files",
+	Long: `Delete the retrieved copy of a file, of every file of a project, or
+of every file (--all). Files are still available remotely.`,
+	Args: cobra.MaximumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		all, _ := cmd.Flags().GetBool("all")
+
+		params := map[string]string{}
+		if len(args) > 0 {
+			params["project"] = args[0]
+		}
+		if len(args) > 1 {
+			params["file"] = args[1]
+		}
+
+		if len(args) == 0 && !all {
+			log.Fatal("give a project (and a file), or use --all")
+		}
+
+		call := client.GlobalAPI.NewCall("POST", "/retrieved/purge", params)
+		call.Do()
+	},
+}
+
+func init() {
+	retrievedCmd.AddCommand(retrievedPurgeCmd)
+	retrievedPurgeCmd.Flags().Bool("all", false, "purge every retrieved file")
+}
@@ -51,6 +51,10 @@ func statusDisplay(reader io.Reader, headers http.Header) {
 	for id, status := range data.Encrypters {
 		fmt.Printf("  %d: %s\n", id+1, status)
 	}
+	fmt.Println("Containers:")
+	for _, status := range data.Containers {
+		fmt.Printf("  %s\n", status)
+	}
 }
 
 func init() {
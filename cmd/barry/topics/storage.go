@@ -0,0 +1,16 @@
+package topics
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// storageCmd represents the storage command
+var storageCmd = &cobra.Command{
+	Use:   "storage",
+	Short: "Storage management",
+	Long:  `Manage remote storages (migration of files between containers, object metadata).`,
+}
+
+func init() {
+	rootCmd.AddCommand(storageCmd)
+}
@@ -0,0 +1,100 @@
+package topics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/OnitiFR/barry/cmd/barry/client"
+	"github.com/OnitiFR/barry/common"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// storageMetadataCmd represents the "storage metadata" command
+var storageMetadataCmd = &cobra.Command{
+	Use:   "metadata",
+	Short: "Attach metadata to existing remote objects",
+	Long: `Every uploaded object carries metadata describing its file (project,
+filename, mtime, size, checksum of the original content, encryption key,
+expiration dates), so a container listing is enough to know what each
+object is.
+
+This command attaches (or refreshes) these metadata on objects uploaded
+before this feature. The checksum of such old files is only known if
+their local copy is still available. With S3, objects are copied onto
+themselves (server-side), and archived objects must be restored first.
+
+Use --status to show the state of the last run without starting a new one.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		project, _ := cmd.Flags().GetString("project")
+		status, _ := cmd.Flags().GetBool("status")
+
+		if !status {
+			call := client.GlobalAPI.NewCall("POST", "/storage/metadata", map[string]string{
+				"project": project,
+			})
+			call.JSONCallback = storageMetadataCB
+			call.Do()
+			fmt.Printf("updating metadata of %d object(s), this may take a while…\n", storageMetadataStatus.Files)
+		}
+
+		call := client.GlobalAPI.NewCall("GET", "/storage/metadata", map[string]string{})
+		call.JSONCallback = storageMetadataCB
+		call.Do()
+		for !status && storageMetadataStatus.Running {
+			time.Sleep(3 * time.Second)
+			call.Do()
+		}
+
+		storageMetadataDisplay(&storageMetadataStatus)
+	},
+}
+
+// storageMetadataStatus is the last state received by storageMetadataCB
+var storageMetadataStatus common.APIMetadataBackfill
+
+func storageMetadataCB(reader io.Reader, headers http.Header) {
+	dec := json.NewDecoder(reader)
+	err := dec.Decode(&storageMetadataStatus)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+}
+
+func storageMetadataDisplay(data *common.APIMetadataBackfill) {
+	if data.StartedAt.IsZero() {
+		fmt.Println("No metadata backfill was done since barryd started.")
+		return
+	}
+
+	red := color.New(color.FgHiRed).SprintFunc()
+	green := color.New(color.FgHiGreen).SprintFunc()
+
+	project := data.Project
+	if project == "" {
+		project = "(all)"
+	}
+
+	fmt.Printf("Project: %s\n", project)
+	fmt.Printf("Started: %s\n", data.StartedAt.Format("2006-01-02 15:04"))
+	if data.Running {
+		fmt.Printf("Status: running\n")
+	} else {
+		fmt.Printf("Status: %s (%s)\n", green("finished"), data.Duration.Round(time.Second))
+	}
+	fmt.Printf("Objects: %d/%d updated\n", data.Updated, data.Files)
+	for _, msg := range data.Errors {
+		fmt.Printf("%s %s\n", red("error:"), msg)
+	}
+}
+
+func init() {
+	storageCmd.AddCommand(storageMetadataCmd)
+	storageMetadataCmd.Flags().StringP("project", "p", "", "only update objects of this project")
+	storageMetadataCmd.Flags().Bool("status", false, "show the state of the last run")
+}
@@ -0,0 +1,47 @@
+package topics
+
+import (
+	"fmt"
+
+	"github.com/OnitiFR/barry/cmd/barry/client"
+	"github.com/spf13/cobra"
+)
+
+// storageMigrateCmd represents the "storage migrate" command
+var storageMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Migrate files from a container to another",
+	Long: `Move every remote file of a container (optionally limited to a project)
+to another container, possibly on another storage. Each file is copied
+through barryd, moved in the database (with its new cost), then deleted
+from the source container.
+
+Sealed (cold) files are unsealed first. The migration runs in the
+background and resumes after a barryd restart, see 'storage migration'
+for progress.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		from, _ := cmd.Flags().GetString("from")
+		to, _ := cmd.Flags().GetString("to")
+		project, _ := cmd.Flags().GetString("project")
+
+		call := client.GlobalAPI.NewCall("POST", "/storage/migrate", map[string]string{
+			"from":    from,
+			"to":      to,
+			"project": project,
+		})
+		call.JSONCallback = storageMigrationCB
+		call.Do()
+
+		fmt.Println("Migration started, see 'storage migration' for progress.")
+	},
+}
+
+func init() {
+	storageCmd.AddCommand(storageMigrateCmd)
+	storageMigrateCmd.Flags().String("from", "", "source container")
+	storageMigrateCmd.Flags().String("to", "", "destination container (must be an upload container)")
+	storageMigrateCmd.Flags().StringP("project", "p", "", "only migrate files of this project")
+	storageMigrateCmd.MarkFlagRequired("from")
+	storageMigrateCmd.MarkFlagRequired("to")
+}
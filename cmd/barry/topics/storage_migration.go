@@ -0,0 +1,83 @@
+package topics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/OnitiFR/barry/cmd/barry/client"
+	"github.com/OnitiFR/barry/common"
+	"github.com/c2h5oh/datasize"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// storageMigrationCmd represents the "storage migration" command
+var storageMigrationCmd = &cobra.Command{
+	Use:   "migration",
+	Short: "Show storage migration progress",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		call := client.GlobalAPI.NewCall("GET", "/storage/migration", map[string]string{})
+		call.JSONCallback = storageMigrationCB
+		call.Do()
+	},
+}
+
+func storageMigrationCB(reader io.Reader, headers http.Header) {
+	var data common.APIMigrationStatus
+	dec := json.NewDecoder(reader)
+	err := dec.Decode(&data)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if data.ID == "" {
+		fmt.Println("No migration was done yet.")
+		return
+	}
+
+	red := color.New(color.FgHiRed).SprintFunc()
+	green := color.New(color.FgHiGreen).SprintFunc()
+
+	project := data.Project
+	if project == "" {
+		project = "(all)"
+	}
+
+	fmt.Printf("Migration: %s\n", data.ID)
+	fmt.Printf("From: %s\n", data.From)
+	fmt.Printf("To: %s\n", data.To)
+	fmt.Printf("Project: %s\n", project)
+	fmt.Printf("Created: %s\n", data.CreatedAt.Format("2006-01-02 15:04"))
+	if data.FinishedAt.IsZero() {
+		fmt.Printf("Status: running\n")
+	} else {
+		fmt.Printf("Status: %s (%s)\n", green("finished"), data.FinishedAt.Format("2006-01-02 15:04"))
+	}
+	fmt.Printf("Files: %d/%d migrated, %d skipped, %d failed, %d unsealing\n",
+		data.FilesDone, data.FilesTotal, data.FilesSkipped, data.FilesFailed, data.FilesUnsealing)
+	fmt.Printf("Size: %s/%s\n", datasize.ByteSize(data.BytesDone).HR(), datasize.ByteSize(data.BytesTotal).HR())
+
+	if data.Current != "" {
+		perc := 0.0
+		if data.CurrentSize > 0 {
+			perc = float64(data.CurrentWritten) / float64(data.CurrentSize) * 100
+		}
+		fmt.Printf("Current: %s (%s/%s, %.1f%%)\n",
+			data.Current,
+			datasize.ByteSize(data.CurrentWritten).HR(),
+			datasize.ByteSize(data.CurrentSize).HR(),
+			perc)
+	}
+
+	for _, msg := range data.Errors {
+		fmt.Printf("%s %s\n", red("error:"), msg)
+	}
+}
+
+func init() {
+	storageCmd.AddCommand(storageMigrationCmd)
+}
@@ -0,0 +1,23 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/OnitiFR/barry/cmd/barryd/server"
+)
+
+// GetAuditController returns the last remote audit report
+func GetAuditController(req *server.Request) {
+	req.Response.Header().Set("Content-Type", "application/json")
+
+	retData := req.App.Audit.Last()
+
+	enc := json.NewEncoder(req.Response)
+	err := enc.Encode(&retData)
+	if err != nil {
+		req.App.Log.Error(server.MsgGlob, err.Error())
+		http.Error(req.Response, err.Error(), 500)
+		return
+	}
+}
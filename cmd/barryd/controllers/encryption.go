@@ -0,0 +1,155 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/OnitiFR/barry/cmd/barryd/server"
+	"github.com/OnitiFR/barry/common"
+)
+
+// ListEncryptionsController lists encryption keys
+func ListEncryptionsController(req *server.Request) {
+	req.Response.Header().Set("Content-Type", "application/json")
+
+	retData := make([]common.APIEncryption, 0)
+	for _, encryption := range req.App.Config.Encryptions {
+		retData = append(retData, common.APIEncryption{
+			Name:          encryption.Name,
+			Type:          encryption.Type,
+			Default:       encryption.Default,
+			Escrow:        encryption.Escrow,
+			UnlockedUntil: req.App.Identities.UnlockedUntil(encryption.Name),
+		})
+	}
+
+	sort.Slice(retData, func(i, j int) bool {
+		return retData[i].Name < retData[j].Name
+	})
+
+	enc := json.NewEncoder(req.Response)
+	err := enc.Encode(&retData)
+	if err != nil {
+		req.App.Log.Error(server.MsgGlob, err.Error())
+		http.Error(req.Response, err.Error(), 500)
+		return
+	}
+}
+
+// EncryptionUsageController lists the count and size of stored files
+// using each encryption key
+func EncryptionUsageController(req *server.Request) {
+	req.Response.Header().Set("Content-Type", "application/json")
+
+	retData := req.App.EncryptionUsage()
+
+	enc := json.NewEncoder(req.Response)
+	err := enc.Encode(&retData)
+	if err != nil {
+		req.App.Log.Error(server.MsgGlob, err.Error())
+		http.Error(req.Response, err.Error(), 500)
+		return
+	}
+}
+
+// UnlockEncryptionController supplies the identity (private key) of a
+// public key encryption for a while
+func UnlockEncryptionController(req *server.Request) {
+	name := strings.TrimSpace(req.HTTP.FormValue("name"))
+	if name == "" {
+		http.Error(req.Response, "invalid name", 400)
+		return
+	}
+
+	identity, err := base64.StdEncoding.DecodeString(strings.TrimSpace(req.HTTP.FormValue("identity")))
+	if err != nil {
+		http.Error(req.Response, "invalid identity: "+err.Error(), 400)
+		return
+	}
+
+	duration := time.Hour
+	if str := req.HTTP.FormValue("duration"); str != "" {
+		duration, err = time.ParseDuration(str)
+		if err != nil {
+			http.Error(req.Response, "invalid duration: "+err.Error(), 400)
+			return
+		}
+	}
+
+	until, err := req.App.UnlockEncryption(name, identity, duration, req.APIKey.Comment)
+	if err != nil {
+		req.App.Log.Error(server.MsgGlob, err.Error())
+		http.Error(req.Response, err.Error(), 400)
+		return
+	}
+
+	req.Response.Write([]byte(fmt.Sprintf("encryption key '%s' unlocked until %s\n", name, until.Format("2006-01-02 15:04"))))
+}
+
+// LockEncryptionController forgets the identity of a public key encryption
+func LockEncryptionController(req *server.Request) {
+	name := strings.TrimSpace(req.HTTP.FormValue("name"))
+	if name == "" {
+		http.Error(req.Response, "invalid name", 400)
+		return
+	}
+
+	err := req.App.LockEncryption(name, req.APIKey.Comment)
+	if err != nil {
+		req.App.Log.Error(server.MsgGlob, err.Error())
+		http.Error(req.Response, err.Error(), 400)
+		return
+	}
+
+	req.Response.Write([]byte(fmt.Sprintf("encryption key '%s' locked\n", name)))
+}
+
+// RotateEncryptionController starts a key rotation job
+func RotateEncryptionController(req *server.Request) {
+	from := strings.TrimSpace(req.HTTP.FormValue("from"))
+	to := strings.TrimSpace(req.HTTP.FormValue("to"))
+	remote := req.HTTP.FormValue("remote") == "true"
+
+	if from == "" || to == "" {
+		msg := "from and to keys are required"
+		req.App.Log.Error(server.MsgGlob, msg)
+		http.Error(req.Response, msg, 400)
+		return
+	}
+
+	status, err := req.App.StartKeyRotation(from, to, remote)
+	if err != nil {
+		req.App.Log.Error(server.MsgGlob, err.Error())
+		http.Error(req.Response, err.Error(), 409)
+		return
+	}
+
+	writeKeyRotationStatus(req, status)
+}
+
+// EncryptionRotationController returns the progress of the current (or
+// last) key rotation
+func EncryptionRotationController(req *server.Request) {
+	status := req.App.KeyRotation.Status()
+	if status == nil {
+		status = &common.APIKeyRotationStatus{}
+	}
+	writeKeyRotationStatus(req, status)
+}
+
+func writeKeyRotationStatus(req *server.Request, status *common.APIKeyRotationStatus) {
+	req.Response.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(req.Response)
+	err := enc.Encode(status)
+	if err != nil {
+		req.App.Log.Error(server.MsgGlob, err.Error())
+		http.Error(req.Response, err.Error(), 500)
+		return
+	}
+}
@@ -47,31 +47,26 @@ func FileStatusController(req *server.Request) {
 	}
 }
 
-// getLocalPath will return the local path of an available file
-func getLocalPath(fullPath string, app *server.App) (string, *server.File, error) {
+// getAvailableFile will return a file, if available (see server.OpenFile)
+func getAvailableFile(fullPath string, app *server.App) (*server.File, error) {
 	projectName := filepath.Dir(fullPath)
 	fileName := filepath.Base(fullPath)
 
 	file := app.ProjectDB.FindFile(projectName, fileName)
 	if file == nil {
-		return "", nil, fmt.Errorf("can't file '%s' in project '%s'", fileName, projectName)
+		return nil, fmt.Errorf("can't file '%s' in project '%s'", fileName, projectName)
 	}
 
 	availability, err := app.MakeFileAvailable(file)
 	if err != nil {
-		return "", file, err
+		return file, err
 	}
 
 	if availability.Status != common.APIFileStatusAvailable {
-		return "", file, fmt.Errorf("file '%s' in project '%s' is not available", fileName, projectName)
+		return file, fmt.Errorf("file '%s' in project '%s' is not available", fileName, projectName)
 	}
 
-	path, err := file.GetLocalPath(app)
-	if err != nil {
-		return "", file, err
-	}
-
-	return path, file, nil
+	return file, nil
 }
 
 // FileDownloadController return the file stream
@@ -83,16 +78,31 @@ func FileDownloadController(req *server.Request) {
 	projectName := filepath.Dir(fullPath)
 	fileName := filepath.Base(fullPath)
 
-	path, _, err := getLocalPath(fullPath, req.App)
+	file, err := getAvailableFile(fullPath, req.App)
 	if err != nil {
 		req.App.Log.Error(projectName, err.Error())
 		http.Error(req.Response, err.Error(), 500)
 		return
 	}
 
+	// decrypted on the fly, the stored file stays encrypted
+	reader, err := req.App.OpenFile(file)
+	if err != nil {
+		req.App.Log.Error(projectName, err.Error())
+		http.Error(req.Response, err.Error(), 500)
+		return
+	}
+	defer reader.Close()
+
 	req.App.Log.Infof(projectName, "file '%s' (%s) is downloaded by key '%s'", fileName, projectName, req.APIKey.Comment)
 
-	http.ServeFile(req.Response, req.HTTP, path)
+	// a decryption error truncates the response (Content-Length)
+	req.Response.Header().Set("Content-Length", strconv.FormatInt(file.GetOriginalSize(), 10))
+	req.Response.Header().Set("Last-Modified", file.ModTime.UTC().Format(http.TimeFormat))
+	_, err = io.Copy(req.Response, reader)
+	if err != nil {
+		req.App.Log.Errorf(projectName, "download of '%s' (%s) failed: %s", fileName, projectName, err)
+	}
 }
 
 // FileUploadController will upload a file to the server
@@ -239,7 +249,7 @@ func FilePushStatusController(req *server.Request) {
 		return
 	}
 
-	path, file, err := getLocalPath(fullPath, req.App)
+	file, err := getAvailableFile(fullPath, req.App)
 	if err != nil {
 		req.App.Log.Error(projectName, err.Error())
 		http.Error(req.Response, err.Error(), 500)
@@ -287,7 +297,7 @@ func FilePushStatusController(req *server.Request) {
 
 		switch pusherConfig.Type {
 		case server.PusherTypeMulch:
-			_, err = server.NewPusherMulch(file, path, expire, pusherConfig, req.App.Log)
+			_, err = server.NewPusherMulch(file, req.App.OpenFile, expire, pusherConfig, req.App.Log)
 		default:
 			err = fmt.Errorf("pusher type '%s' not implemented", pusherConfig.Type)
 		}
@@ -307,3 +317,52 @@ func FilePushStatusController(req *server.Request) {
 		return
 	}
 }
+
+// FileRetrieveController queues a file for retrieval, barryd will make it
+// available by itself and send an alert when it's ready
+func FileRetrieveController(req *server.Request) {
+	req.Response.Header().Set("Content-Type", "application/json")
+
+	fullPath := req.HTTP.FormValue("file")
+
+	projectName := filepath.Dir(fullPath)
+	fileName := filepath.Base(fullPath)
+
+	file := req.App.ProjectDB.FindFile(projectName, fileName)
+	if file == nil {
+		msg := fmt.Sprintf("can't find file '%s' in project '%s'", fileName, projectName)
+		req.App.Log.Error(projectName, msg)
+		http.Error(req.Response, msg, 404)
+		return
+	}
+
+	retData, err := req.App.RequestRetrieval(file, req.APIKey.Comment)
+	if err != nil {
+		req.App.Log.Error(projectName, err.Error())
+		http.Error(req.Response, err.Error(), 500)
+		return
+	}
+
+	enc := json.NewEncoder(req.Response)
+	err = enc.Encode(&retData)
+	if err != nil {
+		req.App.Log.Error(projectName, err.Error())
+		http.Error(req.Response, err.Error(), 500)
+		return
+	}
+}
+
+// ListRetrievalsController returns the retrieval queue
+func ListRetrievalsController(req *server.Request) {
+	req.Response.Header().Set("Content-Type", "application/json")
+
+	retData := req.App.Retrieval.List()
+
+	enc := json.NewEncoder(req.Response)
+	err := enc.Encode(&retData)
+	if err != nil {
+		req.App.Log.Error(server.MsgGlob, err.Error())
+		http.Error(req.Response, err.Error(), 500)
+		return
+	}
+}
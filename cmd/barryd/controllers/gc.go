@@ -0,0 +1,50 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/OnitiFR/barry/cmd/barryd/server"
+	"github.com/OnitiFR/barry/common"
+)
+
+// GetGCController returns the current garbage collection report
+func GetGCController(req *server.Request) {
+	writeGCReport(req, req.App.GC.Report())
+}
+
+// GCScanController starts a new garbage collection scan (dry-run)
+func GCScanController(req *server.Request) {
+	report, err := req.App.StartGCScan()
+	if err != nil {
+		req.App.Log.Error(server.MsgGlob, err.Error())
+		http.Error(req.Response, err.Error(), 409)
+		return
+	}
+	writeGCReport(req, report)
+}
+
+// GCDeleteController deletes every item of a scan report, confirmed by ID
+func GCDeleteController(req *server.Request) {
+	id := req.HTTP.FormValue("id")
+
+	report, err := req.App.ConfirmGC(id)
+	if err != nil {
+		req.App.Log.Error(server.MsgGlob, err.Error())
+		http.Error(req.Response, err.Error(), 409)
+		return
+	}
+	writeGCReport(req, report)
+}
+
+func writeGCReport(req *server.Request, report common.APIGCReport) {
+	req.Response.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(req.Response)
+	err := enc.Encode(&report)
+	if err != nil {
+		req.App.Log.Error(server.MsgGlob, err.Error())
+		http.Error(req.Response, err.Error(), 500)
+		return
+	}
+}
@@ -0,0 +1,42 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/OnitiFR/barry/cmd/barryd/server"
+	"github.com/OnitiFR/barry/common"
+)
+
+// StorageMetadataBackfillController starts attaching metadata to remote
+// objects of existing files
+func StorageMetadataBackfillController(req *server.Request) {
+	project := strings.TrimSpace(req.HTTP.FormValue("project"))
+
+	status, err := req.App.StartMetadataBackfill(project)
+	if err != nil {
+		req.App.Log.Error(server.MsgGlob, err.Error())
+		http.Error(req.Response, err.Error(), 409)
+		return
+	}
+	writeMetadataBackfill(req, status)
+}
+
+// StorageMetadataController returns the state of the current (or last)
+// metadata backfill
+func StorageMetadataController(req *server.Request) {
+	writeMetadataBackfill(req, req.App.MetadataBackfill.Status())
+}
+
+func writeMetadataBackfill(req *server.Request, status common.APIMetadataBackfill) {
+	req.Response.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(req.Response)
+	err := enc.Encode(&status)
+	if err != nil {
+		req.App.Log.Error(server.MsgGlob, err.Error())
+		http.Error(req.Response, err.Error(), 500)
+		return
+	}
+}
@@ -98,6 +98,8 @@ func ListProjectController(req *server.Request) {
 			Filename:      file.Filename,
 			ModTime:       file.ModTime,
 			Size:          file.Size,
+			OriginalSize:  file.GetOriginalSize(),
+			Compression:   file.Compression,
 			ExpireLocal:   file.ExpireLocal,
 			ExpireRemote:  file.ExpireRemote,
 			RemoteKeep:    file.RemoteKeep,
@@ -0,0 +1,47 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/OnitiFR/barry/cmd/barryd/server"
+)
+
+// ListRetrievedController returns the retrieved copies of remote files
+func ListRetrievedController(req *server.Request) {
+	req.Response.Header().Set("Content-Type", "application/json")
+
+	retData := req.App.RetrievedFiles()
+
+	enc := json.NewEncoder(req.Response)
+	err := enc.Encode(&retData)
+	if err != nil {
+		req.App.Log.Error(server.MsgGlob, err.Error())
+		http.Error(req.Response, err.Error(), 500)
+		return
+	}
+}
+
+// PurgeRetrievedController deletes retrieved copies of a file, of a
+// project, or all of them
+func PurgeRetrievedController(req *server.Request) {
+	projectName := strings.TrimSpace(req.HTTP.FormValue("project"))
+	fileName := strings.TrimSpace(req.HTTP.FormValue("file"))
+
+	if fileName != "" && projectName == "" {
+		http.Error(req.Response, "a project is needed with a file", 400)
+		return
+	}
+
+	count, err := req.App.PurgeRetrieved(projectName, fileName)
+	if err != nil {
+		req.App.Log.Error(server.MsgGlob, err.Error())
+		http.Error(req.Response, err.Error(), 500)
+		return
+	}
+
+	req.App.Log.Infof(server.MsgGlob, "%d retrieved file(s) purged by key '%s'", count, req.APIKey.Comment)
+	req.Response.Write([]byte(fmt.Sprintf("%d retrieved file(s) purged\n", count)))
+}
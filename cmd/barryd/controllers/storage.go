@@ -0,0 +1,55 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/OnitiFR/barry/cmd/barryd/server"
+	"github.com/OnitiFR/barry/common"
+)
+
+// StorageMigrateController starts a container-to-container migration
+func StorageMigrateController(req *server.Request) {
+	from := strings.TrimSpace(req.HTTP.FormValue("from"))
+	to := strings.TrimSpace(req.HTTP.FormValue("to"))
+	project := strings.TrimSpace(req.HTTP.FormValue("project"))
+
+	if from == "" || to == "" {
+		msg := "from and to containers are required"
+		req.App.Log.Error(server.MsgGlob, msg)
+		http.Error(req.Response, msg, 400)
+		return
+	}
+
+	status, err := req.App.StartMigration(from, to, project)
+	if err != nil {
+		req.App.Log.Error(server.MsgGlob, err.Error())
+		http.Error(req.Response, err.Error(), 409)
+		return
+	}
+
+	writeMigrationStatus(req, status)
+}
+
+// StorageMigrationController returns the progress of the current (or
+// last) migration
+func StorageMigrationController(req *server.Request) {
+	status := req.App.Migration.Status()
+	if status == nil {
+		status = &common.APIMigrationStatus{}
+	}
+	writeMigrationStatus(req, status)
+}
+
+func writeMigrationStatus(req *server.Request, status *common.APIMigrationStatus) {
+	req.Response.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(req.Response)
+	err := enc.Encode(status)
+	if err != nil {
+		req.App.Log.Error(server.MsgGlob, err.Error())
+		http.Error(req.Response, err.Error(), 500)
+		return
+	}
+}
@@ -17,6 +17,7 @@ var configTrace = flag.Bool("trace", false, "show trace messages (debug)")
 var configPretty = flag.Bool("pretty", false, "show pretty messages")
 var configVersion = flag.Bool("version", false, "show version")
 var configRestore = flag.Bool("restore", false, "restore databases (emergency, will ERASE local projects and keys!)")
+var configRebuild = flag.Bool("rebuild-from-remote", false, "rebuild projects database from storage listings (emergency, will ERASE local projects!)")
 var configGenkey = flag.Bool("genkey", false, "generate non-existing encryption keys")
 
 func main() {
@@ -52,6 +53,15 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *configRebuild {
+		reportPath, err := app.RebuildFromRemote()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("rebuild report: %s\n", reportPath)
+		os.Exit(0)
+	}
+
 	AddRoutes(app)
 	app.Run()
 }
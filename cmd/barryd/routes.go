@@ -45,6 +45,14 @@ func AddRoutes(app *server.App) {
 		Route:   "GET /file/push/status",
 		Handler: controllers.FilePushStatusController,
 	})
+	app.AddRoute(&server.Route{
+		Route:   "POST /file/retrieve",
+		Handler: controllers.FileRetrieveController,
+	})
+	app.AddRoute(&server.Route{
+		Route:   "GET /file/retrieve",
+		Handler: controllers.ListRetrievalsController,
+	})
 	app.AddRoute(&server.Route{
 		Route:   "POST /file/upload",
 		Handler: controllers.FileUploadController,
@@ -61,6 +69,70 @@ func AddRoutes(app *server.App) {
 		Route:   "GET /status",
 		Handler: controllers.GetStatusController,
 	})
+	app.AddRoute(&server.Route{
+		Route:   "GET /audit",
+		Handler: controllers.GetAuditController,
+	})
+	app.AddRoute(&server.Route{
+		Route:   "GET /gc",
+		Handler: controllers.GetGCController,
+	})
+	app.AddRoute(&server.Route{
+		Route:   "POST /gc/scan",
+		Handler: controllers.GCScanController,
+	})
+	app.AddRoute(&server.Route{
+		Route:   "POST /gc/delete",
+		Handler: controllers.GCDeleteController,
+	})
+	app.AddRoute(&server.Route{
+		Route:   "POST /storage/migrate",
+		Handler: controllers.StorageMigrateController,
+	})
+	app.AddRoute(&server.Route{
+		Route:   "GET /storage/migration",
+		Handler: controllers.StorageMigrationController,
+	})
+	app.AddRoute(&server.Route{
+		Route:   "POST /storage/metadata",
+		Handler: controllers.StorageMetadataBackfillController,
+	})
+	app.AddRoute(&server.Route{
+		Route:   "GET /storage/metadata",
+		Handler: controllers.StorageMetadataController,
+	})
+	app.AddRoute(&server.Route{
+		Route:   "GET /retrieved",
+		Handler: controllers.ListRetrievedController,
+	})
+	app.AddRoute(&server.Route{
+		Route:   "POST /retrieved/purge",
+		Handler: controllers.PurgeRetrievedController,
+	})
+	app.AddRoute(&server.Route{
+		Route:   "GET /encryption",
+		Handler: controllers.ListEncryptionsController,
+	})
+	app.AddRoute(&server.Route{
+		Route:   "GET /encryption/usage",
+		Handler: controllers.EncryptionUsageController,
+	})
+	app.AddRoute(&server.Route{
+		Route:   "POST /encryption/unlock",
+		Handler: controllers.UnlockEncryptionController,
+	})
+	app.AddRoute(&server.Route{
+		Route:   "POST /encryption/lock",
+		Handler: controllers.LockEncryptionController,
+	})
+	app.AddRoute(&server.Route{
+		Route:   "POST /encryption/rotate",
+		Handler: controllers.RotateEncryptionController,
+	})
+	app.AddRoute(&server.Route{
+		Route:   "GET /encryption/rotation",
+		Handler: controllers.EncryptionRotationController,
+	})
 	app.AddRoute(&server.Route{
 		Route:   "GET /destination",
 		Handler: controllers.GetDestinationsController,
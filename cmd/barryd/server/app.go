@@ -1,9 +1,13 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"net/http"
@@ -11,30 +15,41 @@ import (
 	"os/signal"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/OnitiFR/barry/common"
+	"github.com/c2h5oh/datasize"
 )
 
 // App describes an application
 type App struct {
-	StartTime   time.Time
-	Config      *AppConfig
-	ProjectDB   *ProjectDatabase
-	WaitList    *WaitList
-	Uploader    *Uploader
-	Encrypter   *Encrypter
-	Storage     *Storage
-	Log         *Log
-	LogHistory  *LogHistory
-	AlertSender *AlertSender
-	Stats       *Stats
-	APIKeysDB   *APIKeyDatabase
-	InternalDB  *InternalDB
-	Rand        *rand.Rand
-	MuxAPI      *http.ServeMux
+	StartTime        time.Time
+	Config           *AppConfig
+	ProjectDB        *ProjectDatabase
+	WaitList         *WaitList
+	Uploader         *Uploader
+	Encrypter        *Encrypter
+	Storage          *Storage
+	Log              *Log
+	LogHistory       *LogHistory
+	AlertSender      *AlertSender
+	Stats            *Stats
+	APIKeysDB        *APIKeyDatabase
+	InternalDB       *InternalDB
+	Audit            *Audit
+	GC               *GC
+	Migration        *Migration
+	KeyRotation      *KeyRotation
+	Quota            *Quota
+	MetadataBackfill *MetadataBackfill
+	Retrieval        *Retrieval
+	Identities       *Identities
+	Rand             *rand.Rand
+	MuxAPI           *http.ServeMux
 
 	// HealthCheckPath is the (stable, randomized) public URL path used for
 	// unauthenticated liveness checks, e.g. "/health-8f3a2b".
@@ -47,9 +62,15 @@ type App struct {
 
 // Database filenames
 const (
-	FilenameAPIDB      = "api-keys.db"
-	FilenameProjectDB  = "projects.db"
-	FilenameInternalDB = "internal.db"
+	FilenameAPIDB         = "api-keys.db"
+	FilenameProjectDB     = "projects.db"
+	FilenameInternalDB    = "internal.db"
+	FilenameUploadJournal = "upload-journal.db"
+	FilenameAuditReport   = "audit.db"
+	FilenameMigration     = "migration.db"
+	FilenameRebuild       = "rebuild-report.txt"
+	FilenameRetrieval     = "retrieval.db"
+	FilenameKeyRotation   = "key-rotation.db"
 )
 
 // internalKeyHealthCheckPath is the InternalDB key holding the health check path
@@ -61,11 +82,12 @@ const healthCheckRandLength = 12
 // NewApp create a new application
 func NewApp(config *AppConfig, rand *rand.Rand) (*App, error) {
 	app := &App{
-		StartTime: time.Now(),
-		Config:    config,
-		Rand:      rand,
-		routesAPI: make(map[string][]*Route),
-		MuxAPI:    http.NewServeMux(),
+		StartTime:  time.Now(),
+		Config:     config,
+		Rand:       rand,
+		routesAPI:  make(map[string][]*Route),
+		MuxAPI:     http.NewServeMux(),
+		Identities: NewIdentities(),
 	}
 	return app, nil
 }
@@ -94,8 +116,14 @@ func (app *App) Init(trace bool, pretty bool) error {
 	defEncrypt := app.Config.GetDefaultEncryption()
 	if defEncrypt != nil {
 		app.Log.Infof(MsgGlob, "default key: %s", defEncrypt.Name)
+		if len(defEncrypt.escrows) > 0 {
+			app.Log.Infof(MsgGlob, "data keys are also wrapped with: %s", strings.Join(defEncrypt.MasterKeyNames()[1:], ", "))
+		}
 	} else {
 		app.Log.Warning(MsgGlob, "no default key defined, backups will be unencrypted")
+		if app.Config.Compression != common.CompressionNone {
+			app.Log.Warningf(MsgGlob, "compression '%s' needs a default key, backups will be uncompressed", app.Config.Compression)
+		}
 	}
 
 	dataBaseFilename, err := app.LocalStoragePath("data", FilenameProjectDB)
@@ -127,13 +155,33 @@ func (app *App) Init(trace bool, pretty bool) error {
 	}
 	app.ProjectDB = db
 
+	err = app.backfillEncryptionKeys()
+	if err != nil {
+		return err
+	}
+
+	err = app.checkRemovedEncryptionKeys()
+	if err != nil {
+		return err
+	}
+
 	waitList, err := NewWaitList(app.Config.QueuePath, app.waitListFilter, app.queueFile, app.Log)
 	if err != nil {
 		return err
 	}
 	app.WaitList = waitList
 
-	app.Storage, err = NewStorage(app.Config)
+	uploadJournalFilename, err := app.LocalStoragePath("data", FilenameUploadJournal)
+	if err != nil {
+		return err
+	}
+
+	uploadJournal, err := NewUploadJournal(uploadJournalFilename, app.Log)
+	if err != nil {
+		return err
+	}
+
+	app.Storage, err = NewStorage(app.Config, uploadJournal, app.Log)
 	if err != nil {
 		return err
 	}
@@ -146,9 +194,17 @@ func (app *App) Init(trace bool, pretty bool) error {
 		uploadContainers[container.Name] = true
 	}
 
+	// an unreachable storage (connected on demand) is not a startup
+	// failure: it's marked unhealthy, and tried again after the cool-down
 	for _, storage := range app.Config.Storages {
 		for _, container := range storage.Containers {
 			err = app.Storage.CheckContainer(container, uploadContainers[container])
+			if isStorageError(err) {
+				until := app.Storage.MarkUnhealthy(container)
+				app.Log.Errorf(MsgGlob, "container '%s': %s (storage '%s' marked unhealthy until %s)",
+					container, err, storage.Name, until.Format("15:04"))
+				continue
+			}
 			if err != nil {
 				return err
 			}
@@ -156,8 +212,11 @@ func (app *App) Init(trace bool, pretty bool) error {
 		}
 	}
 
-	app.Uploader = NewUploader(app.Config.NumUploaders, app.Storage, app.Log)
-	app.Encrypter = NewEncrypter(app.Config.NumEncrypters, app.Log, app.Rand)
+	app.GC = NewGC()
+	app.Quota = NewQuota()
+	app.MetadataBackfill = NewMetadataBackfill()
+	app.Uploader = NewUploader(app.Config.NumUploaders, app.Storage, app.Log, app.Config.QueuePath)
+	app.Encrypter = NewEncrypter(app.Config.NumEncrypters, app.Log)
 	app.Stats = NewStats()
 
 	keyDataBaseFilename, err := app.LocalStoragePath("data", FilenameAPIDB)
@@ -182,6 +241,46 @@ func (app *App) Init(trace bool, pretty bool) error {
 	}
 	app.InternalDB = internalDB
 
+	auditFilename, err := app.LocalStoragePath("data", FilenameAuditReport)
+	if err != nil {
+		return err
+	}
+
+	app.Audit, err = NewAudit(auditFilename)
+	if err != nil {
+		return err
+	}
+
+	migrationFilename, err := app.LocalStoragePath("data", FilenameMigration)
+	if err != nil {
+		return err
+	}
+
+	app.Migration, err = NewMigration(migrationFilename, app.Log)
+	if err != nil {
+		return err
+	}
+
+	keyRotationFilename, err := app.LocalStoragePath("data", FilenameKeyRotation)
+	if err != nil {
+		return err
+	}
+
+	app.KeyRotation, err = NewKeyRotation(keyRotationFilename, app.Log)
+	if err != nil {
+		return err
+	}
+
+	retrievalFilename, err := app.LocalStoragePath("data", FilenameRetrieval)
+	if err != nil {
+		return err
+	}
+
+	app.Retrieval, err = NewRetrieval(retrievalFilename, app.Log)
+	if err != nil {
+		return err
+	}
+
 	// generate the health check path once, then keep it stable across restarts
 	app.HealthCheckPath, err = app.InternalDB.GetOrSet(internalKeyHealthCheckPath, func() string {
 		return "/health-" + RandString(healthCheckRandLength, app.Rand)
@@ -204,9 +303,15 @@ func (app *App) Run() {
 	app.Encrypter.Start()
 	go app.ProjectDB.ScheduleExpireFiles()
 	go app.ProjectDB.ScheduleNoBackupAlerts()
-	go app.ProjectDB.ScheduleReEncryptFiles(app)
+	go app.encryptPlainLocalFiles()
 	go app.ScheduleScan()
 	go app.ScheduleSelfBackup()
+	go app.ScheduleAudit()
+	go app.ScheduleMigration()
+	go app.ScheduleKeyRotation()
+	go app.ScheduleQuotaCheck()
+	go app.ScheduleRetrieval()
+	go app.ScheduleRetrievedClean()
 
 	app.registerRouteHandlers(app.MuxAPI, app.routesAPI)
 
@@ -289,18 +394,90 @@ func (app *App) MoveFileToStorage(file *File) error {
 	return nil
 }
 
+// replaceByLocalCopy will move the local copy written during upload to our
+// storage, and delete the queue file
+func (app *App) replaceByLocalCopy(file *File, localCopy string) error {
+	source := filepath.Clean(app.Config.QueuePath + "/" + file.Path)
+	dest, err := app.LocalStoragePath(FileStorageName, file.Path)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(localCopy, dest)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(source)
+	if err != nil {
+		return err
+	}
+	app.Log.Infof(file.ProjectName(), "file '%s' stored (encrypted during upload)", file.Path)
+	return nil
+}
+
 // UploadAndStore will upload and store a file
 func (app *App) UploadAndStore(projectName string, file *File) error {
 	defEncrypt := app.Config.GetDefaultEncryption()
 	sourcePath := path.Clean(app.Config.QueuePath + "/" + file.Path)
 
+	// plaintext of a queue file encrypted in place, kept until the file is
+	// stored: a retry must not take our ciphertext for a file that was
+	// already encrypted (its compression and sizes would be lost)
+	plainPath := filepath.Join(filepath.Dir(sourcePath), "."+filepath.Base(sourcePath)+".plain")
+	restored, err := app.restoreQueuePlaintext(sourcePath, plainPath)
+	if err != nil {
+		return err
+	}
+	if restored {
+		// interrupted try, the file was queued with its encrypted size
+		stat, err := os.Stat(sourcePath)
+		if err != nil {
+			return err
+		}
+		file.Size = stat.Size()
+	}
+
+	stored := false
+	defer func() {
+		if stored {
+			os.Remove(plainPath)
+			return
+		}
+		_, err := app.restoreQueuePlaintext(sourcePath, plainPath)
+		if err != nil {
+			app.Log.Errorf(projectName, "unable to restore plaintext of '%s': %s", file.Path, err)
+		}
+	}()
+
 	alreadyEncrypted, errE := common.IsFileEncrypted(sourcePath)
 	if errE != nil {
 		return errE
 	}
 
+	// compression is recorded in the encryption header
+	compression := common.CompressionNone
 	if defEncrypt != nil && !alreadyEncrypted {
+		compression = app.Config.Compression
+	}
+
+	// encryption during upload (see uploadToContainer), the compressed
+	// size is not known in advance
+	var streamEncrypt *EncryptionConfig
+	if defEncrypt != nil && !alreadyEncrypted && app.Config.EncryptionMode != EncryptionModeFile && compression == common.CompressionNone {
+		streamEncrypt = defEncrypt
+	}
+
+	file.OriginalSize = file.Size
+	if defEncrypt != nil && !alreadyEncrypted && streamEncrypt == nil {
+		// the encrypted file replaces the queue file, the link is untouched
+		err = os.Link(sourcePath, plainPath)
+		if err != nil {
+			return fmt.Errorf("unable to keep plaintext of '%s': %s", file.Path, err)
+		}
+
 		enc := NewEncrypt(defEncrypt, sourcePath)
+		enc.Compression = compression
 		atomic.AddInt32(&app.encryptQueueSize, 1)
 		app.Encrypter.Channel <- enc
 		atomic.AddInt32(&app.encryptQueueSize, -1)
@@ -310,42 +487,148 @@ func (app *App) UploadAndStore(projectName string, file *File) error {
 		}
 
 		file.Encrypted = true
+
+		if compression != common.CompressionNone {
+			file.Size, err = compressedSize(sourcePath)
+			if err != nil {
+				return err
+			}
+			file.Compression = compression
+			app.Log.Tracef(projectName, "'%s' compressed with %s: %s -> %s", file.Filename, compression,
+				datasize.ByteSize(file.OriginalSize).HR(), datasize.ByteSize(file.Size).HR())
+		}
 	}
 
-	// let's found the cheapest container for this file
-	var minimumCost float64
-	var bestContainer string
+	// checksum of the original content and key, for remote object metadata
+	sha, keyName, err := fileChecksum(sourcePath)
+	if err != nil {
+		return fmt.Errorf("checksum error: %s", err)
+	}
+	file.SHA256 = sha
+	file.EncryptionKey = keyName
+	if streamEncrypt != nil {
+		file.EncryptionKey = streamEncrypt.Name
+	}
+
+	// the local copy is written during upload (encrypted once)
+	localCopy := ""
+	if streamEncrypt != nil {
+		dest, err := app.LocalStoragePath(FileStorageName, file.Path)
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(filepath.Dir(dest), os.ModePerm)
+		if err != nil {
+			return err
+		}
+		localCopy = filepath.Join(filepath.Dir(dest), "."+filepath.Base(dest)+".encrypting")
+		defer os.Remove(localCopy) // no-op after a successful rename
+	}
+
+	// size of the remote object, checked by audits
+	if streamEncrypt != nil {
+		file.ObjectSize = common.EncryptedSize(common.EncryptionV3, streamEncrypt.MasterKeys(), file.Size)
+	} else {
+		stat, err := os.Stat(sourcePath)
+		if err != nil {
+			return err
+		}
+		file.ObjectSize = stat.Size()
+	}
+
+	// rank containers by cost for this file
+	costs := make(map[*Container]float64)
+	candidates := make([]*Container, 0)
 	for _, container := range app.Config.Containers {
 		cost, err := container.Cost(file.Size, file.RemoteKeep)
 		if err != nil {
 			return fmt.Errorf("container cost evaluation error: %s", err)
 		}
 		app.Log.Tracef(projectName, "cost for container '%s': %f", container.Name, cost)
-		if cost < minimumCost || bestContainer == "" {
-			minimumCost = cost
-			bestContainer = container.Name
-		}
+		costs[container] = cost
+		candidates = append(candidates, container)
 	}
-	app.Log.Tracef(projectName, "using container '%s' for file '%s'", bestContainer, file.Filename)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return costs[candidates[i]] < costs[candidates[j]]
+	})
 
-	file.Status = FileStatusUploading // info: does not propagate back to the WaitList (useless?)
-	file.Cost = minimumCost
-	file.Container = bestContainer
+	// try each container, from the cheapest one, failing over to the next
+	// one if the storage is down
+	var bestContainer *Container
+	var lastErr error
+	failures := make([]string, 0)
+	for _, container := range candidates {
+		if !app.Storage.IsHealthy(container.Name) {
+			app.Log.Tracef(projectName, "container '%s' skipped, storage '%s' is unhealthy", container.Name, app.Storage.StorageName(container.Name))
+			continue
+		}
+		if !app.QuotaReserve(container, file.Size) {
+			app.Log.Tracef(projectName, "container '%s' skipped, not enough quota left", container.Name)
+			continue
+		}
+		app.Log.Tracef(projectName, "using container '%s' for file '%s'", container.Name, file.Filename)
 
-	upload := NewUpload(projectName, file)
+		err := app.uploadToContainer(projectName, file, container.Name, costs[container], streamEncrypt, localCopy)
+		if err == nil {
+			bestContainer = container
+			break
+		}
+		app.QuotaRelease(container, file.Size)
 
-	// send to upload worker, and wait
-	atomic.AddInt32(&app.uploadQueueSize, 1)
-	app.Uploader.Channel <- upload
-	atomic.AddInt32(&app.uploadQueueSize, -1)
-	err := <-upload.Result
+		// only failures of the storage itself are worth another container
+		if !isStorageError(err) {
+			return err
+		}
 
-	if err != nil {
-		return fmt.Errorf("upload error: %s", err)
+		until := app.Storage.MarkUnhealthy(container.Name)
+		msg := fmt.Sprintf("container '%s': %s (storage '%s' marked unhealthy until %s)",
+			container.Name, err, app.Storage.StorageName(container.Name), until.Format("15:04"))
+		app.Log.Errorf(projectName, "failover: '%s' to %s", file.Filename, msg)
+		failures = append(failures, msg)
+		lastErr = err
+	}
+
+	if bestContainer == nil {
+		if lastErr != nil {
+			return lastErr
+		}
+		return fmt.Errorf("no healthy upload container with enough quota left for '%s' (%s)", file.Filename, datasize.ByteSize(file.Size).HR())
+	}
+	defer app.QuotaRelease(bestContainer, file.Size)
+
+	// uploads abandoned in other containers (failover, now or during a
+	// previous try) won't be resumed, their segments are useless
+	for _, container := range candidates {
+		if container == bestContainer {
+			continue
+		}
+		err := app.Storage.AbandonUpload(container.Name, file.Path)
+		if err != nil {
+			app.Log.Warningf(projectName, "unable to clean abandoned upload of '%s' in container '%s': %s", file.Path, container.Name, err)
+		}
+	}
+
+	if len(failures) > 0 {
+		msg := fmt.Sprintf("failover: '%s' uploaded to container '%s' after %d failure(s):\n%s",
+			file.Path, bestContainer.Name, len(failures), strings.Join(failures, "\n"))
+		app.Log.Warning(projectName, msg)
+		app.AlertSender.Send(&Alert{
+			Type:    AlertTypeBad,
+			Subject: "Failover",
+			Content: msg,
+		})
 	}
 
 	// move the file to the local storage
-	err = app.MoveFileToStorage(file)
+	if localCopy != "" {
+		err = app.replaceByLocalCopy(file, localCopy)
+		file.Encrypted = true
+	} else {
+		err = app.MoveFileToStorage(file)
+	}
+	if file.Encrypted || alreadyEncrypted {
+		file.LocalEncryptionKey = file.EncryptionKey
+	}
 	if err != nil {
 		return fmt.Errorf("move error: %s", err)
 	}
@@ -359,44 +642,185 @@ func (app *App) UploadAndStore(projectName string, file *File) error {
 	}
 
 	app.Stats.Inc(1, file.Size)
+	stored = true
 
 	return nil
 }
 
-// MakeFileAvailable will do all the work needed to make the file available (downloadable and decypted)
-// This action is asynchronous, the function will return current file status with an ETA.
-// This function is designed to be called repetitively.
-func (app *App) MakeFileAvailable(file *File) (common.APIFileStatus, error) {
-	status, err := app.makeFileLocal(file)
+// restoreQueuePlaintext puts back the plaintext of a queue file (if kept,
+// see UploadAndStore) after a failed try, and returns true if it did. A
+// stale plaintext, for a queue file that is not encrypted anymore, is
+// removed.
+func (app *App) restoreQueuePlaintext(sourcePath string, plainPath string) (bool, error) {
+	_, err := os.Stat(plainPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
 	if err != nil {
-		return status, err
+		return false, err
 	}
 
-	if status.Status != common.APIFileStatusAvailable {
-		return status, nil
+	encrypted, err := common.IsFileEncrypted(sourcePath)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err == nil && !encrypted {
+		return false, os.Remove(plainPath)
+	}
+	return true, os.Rename(plainPath, sourcePath)
+}
+
+// uploadToContainer uploads a file to the given container, checking the
+// result if needed. With encryption, the file is encrypted during upload
+// (and the ciphertext written to localCopy, if not empty).
+func (app *App) uploadToContainer(projectName string, file *File, container string, cost float64, encryption *EncryptionConfig, localCopy string) error {
+	file.Status = FileStatusUploading // info: does not propagate back to the WaitList (useless?)
+	file.Cost = cost
+	file.Container = container
+
+	upload := NewUpload(projectName, file)
+	upload.Encryption = encryption
+	upload.LocalCopy = localCopy
+
+	// send to upload worker, and wait
+	atomic.AddInt32(&app.uploadQueueSize, 1)
+	app.Uploader.Channel <- upload
+	atomic.AddInt32(&app.uploadQueueSize, -1)
+	err := <-upload.Result
+
+	if err != nil {
+		return fmt.Errorf("upload error: %w", err)
 	}
 
-	// File is available locally, let's decrypt it if needed
-	if file.Encrypted {
-		sourcePath, err := file.GetLocalPath(app)
+	// check the remote object before trusting it
+	if app.Config.VerifyUploads {
+		if encryption != nil {
+			err = app.verifyEncryptedUpload(file, encryption)
+		} else {
+			err = app.Storage.Verify(file)
+		}
 		if err != nil {
-			return status, err
+			return fmt.Errorf("upload verification error: %s", err)
 		}
+		app.Log.Tracef(projectName, "upload of file '%s' verified", file.Filename)
+	}
 
-		err = app.DecryptFileInPlace(sourcePath, app.Log)
-		if err != nil {
-			return status, err
+	return nil
+}
+
+// verifyEncryptedUpload reads back an object encrypted during upload,
+// checking its authentication and the checksum of the decrypted content.
+// Sealed objects can't be read and are not verified, objects encrypted
+// with a (locked) public key are only checked for their header and size.
+func (app *App) verifyEncryptedUpload(file *File, encryption *EncryptionConfig) error {
+	availability, _, err := app.Storage.ObjectAvailability(file.Container, file.Path)
+	if err != nil {
+		return err
+	}
+	if availability != ObjectUnsealed {
+		app.Log.Tracef(file.ProjectName(), "verification of '%s' skipped, object is %s", file.Filename, availability)
+		return nil
+	}
+
+	remote, err := app.Storage.ObjectOpen(file.Container, file.Path)
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+
+	reader := bufio.NewReader(remote)
+
+	if encryption.PublicKey != nil {
+		if _, unlocked := app.Identities.get(encryption.Name); !unlocked {
+			header, err := common.ReadEncryptionHeader(reader)
+			if err != nil {
+				return err
+			}
+			if header.KeyName != encryption.Name {
+				return fmt.Errorf("remote key is '%s', expected '%s'", header.KeyName, encryption.Name)
+			}
+
+			n, err := io.Copy(io.Discard, reader)
+			if err != nil {
+				return err
+			}
+			size := header.PlainSize(header.Size() + n)
+			if size != file.Size {
+				return fmt.Errorf("remote content size is %d, local size is %d", size, file.Size)
+			}
+			app.Log.Tracef(file.ProjectName(), "content of '%s' not authenticated (key '%s' is locked)", file.Filename, encryption.Name)
+			return nil
 		}
-		file.Encrypted = false
-		file.ReEncryptDate = time.Now().Add(ReEncryptDelay)
-		app.ProjectDB.Save()
 	}
 
-	return status, nil
+	hash := sha256.New()
+	err = common.DecryptFile(reader, hash, func(keyName string) ([]byte, error) {
+		if keyName != encryption.Name {
+			return nil, fmt.Errorf("remote key is '%s', expected '%s'", keyName, encryption.Name)
+		}
+		return app.encryptionKeyCallback(keyName)
+	})
+	if err != nil {
+		return err
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if sum != file.SHA256 {
+		return fmt.Errorf("remote checksum is %s, local checksum is %s", sum, file.SHA256)
+	}
+	return nil
+}
+
+// verifyObject checks the size of an object written from a stream, and its
+// content against the SHA-256 of that stream (not for sealed objects, they
+// can't be read back)
+func (app *App) verifyObject(container string, objectPath string, size int64, sum []byte) error {
+	remoteSize, err := app.Storage.ObjectSize(container, objectPath)
+	if err != nil {
+		return err
+	}
+	if remoteSize != size {
+		return fmt.Errorf("size is %d, expected %d", remoteSize, size)
+	}
+
+	availability, _, err := app.Storage.ObjectAvailability(container, objectPath)
+	if err != nil {
+		return err
+	}
+	if availability != ObjectUnsealed {
+		app.Log.Tracef(path.Dir(objectPath), "content of '%s' not verified, object is %s", objectPath, availability)
+		return nil
+	}
+
+	remote, err := app.Storage.ObjectOpen(container, objectPath)
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, remote)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash.Sum(nil), sum) {
+		return errors.New("checksum mismatch")
+	}
+
+	return nil
 }
 
-// makeFileLocal do most of MakeFileAvailable internal's work, except decryption
-// TODO: add some sort of watcher to jump automatically from "unsealed" to "retrieving" status
+// MakeFileAvailable will do all the work needed to make the file available (downloadable, see OpenFile)
+// This action is asynchronous, the function will return current file status with an ETA.
+// This function is designed to be called repetitively.
+func (app *App) MakeFileAvailable(file *File) (common.APIFileStatus, error) {
+	unlock := app.Retrieval.lockFile(file.Path)
+	defer unlock()
+
+	return app.makeFileLocal(file)
+}
+
+// makeFileLocal do MakeFileAvailable internal's work
 func (app *App) makeFileLocal(file *File) (common.APIFileStatus, error) {
 	var status common.APIFileStatus
 
@@ -407,6 +831,7 @@ func (app *App) makeFileLocal(file *File) (common.APIFileStatus, error) {
 	}
 
 	if file.RetrievedPath != "" {
+		file.RetrievedUsedAt = time.Now()
 		status.Status = common.APIFileStatusAvailable
 		status.ETA = 0
 		return status, nil
@@ -415,16 +840,20 @@ func (app *App) makeFileLocal(file *File) (common.APIFileStatus, error) {
 	if file.retriever != nil {
 		retriever := file.retriever
 
-		if retriever.Finished {
+		if finished, err := retriever.IsFinished(); finished {
 			file.retriever = nil
-			if retriever.Error != nil {
-				return status, retriever.Error
+			if err != nil {
+				return status, err
 			}
 			app.Log.Infof(file.ProjectName(), "file '%s' retrieved", file.Filename)
 			file.RetrievedPath = retriever.Path
 			file.RetrievedDate = time.Now()
+			file.RetrievedUsedAt = file.RetrievedDate
 			app.ProjectDB.Save()
 
+			// make room in the cache if needed
+			go app.CleanRetrieved()
+
 			status.Status = common.APIFileStatusAvailable
 			status.ETA = 0
 			return status, nil
@@ -459,9 +888,11 @@ func (app *App) makeFileLocal(file *File) (common.APIFileStatus, error) {
 		return status, nil
 
 	case ObjectUnsealed:
-		// TODO: allow two files from two different projects to be retrieved
-		// even if they have the same name!
-		path, err := app.LocalStoragePath(RetrievedStorageName, file.Filename)
+		path, err := app.LocalStoragePath(RetrievedStorageName, file.Path)
+		if err != nil {
+			return status, err
+		}
+		err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
 		if err != nil {
 			return status, err
 		}
@@ -496,9 +927,34 @@ func (app *App) Status() (*common.APIStatus, error) {
 	ret.TotalFileCost = dbStats.TotalCost
 	ret.Uploaders = app.Uploader.StatusSnapshot()
 	ret.Encrypters = app.Encrypter.StatusSnapshot()
-	ret.UploadQueueSize = int(atomic.LoadInt32(&app.uploadQueueSize))
+	ret.Containers = app.QuotaStatus()
+	ret.UploadQueueSize = int(atomic.LoadInt32(&app.uploadQueueSize)) + app.Uploader.HeldCount()
 	ret.EncryptQueueSize = int(atomic.LoadInt32(&app.encryptQueueSize))
 
+	ret.Migration = "none"
+	migration := app.Migration.Status()
+	if migration != nil && migration.FinishedAt.IsZero() {
+		ret.Migration = fmt.Sprintf("%s, %d/%d file(s), %s/%s",
+			migration.ID,
+			migration.FilesDone+migration.FilesSkipped+migration.FilesFailed,
+			migration.FilesTotal,
+			datasize.ByteSize(migration.BytesDone).HR(),
+			datasize.ByteSize(migration.BytesTotal).HR())
+	}
+
+	ret.KeyRotation = "none"
+	rotation := app.KeyRotation.Status()
+	if rotation != nil && rotation.FinishedAt.IsZero() {
+		ret.KeyRotation = fmt.Sprintf("%s, '%s' to '%s', %d/%d file(s), %s/%s",
+			rotation.ID,
+			rotation.From,
+			rotation.To,
+			rotation.FilesDone+rotation.FilesSkipped+rotation.FilesFailed,
+			rotation.FilesTotal,
+			datasize.ByteSize(rotation.BytesDone).HR(),
+			datasize.ByteSize(rotation.BytesTotal).HR())
+	}
+
 	return &ret, nil
 }
 
@@ -8,8 +8,11 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/OnitiFR/barry/common"
+	"github.com/c2h5oh/datasize"
 )
 
 // AppConfig describes the general configuration of an App
@@ -19,7 +22,13 @@ type AppConfig struct {
 	TempPath            string
 	NumUploaders        int
 	NumEncrypters       int
+	EncryptionMode      string
+	Compression         string
 	SelfBackupContainer string
+	VerifyUploads       bool
+	AllowRemovedKeys    bool
+	RetrievedTTL        time.Duration
+	RetrievedMaxSize    uint64
 	Expiration          *ExpirationConfig
 	Storages            []*StorageConfig
 	API                 *APIConfig
@@ -40,7 +49,13 @@ type tomlAppConfig struct {
 	TempPath            string `toml:"temp_path"`
 	NumUploaders        int    `toml:"num_uploaders"`
 	NumEncrypters       int    `toml:"num_encrypters"`
+	EncryptionMode      string `toml:"encryption_mode"`
+	Compression         string `toml:"compression"`
 	SelfBackupContainer string `toml:"self_backup_container"`
+	VerifyUploads       bool   `toml:"verify_uploads"`
+	AllowRemovedKeys    bool   `toml:"allow_removed_keys"`
+	RetrievedTTL        string `toml:"retrieved_ttl"`
+	RetrievedMaxSize    string `toml:"retrieved_max_size"`
 	Expiration          *tomlExpiration
 	Storages            []*tomlStorage         `toml:"storage"`
 	API                 *tomlAPIConfig
@@ -67,6 +82,8 @@ func NewAppConfigFromTomlFile(configPath string, autogenKey bool, rand *rand.Ran
 		LocalStoragePath: "var/storage",
 		NumUploaders:     2,
 		NumEncrypters:    2,
+		EncryptionMode:   EncryptionModeFile,
+		RetrievedTTL:     "168h",
 		Expiration: &tomlExpiration{
 			Local:  []string{"keep 30 days"},
 			Remote: []string{"keep 30 days", "keep 90 days every 7 files"},
@@ -141,7 +158,41 @@ func NewAppConfigFromTomlFile(configPath string, autogenKey bool, rand *rand.Ran
 	}
 	appConfig.NumEncrypters = tConfig.NumEncrypters
 
+	switch tConfig.EncryptionMode {
+	case EncryptionModeFile, EncryptionModeStream:
+		appConfig.EncryptionMode = tConfig.EncryptionMode
+	case EncryptionModeStreamPlainLocal:
+		appConfig.EncryptionMode = EncryptionModeStream
+	default:
+		return nil, fmt.Errorf("encryption_mode: unknown mode '%s'", tConfig.EncryptionMode)
+	}
+
+	err = common.CheckCompression(tConfig.Compression)
+	if err != nil {
+		return nil, fmt.Errorf("compression: %s", err)
+	}
+	appConfig.Compression = tConfig.Compression
+
 	appConfig.SelfBackupContainer = tConfig.SelfBackupContainer
+	appConfig.VerifyUploads = tConfig.VerifyUploads
+	appConfig.AllowRemovedKeys = tConfig.AllowRemovedKeys
+
+	appConfig.RetrievedTTL, err = time.ParseDuration(tConfig.RetrievedTTL)
+	if err != nil {
+		return nil, fmt.Errorf("retrieved_ttl: %s", err)
+	}
+	if appConfig.RetrievedTTL <= 0 {
+		return nil, errors.New("retrieved_ttl must be positive")
+	}
+
+	if tConfig.RetrievedMaxSize != "" {
+		var maxSize datasize.ByteSize
+		err = maxSize.UnmarshalText([]byte(tConfig.RetrievedMaxSize))
+		if err != nil {
+			return nil, fmt.Errorf("retrieved_max_size: %s", err)
+		}
+		appConfig.RetrievedMaxSize = maxSize.Bytes()
+	}
 
 	appConfig.Expiration, err = NewExpirationConfigFromToml(tConfig.Expiration)
 	if err != nil {
@@ -165,7 +216,7 @@ func NewAppConfigFromTomlFile(configPath string, autogenKey bool, rand *rand.Ran
 
 	// spew.Dump(appConfig.Expiration)
 
-	appConfig.Storages, err = NewStoragesConfigFromToml(tConfig.Storages)
+	appConfig.Storages, err = NewStoragesConfigFromToml(tConfig.Storages, configPath)
 	if err != nil {
 		return nil, err
 	}
@@ -9,7 +9,6 @@ import (
 	"time"
 
 	"github.com/c2h5oh/datasize"
-	"github.com/ncw/swift/v2"
 )
 
 // This file hosts all App "callbacks", the core logic of barryd
@@ -37,11 +36,13 @@ func (app *App) queueFile(projectName string, file File) {
 
 	prevFile := project.GetLatestFile()
 	if prevFile != nil {
-		if prevFile.Size > DiffAlertDisableIfLessThan || file.Size > DiffAlertDisableIfLessThan {
-			sizeDiff := float64(file.Size-prevFile.Size) / float64(prevFile.Size) * 100
+		// (the queued file is not compressed yet)
+		prevSize := prevFile.GetOriginalSize()
+		if prevSize > DiffAlertDisableIfLessThan || file.Size > DiffAlertDisableIfLessThan {
+			sizeDiff := float64(file.Size-prevSize) / float64(prevSize) * 100
 
 			if math.Abs(sizeDiff) > DiffAlertThresholdPerc {
-				msg := fmt.Sprintf("size diff for '%s' is %.1f%% (was %s, now %s)", file.Path, sizeDiff, datasize.ByteSize(prevFile.Size).HR(), datasize.ByteSize(file.Size).HR())
+				msg := fmt.Sprintf("size diff for '%s' is %.1f%% (was %s, now %s)", file.Path, sizeDiff, datasize.ByteSize(prevSize).HR(), datasize.ByteSize(file.Size).HR())
 				app.Log.Error(projectName, msg)
 				app.AlertSender.Send(&Alert{
 					Type:    AlertTypeBad,
@@ -65,6 +66,7 @@ func (app *App) queueFile(projectName string, file File) {
 			go app.unqueueFile(projectName, file, err)
 			return
 		}
+		app.CheckQuotaAlerts()
 		// clear all segments used by the file
 		runtime.GC()
 	}()
@@ -119,7 +121,7 @@ func (app *App) deleteRemote(file *File) {
 		}
 
 		// not found? no need to retry → log, exit
-		if err == swift.ObjectNotFound {
+		if err == ErrObjectNotFound {
 			msg := fmt.Sprintf("remote file '%s' not found", file.Path)
 			app.Log.Error(file.ProjectName(), msg)
 			app.AlertSender.Send(&Alert{
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLog returns a quiet Log (traces are not printed)
+func testLog() *Log {
+	return NewLog(false, false, NewLogHistory(100))
+}
+
+// testUploadJournal returns an empty upload journal in a temp directory
+func testUploadJournal(t *testing.T) *UploadJournal {
+	journal, err := NewUploadJournal(filepath.Join(t.TempDir(), FilenameUploadJournal), testLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return journal
+}
+
+// testApp returns an initialized App with its upload and encryption workers
+// started (no API server nor scheduled jobs). settings are appended to the
+// barry.toml file (storages, containers, …), with "$DIR" replaced by the
+// test directory. Directories of local storage containers are created.
+func testApp(t *testing.T, settings string) *App {
+	dir := t.TempDir()
+
+	// Init would set TMPDIR to the temp path, removed after the test
+	if os.Getenv("TMPDIR") == "" {
+		os.Setenv("TMPDIR", os.TempDir())
+	}
+
+	for _, sub := range []string{"queue", "storage", alertScriptDirectory} {
+		err := os.Mkdir(filepath.Join(dir, sub), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	toml := `queue_path = "$DIR/queue"
+local_storage_path = "$DIR/storage"
+num_uploaders = 1
+num_encrypters = 1
+` + settings
+	err := os.WriteFile(filepath.Join(dir, "barry.toml"), []byte(strings.ReplaceAll(toml, "$DIR", dir)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	config, err := NewAppConfigFromTomlFile(dir, true, rnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, storage := range config.Storages {
+		if storage.Type != StorageTypeLocal {
+			continue
+		}
+		for _, container := range storage.Containers {
+			err = os.MkdirAll(filepath.Join(storage.Local.Path, container), 0700)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	app, err := NewApp(config, rnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = app.Init(false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Uploader.Start()
+	app.Encrypter.Start()
+	return app
+}
+
+// testLocalSettings declares a local storage with hot and cold upload
+// containers (cold is cheaper) and a read-only archive container
+const testLocalSettings = `
+[[storage]]
+name = "local"
+type = "local"
+containers = ["hot", "cold", "archive"]
+  [storage.local]
+  path = "$DIR/remote"
+
+[[upload_container]]
+name = "hot"
+cost = "2 * size"
+
+[[upload_container]]
+name = "cold"
+cost = "size"
+`
+
+// testQueueFile writes content in the queue as projectName/filename, and
+// returns the file ready to be uploaded, like queueFile does
+func testQueueFile(t *testing.T, app *App, projectName string, filename string, content []byte) *File {
+	err := os.MkdirAll(filepath.Join(app.Config.QueuePath, projectName), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(app.Config.QueuePath, projectName, filename), content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := File{
+		Filename: filename,
+		Path:     projectName + "/" + filename,
+		ModTime:  time.Now(),
+		Size:     int64(len(content)),
+		AddedAt:  time.Now(),
+		Status:   FileStatusNew,
+	}
+
+	project, err := app.ProjectDB.FindOrCreateProject(projectName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	localExpiration, remoteExpiration, err := app.ProjectDB.GetProjectNextExpiration(project, &file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.ExpireLocal = file.ModTime.Add(localExpiration.Keep)
+	file.ExpireLocalOrg = localExpiration.Original
+	file.ExpireRemote = file.ModTime.Add(remoteExpiration.Keep)
+	file.ExpireRemoteOrg = remoteExpiration.Original
+	file.RemoteKeep = remoteExpiration.Keep
+	return &file
+}
+
+// testStoreFile queues content as projectName/filename, then uploads and
+// stores it (synchronously)
+func testStoreFile(t *testing.T, app *App, projectName string, filename string, content []byte) *File {
+	file := testQueueFile(t, app, projectName, filename, content)
+	err := app.UploadAndStore(projectName, file)
+	if err != nil {
+		t.Fatalf("%s: %s", file.Path, err)
+	}
+
+	stored := app.ProjectDB.FindFile(projectName, filename)
+	if stored == nil {
+		t.Fatalf("%s: not found in the database", file.Path)
+	}
+	return stored
+}
+
+// testRemotePath returns the path of an object of the local storage
+// declared by testLocalSettings
+func testRemotePath(app *App, container string, path string) string {
+	return filepath.Join(app.Config.LocalStoragePath, "..", "remote", container, path)
+}
+
+// testPutRemote writes an object in the local storage declared by
+// testLocalSettings, modified at modTime
+func testPutRemote(t *testing.T, app *App, container string, path string, content string, modTime time.Time) {
+	filename := testRemotePath(app, container, path)
+	err := os.MkdirAll(filepath.Dir(filename), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filename, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(filename, modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testRemoteExists returns true if the object exists in the local storage
+// declared by testLocalSettings
+func testRemoteExists(t *testing.T, app *App, container string, path string) bool {
+	_, err := os.Stat(testRemotePath(app, container, path))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return err == nil
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OnitiFR/barry/common"
+	"github.com/c2h5oh/datasize"
+)
+
+// auditAlertMaxProblems is the maximum number of problems listed in an alert
+const auditAlertMaxProblems = 50
+
+// Audit holds the last remote audit report (persisted)
+type Audit struct {
+	filename string
+	mutex    sync.Mutex
+	last     *common.APIAuditReport
+}
+
+// NewAudit loads the last audit report from the given file, if any
+func NewAudit(filename string) (*Audit, error) {
+	audit := &Audit{
+		filename: filename,
+		last:     &common.APIAuditReport{},
+	}
+
+	// if the file exists, load it
+	if _, err := os.Stat(audit.filename); err == nil {
+		f, err := os.Open(audit.filename)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		dec := json.NewDecoder(f)
+		err = dec.Decode(audit.last)
+		if err != nil {
+			return nil, fmt.Errorf("decoding %s: %s", audit.filename, err)
+		}
+	}
+
+	return audit, nil
+}
+
+// Last returns the last audit report (StartedAt is zero if no audit was
+// done yet)
+func (audit *Audit) Last() common.APIAuditReport {
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	return *audit.last
+}
+
+// setLast replaces and saves the last report
+func (audit *Audit) setLast(report *common.APIAuditReport) error {
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+
+	audit.last = report
+
+	f, err := os.Create(audit.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	return enc.Encode(report)
+}
+
+// ScheduleAudit will audit remote files on a regular basis
+func (app *App) ScheduleAudit() {
+	for {
+		next := app.Audit.Last().StartedAt.Add(AuditDelay)
+		time.Sleep(time.Until(next))
+
+		app.Log.Trace(MsgGlob, "starting remote audit")
+		report := app.runAudit()
+
+		err := app.Audit.setLast(report)
+		if err != nil {
+			app.Log.Errorf(MsgGlob, "unable to save audit report: %s", err)
+		}
+	}
+}
+
+// runAudit lists every container and checks that each remote file of
+// the database exists with the expected size, and that every object is
+// known by the database
+func (app *App) runAudit() *common.APIAuditReport {
+	report := &common.APIAuditReport{
+		StartedAt: time.Now(),
+		Problems:  make([]common.APIAuditProblem, 0),
+		Errors:    make([]string, 0),
+	}
+
+	files := app.ProjectDB.GetRemoteFiles()
+
+	// container -> path -> object
+	listings := make(map[string]map[string]RemoteObject)
+	for _, storage := range app.Config.Storages {
+		for _, container := range storage.Containers {
+			objects, err := app.Storage.ListObjects(container)
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("listing container '%s': %s", container, err))
+				continue
+			}
+			listing := make(map[string]RemoteObject, len(objects))
+			for _, object := range objects {
+				listing[object.Path] = object
+			}
+			listings[container] = listing
+			report.Containers++
+			report.Objects += len(objects)
+		}
+	}
+
+	known := make(map[string]bool) // container/path
+	for _, file := range files {
+		known[file.Container+"/"+file.Path] = true
+
+		listing, listed := listings[file.Container]
+		if !listed {
+			// listing error (already reported) or unknown container
+			if _, err := app.Storage.backendForContainer(file.Container); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("file '%s': %s", file.Path, err))
+			}
+			continue
+		}
+		report.Files++
+
+		minSize, maxSize := file.StoredSizeRange()
+
+		object, exists := listing[file.Path]
+		if !exists {
+			// the file may have expired during the audit
+			current := app.ProjectDB.FindFile(file.ProjectName(), file.Filename)
+			if current == nil || current.ExpiredRemote {
+				continue
+			}
+			report.Problems = append(report.Problems, common.APIAuditProblem{
+				Type:         common.AuditProblemMissing,
+				Container:    file.Container,
+				Path:         file.Path,
+				ExpectedSize: minSize,
+			})
+			continue
+		}
+
+		if object.Size < minSize || object.Size > maxSize {
+			report.Problems = append(report.Problems, common.APIAuditProblem{
+				Type:         common.AuditProblemWrongSize,
+				Container:    file.Container,
+				Path:         file.Path,
+				ExpectedSize: minSize,
+				RemoteSize:   object.Size,
+			})
+		}
+	}
+
+	for container, listing := range listings {
+		for _, object := range listing {
+			// self-backups are not in the database
+			if known[container+"/"+object.Path] || strings.HasPrefix(object.Path, ".barry/") {
+				continue
+			}
+			// added to the database during the audit, or expired and
+			// waiting for deletion?
+			if app.ProjectDB.FileExists(filepath.Dir(object.Path), filepath.Base(object.Path)) {
+				continue
+			}
+			report.Problems = append(report.Problems, common.APIAuditProblem{
+				Type:       common.AuditProblemUnexpected,
+				Container:  container,
+				Path:       object.Path,
+				RemoteSize: object.Size,
+			})
+		}
+	}
+
+	report.Duration = time.Since(report.StartedAt)
+	app.Log.Infof(MsgGlob, "remote audit: %d file(s) checked against %d object(s) in %d container(s), %d problem(s), %d error(s)",
+		report.Files, report.Objects, report.Containers, len(report.Problems), len(report.Errors))
+
+	if len(report.Problems) > 0 || len(report.Errors) > 0 {
+		app.AlertSender.Send(&Alert{
+			Type:    AlertTypeBad,
+			Subject: "Audit",
+			Content: auditReportText(report),
+		})
+	}
+
+	return report
+}
+
+// auditReportText formats problems and errors of a report for alerts
+func auditReportText(report *common.APIAuditReport) string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "remote audit found %d problem(s) and %d error(s)\n", len(report.Problems), len(report.Errors))
+	for _, msg := range report.Errors {
+		fmt.Fprintf(&sb, "error: %s\n", msg)
+	}
+	for i, problem := range report.Problems {
+		if i == auditAlertMaxProblems {
+			fmt.Fprintf(&sb, "… and %d more (see 'barry audit')\n", len(report.Problems)-i)
+			break
+		}
+		switch problem.Type {
+		case common.AuditProblemMissing:
+			fmt.Fprintf(&sb, "missing: %s/%s\n", problem.Container, problem.Path)
+		case common.AuditProblemWrongSize:
+			fmt.Fprintf(&sb, "wrong size: %s/%s (%s instead of %s)\n",
+				problem.Container, problem.Path,
+				datasize.ByteSize(problem.RemoteSize).HR(),
+				datasize.ByteSize(problem.ExpectedSize).HR())
+		case common.AuditProblemUnexpected:
+			fmt.Fprintf(&sb, "unexpected: %s/%s\n", problem.Container, problem.Path)
+		}
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/OnitiFR/barry/common"
+)
+
+func TestAudit(t *testing.T) {
+	app := testApp(t, testLocalSettings)
+
+	ok := testStoreFile(t, app, "project", "ok.tar", []byte("ok"))
+	resized := testStoreFile(t, app, "project", "resized.tar", []byte("resized"))
+	missing := testStoreFile(t, app, "project", "missing.tar", []byte("missing"))
+
+	report := app.runAudit()
+	if len(report.Problems) != 0 || len(report.Errors) != 0 {
+		t.Fatalf("audit of a clean storage: %+v", report)
+	}
+	if report.Files != 3 || report.Containers != 3 {
+		t.Errorf("%d file(s) checked in %d container(s)", report.Files, report.Containers)
+	}
+
+	err := os.WriteFile(testRemotePath(app, resized.Container, resized.Path), []byte("truncated?"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Remove(testRemotePath(app, missing.Container, missing.Path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = app.Storage.FilePutContent("archive", "old/unknown.tar", strings.NewReader("unknown"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// self-backups are not in the database
+	err = app.Storage.FilePutContent(ok.Container, ".barry/projects.db", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report = app.runAudit()
+	if len(report.Errors) != 0 {
+		t.Fatalf("audit errors: %s", report.Errors)
+	}
+
+	expected := []common.APIAuditProblem{
+		{Type: common.AuditProblemWrongSize, Container: resized.Container, Path: resized.Path, ExpectedSize: resized.ObjectSize, RemoteSize: 10},
+		{Type: common.AuditProblemMissing, Container: missing.Container, Path: missing.Path, ExpectedSize: missing.ObjectSize},
+		{Type: common.AuditProblemUnexpected, Container: "archive", Path: "old/unknown.tar", RemoteSize: 7},
+	}
+	sort.Slice(report.Problems, func(i, j int) bool {
+		return report.Problems[i].Path > report.Problems[j].Path
+	})
+	if len(report.Problems) != len(expected) {
+		t.Fatalf("problems: %+v", report.Problems)
+	}
+	for i, problem := range report.Problems {
+		if problem != expected[i] {
+			t.Errorf("problem is %+v, expected %+v", problem, expected[i])
+		}
+	}
+}
@@ -1,15 +1,27 @@
 package server
 
 import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"os"
+	"path"
 	"time"
 )
 
 // Storage type names (used as 'type' in [[storage]] config)
 const (
 	StorageTypeSwift = "swift"
+	StorageTypeS3    = "s3"
+	StorageTypeLocal = "local"
+	StorageTypeSFTP  = "sftp"
 )
 
+// ErrObjectNotFound is returned by backends when an object does not exist
+var ErrObjectNotFound = errors.New("object not found")
+
 // Object availability states (backend-neutral). Backends translate their
 // own native states (e.g. OVH retrieval state, S3 Glacier restore) to these.
 const (
@@ -18,6 +30,29 @@ const (
 	ObjectUnsealed  = "unsealed"
 )
 
+// RemoteObject describes an object found in a container listing
+type RemoteObject struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Leftover is an upload residue not referenced by any object: orphan
+// segments, incomplete multipart upload, temporary file… Kind is one of
+// the common.GCItem* types. Container is where the leftover lives, while
+// DataContainer is the (routed) container it was found through: they
+// differ for Swift segments.
+type Leftover struct {
+	Kind          string
+	Container     string
+	DataContainer string
+	Path          string // segment prefix, object key or file path
+	UploadID      string // S3 multipart uploads only
+	Objects       int
+	Size          int64
+	ModTime       time.Time // most recent write
+}
+
 // Backend is a storage backend (Swift, S3, …) able to store and retrieve
 // files in named containers. Swift is the first implementation.
 type Backend interface {
@@ -27,18 +62,50 @@ type Backend interface {
 	// from each object manifest at retrieve/delete time).
 	CheckContainer(name string, checkSegments bool) error
 
-	// Upload a local file. If written is not nil, it is atomically updated
-	// with the number of bytes read from the source file (progress tracking).
+	// Upload a local file, with its metadata (see NewObjectMetadata). If
+	// written is not nil, it is atomically updated with the number of bytes
+	// read from the source file (progress tracking).
 	Upload(file *File, written *int64) error
 
-	// Delete a File
+	// AbandonUpload drops what a failed upload of a file left to be
+	// resumed (journal entry, segments): the upload will not be tried
+	// again in this container
+	AbandonUpload(container string, path string) error
+
+	// UploadStream uploads size bytes read from source as an object with
+	// the given metadata, replacing any existing one (kept until the new
+	// one is complete, even if the upload fails). Integrity is checked
+	// during the transfer when the backend allows it (segment or part
+	// checksums). If written is not nil, it is atomically updated with the
+	// number of bytes read.
+	UploadStream(container string, path string, size int64, source io.Reader, meta ObjectMetadata, written *int64) error
+
+	// SetMetadata replaces the barry metadata of an existing object
+	SetMetadata(container string, path string, meta ObjectMetadata) error
+
+	// GetMetadata returns the barry metadata of an object (empty for
+	// objects uploaded before metadata were attached)
+	GetMetadata(container string, path string) (ObjectMetadata, error)
+
+	// Delete a File (ErrObjectNotFound if it does not exist)
 	Delete(file *File) error
 
+	// Verify that the remote object of a freshly uploaded file matches the
+	// local (queue) file, using sizes and checksums. Returns an error on
+	// mismatch.
+	Verify(file *File) error
+
+	// ObjectSize returns the full size of an object, even sealed
+	// (ErrObjectNotFound if it does not exist)
+	ObjectSize(container string, path string) (int64, error)
+
 	// ObjectAvailability returns availability state (sealed, unsealing,
 	// unsealed) and a delay (0 meaning ready to download).
+	// (ErrObjectNotFound if it does not exist)
 	ObjectAvailability(container string, path string) (string, time.Duration, error)
 
 	// Unseal a "cold" file, returning availability ETA
+	// (ErrObjectNotFound if it does not exist)
 	Unseal(container string, path string) (time.Duration, error)
 
 	// ObjectOpen returns a ReadCloser on an (unsealed) object
@@ -49,4 +116,87 @@ type Backend interface {
 
 	// FileGetContent will read a file to an io.Writer
 	FileGetContent(container string, path string, output io.Writer) error
+
+	// ListObjects returns every object of a container, with its full size
+	// (large objects are resolved, temporary upload files are skipped)
+	ListObjects(container string) ([]RemoteObject, error)
+
+	// ContainerUsage returns the size used by a container, as seen by the
+	// storage (including segments, when stored apart)
+	ContainerUsage(container string) (int64, error)
+
+	// ListLeftovers returns upload residues of the given containers. Every
+	// container of the backend must be given, since some leftovers (Swift
+	// segments) are shared and can be referenced from any of them.
+	// In-progress uploads recorded in the upload journal are not listed.
+	ListLeftovers(containers []string) ([]Leftover, error)
+
+	// DeleteLeftover deletes all objects of a leftover
+	DeleteLeftover(leftover *Leftover) error
+}
+
+// md5Hex returns the hex MD5 checksum of a reader content
+func md5Hex(reader io.Reader) (string, error) {
+	hash := md5.New()
+	_, err := io.Copy(hash, reader)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// verifyByContent compares a remote object and a local queue file by
+// reading both of them, for backends without server-side checksums
+func verifyByContent(file *File, queuePath string, backend Backend) error {
+	sourcePath := path.Clean(queuePath + "/" + file.Path)
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	localHash, err := md5Hex(source)
+	if err != nil {
+		return err
+	}
+
+	remote, err := backend.ObjectOpen(file.Container, file.Path)
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+
+	counter := &progressReader{reader: remote, written: new(int64)}
+	remoteHash, err := md5Hex(counter)
+	if err != nil {
+		return err
+	}
+
+	stat, err := source.Stat()
+	if err != nil {
+		return err
+	}
+
+	if *counter.written != stat.Size() {
+		return fmt.Errorf("remote size is %d, local size is %d", *counter.written, stat.Size())
+	}
+	if remoteHash != localHash {
+		return fmt.Errorf("remote checksum is %s, local checksum is %s", remoteHash, localHash)
+	}
+	return nil
+}
+
+// containerUsageFromListing sums the size of every object of a container,
+// for backends without container statistics
+func containerUsageFromListing(backend Backend, container string) (int64, error) {
+	objects, err := backend.ListObjects(container)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, object := range objects {
+		total += object.Size
+	}
+	return total, nil
 }
@@ -18,6 +18,10 @@ const LogHistorySize = 5000
 // RetryDelay is used when an upload/move/delete failed
 const RetryDelay = 15 * time.Minute
 
+// StorageUnhealthyDelay is the cool-down period during which a storage is
+// not used for uploads after a failure (other containers are used instead)
+const StorageUnhealthyDelay = 10 * time.Minute
+
 // QueueScanDelay is the delay between consecutive queue scans
 const QueueScanDelay = 1 * time.Minute
 
@@ -41,8 +45,28 @@ const NoBackupAlertSchedule = 1 * time.Hour
 // SelfBackupDelay is the delay between each self-backup
 const SelfBackupDelay = 3 * time.Hour
 
-// ReEncryptDelay is the delay after which a file will be re-encrypted after being decrypted
-const ReEncryptDelay = 1 * time.Hour
+// RetrievalCheckDelay is the delay between each progress check of the
+// retrieval queue (unsealing, download)
+const RetrievalCheckDelay = 1 * time.Minute
+
+// AuditDelay is the delay between each remote audit
+const AuditDelay = 24 * time.Hour
+
+// QuotaCheckDelay is the delay between each container quota check
+// (storage usage refresh and fill alerts)
+const QuotaCheckDelay = 1 * time.Hour
+
+// GCMinAge is the minimum age of an unreferenced object or upload leftover
+// before garbage collection considers it (uploads may be in flight)
+const GCMinAge = 48 * time.Hour
+
+// GCReportMaxAge is the delay after which a GC report can't be confirmed
+// anymore (a new scan is needed)
+const GCReportMaxAge = 1 * time.Hour
+
+// KeyRotationPause is the pause between each file of a key rotation job,
+// so regular uploads keep most of the encryption and upload capacity
+const KeyRotationPause = 2 * time.Second
 
 // DiffAlertThresholdPerc is the percentage of difference between two files to trigger an alert
 const DiffAlertThresholdPerc = 20
@@ -18,6 +18,10 @@ const LogHistorySize = 5000
 // RetryDelay is used when an upload/move failed
 const RetryDelay = 10 * time.Second
 
+// StorageUnhealthyDelay is the cool-down period during which a storage is
+// not used for uploads after a failure (other containers are used instead)
+const StorageUnhealthyDelay = 1 * time.Minute
+
 // QueueScanDelay is the delay between consecutive queue scans
 const QueueScanDelay = 3 * time.Second
 
@@ -41,8 +45,28 @@ const NoBackupAlertSchedule = 1 * time.Hour
 // SelfBackupDelay is the delay between each self-backup
 const SelfBackupDelay = 1 * time.Minute
 
-// ReEncryptDelay is the delay after which a file will be re-encrypted after being decrypted
-const ReEncryptDelay = 1 * time.Minute
+// RetrievalCheckDelay is the delay between each progress check of the
+// retrieval queue (unsealing, download)
+const RetrievalCheckDelay = 10 * time.Second
+
+// AuditDelay is the delay between each remote audit
+const AuditDelay = 5 * time.Minute
+
+// QuotaCheckDelay is the delay between each container quota check
+// (storage usage refresh and fill alerts)
+const QuotaCheckDelay = 1 * time.Minute
+
+// GCMinAge is the minimum age of an unreferenced object or upload leftover
+// before garbage collection considers it (uploads may be in flight)
+const GCMinAge = 2 * time.Minute
+
+// GCReportMaxAge is the delay after which a GC report can't be confirmed
+// anymore (a new scan is needed)
+const GCReportMaxAge = 10 * time.Minute
+
+// KeyRotationPause is the pause between each file of a key rotation job,
+// so regular uploads keep most of the encryption and upload capacity
+const KeyRotationPause = 100 * time.Millisecond
 
 // DiffAlertThresholdPerc is the percentage of difference between two files to trigger an alert
 const DiffAlertThresholdPerc = 20
@@ -3,9 +3,11 @@ package server
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/Knetic/govaluate"
+	"github.com/c2h5oh/datasize"
 )
 
 // Container describes a storage Container
@@ -15,14 +17,26 @@ type Container struct {
 	// SegmentContainer is the container hosting large-object segments. Empty
 	// means the default "<name>_segments" convention is used.
 	SegmentContainer string
+	// Quota is the maximum used size (bytes, 0 = no quota). QuotaAlerts are
+	// fill percentages triggering an alert. If QuotaFromStorage is set, the
+	// size reported by the storage is used when larger than the database one.
+	Quota            uint64
+	QuotaAlerts      []int
+	QuotaFromStorage bool
 }
 
 type tomlContainer struct {
 	Name             string
 	Cost             string
-	SegmentContainer string `toml:"segments_container"`
+	SegmentContainer string            `toml:"segments_container"`
+	Quota            datasize.ByteSize `toml:"quota"`
+	QuotaAlerts      []int             `toml:"quota_alerts"`
+	QuotaFromStorage bool              `toml:"quota_from_storage"`
 }
 
+// default fill percentages triggering a quota alert
+var defaultQuotaAlerts = []int{80, 95}
+
 // NewContainersConfigFromToml return a list of Container based on TOML [[upload_container]] settings
 func NewContainersConfigFromToml(tContainers []*tomlContainer) ([]*Container, error) {
 	if len(tContainers) == 0 {
@@ -49,7 +63,20 @@ func NewContainersConfigFromToml(tContainers []*tomlContainer) ([]*Container, er
 			Name:             tContainer.Name,
 			CostExpr:         expr,
 			SegmentContainer: tContainer.SegmentContainer,
+			Quota:            tContainer.Quota.Bytes(),
+			QuotaAlerts:      tContainer.QuotaAlerts,
+			QuotaFromStorage: tContainer.QuotaFromStorage,
+		}
+
+		if container.QuotaAlerts == nil {
+			container.QuotaAlerts = append([]int{}, defaultQuotaAlerts...)
+		}
+		for _, perc := range container.QuotaAlerts {
+			if perc < 1 || perc > 100 {
+				return nil, fmt.Errorf("container '%s': invalid quota_alerts value %d (percentage)", container.Name, perc)
+			}
 		}
+		sort.Ints(container.QuotaAlerts)
 
 		_, err = container.Cost(1, time.Second)
 		if err != nil {
@@ -89,3 +116,13 @@ func (c *Container) Cost(size int64, duration time.Duration) (float64, error) {
 
 	return costFloat, nil
 }
+
+// GetContainer returns an upload container by name, or nil if not found
+func (conf *AppConfig) GetContainer(name string) *Container {
+	for _, container := range conf.Containers {
+		if container.Name == name {
+			return container
+		}
+	}
+	return nil
+}
@@ -2,7 +2,6 @@ package server
 
 import (
 	"fmt"
-	"math/rand"
 	"sync"
 )
 
@@ -10,6 +9,11 @@ type Encrypt struct {
 	// input parameters
 	EncryptionConfig *EncryptionConfig
 	Filename         string
+	Compression      string // compressed before encryption, if set
+
+	// if set, the file is already encrypted and will be rekeyed (see
+	// RekeyFileInPlace), this callback giving its current keys
+	KeyCallback func(string) ([]byte, error)
 
 	// output chan
 	Result chan error
@@ -19,19 +23,17 @@ type Encrypter struct {
 	NumWorkers int
 	Channel    chan *Encrypt
 	Log        *Log
-	Rand       *rand.Rand
 
 	statusMutex sync.Mutex
 	status      []string
 }
 
 // NewEncrypter initialize a new instance
-func NewEncrypter(numWorkers int, log *Log, rand *rand.Rand) *Encrypter {
+func NewEncrypter(numWorkers int, log *Log) *Encrypter {
 	return &Encrypter{
 		NumWorkers: numWorkers,
 		Channel:    make(chan *Encrypt),
 		Log:        log,
-		Rand:       rand,
 		status:     make([]string, numWorkers),
 	}
 }
@@ -84,9 +86,19 @@ func (enc *Encrypter) worker(id int) {
 		encrypt.Result <- err
 	}()
 
+	if encrypt.KeyCallback != nil {
+		enc.setStatus(id, fmt.Sprintf("rekeying %s", encrypt.Filename))
+		enc.Log.Infof(MsgGlob, "worker %d: rekeying %s with %s", id, encrypt.Filename, encrypt.EncryptionConfig.Name)
+		err = encrypt.EncryptionConfig.RekeyFileInPlace(encrypt.Filename, encrypt.KeyCallback, enc.Log)
+		if err != nil {
+			enc.Log.Errorf(MsgGlob, "worker %d: error rekeying %s: %s", id, encrypt.Filename, err)
+		}
+		return
+	}
+
 	enc.setStatus(id, fmt.Sprintf("encrypting %s", encrypt.Filename))
 	enc.Log.Infof(MsgGlob, "worker %d: encrypting %s", id, encrypt.Filename)
-	err = encrypt.EncryptionConfig.EncryptFileInPlace(encrypt.Filename, enc.Rand, enc.Log)
+	err = encrypt.EncryptionConfig.EncryptFileInPlace(encrypt.Filename, encrypt.Compression, enc.Log)
 	if err != nil {
 		enc.Log.Errorf(MsgGlob, "worker %d: error encrypting %s: %s", id, encrypt.Filename, err)
 	} else {
@@ -1,11 +1,8 @@
 package server
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/sha256"
+	"bufio"
 	"encoding/base64"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -13,23 +10,53 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/OnitiFR/barry/common"
 	"github.com/c2h5oh/datasize"
 )
 
+// Encryption modes (encryption_mode setting)
+const (
+	// the queue file is encrypted (rewritten) before upload
+	EncryptionModeFile = "file"
+	// the file is encrypted during upload, the same ciphertext is written
+	// to the local storage
+	EncryptionModeStream = "stream"
+	// deprecated: was "stream", with a plaintext local copy (stored files
+	// are now always encrypted, see OpenFile), same as EncryptionModeStream
+	EncryptionModeStreamPlainLocal = "stream_plain_local"
+)
+
+// Encryption types ([[encryption]] type setting)
+const (
+	// symmetric key (.key file), barryd can encrypt and decrypt
+	EncryptionTypeSymmetric = "symmetric"
+	// X25519 public key (.pub file), barryd can only encrypt, the private
+	// key (identity) must be supplied to decrypt (see UnlockEncryption)
+	EncryptionTypeX25519 = "x25519"
+)
+
 type tomlEncryption struct {
 	Name    string
+	Type    string
 	File    string
 	Default bool
+	Escrow  bool
 }
 
 type EncryptionConfig struct {
-	Name     string
-	Filename string
-	Key      []byte
-	Default  bool
+	Name      string
+	Type      string
+	Filename  string
+	Key       []byte // symmetric
+	PublicKey []byte // x25519
+	Default   bool
+	Escrow    bool // data keys of new files are wrapped with this key too
+
+	escrows []*EncryptionConfig
 }
 
 // NewEncryptionsConfigFromToml will "parse" TOML encryptions
@@ -49,20 +76,40 @@ func NewEncryptionsConfigFromToml(tEncryptions []*tomlEncryption, autogenerate b
 
 		conf := EncryptionConfig{
 			Name: tEncryption.Name,
+			Type: tEncryption.Type,
 		}
 
-		if tEncryption.File == "" {
-			return nil, fmt.Errorf("encryption %s: 'file' is needed", tEncryption.Name)
+		if conf.Type == "" {
+			conf.Type = EncryptionTypeSymmetric
 		}
 
-		if path.Ext(tEncryption.File) != ".key" {
-			return nil, fmt.Errorf("encryption %s: 'file' must have a .key extension", tEncryption.Name)
+		if tEncryption.File == "" {
+			return nil, fmt.Errorf("encryption %s: 'file' is needed", tEncryption.Name)
 		}
 
 		keyPath := path.Clean(configPath + "/" + tEncryption.File)
 		conf.Filename = keyPath
 
-		if autogenerate {
+		switch conf.Type {
+		case EncryptionTypeSymmetric:
+			if path.Ext(tEncryption.File) != ".key" {
+				return nil, fmt.Errorf("encryption %s: 'file' must have a .key extension", tEncryption.Name)
+			}
+		case EncryptionTypeX25519:
+			if path.Ext(tEncryption.File) != ".pub" {
+				return nil, fmt.Errorf("encryption %s: 'file' must have a .pub extension", tEncryption.Name)
+			}
+		default:
+			return nil, fmt.Errorf("encryption %s: unknown type '%s'", tEncryption.Name, conf.Type)
+		}
+
+		if conf.Type == EncryptionTypeX25519 {
+			public, err := loadPublicKeyFile(keyPath)
+			if err != nil {
+				return nil, fmt.Errorf("encryption %s: %w", tEncryption.Name, err)
+			}
+			conf.PublicKey = public
+		} else if autogenerate {
 			key, err := loadOrGenerateKeyFile(keyPath, rand)
 			if err != nil {
 				return nil, fmt.Errorf("encryption %s: %w", tEncryption.Name, err)
@@ -84,9 +131,33 @@ func NewEncryptionsConfigFromToml(tEncryptions []*tomlEncryption, autogenerate b
 			conf.Default = true
 		}
 
+		if tEncryption.Escrow {
+			if tEncryption.Default {
+				return nil, fmt.Errorf("encryption %s: an escrow key can't be the default key", tEncryption.Name)
+			}
+			conf.Escrow = true
+		}
+
 		res[tEncryption.Name] = &conf
 	}
 
+	escrows := make([]*EncryptionConfig, 0)
+	for _, tEncryption := range tEncryptions {
+		if tEncryption.Escrow {
+			escrows = append(escrows, res[tEncryption.Name])
+		}
+	}
+
+	if len(escrows)+1 > common.EncryptionMaxKeys {
+		return nil, fmt.Errorf("too many escrow keys (%d max)", common.EncryptionMaxKeys-1)
+	}
+
+	for _, conf := range res {
+		if !conf.Escrow {
+			conf.escrows = escrows
+		}
+	}
+
 	return res, nil
 }
 
@@ -136,6 +207,25 @@ func loadKeyFile(filename string) ([]byte, error) {
 	return passphrase, nil
 }
 
+// load a public key file (base64 encoded)
+func loadPublicKeyFile(filename string) ([]byte, error) {
+	b64, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("%w (see 'barry emergency keygen' command)", err)
+	}
+
+	public, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b64)))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(public) != 32 {
+		return nil, fmt.Errorf("%s: invalid X25519 public key size", filename)
+	}
+
+	return public, nil
+}
+
 // generate a randome key file (256 bits, base64 encoded)
 func generateKeyFile(filename string, rand *rand.Rand) ([]byte, error) {
 	passphrase := make([]byte, 32)
@@ -184,120 +274,130 @@ func (conf *AppConfig) GetEncryption(name string) (*EncryptionConfig, error) {
 	return encryption, nil
 }
 
-// EncryptFile encrypt a file
-func (enc *EncryptionConfig) EncryptFile(srcFilename string, dstFilename string, rand *rand.Rand) error {
-	infile, err := os.Open(srcFilename)
-	if err != nil {
-		return err
+// MasterKeys returns the keys wrapping the data key of a file encrypted
+// with this key: the key itself, then every escrow key
+func (enc *EncryptionConfig) MasterKeys() []common.EncryptionKey {
+	keys := []common.EncryptionKey{enc.masterKey()}
+	for _, escrow := range enc.escrows {
+		keys = append(keys, escrow.masterKey())
 	}
-	defer infile.Close()
+	return keys
+}
 
-	block, err := aes.NewCipher(enc.Key)
-	if err != nil {
-		return err
+func (enc *EncryptionConfig) masterKey() common.EncryptionKey {
+	return common.EncryptionKey{
+		Name:      enc.Name,
+		Key:       enc.Key,
+		PublicKey: enc.PublicKey,
 	}
+}
 
-	iv := make([]byte, block.BlockSize())
-	if _, err := io.ReadFull(rand, iv); err != nil {
-		return err
+// MasterKeyNames returns the names of MasterKeys
+func (enc *EncryptionConfig) MasterKeyNames() []string {
+	names := make([]string, 0)
+	for _, key := range enc.MasterKeys() {
+		names = append(names, key.Name)
 	}
+	return names
+}
 
-	outfile, err := os.OpenFile(dstFilename, os.O_WRONLY|os.O_CREATE, 0644)
+// EncryptFile encrypt a file (BARRY3 format, BARRY4 when compressed)
+func (enc *EncryptionConfig) EncryptFile(srcFilename string, dstFilename string, compression string) error {
+	infile, err := os.Open(srcFilename)
 	if err != nil {
 		return err
 	}
-	defer outfile.Close()
+	defer infile.Close()
 
-	_, err = outfile.WriteString(common.BarrySignature)
+	outfile, err := os.OpenFile(dstFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
+	defer outfile.Close()
 
-	// write comment
-	_, err = outfile.WriteString("Barry Encryption v1")
-	if err != nil {
-		return err
-	}
+	return common.EncryptStreamCompressed(bufio.NewReader(infile), outfile, enc.MasterKeys(), compression)
+}
 
-	_, err = outfile.Write([]byte{0})
+// EncryptFileInPlace encrypt a file in place (using a temp file)
+func (enc *EncryptionConfig) EncryptFileInPlace(filename string, compression string, log *Log) error {
+	// get original file info
+	stat, err := os.Stat(filename)
 	if err != nil {
 		return err
 	}
 
-	// write key name
-	_, err = outfile.WriteString(enc.Name)
+	// create a temp file
+	tmp, err := os.CreateTemp("", path.Base(filename)+"-encrypt")
 	if err != nil {
 		return err
 	}
 
-	_, err = outfile.Write([]byte{0})
-	if err != nil {
+	if err := tmp.Close(); err != nil {
 		return err
 	}
 
-	// get the current position and write a blank 256 bits checksum (so we can update it later)
-	hashPos, err := outfile.Seek(0, io.SeekCurrent)
+	defer os.Remove(tmp.Name())
+
+	log.Tracef(MsgGlob, "encrypting %s (using %s)", filename, tmp.Name())
+	start := time.Now()
+
+	// encrypt the file
+	err = enc.EncryptFile(filename, tmp.Name(), compression)
 	if err != nil {
 		return err
 	}
 
-	_, err = outfile.Write(make([]byte, 32))
+	dur := time.Since(start)
+	bps := float64(stat.Size()) / dur.Seconds()
+
+	hr := datasize.ByteSize(bps).HR()
+
+	log.Infof(MsgGlob, "encryption of %s done in %s (%s/s), finalizing", filename, dur, hr)
+	start = time.Now()
+
+	// move the temp file to the original file
+	err = os.Rename(tmp.Name(), filename)
 	if err != nil {
 		return err
 	}
 
-	// write the IV
-	_, err = outfile.Write(iv)
+	// restore original file info (mode, date)
+	err = os.Chmod(filename, stat.Mode())
 	if err != nil {
 		return err
 	}
 
-	// The buffer size must be multiple of 16 bytes
-	bufferSize := 4096
-
-	// write buffer size
-	err = binary.Write(outfile, binary.LittleEndian, uint32(bufferSize))
+	err = os.Chtimes(filename, stat.ModTime(), stat.ModTime())
 	if err != nil {
 		return err
 	}
 
-	hash := sha256.New()
-
-	buf := make([]byte, bufferSize)
-	stream := cipher.NewCTR(block, iv)
-	for {
-		n, err := infile.Read(buf)
-		if n > 0 {
-			hash.Write(buf[:n])
-			stream.XORKeyStream(buf, buf[:n])
-			outfile.Write(buf[:n])
-		}
-
-		if err == io.EOF {
-			break
-		}
+	log.Tracef(MsgGlob, "finalization of %s done in %s", filename, time.Since(start))
 
-		if err != nil {
-			return err
-		}
-	}
+	return nil
+}
 
-	// update the checksum
-	_, err = outfile.Seek(hashPos, io.SeekStart)
+// RekeyFile copies an encrypted file, re-encrypted (or only rewrapped, for
+// BARRY3 files) with this key, keyCallback giving the current keys
+func (enc *EncryptionConfig) RekeyFile(srcFilename string, dstFilename string, keyCallback func(string) ([]byte, error)) error {
+	infile, err := os.Open(srcFilename)
 	if err != nil {
 		return err
 	}
+	defer infile.Close()
 
-	_, err = outfile.Write(hash.Sum(nil))
+	outfile, err := os.OpenFile(dstFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
+	defer outfile.Close()
 
-	return nil
+	return common.RekeyFile(bufio.NewReader(infile), outfile, keyCallback, enc.MasterKeys())
 }
 
-// EncryptFileInPlace encrypt a file in place (using a temp file)
-func (enc *EncryptionConfig) EncryptFileInPlace(filename string, rand *rand.Rand, log *Log) error {
+// RekeyFileInPlace rekeys a file in place (using a temp file, in the same
+// directory)
+func (enc *EncryptionConfig) RekeyFileInPlace(filename string, keyCallback func(string) ([]byte, error), log *Log) error {
 	// get original file info
 	stat, err := os.Stat(filename)
 	if err != nil {
@@ -305,7 +405,7 @@ func (enc *EncryptionConfig) EncryptFileInPlace(filename string, rand *rand.Rand
 	}
 
 	// create a temp file
-	tmp, err := os.CreateTemp("", path.Base(filename)+"-encrypt")
+	tmp, err := os.CreateTemp(path.Dir(filename), "."+path.Base(filename)+"-rekey")
 	if err != nil {
 		return err
 	}
@@ -316,124 +416,162 @@ func (enc *EncryptionConfig) EncryptFileInPlace(filename string, rand *rand.Rand
 
 	defer os.Remove(tmp.Name())
 
-	log.Tracef(MsgGlob, "encrypting %s (using %s)", filename, tmp.Name())
+	log.Tracef(MsgGlob, "rekeying %s with %s (using %s)", filename, enc.Name, tmp.Name())
 	start := time.Now()
 
-	// encrypt the file
-	err = enc.EncryptFile(filename, tmp.Name(), rand)
+	err = enc.RekeyFile(filename, tmp.Name(), keyCallback)
 	if err != nil {
 		return err
 	}
 
-	dur := time.Since(start)
-	bps := float64(stat.Size()) / dur.Seconds()
-
-	hr := datasize.ByteSize(bps).HR()
-
-	log.Infof(MsgGlob, "encryption of %s done in %s (%s/s), finalizing", filename, dur, hr)
-	start = time.Now()
-
-	// move the temp file to the original file
-	err = os.Rename(tmp.Name(), filename)
+	// restore original file info (mode, date)
+	err = os.Chmod(tmp.Name(), stat.Mode())
 	if err != nil {
 		return err
 	}
 
-	// restore original file info (mode, date)
-	err = os.Chmod(filename, stat.Mode())
+	err = os.Chtimes(tmp.Name(), stat.ModTime(), stat.ModTime())
 	if err != nil {
 		return err
 	}
 
-	err = os.Chtimes(filename, stat.ModTime(), stat.ModTime())
+	// move the temp file to the original file
+	err = os.Rename(tmp.Name(), filename)
 	if err != nil {
 		return err
 	}
 
-	log.Tracef(MsgGlob, "finalization of %s done in %s", filename, time.Since(start))
-
+	log.Infof(MsgGlob, "rekeying of %s done in %s", filename, time.Since(start))
 	return nil
 }
 
-// DecryptFile decrypt a file
-func (app *App) DecryptFile(srcFilename string, dstFilename string) error {
-	infile, err := os.Open(srcFilename)
+// OpenFile returns the content of an available file (see
+// MakeFileAvailable), decrypted on the fly if barryd encrypted it: stored
+// files are never decrypted on disk. Files queued already encrypted are
+// served as they were sent.
+func (app *App) OpenFile(file *File) (io.ReadCloser, error) {
+	filename, err := file.GetLocalPath(app)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer infile.Close()
 
-	outfile, err := os.OpenFile(dstFilename, os.O_WRONLY|os.O_CREATE, 0644)
-	if err != nil {
-		return err
+	encrypted := file.Encrypted
+	if file.ExpiredLocal {
+		// retrieved copy of the remote object (encrypted even if the local
+		// copy was left decrypted, see ReEncryptDate)
+		encrypted = file.Encrypted || !file.ReEncryptDate.IsZero()
 	}
-	defer outfile.Close()
 
-	err = common.DecryptFile(infile, outfile, func(keyName string) ([]byte, error) {
-		encryption, err := app.Config.GetEncryption(keyName)
-		if err != nil {
-			return nil, err
-		}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
 
-		return encryption.Key, nil
-	})
+	if !encrypted {
+		return f, nil
+	}
 
+	reader, err := common.NewDecryptReader(bufio.NewReader(f), app.encryptionKeyCallback)
 	if err != nil {
-		return err
+		f.Close()
+		return nil, err
 	}
 
-	return nil
+	return &decryptedFile{ReadCloser: reader, file: f}, nil
 }
 
-// DecryptFileInPlace decrypt a file in place (using a temp file)
-func (app *App) DecryptFileInPlace(filename string, log *Log) error {
-	// get original file info
-	stat, err := os.Stat(filename)
-	if err != nil {
-		return err
+// encryptPlainLocalFiles encrypts local copies left decrypted on disk by
+// previous versions (ReEncryptDate is set), once at startup
+func (app *App) encryptPlainLocalFiles() {
+	defEncrypt := app.Config.GetDefaultEncryption()
+
+	for _, file := range app.ProjectDB.GetStoredFiles() {
+		if file.Encrypted || file.ReEncryptDate.IsZero() {
+			continue
+		}
+
+		if defEncrypt == nil {
+			app.Log.Warningf(file.ProjectName(), "local copy of '%s' is not encrypted (no default encryption key)", file.Path)
+			continue
+		}
+
+		err := app.encryptPlainLocalFile(&file, defEncrypt)
+		if err != nil {
+			app.Log.Errorf(file.ProjectName(), "error encrypting local copy of '%s': %s", file.Path, err)
+		}
 	}
+}
 
-	// create a temp file
-	tmp, err := os.CreateTemp("", path.Base(filename)+"-decrypt")
+func (app *App) encryptPlainLocalFile(file *File, defEncrypt *EncryptionConfig) error {
+	unlock := app.Retrieval.lockFile(file.Path)
+	defer unlock()
+
+	filename, err := file.GetLocalPath(app)
 	if err != nil {
 		return err
 	}
 
-	if err := tmp.Close(); err != nil {
+	enc := NewEncrypt(defEncrypt, filename)
+	// same stored content as the remote object
+	enc.Compression = file.Compression
+	atomic.AddInt32(&app.encryptQueueSize, 1)
+	app.Encrypter.Channel <- enc
+	atomic.AddInt32(&app.encryptQueueSize, -1)
+	err = <-enc.Result
+	if err != nil {
 		return err
 	}
 
-	defer os.Remove(tmp.Name())
+	return app.ProjectDB.SetFileLocalEncrypted(file.ProjectName(), file.Filename, defEncrypt.Name)
+}
 
-	log.Tracef(MsgGlob, "decrypting %s (using %s)", filename, tmp.Name())
-	start := time.Now()
+// decryptedFile closes the decrypting reader, then the file itself
+type decryptedFile struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (df *decryptedFile) Close() error {
+	df.ReadCloser.Close()
+	return df.file.Close()
+}
 
-	err = app.DecryptFile(filename, tmp.Name())
+// encryptionKeyCallback returns a configured key, by name (the identity
+// for public keys, if unlocked)
+func (app *App) encryptionKeyCallback(keyName string) ([]byte, error) {
+	encryption, err := app.Config.GetEncryption(keyName)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	log.Tracef(MsgGlob, "decryption of %s done in %s, finalizing", filename, time.Since(start))
-	start = time.Now()
+	if encryption.PublicKey != nil {
+		identity, unlocked := app.Identities.get(keyName)
+		if !unlocked {
+			return nil, fmt.Errorf("encryption key '%s' is locked (public key only, see 'barry key unlock')", keyName)
+		}
+		return identity, nil
+	}
 
-	// move the temp file to the original file
-	err = os.Rename(tmp.Name(), filename)
+	return encryption.Key, nil
+}
+
+// compressedSize returns the size of the compressed content of a BARRY4
+// file (its stored size, before encryption)
+func compressedSize(filename string) (int64, error) {
+	f, err := os.Open(filename)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	defer f.Close()
 
-	// restore original file info (mode, date)
-	err = os.Chmod(filename, stat.Mode())
+	stat, err := f.Stat()
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	err = os.Chtimes(filename, stat.ModTime(), stat.ModTime())
+	header, err := common.ReadEncryptionHeader(bufio.NewReader(f))
 	if err != nil {
-		return err
+		return 0, err
 	}
-
-	log.Tracef(MsgGlob, "finalization of %s done in %s", filename, time.Since(start))
-
-	return nil
+	return header.PlainSize(stat.Size()), nil
 }
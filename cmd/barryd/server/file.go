@@ -3,7 +3,10 @@ package server
 import (
 	"fmt"
 	"path/filepath"
+	"strings"
 	"time"
+
+	"github.com/OnitiFR/barry/common"
 )
 
 // FileStatus list all possible status for a file in WaitList and ProjectDB
@@ -16,27 +19,34 @@ const (
 
 // File is a file in our DB (final leaf)
 type File struct {
-	Filename        string
-	Path            string
-	ModTime         time.Time
-	Size            int64
-	AddedAt         time.Time
-	Status          string
-	ExpireLocal     time.Time // expiration date
-	ExpireRemote    time.Time // (same)
-	ExpireLocalOrg  string    // original expire string
-	ExpireRemoteOrg string    // (same)
-	RemoteKeep      time.Duration
-	ExpiredLocal    bool
-	ExpiredRemote   bool
-	Container       string
-	Cost            float64
-	Encrypted       bool
-	ReEncryptDate   time.Time
-	RetrievedPath   string
-	RetrievedDate   time.Time
-	retriever       *Retriever
-	pushers         map[string]Pusher // one push per destination
+	Filename           string
+	Path               string
+	ModTime            time.Time
+	Size               int64  // stored size, before encryption (compressed, see Compression)
+	OriginalSize       int64  // size of the original content (0: same as Size)
+	Compression        string // compressed before encryption (BARRY4), if set
+	ObjectSize         int64  // size of the remote object (0: unknown, legacy)
+	AddedAt            time.Time
+	Status             string
+	ExpireLocal        time.Time // expiration date
+	ExpireRemote       time.Time // (same)
+	ExpireLocalOrg     string    // original expire string
+	ExpireRemoteOrg    string    // (same)
+	RemoteKeep         time.Duration
+	ExpiredLocal       bool
+	ExpiredRemote      bool
+	Container          string
+	Cost               float64
+	Encrypted          bool
+	SHA256             string    // checksum of the original (plaintext) content
+	EncryptionKey      string    // name of the key (empty: not encrypted)
+	LocalEncryptionKey string    // key of the local copy (empty: plaintext)
+	ReEncryptDate      time.Time // local copy left decrypted (legacy), encrypted at startup
+	RetrievedPath      string
+	RetrievedDate      time.Time
+	RetrievedUsedAt    time.Time // last use of the retrieved copy (cache eviction)
+	retriever          *Retriever
+	pushers            map[string]Pusher // one push per destination
 }
 
 // FileMap is a map of File
@@ -47,6 +57,58 @@ func (file *File) ProjectName() string {
 	return filepath.Dir(file.Path)
 }
 
+// GetOriginalSize returns the size of the original content of the file
+// (before compression)
+func (file *File) GetOriginalSize() int64 {
+	if file.OriginalSize == 0 {
+		return file.Size
+	}
+	return file.OriginalSize
+}
+
+// encryptionVersion returns the format of the file once (re)encrypted
+// with a data key
+func (file *File) encryptionVersion() int {
+	if file.Compression != common.CompressionNone {
+		return common.EncryptionV4
+	}
+	return common.EncryptionV3
+}
+
+// StoredSizeRange returns the expected size of the remote object, exact
+// if recorded. Otherwise (legacy files), files encrypted by barryd are
+// stored with an encryption header (and BARRY2+ authentication tags), of
+// unknown size if the format and key name were not recorded
+func (file *File) StoredSizeRange() (int64, int64) {
+	if file.ObjectSize != 0 {
+		return file.ObjectSize, file.ObjectSize
+	}
+	// the local copy may be decrypted (for a while), not the remote one
+	if !file.Encrypted && file.ReEncryptDate.IsZero() {
+		return file.Size, file.Size
+	}
+	return encryptedSizeRange(file.EncryptionKey, file.Size)
+}
+
+// encryptedSizeRange returns the smallest (BARRY1) and the largest
+// (BARRY4, escrow keys being unknown) sizes of an encrypted file
+func encryptedSizeRange(keyName string, size int64) (int64, int64) {
+	// largest key slots: longest names, public keys
+	unknown := common.EncryptionKey{
+		Name:      strings.Repeat(" ", common.EncryptionKeyNameMaxLen),
+		PublicKey: make([]byte, 32),
+	}
+	keys := make([]common.EncryptionKey, 0, common.EncryptionMaxKeys)
+	if keyName != "" {
+		keys = append(keys, common.EncryptionKey{Name: keyName, PublicKey: unknown.PublicKey})
+	}
+	for len(keys) < common.EncryptionMaxKeys {
+		keys = append(keys, unknown)
+	}
+	return common.EncryptedSize(common.EncryptionV1, []common.EncryptionKey{{Name: keyName}}, size),
+		common.EncryptedSize(common.EncryptionV4, keys, size)
+}
+
 // CheckInit will init all fields of the *File fileds that needs it
 func (file *File) checkInit() {
 	if file.pushers == nil {
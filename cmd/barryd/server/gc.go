@@ -0,0 +1,243 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OnitiFR/barry/common"
+)
+
+// gcIDLength is the number of random chars of a GC report ID
+const gcIDLength = 8
+
+// GC finds remote objects and upload leftovers referenced by no file. A
+// scan produces a dry-run report, and nothing is deleted until this report
+// is confirmed using its ID.
+type GC struct {
+	mutex   sync.Mutex
+	report  *common.APIGCReport
+	entries []*gcEntry
+}
+
+// gcEntry is an item of the report, with what's needed to delete it
+type gcEntry struct {
+	item     common.APIGCItem
+	leftover *Leftover // nil for unreferenced objects
+}
+
+// NewGC creates an idle GC (no report yet)
+func NewGC() *GC {
+	return &GC{
+		report: &common.APIGCReport{},
+	}
+}
+
+// Report returns a copy of the current report (ID is empty if no scan
+// was done since barryd started)
+func (gc *GC) Report() common.APIGCReport {
+	gc.mutex.Lock()
+	defer gc.mutex.Unlock()
+
+	res := *gc.report
+	res.Errors = append([]string{}, gc.report.Errors...)
+	return res
+}
+
+// StartGCScan starts a new scan in the background, returning the initial
+// report
+func (app *App) StartGCScan() (common.APIGCReport, error) {
+	app.GC.mutex.Lock()
+	defer app.GC.mutex.Unlock()
+
+	status := app.GC.report.Status
+	if status == common.GCStatusScanning || status == common.GCStatusDeleting {
+		return common.APIGCReport{}, fmt.Errorf("garbage collection is busy (%s)", status)
+	}
+
+	app.GC.report = &common.APIGCReport{
+		ID:        RandString(gcIDLength, app.Rand),
+		Status:    common.GCStatusScanning,
+		StartedAt: time.Now(),
+		MinAge:    GCMinAge,
+		Items:     make([]common.APIGCItem, 0),
+		Errors:    make([]string, 0),
+	}
+	app.GC.entries = nil
+
+	go app.gcScan()
+
+	return *app.GC.report, nil
+}
+
+// ConfirmGC starts the deletion of every item of the report, if id
+// matches the current (ready and recent enough) report
+func (app *App) ConfirmGC(id string) (common.APIGCReport, error) {
+	app.GC.mutex.Lock()
+	defer app.GC.mutex.Unlock()
+
+	report := app.GC.report
+	if report.ID == "" || report.ID != id {
+		return common.APIGCReport{}, fmt.Errorf("unknown GC report '%s' (run a new scan)", id)
+	}
+	if report.Status != common.GCStatusReady {
+		return common.APIGCReport{}, fmt.Errorf("GC report '%s' is not ready for deletion (%s)", id, report.Status)
+	}
+	if time.Since(report.StartedAt) > GCReportMaxAge {
+		return common.APIGCReport{}, fmt.Errorf("GC report '%s' is too old (more than %s), run a new scan", id, GCReportMaxAge)
+	}
+
+	report.Status = common.GCStatusDeleting
+	go app.gcDelete()
+
+	return *report, nil
+}
+
+// gcObjectReferenced returns true if a file of the database references
+// this object, or if it may be uploaded right now (still in the queue)
+func (app *App) gcObjectReferenced(container string, objectPath string) bool {
+	file := app.ProjectDB.FindFile(path.Dir(objectPath), path.Base(objectPath))
+	if file != nil && file.Container == container {
+		return true
+	}
+
+	_, err := os.Stat(filepath.Join(app.Config.QueuePath, filepath.FromSlash(objectPath)))
+	return err == nil
+}
+
+func (app *App) gcScan() {
+	entries := make([]*gcEntry, 0)
+	errs := make([]string, 0)
+	tooRecent := 0
+	limit := time.Now().Add(-GCMinAge)
+
+	// objects of upload containers, referenced by no file
+	for _, container := range app.Config.Containers {
+		objects, err := app.Storage.ListObjects(container.Name)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("listing container '%s': %s", container.Name, err))
+			continue
+		}
+		for _, object := range objects {
+			// self-backups are not in the database
+			if strings.HasPrefix(object.Path, ".barry/") {
+				continue
+			}
+			if app.gcObjectReferenced(container.Name, object.Path) {
+				continue
+			}
+			if object.ModTime.After(limit) {
+				tooRecent++
+				continue
+			}
+			entries = append(entries, &gcEntry{
+				item: common.APIGCItem{
+					Type:      common.GCItemObject,
+					Container: container.Name,
+					Path:      object.Path,
+					Objects:   1,
+					Size:      object.Size,
+					ModTime:   object.ModTime,
+				},
+			})
+		}
+	}
+
+	// upload leftovers (segments, …), each storage with all its containers
+	for _, storage := range app.Config.Storages {
+		leftovers, err := app.Storage.ListLeftovers(storage.Containers)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("listing leftovers of storage '%s': %s", storage.Name, err))
+			continue
+		}
+		for i := range leftovers {
+			leftover := &leftovers[i]
+			if leftover.ModTime.After(limit) {
+				tooRecent++
+				continue
+			}
+			entries = append(entries, &gcEntry{
+				item: common.APIGCItem{
+					Type:      leftover.Kind,
+					Container: leftover.Container,
+					Path:      leftover.Path,
+					Objects:   leftover.Objects,
+					Size:      leftover.Size,
+					ModTime:   leftover.ModTime,
+				},
+				leftover: leftover,
+			})
+		}
+	}
+
+	app.GC.mutex.Lock()
+	defer app.GC.mutex.Unlock()
+
+	report := app.GC.report
+	for _, entry := range entries {
+		report.Items = append(report.Items, entry.item)
+	}
+	report.TooRecent = tooRecent
+	report.Errors = errs
+	report.Duration = time.Since(report.StartedAt)
+	report.Status = common.GCStatusReady
+	app.GC.entries = entries
+
+	app.Log.Infof(MsgGlob, "gc: scan %s found %d item(s) to delete (%d too recent, %d error(s))",
+		report.ID, len(report.Items), report.TooRecent, len(report.Errors))
+}
+
+func (app *App) gcDelete() {
+	app.GC.mutex.Lock()
+	id := app.GC.report.ID
+	entries := app.GC.entries
+	app.GC.mutex.Unlock()
+
+	app.Log.Infof(MsgGlob, "gc: deleting %d item(s) of report %s", len(entries), id)
+
+	deleted := 0
+	errs := make([]string, 0)
+	for _, entry := range entries {
+		var err error
+		item := entry.item
+
+		if entry.leftover != nil {
+			err = app.Storage.DeleteLeftover(entry.leftover)
+		} else {
+			// the object may have been referenced since the scan
+			if app.gcObjectReferenced(item.Container, item.Path) {
+				app.Log.Warningf(MsgGlob, "gc: object '%s/%s' is now referenced, skipped", item.Container, item.Path)
+				continue
+			}
+			err = app.Storage.Delete(&File{
+				Path:      item.Path,
+				Container: item.Container,
+			})
+		}
+
+		if err != nil && !errors.Is(err, ErrObjectNotFound) {
+			msg := fmt.Sprintf("deleting %s '%s/%s': %s", item.Type, item.Container, item.Path, err)
+			app.Log.Error(MsgGlob, "gc: "+msg)
+			errs = append(errs, msg)
+			continue
+		}
+		app.Log.Infof(MsgGlob, "gc: %s '%s/%s' deleted", item.Type, item.Container, item.Path)
+		deleted++
+	}
+
+	app.GC.mutex.Lock()
+	defer app.GC.mutex.Unlock()
+
+	report := app.GC.report
+	report.Deleted = deleted
+	report.Errors = append(report.Errors, errs...)
+	report.Status = common.GCStatusDone
+	app.GC.entries = nil
+
+	app.Log.Infof(MsgGlob, "gc: report %s done, %d item(s) deleted, %d error(s)", id, deleted, len(errs))
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/OnitiFR/barry/common"
+)
+
+// testWaitGC waits for the GC report to reach status
+func testWaitGC(t *testing.T, app *App, status string) common.APIGCReport {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		report := app.GC.Report()
+		if report.Status == status {
+			return report
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("GC status is still '%s', expected '%s'", report.Status, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGC(t *testing.T) {
+	app := testApp(t, testLocalSettings)
+
+	stored := testStoreFile(t, app, "project", "stored.tar", []byte("stored"))
+	if stored.Container != "cold" {
+		t.Fatalf("file stored in '%s'", stored.Container)
+	}
+
+	old := time.Now().Add(-2 * GCMinAge)
+	// a copy left by a failover, and an expired file
+	testPutRemote(t, app, "hot", stored.Path, "stored", old)
+	testPutRemote(t, app, "cold", "project/expired.tar", "expired", old)
+	// being uploaded
+	testPutRemote(t, app, "cold", "project/queued.tar", "queued", old)
+	err := os.WriteFile(filepath.Join(app.Config.QueuePath, "project", "queued.tar"), []byte("queued"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// too recent, self-backup, read-only container, upload leftover
+	testPutRemote(t, app, "cold", "project/recent.tar", "recent", time.Now())
+	testPutRemote(t, app, "cold", ".barry/projects.db", "{}", old)
+	testPutRemote(t, app, "archive", "project/archived.tar", "archived", old)
+	testPutRemote(t, app, "archive", "project/.archived.tar.part", "part", old)
+
+	_, err = app.ConfirmGC("unknown")
+	if err == nil {
+		t.Error("GC confirmed without a scan")
+	}
+
+	started, err := app.StartGCScan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := testWaitGC(t, app, common.GCStatusReady)
+	if len(report.Errors) != 0 {
+		t.Fatalf("GC errors: %s", report.Errors)
+	}
+	if report.TooRecent != 1 {
+		t.Errorf("%d item(s) too recent, expected 1", report.TooRecent)
+	}
+
+	sort.Slice(report.Items, func(i, j int) bool {
+		return report.Items[i].Container+report.Items[i].Path < report.Items[j].Container+report.Items[j].Path
+	})
+	expected := []common.APIGCItem{
+		{Type: common.GCItemTempFile, Container: "archive", Path: "project/.archived.tar.part", Objects: 1, Size: 4},
+		{Type: common.GCItemObject, Container: "cold", Path: "project/expired.tar", Objects: 1, Size: 7},
+		{Type: common.GCItemObject, Container: "hot", Path: stored.Path, Objects: 1, Size: 6},
+	}
+	if len(report.Items) != len(expected) {
+		t.Fatalf("GC items: %+v", report.Items)
+	}
+	for i, item := range report.Items {
+		item.ModTime = time.Time{}
+		if item != expected[i] {
+			t.Errorf("GC item is %+v, expected %+v", item, expected[i])
+		}
+	}
+
+	// uploaded again since the scan
+	err = os.WriteFile(filepath.Join(app.Config.QueuePath, "project", "expired.tar"), []byte("expired"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = app.ConfirmGC(started.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report = testWaitGC(t, app, common.GCStatusDone)
+	if report.Deleted != 2 || len(report.Errors) != 0 {
+		t.Errorf("%d item(s) deleted, errors: %s", report.Deleted, report.Errors)
+	}
+
+	objects := []struct {
+		container string
+		path      string
+		exists    bool
+	}{
+		{"cold", stored.Path, true},
+		{"hot", stored.Path, false},
+		{"cold", "project/expired.tar", true},
+		{"cold", "project/queued.tar", true},
+		{"cold", "project/recent.tar", true},
+		{"cold", ".barry/projects.db", true},
+		{"archive", "project/archived.tar", true},
+		{"archive", "project/.archived.tar.part", false},
+	}
+	for _, object := range objects {
+		if testRemoteExists(t, app, object.container, object.path) != object.exists {
+			t.Errorf("%s/%s: exists is %t, expected %t", object.container, object.path, !object.exists, object.exists)
+		}
+	}
+
+	_, err = app.ConfirmGC(started.ID)
+	if err == nil {
+		t.Error("GC report confirmed twice")
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/OnitiFR/barry/common"
+)
+
+// IdentityMaxUnlock is the longest time an identity can stay unlocked
+const IdentityMaxUnlock = 24 * time.Hour
+
+// Identities are the private keys (identities) of public key encryptions,
+// temporarily supplied by operators: barryd can't decrypt files of such
+// encryptions otherwise. They're only kept in memory.
+type Identities struct {
+	mutex    sync.Mutex
+	unlocked map[string]*unlockedIdentity
+}
+
+type unlockedIdentity struct {
+	identity []byte
+	until    time.Time
+	timer    *time.Timer
+}
+
+// NewIdentities creates an empty (all locked) Identities
+func NewIdentities() *Identities {
+	return &Identities{
+		unlocked: make(map[string]*unlockedIdentity),
+	}
+}
+
+// get returns the identity of an encryption, if unlocked
+func (ids *Identities) get(name string) ([]byte, bool) {
+	ids.mutex.Lock()
+	defer ids.mutex.Unlock()
+
+	unlocked, exists := ids.unlocked[name]
+	if !exists || time.Now().After(unlocked.until) {
+		return nil, false
+	}
+	return unlocked.identity, true
+}
+
+// UnlockedUntil returns when the identity of an encryption will be locked
+// again (zero time if it's locked)
+func (ids *Identities) UnlockedUntil(name string) time.Time {
+	ids.mutex.Lock()
+	defer ids.mutex.Unlock()
+
+	unlocked, exists := ids.unlocked[name]
+	if !exists {
+		return time.Time{}
+	}
+	return unlocked.until
+}
+
+// lock forgets an identity, returning false if it was not unlocked
+func (ids *Identities) lock(name string) bool {
+	return ids.lockEntry(name, nil)
+}
+
+// lockEntry forgets an identity, only if it's still the given entry (if
+// not nil): a previous unlock timer must not lock a new unlock
+func (ids *Identities) lockEntry(name string, entry *unlockedIdentity) bool {
+	ids.mutex.Lock()
+	defer ids.mutex.Unlock()
+
+	unlocked, exists := ids.unlocked[name]
+	if !exists || (entry != nil && unlocked != entry) {
+		return false
+	}
+
+	unlocked.timer.Stop()
+	for i := range unlocked.identity {
+		unlocked.identity[i] = 0
+	}
+	delete(ids.unlocked, name)
+	return true
+}
+
+// UnlockEncryption supplies the identity of a public key encryption for
+// the given duration, so barryd can decrypt its files
+func (app *App) UnlockEncryption(name string, identity []byte, duration time.Duration, by string) (time.Time, error) {
+	encryption, err := app.Config.GetEncryption(name)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if encryption.PublicKey == nil {
+		return time.Time{}, fmt.Errorf("encryption key '%s' is not a public key", name)
+	}
+
+	if duration <= 0 || duration > IdentityMaxUnlock {
+		return time.Time{}, fmt.Errorf("unlock duration must be between 0 and %s", IdentityMaxUnlock)
+	}
+
+	public, err := common.X25519PublicKey(identity)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if !bytes.Equal(public, encryption.PublicKey) {
+		return time.Time{}, fmt.Errorf("this identity does not match the public key of '%s'", name)
+	}
+
+	// replaces any previous unlock
+	app.Identities.lock(name)
+
+	until := time.Now().Add(duration)
+	entry := &unlockedIdentity{
+		identity: identity,
+		until:    until,
+	}
+
+	app.Identities.mutex.Lock()
+	entry.timer = time.AfterFunc(duration, func() {
+		if app.Identities.lockEntry(name, entry) {
+			app.Log.Infof(MsgGlob, "encryption key '%s' locked again (unlock expired)", name)
+		}
+	})
+	app.Identities.unlocked[name] = entry
+	app.Identities.mutex.Unlock()
+
+	app.Log.Infof(MsgGlob, "encryption key '%s' unlocked by '%s' until %s", name, by, until.Format("2006-01-02 15:04"))
+	return until, nil
+}
+
+// LockEncryption forgets the identity of a public key encryption
+func (app *App) LockEncryption(name string, by string) error {
+	_, err := app.Config.GetEncryption(name)
+	if err != nil {
+		return err
+	}
+
+	if !app.Identities.lock(name) {
+		return fmt.Errorf("encryption key '%s' is not unlocked", name)
+	}
+
+	app.Log.Infof(MsgGlob, "encryption key '%s' locked by '%s'", name, by)
+	return nil
+}
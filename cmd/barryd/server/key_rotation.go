@@ -0,0 +1,598 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/OnitiFR/barry/common"
+)
+
+// keyRotationMaxTries is the number of attempts for each file
+const keyRotationMaxTries = 3
+
+// keyRotationIDLength is the number of random chars of a key rotation ID
+const keyRotationIDLength = 8
+
+// keyRotationCopySuffix names the rekeyed copy of a remote object (hidden),
+// written next to it and verified before the object is replaced
+const keyRotationCopySuffix = ".rekey"
+
+// KeyRotation manages the (persistent) key rotation job: files using the
+// From key are rekeyed with the To key, locally through the Encrypter
+// workers and, optionally, remotely (objects are replaced by a verified
+// rekeyed copy). Only one job can run at a time, and an unfinished job is
+// resumed when barryd starts.
+type KeyRotation struct {
+	filename string
+	mutex    sync.Mutex
+	job      *KeyRotationJob
+	wake     chan bool
+	current  string
+}
+
+// KeyRotationJob is a rotation of files from a key to another
+type KeyRotationJob struct {
+	ID         string
+	From       string
+	To         string
+	Remote     bool // rewrite remote objects too
+	CreatedAt  time.Time
+	FinishedAt time.Time
+	References int // files still using From, once finished
+	Files      []*KeyRotationFile
+}
+
+// KeyRotationFile is a file of a key rotation job (Path is project/filename)
+type KeyRotationFile struct {
+	Path      string
+	Size      int64
+	LocalDone bool
+	Status    string
+	Tries     int
+	Error     string
+}
+
+// NewKeyRotation loads the key rotation job from the given file, if any
+func NewKeyRotation(filename string, log *Log) (*KeyRotation, error) {
+	rotation := &KeyRotation{
+		filename: filename,
+		wake:     make(chan bool, 1),
+	}
+
+	// if the file exists, load it
+	if _, err := os.Stat(rotation.filename); err == nil {
+		f, err := os.Open(rotation.filename)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		dec := json.NewDecoder(f)
+		err = dec.Decode(&rotation.job)
+		if err != nil {
+			return nil, fmt.Errorf("decoding %s: %s", rotation.filename, err)
+		}
+
+		if rotation.job != nil && rotation.job.FinishedAt.IsZero() {
+			log.Infof(MsgGlob, "unfinished key rotation %s found, will be resumed", rotation.job.ID)
+		}
+	}
+
+	// save the file to check if it's writable
+	err := rotation.save()
+	if err != nil {
+		return nil, err
+	}
+
+	return rotation, nil
+}
+
+// you should lock the mutex before calling save()
+func (rotation *KeyRotation) save() error {
+	f, err := os.Create(rotation.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	return enc.Encode(rotation.job)
+}
+
+// runningID returns the ID of the running job (empty if none)
+func (rotation *KeyRotation) runningID() string {
+	rotation.mutex.Lock()
+	defer rotation.mutex.Unlock()
+
+	if rotation.job != nil && rotation.job.FinishedAt.IsZero() {
+		return rotation.job.ID
+	}
+	return ""
+}
+
+// Status returns the progress of the current (or last) job, nil if
+// there was never any job
+func (rotation *KeyRotation) Status() *common.APIKeyRotationStatus {
+	rotation.mutex.Lock()
+	defer rotation.mutex.Unlock()
+
+	job := rotation.job
+	if job == nil {
+		return nil
+	}
+
+	status := &common.APIKeyRotationStatus{
+		ID:         job.ID,
+		From:       job.From,
+		To:         job.To,
+		Remote:     job.Remote,
+		CreatedAt:  job.CreatedAt,
+		FinishedAt: job.FinishedAt,
+		FilesTotal: len(job.Files),
+		Current:    rotation.current,
+		References: job.References,
+		Errors:     make([]string, 0),
+	}
+
+	for _, file := range job.Files {
+		status.BytesTotal += file.Size
+		switch file.Status {
+		case common.KeyRotationFileDone:
+			status.FilesDone++
+			status.BytesDone += file.Size
+		case common.KeyRotationFileSkipped:
+			status.FilesSkipped++
+		case common.KeyRotationFileFailed:
+			status.FilesFailed++
+		case common.KeyRotationFileUnsealing:
+			status.FilesUnsealing++
+		}
+		if file.Error != "" {
+			status.Errors = append(status.Errors, fmt.Sprintf("%s: %s", file.Path, file.Error))
+		}
+	}
+
+	return status
+}
+
+// setFileStatus updates and saves the status of a job file
+func (rotation *KeyRotation) setFileStatus(file *KeyRotationFile, status string, errMsg string) {
+	rotation.mutex.Lock()
+	defer rotation.mutex.Unlock()
+
+	file.Status = status
+	file.Error = errMsg
+	rotation.save()
+}
+
+// localKeyNames returns the key names of the local (encrypted) copy of a
+// file, read from its header (nil if there's no such copy)
+func (app *App) localKeyNames(file *File) []string {
+	if file.ExpiredLocal || !file.Encrypted || !file.ReEncryptDate.IsZero() {
+		return nil
+	}
+
+	localPath, err := app.LocalStoragePath(FileStorageName, file.Path)
+	if err != nil {
+		return nil
+	}
+	return readKeyNames(localPath)
+}
+
+// fileUsesKey returns if the local copy and the remote object of a file
+// need the given key
+func (app *App) fileUsesKey(file *File, keyName string) (bool, bool) {
+	local := false
+	for _, name := range app.localKeyNames(file) {
+		if name == keyName {
+			local = true
+		}
+	}
+	remote := !file.ExpiredRemote && file.EncryptionKey == keyName
+	return local, remote
+}
+
+// KeyReferences returns the number of stored files (local copy or remote
+// object) still using the given key
+func (app *App) KeyReferences(keyName string) int {
+	count := 0
+	for _, file := range app.ProjectDB.GetStoredFiles() {
+		local, remote := app.fileUsesKey(&file, keyName)
+		if local || remote {
+			count++
+		}
+	}
+	return count
+}
+
+// StartKeyRotation creates a new key rotation job of all files using the
+// from key (local copies, and remote objects if remote is true)
+func (app *App) StartKeyRotation(from string, to string, remote bool) (*common.APIKeyRotationStatus, error) {
+	if from == to {
+		return nil, errors.New("source and destination keys are the same")
+	}
+
+	fromEncryption, err := app.Config.GetEncryption(from)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = app.Config.GetEncryption(to)
+	if err != nil {
+		return nil, err
+	}
+
+	if fromEncryption.PublicKey != nil {
+		if _, unlocked := app.Identities.get(from); !unlocked {
+			return nil, fmt.Errorf("encryption key '%s' is locked, unlock it first", from)
+		}
+	}
+
+	// both jobs rewrite remote objects
+	if id := app.Migration.runningID(); id != "" {
+		return nil, fmt.Errorf("storage migration %s is running, wait for its end", id)
+	}
+
+	job := &KeyRotationJob{
+		ID:        RandString(keyRotationIDLength, app.Rand),
+		From:      from,
+		To:        to,
+		Remote:    remote,
+		CreatedAt: time.Now(),
+		Files:     make([]*KeyRotationFile, 0),
+	}
+
+	for _, file := range app.ProjectDB.GetStoredFiles() {
+		local, remoteUse := app.fileUsesKey(&file, from)
+		if !local && !(remote && remoteUse) {
+			continue
+		}
+		job.Files = append(job.Files, &KeyRotationFile{
+			Path:   file.Path,
+			Size:   file.Size,
+			Status: common.KeyRotationFilePending,
+		})
+	}
+
+	if len(job.Files) == 0 {
+		return nil, fmt.Errorf("no file to rotate from key '%s'", from)
+	}
+
+	sort.Slice(job.Files, func(i, j int) bool {
+		return job.Files[i].Path < job.Files[j].Path
+	})
+
+	app.KeyRotation.mutex.Lock()
+	if app.KeyRotation.job != nil && app.KeyRotation.job.FinishedAt.IsZero() {
+		app.KeyRotation.mutex.Unlock()
+		return nil, fmt.Errorf("key rotation %s is still running", app.KeyRotation.job.ID)
+	}
+	app.KeyRotation.job = job
+	err = app.KeyRotation.save()
+	app.KeyRotation.mutex.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	app.Log.Infof(MsgGlob, "key rotation %s: %d file(s) from '%s' to '%s'", job.ID, len(job.Files), from, to)
+
+	select {
+	case app.KeyRotation.wake <- true:
+	default:
+	}
+
+	return app.KeyRotation.Status(), nil
+}
+
+// ScheduleKeyRotation runs the key rotation job, if any. Files waiting
+// for unsealing or failed (with tries left) are retried every RetryDelay.
+func (app *App) ScheduleKeyRotation() {
+	for {
+		app.KeyRotation.mutex.Lock()
+		job := app.KeyRotation.job
+		running := job != nil && job.FinishedAt.IsZero()
+		app.KeyRotation.mutex.Unlock()
+
+		if !running {
+			<-app.KeyRotation.wake
+			continue
+		}
+
+		if app.keyRotationPass(job) {
+			app.keyRotationFinish(job)
+			continue
+		}
+
+		time.Sleep(RetryDelay)
+	}
+}
+
+// keyRotationPass processes each remaining file of the job, returning
+// true when every file is processed
+func (app *App) keyRotationPass(job *KeyRotationJob) bool {
+	finished := true
+	for _, file := range job.Files {
+		if file.Status != common.KeyRotationFilePending && file.Status != common.KeyRotationFileUnsealing {
+			continue
+		}
+
+		app.rotateFile(job, file)
+		time.Sleep(KeyRotationPause)
+
+		if file.Status == common.KeyRotationFilePending || file.Status == common.KeyRotationFileUnsealing {
+			finished = false
+		}
+	}
+	return finished
+}
+
+func (app *App) keyRotationFinish(job *KeyRotationJob) {
+	references := app.KeyReferences(job.From)
+
+	app.KeyRotation.mutex.Lock()
+	job.FinishedAt = time.Now()
+	job.References = references
+	app.KeyRotation.save()
+	app.KeyRotation.mutex.Unlock()
+
+	status := app.KeyRotation.Status()
+	msg := fmt.Sprintf("key rotation %s from '%s' to '%s' finished: %d file(s) rotated, %d skipped, %d failed",
+		job.ID, job.From, job.To, status.FilesDone, status.FilesSkipped, status.FilesFailed)
+	if references == 0 {
+		msg += fmt.Sprintf(", key '%s' is not used anymore and can be removed", job.From)
+	} else {
+		msg += fmt.Sprintf(", key '%s' is still used by %d file(s)", job.From, references)
+	}
+	app.Log.Info(MsgGlob, msg)
+
+	alertType := AlertTypeGood
+	if status.FilesFailed > 0 {
+		alertType = AlertTypeBad
+	}
+	app.AlertSender.Send(&Alert{
+		Type:    alertType,
+		Subject: "Key rotation",
+		Content: msg,
+	})
+}
+
+// keyRotationFileFailed records an error: the file is retried on next
+// pass, or failed when there's no more try left
+func (app *App) keyRotationFileFailed(file *KeyRotationFile, err error) {
+	app.KeyRotation.mutex.Lock()
+	file.Tries++
+	tries := file.Tries
+	app.KeyRotation.mutex.Unlock()
+
+	status := common.KeyRotationFilePending
+	if tries >= keyRotationMaxTries {
+		status = common.KeyRotationFileFailed
+	}
+	app.Log.Errorf(path.Dir(file.Path), "key rotation of '%s' (try %d/%d): %s", file.Path, tries, keyRotationMaxTries, err)
+	app.KeyRotation.setFileStatus(file, status, err.Error())
+}
+
+// rotateFile rekeys the local copy of a file, then its remote object (if
+// requested, unsealing it first if needed)
+func (app *App) rotateFile(job *KeyRotationJob, rFile *KeyRotationFile) {
+	projectName := path.Dir(rFile.Path)
+	fileName := path.Base(rFile.Path)
+
+	// the file must not be migrated meanwhile (see migrateFile)
+	unlock := app.Retrieval.lockFile(rFile.Path)
+	defer unlock()
+
+	file := app.ProjectDB.FindFile(projectName, fileName)
+	if file == nil {
+		app.KeyRotation.setFileStatus(rFile, common.KeyRotationFileSkipped, "")
+		return
+	}
+
+	to, err := app.Config.GetEncryption(job.To)
+	if err != nil {
+		app.keyRotationFileFailed(rFile, err)
+		return
+	}
+
+	app.KeyRotation.mutex.Lock()
+	app.KeyRotation.current = rFile.Path
+	app.KeyRotation.mutex.Unlock()
+
+	defer func() {
+		app.KeyRotation.mutex.Lock()
+		app.KeyRotation.current = ""
+		app.KeyRotation.mutex.Unlock()
+	}()
+
+	local, remote := app.fileUsesKey(file, job.From)
+
+	if local && !rFile.LocalDone {
+		err = app.rotateLocalFile(file, to)
+		if err != nil {
+			app.keyRotationFileFailed(rFile, err)
+			return
+		}
+		app.Log.Infof(projectName, "key rotation: local copy of '%s' rekeyed with '%s'", fileName, to.Name)
+
+		err = app.ProjectDB.UpdateFileLocalEncryptionKey(projectName, fileName, to.Name)
+		if err != nil {
+			app.keyRotationFileFailed(rFile, err)
+			return
+		}
+	}
+
+	app.KeyRotation.mutex.Lock()
+	rFile.LocalDone = true
+	app.KeyRotation.mutex.Unlock()
+
+	if job.Remote && remote {
+		state, _, err := app.Storage.ObjectAvailability(file.Container, file.Path)
+		if err != nil {
+			app.keyRotationFileFailed(rFile, err)
+			return
+		}
+
+		// the local copy is enough to rewrite the object
+		rekeyed := app.localKeyNames(file)
+		if len(rekeyed) == 0 || rekeyed[0] != to.Name {
+			switch state {
+			case ObjectSealed:
+				eta, err := app.Storage.Unseal(file.Container, file.Path)
+				if err != nil {
+					app.keyRotationFileFailed(rFile, err)
+					return
+				}
+				app.Log.Infof(projectName, "key rotation: unsealing '%s' (ETA %s)", file.Path, eta)
+				app.KeyRotation.setFileStatus(rFile, common.KeyRotationFileUnsealing, "")
+				return
+			case ObjectUnsealing:
+				return
+			}
+		}
+
+		err = app.rotateRemoteFile(file, to, len(rekeyed) > 0 && rekeyed[0] == to.Name)
+		if err != nil {
+			app.keyRotationFileFailed(rFile, err)
+			return
+		}
+		app.Log.Infof(projectName, "key rotation: remote object '%s' rekeyed with '%s'", file.Path, to.Name)
+	}
+
+	app.KeyRotation.setFileStatus(rFile, common.KeyRotationFileDone, "")
+}
+
+// rotateLocalFile rekeys the local copy of a file with the Encrypter workers
+func (app *App) rotateLocalFile(file *File, to *EncryptionConfig) error {
+	localPath, err := app.LocalStoragePath(FileStorageName, file.Path)
+	if err != nil {
+		return err
+	}
+
+	enc := NewEncrypt(to, localPath)
+	enc.KeyCallback = app.encryptionKeyCallback
+	atomic.AddInt32(&app.encryptQueueSize, 1)
+	app.Encrypter.Channel <- enc
+	atomic.AddInt32(&app.encryptQueueSize, -1)
+	return <-enc.Result
+}
+
+// rotateRemoteFile rewrites the remote object of a file rekeyed with the
+// to key, from the (already rekeyed) local copy if fromLocal is true, or
+// from a rekeyed temporary copy of the object. The rekeyed content is first
+// uploaded next to the object and verified: the object is replaced, and the
+// file switched to the new key, only once this copy is trusted.
+func (app *App) rotateRemoteFile(file *File, to *EncryptionConfig, fromLocal bool) error {
+	rotated := *file
+	rotated.EncryptionKey = to.Name
+	size := common.EncryptedSize(file.encryptionVersion(), to.MasterKeys(), file.Size)
+	meta := NewObjectMetadata(&rotated)
+
+	var sourcePath string
+	if fromLocal {
+		localPath, err := app.LocalStoragePath(FileStorageName, file.Path)
+		if err != nil {
+			return err
+		}
+		sourcePath = localPath
+	} else {
+		tmpPath, err := app.rekeyRemoteFile(file, to)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmpPath)
+		sourcePath = tmpPath
+	}
+
+	// dot files are never queued: no stored file can have this name
+	copyPath := path.Join(path.Dir(file.Path), "."+path.Base(file.Path)+keyRotationCopySuffix)
+	sum, err := app.rotationUpload(sourcePath, file.Container, copyPath, size, meta)
+	if err == nil {
+		err = app.verifyObject(file.Container, copyPath, size, sum)
+	}
+	if err != nil {
+		app.Storage.Delete(&File{Path: copyPath, Container: file.Container})
+		return fmt.Errorf("rekeyed copy: %s", err)
+	}
+
+	// the previous object is kept by backends until the new one is complete
+	_, err = app.rotationUpload(sourcePath, file.Container, file.Path, size, meta)
+	if err != nil {
+		app.Storage.Delete(&File{Path: copyPath, Container: file.Container})
+		return err
+	}
+
+	err = app.verifyObject(file.Container, file.Path, size, sum)
+	if err == nil && app.Config.VerifyUploads {
+		err = app.verifyEncryptedUpload(&rotated, to)
+	}
+	if err != nil {
+		// the object is lost, not its verified copy
+		return fmt.Errorf("verification error: %s (rekeyed copy kept as '%s')", err, copyPath)
+	}
+
+	err = app.ProjectDB.UpdateFileEncryptionKey(file.ProjectName(), file.Filename, to.Name, size)
+	if err != nil {
+		return err
+	}
+
+	err = app.Storage.Delete(&File{Path: copyPath, Container: file.Container})
+	if err != nil {
+		app.Log.Warningf(file.ProjectName(), "key rotation: unable to delete rekeyed copy '%s': %s", copyPath, err)
+	}
+	return nil
+}
+
+// rekeyRemoteFile writes the remote object of a file, rekeyed with the to
+// key, to a temporary file (to be removed by the caller)
+func (app *App) rekeyRemoteFile(file *File, to *EncryptionConfig) (string, error) {
+	remote, err := app.Storage.ObjectOpen(file.Container, file.Path)
+	if err != nil {
+		return "", err
+	}
+	defer remote.Close()
+
+	tmp, err := os.CreateTemp("", path.Base(file.Path)+"-rekey")
+	if err != nil {
+		return "", err
+	}
+
+	err = common.RekeyFile(bufio.NewReader(remote), tmp, app.encryptionKeyCallback, to.MasterKeys())
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// rotationUpload uploads a rekeyed file of the given size as an object,
+// and returns the SHA-256 of the uploaded stream
+func (app *App) rotationUpload(sourcePath string, container string, objectPath string, size int64, meta ObjectMetadata) ([]byte, error) {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+
+	hash := sha256.New()
+	err = app.Storage.UploadStream(container, objectPath, size, io.TeeReader(newSizedReader(source, size), hash), meta, nil)
+	if err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/OnitiFR/barry/common"
+)
+
+const testRotationSettings = testKeySettings + `
+[[encryption]]
+name = "key-b"
+file = "key-b.key"
+`
+
+// testNoReplaceBackend accepts rekeyed copies, but fails to replace objects
+type testNoReplaceBackend struct {
+	Backend
+}
+
+func (b *testNoReplaceBackend) UploadStream(container string, path string, size int64, source io.Reader, meta ObjectMetadata, written *int64) error {
+	if !strings.HasSuffix(path, keyRotationCopySuffix) {
+		return errors.New("connection refused")
+	}
+	return b.Backend.UploadStream(container, path, size, source, meta, written)
+}
+
+// testRemoteKey returns the key name in the header of a remote object
+func testRemoteKey(t *testing.T, app *App, file *File) string {
+	remote, err := app.Storage.ObjectOpen(file.Container, file.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+
+	header, err := common.ReadEncryptionHeader(bufio.NewReader(remote))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return header.KeyName
+}
+
+// testRotationCopyExists returns true if the rekeyed copy of a file is
+// still stored
+func testRotationCopyExists(t *testing.T, app *App, file *File) bool {
+	return testRemoteExists(t, app, file.Container, file.ProjectName()+"/."+file.Filename+keyRotationCopySuffix)
+}
+
+func TestRotateRemoteFile(t *testing.T) {
+	app := testApp(t, testRotationSettings)
+	keyB, err := app.Config.GetEncryption("key-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local := testStoreFile(t, app, "project", "local.tar", []byte("local"))
+	remote := testStoreFile(t, app, "project", "remote.tar", []byte("remote"))
+	remote = testExpireLocal(t, app, remote)
+
+	// from the local copy (already rekeyed) and from the remote object
+	err = app.rotateLocalFile(local, keyB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for file, fromLocal := range map[*File]bool{local: true, remote: false} {
+		err = app.rotateRemoteFile(file, keyB, fromLocal)
+		if err != nil {
+			t.Fatalf("%s: %s", file.Path, err)
+		}
+
+		if file.EncryptionKey != "key-b" {
+			t.Errorf("%s: key is '%s'", file.Path, file.EncryptionKey)
+		}
+		if key := testRemoteKey(t, app, file); key != "key-b" {
+			t.Errorf("%s: remote object key is '%s'", file.Path, key)
+		}
+		err = app.verifyEncryptedUpload(file, keyB)
+		if err != nil {
+			t.Errorf("%s: %s", file.Path, err)
+		}
+		if testRotationCopyExists(t, app, file) {
+			t.Errorf("%s: rekeyed copy not deleted", file.Path)
+		}
+	}
+}
+
+func TestRotateRemoteFileFailure(t *testing.T) {
+	app := testApp(t, testRotationSettings)
+	keyB, err := app.Config.GetEncryption("key-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := app.Storage.containerBackend["cold"]
+
+	file := testStoreFile(t, app, "project", "file.tar", []byte("content"))
+	file = testExpireLocal(t, app, file)
+
+	failures := map[string]Backend{
+		"corrupted copy":    &testCorruptBackend{backend},
+		"replacement error": &testNoReplaceBackend{backend},
+	}
+	for name, failing := range failures {
+		app.Storage.containerBackend["cold"] = failing
+		err = app.rotateRemoteFile(file, keyB, false)
+		if err == nil {
+			t.Fatalf("%s: no error", name)
+		}
+
+		// the object and the file are left untouched
+		app.Storage.containerBackend["cold"] = backend
+		if file.EncryptionKey != "key-a" {
+			t.Errorf("%s: key is '%s'", name, file.EncryptionKey)
+		}
+		if key := testRemoteKey(t, app, file); key != "key-a" {
+			t.Errorf("%s: remote object key is '%s'", name, key)
+		}
+		if testRotationCopyExists(t, app, file) {
+			t.Errorf("%s: rekeyed copy not deleted", name)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/OnitiFR/barry/common"
+)
+
+// readKeyNames returns the key names of an encrypted file, read from its
+// header (nil if not encrypted or unreadable)
+func readKeyNames(filename string) []string {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	header, err := common.ReadEncryptionHeader(bufio.NewReader(f))
+	if err != nil {
+		return nil
+	}
+	return header.KeyNames()
+}
+
+// localEncryptionKey returns the name of the (primary) key of an
+// encrypted file (empty if not encrypted or unreadable)
+func localEncryptionKey(filename string) string {
+	names := readKeyNames(filename)
+	if len(names) == 0 {
+		return ""
+	}
+	return names[0]
+}
+
+// backfillEncryptionKeys records the key of files encrypted before it was
+// stored in the database, read from their local copy
+func (app *App) backfillEncryptionKeys() error {
+	count, err := app.ProjectDB.BackfillEncryptionKeys(func(file *File) string {
+		localPath, err := app.LocalStoragePath(FileStorageName, file.Path)
+		if err != nil {
+			return ""
+		}
+		return localEncryptionKey(localPath)
+	})
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		app.Log.Infof(MsgGlob, "encryption key of %d file(s) read from local copy headers", count)
+	}
+	return nil
+}
+
+// EncryptionUsage returns the count and size of stored files using each
+// key: configured keys, and keys still used but no longer configured.
+// Remote objects encrypted by barryd with an unknown key (uploaded before
+// it was recorded, local copy expired) are counted with an empty name.
+func (app *App) EncryptionUsage() []common.APIEncryptionUsage {
+	usages := make(map[string]*common.APIEncryptionUsage)
+	get := func(name string) *common.APIEncryptionUsage {
+		usage, exists := usages[name]
+		if !exists {
+			usage = &common.APIEncryptionUsage{Name: name}
+			usages[name] = usage
+		}
+		return usage
+	}
+
+	for name := range app.Config.Encryptions {
+		get(name).Configured = true
+	}
+
+	for _, file := range app.ProjectDB.GetStoredFiles() {
+		if !file.ExpiredLocal && file.Encrypted && file.LocalEncryptionKey != "" {
+			usage := get(file.LocalEncryptionKey)
+			usage.LocalFiles++
+			usage.LocalSize += file.Size
+		}
+		remoteEncrypted := file.Encrypted || !file.ReEncryptDate.IsZero()
+		if !file.ExpiredRemote && (file.EncryptionKey != "" || remoteEncrypted) {
+			usage := get(file.EncryptionKey)
+			usage.RemoteFiles++
+			usage.RemoteSize += file.Size
+		}
+	}
+
+	ret := make([]common.APIEncryptionUsage, 0, len(usages))
+	for _, usage := range usages {
+		ret = append(ret, *usage)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+// checkRemovedEncryptionKeys refuses to start (or only warns, with
+// allow_removed_keys) when stored files use keys that are not configured
+func (app *App) checkRemovedEncryptionKeys() error {
+	removed := make([]string, 0)
+	for _, usage := range app.EncryptionUsage() {
+		if usage.Configured {
+			continue
+		}
+		if usage.Name == "" {
+			app.Log.Warningf(MsgGlob, "%d remote file(s) encrypted with an unknown key (uploaded before keys were recorded, local copy expired), removed keys can't be detected for them", usage.RemoteFiles)
+			continue
+		}
+		removed = append(removed, fmt.Sprintf("'%s' (%d local, %d remote file(s))", usage.Name, usage.LocalFiles, usage.RemoteFiles))
+	}
+
+	if len(removed) == 0 {
+		return nil
+	}
+
+	msg := fmt.Sprintf("removed encryption key(s) still used by stored files: %s", strings.Join(removed, ", "))
+	if !app.Config.AllowRemovedKeys {
+		return fmt.Errorf("%s (configure them again, or see allow_removed_keys)", msg)
+	}
+
+	app.Log.Warning(MsgGlob, msg)
+	app.AlertSender.Send(&Alert{
+		Type:    AlertTypeBad,
+		Subject: "Encryption keys",
+		Content: msg + ", these files can't be restored",
+	})
+	return nil
+}
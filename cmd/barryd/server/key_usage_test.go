@@ -0,0 +1,109 @@
+package server
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/OnitiFR/barry/common"
+)
+
+const testKeySettings = testLocalSettings + `
+[[encryption]]
+name = "key-a"
+file = "key-a.key"
+default = true
+`
+
+// testRestartApp initializes a new App using the directories of app, with
+// another key configuration (the previous App must not be used anymore)
+func testRestartApp(t *testing.T, app *App, keys []*tomlEncryption, allowRemovedKeys bool) (*App, error) {
+	rnd := rand.New(rand.NewSource(1))
+
+	config := *app.Config
+	config.AllowRemovedKeys = allowRemovedKeys
+	encryptions, err := NewEncryptionsConfigFromToml(keys, true, rnd, config.configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Encryptions = encryptions
+
+	restarted, err := NewApp(&config, rnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return restarted, restarted.Init(false, false)
+}
+
+func TestEncryptionUsage(t *testing.T) {
+	app := testApp(t, testKeySettings)
+
+	first := testStoreFile(t, app, "project", "first.tar", []byte("first"))
+	testStoreFile(t, app, "project", "second.tar", []byte("second"))
+	if first.EncryptionKey != "key-a" || first.LocalEncryptionKey != "key-a" {
+		t.Fatalf("keys are '%s' (remote) and '%s' (local)", first.EncryptionKey, first.LocalEncryptionKey)
+	}
+
+	expected := []common.APIEncryptionUsage{
+		{Name: "key-a", Configured: true, LocalFiles: 2, LocalSize: 11, RemoteFiles: 2, RemoteSize: 11},
+	}
+	usage := app.EncryptionUsage()
+	if len(usage) != 1 || usage[0] != expected[0] {
+		t.Fatalf("usage is %+v", usage)
+	}
+
+	// files recorded before their keys: backfilled from local copies
+	first.EncryptionKey = ""
+	first.LocalEncryptionKey = ""
+	err := app.ProjectDB.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyA := &tomlEncryption{Name: "key-a", File: "key-a.key", Default: true}
+	keyB := &tomlEncryption{Name: "key-b", File: "key-b.key", Default: true}
+	app, err = testRestartApp(t, app, []*tomlEncryption{keyA}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage = app.EncryptionUsage()
+	if len(usage) != 1 || usage[0] != expected[0] {
+		t.Fatalf("usage after backfill is %+v", usage)
+	}
+
+	// key-a is still used
+	_, err = testRestartApp(t, app, []*tomlEncryption{keyB}, false)
+	if err == nil || !strings.Contains(err.Error(), "'key-a' (2 local, 2 remote file(s))") {
+		t.Fatalf("start without a used key returned %v", err)
+	}
+
+	app, err = testRestartApp(t, app, []*tomlEncryption{keyB}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage = app.EncryptionUsage()
+	if len(usage) != 2 || usage[0].Name != "key-a" || usage[0].Configured || !usage[1].Configured {
+		t.Errorf("usage without key-a is %+v", usage)
+	}
+}
+
+func TestEncryptionUsageUnknownKey(t *testing.T) {
+	app := testApp(t, testKeySettings)
+
+	// uploaded before keys were recorded, local copy expired
+	file := testStoreFile(t, app, "project", "file.tar", []byte("content"))
+	file = testExpireLocal(t, app, file)
+	file.EncryptionKey = ""
+	file.LocalEncryptionKey = ""
+
+	usage := app.EncryptionUsage()
+	if len(usage) != 2 || usage[0].Name != "" || usage[0].RemoteFiles != 1 || usage[0].LocalFiles != 0 {
+		t.Fatalf("usage is %+v", usage)
+	}
+
+	// can't be detected, not a startup failure
+	err := app.checkRemovedEncryptionKeys()
+	if err != nil {
+		t.Error(err)
+	}
+}
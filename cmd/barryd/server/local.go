@@ -0,0 +1,388 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/OnitiFR/barry/common"
+)
+
+type tomlLocalConfig struct {
+	Path string `toml:"path"`
+}
+
+// LocalConfig stores final settings for a local (filesystem) storage
+type LocalConfig struct {
+	Path string
+}
+
+// Local is a storage on a local filesystem (local disk, NAS/NFS mount, USB
+// disk, …). It implements the Backend interface, each container being a
+// sub-directory of the configured path. Objects are always unsealed.
+type Local struct {
+	Config    *LocalConfig
+	QueuePath string
+	limiter   *rateLimiter // upload bandwidth (nil: unlimited)
+}
+
+// NewLocal will create a new Local instance from a connection config
+func NewLocal(config *LocalConfig, queuePath string, limiter *rateLimiter) (*Local, error) {
+	// an unmounted volume must not silently become a directory on the root fs
+	if isDir, err := IsDir(config.Path); !isDir {
+		return nil, err
+	}
+
+	return &Local{
+		Config:    config,
+		QueuePath: queuePath,
+		limiter:   limiter,
+	}, nil
+}
+
+// NewLocalConfigFromToml will check tomlLocalConfig and create a LocalConfig
+func NewLocalConfigFromToml(tConfig *tomlLocalConfig) (*LocalConfig, error) {
+	config := &LocalConfig{}
+
+	if tConfig.Path == "" {
+		return nil, errors.New("local path setting cannot be empty")
+	}
+	config.Path = filepath.Clean(tConfig.Path)
+
+	return config, nil
+}
+
+// objectPath returns the filesystem path of an object (path is anchored
+// in the container directory, it can't escape it)
+func (l *Local) objectPath(container string, objectPath string) string {
+	return filepath.Join(l.Config.Path, container, filepath.Clean("/"+objectPath))
+}
+
+// writeObject will atomically create / overwrite an object: content is
+// written to a temporary file in the same directory, synced, then renamed.
+func (l *Local) writeObject(container string, objectPath string, content io.Reader) error {
+	destPath := l.objectPath(container, objectPath)
+
+	err := os.MkdirAll(filepath.Dir(destPath), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := filepath.Join(filepath.Dir(destPath), "."+filepath.Base(destPath)+".part")
+	dest, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath) // no-op after a successful rename
+
+	_, err = io.Copy(dest, content)
+	if err != nil {
+		dest.Close()
+		return err
+	}
+
+	err = dest.Sync()
+	if err != nil {
+		dest.Close()
+		return err
+	}
+
+	err = dest.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, destPath)
+}
+
+// CheckContainer will return nil if the container directory exists. There's
+// no segment container with local storage, so checkSegments is ignored.
+func (l *Local) CheckContainer(name string, checkSegments bool) error {
+	isDir, err := IsDir(filepath.Join(l.Config.Path, name))
+	if !isDir {
+		return fmt.Errorf("container '%s': %s", name, err)
+	}
+	return nil
+}
+
+// Upload a local file to the storage directory. If written is not nil, it
+// is atomically updated with the number of bytes read from the source file,
+// so callers can track upload progress.
+func (l *Local) Upload(file *File, written *int64) error {
+	sourcePath := path.Clean(l.QueuePath + "/" + file.Path)
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	reader := uploadReader(source, written, l.limiter)
+
+	err = l.writeObject(file.Container, file.Path, reader)
+	if err != nil {
+		return err
+	}
+	return l.writeMetadata(file.Container, file.Path, NewObjectMetadata(file))
+}
+
+// AbandonUpload: nothing to do, failed writes are not resumed (and their
+// temporary file is removed)
+func (l *Local) AbandonUpload(container string, path string) error {
+	return nil
+}
+
+// UploadStream writes size bytes read from source as an object
+func (l *Local) UploadStream(container string, path string, size int64, source io.Reader, meta ObjectMetadata, written *int64) error {
+	reader := uploadReader(source, written, l.limiter)
+	err := l.writeObject(container, path, newSizedReader(reader, size))
+	if err != nil {
+		return err
+	}
+	return l.writeMetadata(container, path, meta)
+}
+
+// writeMetadata writes the metadata file of an object
+func (l *Local) writeMetadata(container string, objectPath string, meta ObjectMetadata) error {
+	content, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return l.writeObject(container, metaObjectName(objectPath), bytes.NewReader(content))
+}
+
+// GetMetadata reads the metadata file of an object (if any)
+func (l *Local) GetMetadata(container string, path string) (ObjectMetadata, error) {
+	_, err := os.Stat(l.objectPath(container, path))
+	if os.IsNotExist(err) {
+		return nil, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := ioutil.ReadFile(l.objectPath(container, metaObjectName(path)))
+	if os.IsNotExist(err) {
+		return make(ObjectMetadata), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseObjectMetadata(content)
+}
+
+// SetMetadata replaces the metadata file of an object
+func (l *Local) SetMetadata(container string, path string, meta ObjectMetadata) error {
+	_, err := os.Stat(l.objectPath(container, path))
+	if os.IsNotExist(err) {
+		return ErrObjectNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return l.writeMetadata(container, path, meta)
+}
+
+// Delete a File (and its metadata file)
+func (l *Local) Delete(file *File) error {
+	err := os.Remove(l.objectPath(file.Container, file.Path))
+	if os.IsNotExist(err) {
+		return ErrObjectNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(l.objectPath(file.Container, metaObjectName(file.Path)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Verify the stored object against the local file (size and checksum)
+func (l *Local) Verify(file *File) error {
+	return verifyByContent(file, l.QueuePath, l)
+}
+
+// ObjectSize returns the size of a local object
+func (l *Local) ObjectSize(container string, path string) (int64, error) {
+	stat, err := os.Stat(l.objectPath(container, path))
+	if os.IsNotExist(err) {
+		return 0, ErrObjectNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+// ObjectAvailability of a local object: always unsealed
+func (l *Local) ObjectAvailability(container string, path string) (string, time.Duration, error) {
+	_, err := os.Stat(l.objectPath(container, path))
+	if os.IsNotExist(err) {
+		return "", 0, ErrObjectNotFound
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	return ObjectUnsealed, 0, nil
+}
+
+// Unseal a file: nothing to do with local storage
+func (l *Local) Unseal(container string, path string) (time.Duration, error) {
+	_, _, err := l.ObjectAvailability(container, path)
+	if err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// ObjectOpen a local object, returning a ReadCloser
+func (l *Local) ObjectOpen(container string, path string) (io.ReadCloser, error) {
+	file, err := os.Open(l.objectPath(container, path))
+	if os.IsNotExist(err) {
+		return nil, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// FilePutContent will create / overwrite a file with a content
+func (l *Local) FilePutContent(container string, path string, content io.Reader) error {
+	return l.writeObject(container, path, content)
+}
+
+// FileGetContent will read a file to io.Writer
+func (l *Local) FileGetContent(container string, path string, output io.Writer) error {
+	source, err := l.ObjectOpen(container, path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	_, err = io.Copy(output, source)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// isTempObjectName returns true for temporary files of writeObject
+func isTempObjectName(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, ".part")
+}
+
+// metaObjectName returns the name of the (hidden) metadata file of an
+// object, since files have no portable metadata: ".name.meta"
+func metaObjectName(objectPath string) string {
+	return path.Join(path.Dir(objectPath), "."+path.Base(objectPath)+".meta")
+}
+
+// parseObjectMetadata decodes the content of a metadata file
+func parseObjectMetadata(content []byte) (ObjectMetadata, error) {
+	var meta ObjectMetadata
+	err := json.Unmarshal(content, &meta)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata file: %s", err)
+	}
+	return filterObjectMetadata(meta), nil
+}
+
+// isMetaObjectName returns true for metadata files (see metaObjectName)
+func isMetaObjectName(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, ".meta")
+}
+
+// ListObjects returns every file of a container directory
+func (l *Local) ListObjects(container string) ([]RemoteObject, error) {
+	root := filepath.Join(l.Config.Path, container)
+	res := make([]RemoteObject, 0)
+
+	err := filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || isTempObjectName(info.Name()) || isMetaObjectName(info.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+		res = append(res, RemoteObject{
+			Path:    filepath.ToSlash(rel),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// ListLeftovers returns temporary files left by interrupted writes
+func (l *Local) ListLeftovers(containers []string) ([]Leftover, error) {
+	res := make([]Leftover, 0)
+
+	for _, container := range containers {
+		root := filepath.Join(l.Config.Path, container)
+		err := filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() || !isTempObjectName(info.Name()) {
+				return nil
+			}
+			rel, err := filepath.Rel(root, filePath)
+			if err != nil {
+				return err
+			}
+			res = append(res, Leftover{
+				Kind:          common.GCItemTempFile,
+				Container:     container,
+				DataContainer: container,
+				Path:          filepath.ToSlash(rel),
+				Objects:       1,
+				Size:          info.Size(),
+				ModTime:       info.ModTime(),
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+// DeleteLeftover removes a temporary file
+func (l *Local) DeleteLeftover(leftover *Leftover) error {
+	if leftover.Kind != common.GCItemTempFile || !isTempObjectName(path.Base(leftover.Path)) {
+		return fmt.Errorf("'%s' is not a temporary file", leftover.Path)
+	}
+	err := os.Remove(l.objectPath(leftover.Container, leftover.Path))
+	if os.IsNotExist(err) {
+		return ErrObjectNotFound
+	}
+	return err
+}
+
+// ContainerUsage returns the total size of the objects of a container
+func (l *Local) ContainerUsage(container string) (int64, error) {
+	return containerUsageFromListing(l, container)
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OnitiFR/barry/common"
+)
+
+// Remote object metadata names. Each backend adds its own prefix
+// (X-Object-Meta- for Swift, X-Amz-Meta- for S3, …)
+const (
+	MetadataProject       = "barry-project"
+	MetadataFilename      = "barry-filename"
+	MetadataModTime       = "barry-mtime"
+	MetadataSize          = "barry-size"
+	MetadataOriginalSize  = "barry-original-size"
+	MetadataCompression   = "barry-compression"
+	MetadataSHA256        = "barry-sha256"
+	MetadataEncryptionKey = "barry-encryption-key"
+	MetadataExpireLocal   = "barry-expire-local"
+	MetadataExpireRemote  = "barry-expire-remote"
+)
+
+// ObjectMetadata describes the file stored in a remote object, so a
+// container listing is enough to know what each object is
+type ObjectMetadata map[string]string
+
+// filterObjectMetadata returns barry metadata found in a set of (lowercase
+// or not) user metadata
+func filterObjectMetadata(userMeta map[string]string) ObjectMetadata {
+	meta := make(ObjectMetadata)
+	for key, value := range userMeta {
+		key = strings.ToLower(key)
+		if strings.HasPrefix(key, "barry-") {
+			meta[key] = value
+		}
+	}
+	return meta
+}
+
+// NewObjectMetadata returns the metadata of a file (unknown values, like
+// the checksum of old files, are not included)
+func NewObjectMetadata(file *File) ObjectMetadata {
+	meta := ObjectMetadata{
+		MetadataProject:      file.ProjectName(),
+		MetadataFilename:     file.Filename,
+		MetadataModTime:      file.ModTime.Format(time.RFC3339),
+		MetadataSize:         strconv.FormatInt(file.Size, 10),
+		MetadataExpireLocal:  file.ExpireLocal.Format(time.RFC3339),
+		MetadataExpireRemote: file.ExpireRemote.Format(time.RFC3339),
+	}
+	if file.SHA256 != "" {
+		meta[MetadataSHA256] = file.SHA256
+	}
+	if file.EncryptionKey != "" {
+		meta[MetadataEncryptionKey] = file.EncryptionKey
+	}
+	if file.Compression != "" {
+		meta[MetadataCompression] = file.Compression
+		meta[MetadataOriginalSize] = strconv.FormatInt(file.OriginalSize, 10)
+	}
+	return meta
+}
+
+// fileChecksum returns the SHA-256 of the original content of a local file
+// and the name of its encryption key: for an encrypted file, both are read
+// from its header, otherwise the file is hashed (and the key is empty)
+func fileChecksum(filename string) (string, string, error) {
+	encrypted, err := common.IsFileEncrypted(filename)
+	if err != nil {
+		return "", "", err
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	if encrypted {
+		keyName, hash, err := common.ReadEncryptionChecksum(f)
+		if err != nil {
+			return "", "", err
+		}
+		return hex.EncodeToString(hash), keyName, nil
+	}
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), "", nil
+}
+
+// MetadataBackfill attaches metadata to remote objects of existing files
+// (one run at a time)
+type MetadataBackfill struct {
+	mutex  sync.Mutex
+	status *common.APIMetadataBackfill
+}
+
+// NewMetadataBackfill creates an idle backfill
+func NewMetadataBackfill() *MetadataBackfill {
+	return &MetadataBackfill{
+		status: &common.APIMetadataBackfill{
+			Errors: make([]string, 0),
+		},
+	}
+}
+
+// Status returns a copy of the current (or last) backfill status
+func (mb *MetadataBackfill) Status() common.APIMetadataBackfill {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	res := *mb.status
+	res.Errors = append([]string{}, mb.status.Errors...)
+	return res
+}
+
+// StartMetadataBackfill updates metadata of every remote object of the
+// project (all projects if empty) in the background
+func (app *App) StartMetadataBackfill(projectName string) (common.APIMetadataBackfill, error) {
+	app.MetadataBackfill.mutex.Lock()
+	defer app.MetadataBackfill.mutex.Unlock()
+
+	if app.MetadataBackfill.status.Running {
+		return common.APIMetadataBackfill{}, fmt.Errorf("a metadata backfill is already running")
+	}
+
+	if projectName != "" {
+		_, err := app.ProjectDB.GetByName(projectName)
+		if err != nil {
+			return common.APIMetadataBackfill{}, err
+		}
+	}
+
+	files := make([]File, 0)
+	for _, file := range app.ProjectDB.GetRemoteFiles() {
+		if projectName == "" || file.ProjectName() == projectName {
+			files = append(files, file)
+		}
+	}
+
+	app.MetadataBackfill.status = &common.APIMetadataBackfill{
+		Running:   true,
+		Project:   projectName,
+		StartedAt: time.Now(),
+		Files:     len(files),
+		Errors:    make([]string, 0),
+	}
+
+	go app.runMetadataBackfill(files)
+
+	return *app.MetadataBackfill.status, nil
+}
+
+func (app *App) runMetadataBackfill(files []File) {
+	app.Log.Infof(MsgGlob, "metadata: backfilling %d remote object(s)", len(files))
+
+	for i := range files {
+		file := &files[i]
+		err := app.backfillFileMetadata(file)
+
+		app.MetadataBackfill.mutex.Lock()
+		if err != nil {
+			msg := fmt.Sprintf("'%s' (container '%s'): %s", file.Path, file.Container, err)
+			app.Log.Errorf(file.ProjectName(), "metadata: %s", msg)
+			app.MetadataBackfill.status.Errors = append(app.MetadataBackfill.status.Errors, msg)
+		} else {
+			app.MetadataBackfill.status.Updated++
+		}
+		app.MetadataBackfill.mutex.Unlock()
+	}
+
+	app.MetadataBackfill.mutex.Lock()
+	defer app.MetadataBackfill.mutex.Unlock()
+
+	status := app.MetadataBackfill.status
+	status.Running = false
+	status.Duration = time.Since(status.StartedAt)
+
+	app.Log.Infof(MsgGlob, "metadata: backfill done, %d object(s) updated, %d error(s)", status.Updated, len(status.Errors))
+}
+
+// backfillFileMetadata sets metadata of the remote object of a file. The
+// checksum of files uploaded before it was recorded is computed from the
+// local copy, when there's one.
+func (app *App) backfillFileMetadata(file *File) error {
+	if file.SHA256 == "" {
+		localPath, err := file.GetLocalPath(app)
+		if err == nil && common.PathExist(localPath) {
+			sha, keyName, err := fileChecksum(localPath)
+			if err != nil {
+				return fmt.Errorf("local copy checksum: %s", err)
+			}
+			err = app.ProjectDB.UpdateFileChecksum(file.ProjectName(), file.Filename, sha, keyName)
+			if err != nil {
+				return err
+			}
+			file.SHA256 = sha
+			if file.EncryptionKey == "" {
+				file.EncryptionKey = keyName
+			}
+		}
+	}
+
+	return app.Storage.SetMetadata(file.Container, file.Path, NewObjectMetadata(file))
+}
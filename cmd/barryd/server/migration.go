@@ -0,0 +1,519 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/OnitiFR/barry/common"
+)
+
+// migrationMaxTries is the number of copy attempts for each file
+const migrationMaxTries = 3
+
+// migrationIDLength is the number of random chars of a migration job ID
+const migrationIDLength = 8
+
+// Migration manages the (persistent) storage migration job: files are
+// streamed from a container to another, possibly across storages, then the
+// source object is deleted. Only one job can run at a time, and an
+// unfinished job is resumed when barryd starts.
+type Migration struct {
+	filename string
+	mutex    sync.Mutex
+	job      *MigrationJob
+	wake     chan bool
+
+	// progress of the current copy
+	current        string
+	currentSize    int64
+	currentWritten int64
+}
+
+// MigrationJob is a migration of files from a container to another
+type MigrationJob struct {
+	ID         string
+	From       string
+	To         string
+	Project    string // empty for all projects
+	CreatedAt  time.Time
+	FinishedAt time.Time
+	Files      []*MigrationFile
+}
+
+// MigrationFile is a file of a migration job (Path is project/filename)
+type MigrationFile struct {
+	Path   string
+	Size   int64
+	Status string
+	Tries  int
+	Error  string
+}
+
+// NewMigration loads the migration job from the given file, if any
+func NewMigration(filename string, log *Log) (*Migration, error) {
+	migration := &Migration{
+		filename: filename,
+		wake:     make(chan bool, 1),
+	}
+
+	// if the file exists, load it
+	if _, err := os.Stat(migration.filename); err == nil {
+		f, err := os.Open(migration.filename)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		dec := json.NewDecoder(f)
+		err = dec.Decode(&migration.job)
+		if err != nil {
+			return nil, fmt.Errorf("decoding %s: %s", migration.filename, err)
+		}
+
+		if migration.job != nil && migration.job.FinishedAt.IsZero() {
+			log.Infof(MsgGlob, "unfinished storage migration %s found, will be resumed", migration.job.ID)
+		}
+	}
+
+	// save the file to check if it's writable
+	err := migration.save()
+	if err != nil {
+		return nil, err
+	}
+
+	return migration, nil
+}
+
+// you should lock the mutex before calling save()
+func (migration *Migration) save() error {
+	f, err := os.Create(migration.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	return enc.Encode(migration.job)
+}
+
+// runningID returns the ID of the running job (empty if none)
+func (migration *Migration) runningID() string {
+	migration.mutex.Lock()
+	defer migration.mutex.Unlock()
+
+	if migration.job != nil && migration.job.FinishedAt.IsZero() {
+		return migration.job.ID
+	}
+	return ""
+}
+
+// Status returns the progress of the current (or last) job, nil if
+// there was never any job
+func (migration *Migration) Status() *common.APIMigrationStatus {
+	migration.mutex.Lock()
+	defer migration.mutex.Unlock()
+
+	job := migration.job
+	if job == nil {
+		return nil
+	}
+
+	status := &common.APIMigrationStatus{
+		ID:         job.ID,
+		From:       job.From,
+		To:         job.To,
+		Project:    job.Project,
+		CreatedAt:  job.CreatedAt,
+		FinishedAt: job.FinishedAt,
+		FilesTotal: len(job.Files),
+		Errors:     make([]string, 0),
+	}
+
+	for _, file := range job.Files {
+		status.BytesTotal += file.Size
+		switch file.Status {
+		case common.MigrationFileDone:
+			status.FilesDone++
+			status.BytesDone += file.Size
+		case common.MigrationFileSkipped:
+			status.FilesSkipped++
+		case common.MigrationFileFailed:
+			status.FilesFailed++
+		case common.MigrationFileUnsealing:
+			status.FilesUnsealing++
+		}
+		if file.Error != "" {
+			status.Errors = append(status.Errors, fmt.Sprintf("%s: %s", file.Path, file.Error))
+		}
+	}
+
+	if migration.current != "" {
+		status.Current = migration.current
+		status.CurrentSize = migration.currentSize
+		status.CurrentWritten = atomic.LoadInt64(&migration.currentWritten)
+	}
+
+	return status
+}
+
+// setFileStatus updates and saves the status of a job file
+func (migration *Migration) setFileStatus(file *MigrationFile, status string, errMsg string) {
+	migration.mutex.Lock()
+	defer migration.mutex.Unlock()
+
+	file.Status = status
+	file.Error = errMsg
+	migration.save()
+}
+
+// StartMigration creates a new migration job of all remote files of the
+// from container (optionally limited to a project) to the to container
+func (app *App) StartMigration(from string, to string, projectName string) (*common.APIMigrationStatus, error) {
+	if from == to {
+		return nil, errors.New("source and destination containers are the same")
+	}
+
+	_, err := app.Storage.backendForContainer(from)
+	if err != nil {
+		return nil, err
+	}
+
+	if app.Config.GetContainer(to) == nil {
+		return nil, fmt.Errorf("destination container '%s' must be an [[upload_container]]", to)
+	}
+
+	if projectName != "" {
+		_, err = app.ProjectDB.GetByName(projectName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// both jobs rewrite remote objects
+	if id := app.KeyRotation.runningID(); id != "" {
+		return nil, fmt.Errorf("key rotation %s is running, wait for its end", id)
+	}
+
+	// the real size of each object (encrypted files are larger than the
+	// size recorded in the database)
+	objects, err := app.Storage.ListObjects(from)
+	if err != nil {
+		return nil, fmt.Errorf("listing container '%s': %s", from, err)
+	}
+	sizes := make(map[string]int64, len(objects))
+	for _, object := range objects {
+		sizes[object.Path] = object.Size
+	}
+
+	job := &MigrationJob{
+		ID:        RandString(migrationIDLength, app.Rand),
+		From:      from,
+		To:        to,
+		Project:   projectName,
+		CreatedAt: time.Now(),
+		Files:     make([]*MigrationFile, 0),
+	}
+
+	for _, file := range app.ProjectDB.GetRemoteFiles() {
+		if file.Container != from {
+			continue
+		}
+		if projectName != "" && file.ProjectName() != projectName {
+			continue
+		}
+		size, listed := sizes[file.Path]
+		if !listed {
+			size, _ = file.StoredSizeRange()
+		}
+		job.Files = append(job.Files, &MigrationFile{
+			Path:   file.Path,
+			Size:   size,
+			Status: common.MigrationFilePending,
+		})
+	}
+
+	if len(job.Files) == 0 {
+		return nil, fmt.Errorf("no file to migrate from container '%s'", from)
+	}
+
+	sort.Slice(job.Files, func(i, j int) bool {
+		return job.Files[i].Path < job.Files[j].Path
+	})
+
+	app.Migration.mutex.Lock()
+	if app.Migration.job != nil && app.Migration.job.FinishedAt.IsZero() {
+		app.Migration.mutex.Unlock()
+		return nil, fmt.Errorf("migration %s is still running", app.Migration.job.ID)
+	}
+	app.Migration.job = job
+	err = app.Migration.save()
+	app.Migration.mutex.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	app.Log.Infof(MsgGlob, "storage migration %s: %d file(s) from '%s' to '%s'", job.ID, len(job.Files), from, to)
+
+	select {
+	case app.Migration.wake <- true:
+	default:
+	}
+
+	return app.Migration.Status(), nil
+}
+
+// ScheduleMigration runs the migration job, if any. Files waiting for
+// unsealing or failed (with tries left) are retried every RetryDelay.
+func (app *App) ScheduleMigration() {
+	for {
+		app.Migration.mutex.Lock()
+		job := app.Migration.job
+		running := job != nil && job.FinishedAt.IsZero()
+		app.Migration.mutex.Unlock()
+
+		if !running {
+			<-app.Migration.wake
+			continue
+		}
+
+		if app.migrationPass(job) {
+			app.migrationFinish(job)
+			continue
+		}
+
+		time.Sleep(RetryDelay)
+	}
+}
+
+// migrationPass processes each remaining file of the job, returning true
+// when every file is processed
+func (app *App) migrationPass(job *MigrationJob) bool {
+	finished := true
+	for _, file := range job.Files {
+		if file.Status != common.MigrationFilePending && file.Status != common.MigrationFileUnsealing {
+			continue
+		}
+
+		app.migrateFile(job, file)
+
+		if file.Status == common.MigrationFilePending || file.Status == common.MigrationFileUnsealing {
+			finished = false
+		}
+	}
+	return finished
+}
+
+func (app *App) migrationFinish(job *MigrationJob) {
+	app.Migration.mutex.Lock()
+	job.FinishedAt = time.Now()
+	app.Migration.save()
+	app.Migration.mutex.Unlock()
+
+	status := app.Migration.Status()
+	msg := fmt.Sprintf("storage migration %s from '%s' to '%s' finished: %d file(s) migrated, %d skipped, %d failed",
+		job.ID, job.From, job.To, status.FilesDone, status.FilesSkipped, status.FilesFailed)
+	app.Log.Info(MsgGlob, msg)
+
+	alertType := AlertTypeGood
+	if status.FilesFailed > 0 {
+		alertType = AlertTypeBad
+	}
+	app.AlertSender.Send(&Alert{
+		Type:    alertType,
+		Subject: "Migration",
+		Content: msg,
+	})
+}
+
+// migrationFileFailed records a copy error: the file is retried on next
+// pass, or failed when there's no more try left
+func (app *App) migrationFileFailed(file *MigrationFile, err error) {
+	app.Migration.mutex.Lock()
+	file.Tries++
+	tries := file.Tries
+	app.Migration.mutex.Unlock()
+
+	status := common.MigrationFilePending
+	if tries >= migrationMaxTries {
+		status = common.MigrationFileFailed
+	}
+	app.Log.Errorf(path.Dir(file.Path), "migration of '%s' (try %d/%d): %s", file.Path, tries, migrationMaxTries, err)
+	app.Migration.setFileStatus(file, status, err.Error())
+}
+
+// migrateFile copies a file to the destination container (unsealing it
+// first if needed), moves it in the database, then deletes the source
+func (app *App) migrateFile(job *MigrationJob, mFile *MigrationFile) {
+	projectName := path.Dir(mFile.Path)
+	fileName := path.Base(mFile.Path)
+
+	// the remote object must not be rewritten meanwhile (key rotation)
+	unlock := app.Retrieval.lockFile(mFile.Path)
+	defer unlock()
+
+	file := app.ProjectDB.FindFile(projectName, fileName)
+	if file == nil || file.ExpiredRemote || file.Container != job.From {
+		app.Migration.setFileStatus(mFile, common.MigrationFileSkipped, "")
+		return
+	}
+
+	state, _, err := app.Storage.ObjectAvailability(job.From, file.Path)
+	if err != nil {
+		app.migrationFileFailed(mFile, err)
+		return
+	}
+
+	switch state {
+	case ObjectSealed:
+		eta, err := app.Storage.Unseal(job.From, file.Path)
+		if err != nil {
+			app.migrationFileFailed(mFile, err)
+			return
+		}
+		app.Log.Infof(projectName, "migration: unsealing '%s' (ETA %s)", file.Path, eta)
+		app.Migration.setFileStatus(mFile, common.MigrationFileUnsealing, "")
+		return
+	case ObjectUnsealing:
+		return
+	}
+
+	container := app.Config.GetContainer(job.To)
+	if container == nil {
+		app.migrationFileFailed(mFile, fmt.Errorf("unknown container '%s'", job.To))
+		return
+	}
+	if !app.QuotaReserve(container, mFile.Size) {
+		app.migrationFileFailed(mFile, fmt.Errorf("not enough quota left in container '%s'", job.To))
+		return
+	}
+	defer app.QuotaRelease(container, mFile.Size)
+
+	app.Log.Infof(projectName, "migration: copying '%s' from '%s' to '%s'", file.Path, job.From, job.To)
+	sum, err := app.migrationCopy(job, file, mFile.Size)
+	if err != nil {
+		app.migrationFileFailed(mFile, err)
+		return
+	}
+
+	// the source is deleted below, the copy must be trusted
+	err = app.verifyObject(job.To, file.Path, mFile.Size, sum)
+	if err != nil {
+		app.Storage.Delete(&File{Path: file.Path, Container: job.To})
+		app.migrationFileFailed(mFile, fmt.Errorf("destination object: %s", err))
+		return
+	}
+
+	// the file may have expired (and its source deleted) during the copy
+	current := app.ProjectDB.FindFile(projectName, fileName)
+	if current == nil || current.ExpiredRemote || current.Container != job.From {
+		app.Storage.Delete(&File{Path: file.Path, Container: job.To})
+		app.Migration.setFileStatus(mFile, common.MigrationFileSkipped, "")
+		return
+	}
+
+	cost, err := app.migrationCost(current, job.To)
+	if err != nil {
+		app.migrationFileFailed(mFile, err)
+		return
+	}
+
+	err = app.ProjectDB.UpdateFileContainer(projectName, fileName, job.To, cost, mFile.Size)
+	if err != nil {
+		app.migrationFileFailed(mFile, err)
+		return
+	}
+
+	err = app.Storage.Delete(&File{Path: file.Path, Container: job.From})
+	if err != nil && err != ErrObjectNotFound {
+		// the copy is done, the source is now an orphan (see GC)
+		msg := fmt.Sprintf("migration: unable to delete '%s' from source container '%s': %s", file.Path, job.From, err)
+		app.Log.Error(projectName, msg)
+		app.AlertSender.Send(&Alert{
+			Type:    AlertTypeBad,
+			Subject: "Error",
+			Content: msg,
+		})
+	}
+
+	app.Log.Infof(projectName, "migration: '%s' moved to '%s'", file.Path, job.To)
+	app.Migration.setFileStatus(mFile, common.MigrationFileDone, "")
+}
+
+// migrationCopy streams an object of the given size from the source to
+// the destination container, making sure the whole source object was
+// copied, and returns the SHA-256 of the copied stream
+func (app *App) migrationCopy(job *MigrationJob, file *File, size int64) ([]byte, error) {
+	source, err := app.Storage.ObjectOpen(job.From, file.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+
+	app.Migration.mutex.Lock()
+	app.Migration.current = file.Path
+	app.Migration.currentSize = size
+	atomic.StoreInt64(&app.Migration.currentWritten, 0)
+	app.Migration.mutex.Unlock()
+
+	defer func() {
+		app.Migration.mutex.Lock()
+		app.Migration.current = ""
+		app.Migration.mutex.Unlock()
+	}()
+
+	hash := sha256.New()
+	reader := newSizedReader(source, size)
+	err = app.Storage.UploadStream(job.To, file.Path, size, io.TeeReader(reader, hash), NewObjectMetadata(file), &app.Migration.currentWritten)
+	if err != nil {
+		return nil, err
+	}
+
+	// the source must not be longer than expected
+	_, err = reader.Read(make([]byte, 1))
+	if err != io.EOF {
+		app.Storage.Delete(&File{Path: file.Path, Container: job.To})
+		if err == nil {
+			err = errors.New("unexpected data after end of stream")
+		}
+		return nil, fmt.Errorf("source object: %s", err)
+	}
+
+	return hash.Sum(nil), nil
+}
+
+// migrationCost returns the lifetime cost of a file moved now to the
+// given container: the part already spent in its current container, plus
+// the cost of the remaining storage duration in the new one
+func (app *App) migrationCost(file *File, containerName string) (float64, error) {
+	container := app.Config.GetContainer(containerName)
+	if container == nil {
+		return 0, fmt.Errorf("container '%s' not found", containerName)
+	}
+
+	remaining := time.Until(file.ExpireRemote)
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	spent := file.Cost
+	if file.RemoteKeep > 0 && remaining < file.RemoteKeep {
+		spent = file.Cost * float64(file.RemoteKeep-remaining) / float64(file.RemoteKeep)
+	}
+
+	cost, err := container.Cost(file.Size, remaining)
+	if err != nil {
+		return 0, fmt.Errorf("container cost evaluation error: %s", err)
+	}
+
+	return spent + cost, nil
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/OnitiFR/barry/common"
+)
+
+// testCorruptBackend alters the content of streamed uploads (first byte)
+type testCorruptBackend struct {
+	Backend
+}
+
+func (b *testCorruptBackend) UploadStream(container string, path string, size int64, source io.Reader, meta ObjectMetadata, written *int64) error {
+	content, err := io.ReadAll(source)
+	if err != nil {
+		return err
+	}
+	if len(content) > 0 {
+		content[0]++
+	}
+	return b.Backend.UploadStream(container, path, size, bytes.NewReader(content), meta, written)
+}
+
+// testStartMigration starts a migration job, to be run with migrationPass
+func testStartMigration(t *testing.T, app *App, from string, to string) *MigrationJob {
+	_, err := app.StartMigration(from, to, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return app.Migration.job
+}
+
+func TestMigration(t *testing.T) {
+	app := testApp(t, testLocalSettings)
+
+	first := testStoreFile(t, app, "project", "first.tar", []byte("first"))
+	second := testStoreFile(t, app, "project", "second.tar", []byte("second"))
+
+	_, err := app.StartMigration("cold", "archive", "")
+	if err == nil {
+		t.Error("migration to a read-only container")
+	}
+
+	job := testStartMigration(t, app, "cold", "hot")
+	if !app.migrationPass(job) {
+		t.Fatal("migration pass not finished")
+	}
+	app.migrationFinish(job)
+
+	status := app.Migration.Status()
+	if status.FilesDone != 2 || len(status.Errors) != 0 {
+		t.Fatalf("migration status: %+v", status)
+	}
+
+	for _, file := range []*File{first, second} {
+		moved := app.ProjectDB.FindFile("project", file.Filename)
+		if moved.Container != "hot" {
+			t.Errorf("%s: container is '%s' in the database", file.Path, moved.Container)
+		}
+		if testRemoteExists(t, app, "cold", file.Path) {
+			t.Errorf("%s: source object not deleted", file.Path)
+		}
+		content, err := os.ReadFile(testRemotePath(app, "hot", file.Path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(content)) != file.Size {
+			t.Errorf("%s: destination object is %d bytes", file.Path, len(content))
+		}
+	}
+}
+
+func TestMigrationVerify(t *testing.T) {
+	app := testApp(t, testLocalSettings)
+
+	file := testStoreFile(t, app, "project", "file.tar", []byte("content"))
+	app.Storage.containerBackend["hot"] = &testCorruptBackend{app.Storage.containerBackend["hot"]}
+
+	job := testStartMigration(t, app, "cold", "hot")
+	for try := 1; try <= migrationMaxTries; try++ {
+		finished := app.migrationPass(job)
+		if finished != (try == migrationMaxTries) {
+			t.Fatalf("try %d: migration finished is %t", try, finished)
+		}
+
+		// the source is kept, the corrupted copy is removed
+		if !testRemoteExists(t, app, "cold", file.Path) {
+			t.Fatalf("try %d: source object deleted", try)
+		}
+		if testRemoteExists(t, app, "hot", file.Path) {
+			t.Errorf("try %d: corrupted destination object not deleted", try)
+		}
+		if container := app.ProjectDB.FindFile("project", "file.tar").Container; container != "cold" {
+			t.Fatalf("try %d: container is '%s' in the database", try, container)
+		}
+	}
+
+	status := app.Migration.Status()
+	if status.FilesFailed != 1 || len(status.Errors) != 1 {
+		t.Fatalf("migration status: %+v", status)
+	}
+	if expected := file.Path + ": destination object: checksum mismatch"; status.Errors[0] != expected {
+		t.Errorf("migration error is '%s', expected '%s'", status.Errors[0], expected)
+	}
+}
+
+func TestMigrationSourceChanged(t *testing.T) {
+	app := testApp(t, testLocalSettings)
+
+	file := testStoreFile(t, app, "project", "file.tar", []byte("content"))
+	job := testStartMigration(t, app, "cold", "hot")
+
+	// the source object is longer than listed when the job started
+	err := os.WriteFile(testRemotePath(app, "cold", file.Path), []byte("content, and more"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.migrationPass(job)
+
+	mFile := job.Files[0]
+	if mFile.Status != common.MigrationFilePending || mFile.Tries != 1 {
+		t.Errorf("migration file is %+v", mFile)
+	}
+	if !testRemoteExists(t, app, "cold", file.Path) || testRemoteExists(t, app, "hot", file.Path) {
+		t.Error("source object deleted, or destination object kept")
+	}
+}
@@ -177,6 +177,27 @@ func (db *ProjectDatabase) SaveToWriter(writer io.Writer) error {
 	return nil
 }
 
+// ReplaceProjects replaces the whole database content (counters are
+// computed from files), see RebuildFromRemote
+func (db *ProjectDatabase) ReplaceProjects(projects ProjectMap) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	for _, project := range projects {
+		project.FileCount = 0
+		project.SizeCount = 0
+		project.CostCount = 0
+		for _, file := range project.Files {
+			project.FileCount++
+			project.SizeCount += file.Size
+			project.CostCount += file.Cost
+		}
+	}
+	db.projects = projects
+
+	return db.save()
+}
+
 // GetNames returns all projects names, sorted
 func (db *ProjectDatabase) GetNames() []string {
 	db.mutex.Lock()
@@ -248,6 +269,98 @@ func (db *ProjectDatabase) FindFile(projectName string, fileName string) *File {
 	return file
 }
 
+// GetRemoteFiles returns a copy of every file still stored remotely
+func (db *ProjectDatabase) GetRemoteFiles() []File {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	files := make([]File, 0)
+	for _, project := range db.projects {
+		for _, file := range project.Files {
+			if !file.ExpiredRemote {
+				files = append(files, *file)
+			}
+		}
+	}
+	return files
+}
+
+// GetStoredFiles returns a copy of every file still stored locally or
+// remotely
+func (db *ProjectDatabase) GetStoredFiles() []File {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	files := make([]File, 0)
+	for _, project := range db.projects {
+		for _, file := range project.Files {
+			if !file.ExpiredRemote || !file.ExpiredLocal {
+				files = append(files, *file)
+			}
+		}
+	}
+	return files
+}
+
+// GetRetrievedFiles returns a copy of every file with a retrieved local copy
+func (db *ProjectDatabase) GetRetrievedFiles() []File {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	files := make([]File, 0)
+	for _, project := range db.projects {
+		for _, file := range project.Files {
+			if file.RetrievedPath != "" {
+				files = append(files, *file)
+			}
+		}
+	}
+	return files
+}
+
+// ClearRetrieved forgets the retrieved copy of a file (the caller deletes
+// it). A decrypted copy is forgotten too, since the remote one is encrypted.
+func (db *ProjectDatabase) ClearRetrieved(projectName string, fileName string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	project, projectExists := db.projects[projectName]
+	if !projectExists {
+		return fmt.Errorf("project '%s' does not exists in database", projectName)
+	}
+
+	file, fileExists := project.Files[fileName]
+	if !fileExists {
+		return fmt.Errorf("file '%s' does not exists in database for project '%s'", fileName, projectName)
+	}
+
+	file.RetrievedPath = ""
+	file.RetrievedDate = time.Time{}
+	file.RetrievedUsedAt = time.Time{}
+	if file.ExpiredLocal && !file.ReEncryptDate.IsZero() {
+		file.Encrypted = true
+		file.ReEncryptDate = time.Time{}
+	}
+
+	return db.save()
+}
+
+// ContainerUsage returns the total size of the remote files, by container
+func (db *ProjectDatabase) ContainerUsage() map[string]int64 {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	usage := make(map[string]int64)
+	for _, project := range db.projects {
+		for _, file := range project.Files {
+			if !file.ExpiredRemote {
+				usage[file.Container] += file.Size
+			}
+		}
+	}
+	return usage
+}
+
 // FileExists returns true if the file exists in the project
 func (db *ProjectDatabase) FileExists(projectName string, fileName string) bool {
 	return db.FindFile(projectName, fileName) != nil
@@ -311,6 +424,162 @@ func (db *ProjectDatabase) AddFile(projectName string, file *File) error {
 	return nil
 }
 
+// UpdateFileContainer moves a file to another container (after a storage
+// migration), with its new lifetime cost
+func (db *ProjectDatabase) UpdateFileContainer(projectName string, fileName string, container string, cost float64, objectSize int64) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	project, projectExists := db.projects[projectName]
+	if !projectExists {
+		return fmt.Errorf("project '%s' does not exists in database", projectName)
+	}
+
+	file, fileExists := project.Files[fileName]
+	if !fileExists {
+		return fmt.Errorf("file '%s' does not exists in database for project '%s'", fileName, projectName)
+	}
+
+	project.CostCount += cost - file.Cost
+	file.Cost = cost
+	file.Container = container
+	file.ObjectSize = objectSize
+
+	return db.save()
+}
+
+// UpdateFileChecksum sets the plaintext checksum and encryption key name
+// of a file, if unknown yet (empty values are ignored)
+func (db *ProjectDatabase) UpdateFileChecksum(projectName string, fileName string, sha256 string, encryptionKey string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	project, projectExists := db.projects[projectName]
+	if !projectExists {
+		return fmt.Errorf("project '%s' does not exists in database", projectName)
+	}
+
+	file, fileExists := project.Files[fileName]
+	if !fileExists {
+		return fmt.Errorf("file '%s' does not exists in database for project '%s'", fileName, projectName)
+	}
+
+	if file.SHA256 == "" {
+		file.SHA256 = sha256
+	}
+	if file.EncryptionKey == "" {
+		file.EncryptionKey = encryptionKey
+	}
+
+	return db.save()
+}
+
+// UpdateFileEncryptionKey sets the encryption key name and the object size
+// of a file (after a key rotation of its remote object)
+func (db *ProjectDatabase) UpdateFileEncryptionKey(projectName string, fileName string, encryptionKey string, objectSize int64) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	project, projectExists := db.projects[projectName]
+	if !projectExists {
+		return fmt.Errorf("project '%s' does not exists in database", projectName)
+	}
+
+	file, fileExists := project.Files[fileName]
+	if !fileExists {
+		return fmt.Errorf("file '%s' does not exists in database for project '%s'", fileName, projectName)
+	}
+
+	file.EncryptionKey = encryptionKey
+	file.ObjectSize = objectSize
+
+	return db.save()
+}
+
+// UpdateFileLocalEncryptionKey sets the encryption key name of the local
+// copy of a file (after a key rotation)
+func (db *ProjectDatabase) UpdateFileLocalEncryptionKey(projectName string, fileName string, encryptionKey string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	project, projectExists := db.projects[projectName]
+	if !projectExists {
+		return fmt.Errorf("project '%s' does not exists in database", projectName)
+	}
+
+	file, fileExists := project.Files[fileName]
+	if !fileExists {
+		return fmt.Errorf("file '%s' does not exists in database for project '%s'", fileName, projectName)
+	}
+
+	file.LocalEncryptionKey = encryptionKey
+
+	return db.save()
+}
+
+// SetFileLocalEncrypted records that the (plaintext) local copy of a file
+// was encrypted with the given key
+func (db *ProjectDatabase) SetFileLocalEncrypted(projectName string, fileName string, encryptionKey string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	project, projectExists := db.projects[projectName]
+	if !projectExists {
+		return fmt.Errorf("project '%s' does not exists in database", projectName)
+	}
+
+	file, fileExists := project.Files[fileName]
+	if !fileExists {
+		return fmt.Errorf("file '%s' does not exists in database for project '%s'", fileName, projectName)
+	}
+
+	file.Encrypted = true
+	file.ReEncryptDate = time.Time{}
+	file.LocalEncryptionKey = encryptionKey
+
+	return db.save()
+}
+
+// BackfillEncryptionKeys sets the encryption key names of files where
+// they're unknown, using keyName (the key of the encrypted local copy,
+// or an empty string if it's not encrypted): for the local copy, and for
+// the remote object, uploaded from this copy. Returns the number of
+// updated files.
+func (db *ProjectDatabase) BackfillEncryptionKeys(keyName func(*File) string) (int, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	count := 0
+	for _, project := range db.projects {
+		for _, file := range project.Files {
+			if file.ExpiredLocal || !file.Encrypted {
+				continue
+			}
+			remoteUnknown := !file.ExpiredRemote && file.EncryptionKey == ""
+			if file.LocalEncryptionKey != "" && !remoteUnknown {
+				continue
+			}
+
+			name := keyName(file)
+			if name == "" {
+				continue
+			}
+			if file.LocalEncryptionKey == "" {
+				file.LocalEncryptionKey = name
+			}
+			if remoteUnknown {
+				file.EncryptionKey = name
+			}
+			count++
+		}
+	}
+
+	if count == 0 {
+		return 0, nil
+	}
+	return count, db.save()
+}
+
 // GetProjectNextExpiration return next (= for next file) expiration values
 func (db *ProjectDatabase) GetProjectNextExpiration(project *Project, file *File) (ExpirationResult, ExpirationResult, error) {
 	db.mutex.Lock()
@@ -351,17 +620,6 @@ func (db *ProjectDatabase) ScheduleExpireFiles() {
 	}
 }
 
-// ScheduleReEncryptFiles will schedule file re-encryption tasks (call as a goroutine)
-func (db *ProjectDatabase) ScheduleReEncryptFiles(app *App) {
-	for {
-		err := db.reEncryptFiles(app)
-		if err != nil {
-			db.log.Errorf(MsgGlob, "error re-encrypting files: %s", err)
-		}
-		time.Sleep(ReEncryptDelay)
-	}
-}
-
 // ExpireLocalFiles will scan the database, deleting expired files in local storage
 func (db *ProjectDatabase) expireLocalFiles() {
 	db.mutex.Lock()
@@ -463,54 +721,6 @@ func (db *ProjectDatabase) expireClean() {
 	}
 }
 
-func (db *ProjectDatabase) reEncryptFiles(app *App) error {
-	db.mutex.Lock()
-	defer db.mutex.Unlock()
-
-	defEncrypt := app.Config.GetDefaultEncryption()
-	if defEncrypt == nil {
-		return nil
-	}
-
-	dbModified := false
-	for _, project := range db.projects {
-		for _, file := range project.Files {
-			if file.Encrypted || file.ReEncryptDate.IsZero() {
-				continue
-			}
-
-			if time.Now().Before(file.ReEncryptDate) {
-				continue
-			}
-
-			path, err := file.GetLocalPath(app)
-			if err != nil {
-				return err
-			}
-
-			// i'm not happy with this, re-encryption can take a long time and we're locking the mutex :(
-			// (a goroutine is not a solution, because we need to update the database on success only)
-			err = defEncrypt.EncryptFileInPlace(path, app.Rand, app.Log)
-			if err != nil {
-				return err
-			}
-
-			dbModified = true
-			file.Encrypted = true
-			file.ReEncryptDate = time.Time{}
-		}
-	}
-
-	if dbModified {
-		err := db.save()
-		if err != nil {
-			return fmt.Errorf("error saving database: %c", err)
-		}
-	}
-
-	return nil
-}
-
 // ScheduleNoBackupAlerts will schedule NoBackupAlerts task
 func (db *ProjectDatabase) ScheduleNoBackupAlerts() {
 	for {
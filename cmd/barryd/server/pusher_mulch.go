@@ -8,7 +8,6 @@ import (
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
-	"os"
 	"strconv"
 	"sync"
 	"time"
@@ -26,7 +25,7 @@ type PusherMulch struct {
 	config *PusherConfig
 
 	dest         io.Writer
-	src          *os.File
+	src          io.ReadCloser
 	startedAt    time.Time
 	uploadedSize int64
 	mutex        sync.Mutex
@@ -40,8 +39,9 @@ type mulchMessage struct {
 	Message string    `json:"message"`
 }
 
-// NewPusherMulch create a new Pusher to mulch
-func NewPusherMulch(file *File, path string, expire time.Duration, config *PusherConfig, log *Log) (Pusher, error) {
+// NewPusherMulch create a new Pusher to mulch, the file content is read
+// (decrypted) using open (see App.OpenFile)
+func NewPusherMulch(file *File, open func(*File) (io.ReadCloser, error), expire time.Duration, config *PusherConfig, log *Log) (Pusher, error) {
 	p := &PusherMulch{
 		startedAt: time.Now(),
 		file:      file,
@@ -88,7 +88,7 @@ func NewPusherMulch(file *File, path string, expire time.Duration, config *Pushe
 			return
 		}
 
-		p.src, err = os.Open(path)
+		p.src, err = open(file)
 		if err != nil {
 			p.error(err)
 			return
@@ -191,7 +191,7 @@ func (p *PusherMulch) copy(bufferSize int64) error {
 
 		// update ETA
 		p.uploadedSize += int64(n)
-		done := float64(p.uploadedSize) / float64(p.file.Size)
+		done := float64(p.uploadedSize) / float64(p.file.GetOriginalSize())
 		elapsed := time.Since(p.startedAt).Seconds()
 
 		p.mutex.Lock()
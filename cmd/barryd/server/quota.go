@@ -0,0 +1,186 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+)
+
+// Quota tracks the used size of upload containers with a quota: size of
+// the remote files of the database, (optionally) size reported by the
+// storage, and size reserved by uploads in progress.
+type Quota struct {
+	mutex        sync.Mutex
+	reserved     map[string]int64
+	storageUsage map[string]int64
+	alerted      map[string]int // highest alerted percentage, by container
+}
+
+// NewQuota creates an empty quota tracker
+func NewQuota() *Quota {
+	return &Quota{
+		reserved:     make(map[string]int64),
+		storageUsage: make(map[string]int64),
+		alerted:      make(map[string]int),
+	}
+}
+
+// usedLocked returns the used size of a container, mutex must be held
+func (quota *Quota) usedLocked(container *Container, dbUsage map[string]int64) int64 {
+	used := dbUsage[container.Name]
+	if container.QuotaFromStorage && quota.storageUsage[container.Name] > used {
+		used = quota.storageUsage[container.Name]
+	}
+	return used + quota.reserved[container.Name]
+}
+
+// reserve size bytes in the container, if its quota allows it (always
+// true for containers without quota)
+func (quota *Quota) reserve(container *Container, size int64, dbUsage map[string]int64) bool {
+	if container.Quota == 0 {
+		return true
+	}
+
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+
+	if uint64(quota.usedLocked(container, dbUsage)+size) > container.Quota {
+		return false
+	}
+	quota.reserved[container.Name] += size
+	return true
+}
+
+// release a previous reservation
+func (quota *Quota) release(container *Container, size int64) {
+	if container.Quota == 0 {
+		return
+	}
+
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+
+	quota.reserved[container.Name] -= size
+	if quota.reserved[container.Name] <= 0 {
+		delete(quota.reserved, container.Name)
+	}
+}
+
+// QuotaReserve reserves size bytes in the container, returning false if
+// this would exceed its quota. A successful reservation must be released
+// once the file is in the database (or on failure).
+func (app *App) QuotaReserve(container *Container, size int64) bool {
+	if container.Quota == 0 {
+		return true
+	}
+	return app.Quota.reserve(container, size, app.ProjectDB.ContainerUsage())
+}
+
+// QuotaRelease releases a reservation made with QuotaReserve
+func (app *App) QuotaRelease(container *Container, size int64) {
+	app.Quota.release(container, size)
+}
+
+// QuotaStatus returns a description of each upload container usage
+func (app *App) QuotaStatus() []string {
+	dbUsage := app.ProjectDB.ContainerUsage()
+
+	app.Quota.mutex.Lock()
+	defer app.Quota.mutex.Unlock()
+
+	res := make([]string, 0)
+	for _, container := range app.Config.Containers {
+		used := app.Quota.usedLocked(container, dbUsage)
+		var status string
+		if container.Quota == 0 {
+			status = fmt.Sprintf("%s: %s (no quota)", container.Name, datasize.ByteSize(used).HR())
+		} else {
+			status = fmt.Sprintf("%s: %s / %s (%d%%)",
+				container.Name,
+				datasize.ByteSize(used).HR(),
+				datasize.ByteSize(container.Quota).HR(),
+				uint64(used)*100/container.Quota)
+		}
+		if !app.Storage.IsHealthy(container.Name) {
+			status += ", storage unhealthy"
+		}
+		res = append(res, status)
+	}
+	return res
+}
+
+// ScheduleQuotaCheck will refresh storage usage and check quota alert
+// thresholds on a regular basis
+func (app *App) ScheduleQuotaCheck() {
+	for {
+		app.refreshStorageUsage()
+		app.CheckQuotaAlerts()
+		time.Sleep(QuotaCheckDelay)
+	}
+}
+
+// refreshStorageUsage asks the storage for the used size of containers
+// with quota_from_storage
+func (app *App) refreshStorageUsage() {
+	for _, container := range app.Config.Containers {
+		if container.Quota == 0 || !container.QuotaFromStorage {
+			continue
+		}
+		usage, err := app.Storage.ContainerUsage(container.Name)
+		if err != nil {
+			app.Log.Errorf(MsgGlob, "unable to get usage of container '%s': %s", container.Name, err)
+			continue
+		}
+		app.Quota.mutex.Lock()
+		app.Quota.storageUsage[container.Name] = usage
+		app.Quota.mutex.Unlock()
+	}
+}
+
+// CheckQuotaAlerts sends an alert when a container crosses one of its
+// fill thresholds (once per threshold, until the usage goes down again)
+func (app *App) CheckQuotaAlerts() {
+	dbUsage := app.ProjectDB.ContainerUsage()
+	msgs := make([]string, 0)
+
+	app.Quota.mutex.Lock()
+	for _, container := range app.Config.Containers {
+		if container.Quota == 0 {
+			continue
+		}
+
+		used := app.Quota.usedLocked(container, dbUsage)
+		perc := int(uint64(used) * 100 / container.Quota)
+
+		reached := 0
+		for _, threshold := range container.QuotaAlerts {
+			if perc >= threshold {
+				reached = threshold
+			}
+		}
+
+		if reached <= app.Quota.alerted[container.Name] {
+			// lower usage: allow a new alert when crossing up again
+			app.Quota.alerted[container.Name] = reached
+			continue
+		}
+		app.Quota.alerted[container.Name] = reached
+
+		msgs = append(msgs, fmt.Sprintf("container '%s' is %d%% full (%s/%s)",
+			container.Name, perc,
+			datasize.ByteSize(used).HR(),
+			datasize.ByteSize(container.Quota).HR()))
+	}
+	app.Quota.mutex.Unlock()
+
+	for _, msg := range msgs {
+		app.Log.Warning(MsgGlob, msg)
+		app.AlertSender.Send(&Alert{
+			Type:    AlertTypeBad,
+			Subject: "Quota",
+			Content: msg,
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// cold (the cheapest container) is limited to 10 bytes
+var testQuotaSettings = strings.Replace(testLocalSettings, `cost = "size"`, `cost = "size"
+quota = "10B"
+quota_from_storage = true`, 1)
+
+func TestQuotaReserve(t *testing.T) {
+	app := testApp(t, testQuotaSettings)
+	cold := app.Config.GetContainer("cold")
+	hot := app.Config.GetContainer("hot")
+
+	if !app.QuotaReserve(cold, 6) {
+		t.Fatal("reservation refused")
+	}
+	if app.QuotaReserve(cold, 6) {
+		t.Error("reservation accepted over quota (reserved size ignored)")
+	}
+	if !app.QuotaReserve(cold, 4) {
+		t.Error("reservation refused up to the quota")
+	}
+	if !app.QuotaReserve(hot, 1000) {
+		t.Error("reservation refused without quota")
+	}
+
+	app.QuotaRelease(cold, 6)
+	app.QuotaRelease(cold, 4)
+	app.QuotaRelease(hot, 1000)
+	if len(app.Quota.reserved) != 0 {
+		t.Errorf("reservations left after release: %v", app.Quota.reserved)
+	}
+	if !app.QuotaReserve(cold, 10) {
+		t.Error("reservation refused after release")
+	}
+	app.QuotaRelease(cold, 10)
+}
+
+func TestQuotaPlacement(t *testing.T) {
+	app := testApp(t, testQuotaSettings)
+
+	first := testStoreFile(t, app, "project", "first.tar", []byte("12345678"))
+	if first.Container != "cold" {
+		t.Errorf("first file stored in '%s', expected 'cold'", first.Container)
+	}
+	if len(app.Quota.reserved) != 0 {
+		t.Errorf("reservations left after upload: %v", app.Quota.reserved)
+	}
+
+	app.CheckQuotaAlerts()
+	if alerted := app.Quota.alerted["cold"]; alerted != 80 {
+		t.Errorf("alerted percentage is %d, expected 80", alerted)
+	}
+
+	// over the quota of the cheapest container
+	second := testStoreFile(t, app, "project", "second.tar", []byte("12345678"))
+	if second.Container != "hot" {
+		t.Errorf("second file stored in '%s', expected 'hot'", second.Container)
+	}
+}
+
+func TestQuotaFromStorage(t *testing.T) {
+	app := testApp(t, testQuotaSettings)
+
+	// the storage reports more than the database (unknown objects)
+	testPutRemote(t, app, "cold", "unknown.tar", "123456789", time.Now())
+	app.refreshStorageUsage()
+
+	file := testStoreFile(t, app, "project", "file.tar", []byte("12"))
+	if file.Container != "hot" {
+		t.Errorf("file stored in '%s', expected 'hot'", file.Container)
+	}
+}
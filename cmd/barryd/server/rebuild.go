@@ -0,0 +1,260 @@
+package server
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/OnitiFR/barry/common"
+)
+
+// RebuildFromRemote replaces the project database with the files found in
+// every container of every storage, inferred from object paths and
+// metadata (disaster recovery, when no usable self-backup exists).
+// Expirations are computed again with the current configuration. What
+// can't be inferred is written to a report, whose path is returned.
+func (app *App) RebuildFromRemote() (string, error) {
+	reportPath, err := app.LocalStoragePath("data", FilenameRebuild)
+	if err != nil {
+		return "", err
+	}
+
+	notes := make([]string, 0)
+	note := func(format string, args ...interface{}) {
+		msg := fmt.Sprintf(format, args...)
+		app.Log.Warning(MsgGlob, "rebuild: "+msg)
+		notes = append(notes, msg)
+	}
+
+	files := make(map[string]*File) // by path
+	objectCount := 0
+	for _, storage := range app.Config.Storages {
+		for _, container := range storage.Containers {
+			// a partial listing would silently lose files, stop here
+			objects, err := app.Storage.ListObjects(container)
+			if err != nil {
+				return "", fmt.Errorf("listing container '%s': %s", container, err)
+			}
+			app.Log.Infof(MsgGlob, "rebuild: %d object(s) in container '%s'", len(objects), container)
+
+			for _, object := range objects {
+				// self-backups are not in the database
+				if strings.HasPrefix(object.Path, ".barry/") {
+					continue
+				}
+				objectCount++
+
+				file, err := app.rebuildFile(container, object, note)
+				if err != nil {
+					note("'%s/%s': %s, ignored", container, object.Path, err)
+					continue
+				}
+
+				// ex: interrupted migration, the newest copy wins
+				if other, exists := files[file.Path]; exists {
+					if other.AddedAt.After(file.AddedAt) {
+						file, other = other, file
+					}
+					note("'%s' found in containers '%s' and '%s', using '%s'", file.Path, other.Container, file.Container, file.Container)
+				}
+				files[file.Path] = file
+			}
+		}
+	}
+
+	// expiration cycles depend on file order
+	sorted := make([]*File, 0, len(files))
+	for _, file := range files {
+		sorted = append(sorted, file)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].ModTime.Before(sorted[j].ModTime)
+	})
+
+	now := time.Now()
+	projects := make(ProjectMap)
+	for _, file := range sorted {
+		projectName := file.ProjectName()
+		project, exists := projects[projectName]
+		if !exists {
+			project = NewProject(projectName, app.Config.Expiration)
+			project.LocalExpiration.ReferenceDate = file.ModTime
+			project.RemoteExpiration.ReferenceDate = file.ModTime
+			projects[projectName] = project
+		}
+
+		localExpiration := project.LocalExpiration.GetNext(file.ModTime)
+		remoteExpiration := project.RemoteExpiration.GetNext(file.ModTime)
+		file.ExpireLocal = file.ModTime.Add(localExpiration.Keep)
+		file.ExpireLocalOrg = localExpiration.Original
+		file.ExpireRemote = file.ModTime.Add(remoteExpiration.Keep)
+		file.ExpireRemoteOrg = remoteExpiration.Original
+		file.RemoteKeep = remoteExpiration.Keep
+
+		if file.ExpireRemote.Before(now) {
+			note("'%s' expired on %s with current settings, it will be deleted", file.Path, file.ExpireRemote.Format("2006-01-02 15:04"))
+		}
+
+		container := app.Config.GetContainer(file.Container)
+		if container != nil {
+			file.Cost, err = container.Cost(file.Size, file.RemoteKeep)
+			if err != nil {
+				return "", fmt.Errorf("container cost evaluation error: %s", err)
+			}
+		}
+
+		err = app.rebuildLocalState(file)
+		if err != nil {
+			return "", err
+		}
+
+		project.Files[file.Filename] = file
+	}
+
+	err = app.ProjectDB.ReplaceProjects(projects)
+	if err != nil {
+		return "", err
+	}
+
+	report := fmt.Sprintf("barry database rebuild from remote, %s\n%d object(s), %d file(s) in %d project(s), %d note(s)\n\n%s\n",
+		now.Format("2006-01-02 15:04"), objectCount, len(files), len(projects), len(notes), strings.Join(notes, "\n"))
+	err = os.WriteFile(reportPath, []byte(report), 0644)
+	if err != nil {
+		return "", err
+	}
+
+	app.Log.Infof(MsgGlob, "rebuild: %d file(s) in %d project(s), %d note(s), see %s", len(files), len(projects), len(notes), reportPath)
+	return reportPath, nil
+}
+
+// rebuildFile infers a file from an object path and metadata
+func (app *App) rebuildFile(container string, object RemoteObject, note func(string, ...interface{})) (*File, error) {
+	dir := path.Dir(object.Path)
+	if dir == "." || dir == "/" {
+		return nil, errors.New("no project directory in path")
+	}
+
+	meta, err := app.Storage.GetMetadata(container, object.Path)
+	if err != nil {
+		note("'%s/%s': unable to read metadata: %s", container, object.Path, err)
+		meta = make(ObjectMetadata)
+	}
+
+	file := &File{
+		Filename:      path.Base(object.Path),
+		Path:          object.Path,
+		Container:     container,
+		Size:          object.Size,
+		ObjectSize:    object.Size,
+		AddedAt:       object.ModTime,
+		Status:        FileStatusUploaded,
+		SHA256:        meta[MetadataSHA256],
+		EncryptionKey: meta[MetadataEncryptionKey],
+		Compression:   meta[MetadataCompression],
+	}
+
+	if originalSize, err := strconv.ParseInt(meta[MetadataOriginalSize], 10, 64); err == nil {
+		file.OriginalSize = originalSize
+	}
+
+	// the path is how files are addressed, it wins
+	if project := meta[MetadataProject]; project != "" && project != dir {
+		note("'%s/%s': metadata project is '%s', using '%s'", container, object.Path, project, dir)
+	}
+
+	file.ModTime, err = time.Parse(time.RFC3339, meta[MetadataModTime])
+	if err != nil {
+		file.ModTime = object.ModTime
+		note("'%s/%s': unknown mtime, using upload date", container, object.Path)
+	}
+
+	size, err := strconv.ParseInt(meta[MetadataSize], 10, 64)
+	if err == nil {
+		file.Size = size
+		minSize, maxSize := encryptedSizeRange(file.EncryptionKey, size)
+		if file.EncryptionKey != "" && object.Size >= minSize && object.Size <= maxSize {
+			file.Encrypted = true
+		} else if object.Size != size {
+			note("'%s/%s': metadata size is %d, object size is %d", container, object.Path, size, object.Size)
+		}
+		return file, nil
+	}
+
+	// no metadata: the encryption header tells the key and size (and the
+	// checksum, with BARRY1)
+	header, err := app.rebuildReadHeader(container, object.Path)
+	switch {
+	case err != nil:
+		note("'%s/%s': unknown encryption and size (%s)", container, object.Path, err)
+	case header != nil:
+		file.Encrypted = true
+		file.EncryptionKey = header.KeyName
+		file.Compression = header.Compression
+		file.Size = header.PlainSize(object.Size)
+		if header.Hash != nil {
+			file.SHA256 = hex.EncodeToString(header.Hash)
+		}
+	}
+
+	return file, nil
+}
+
+// rebuildReadHeader reads the encryption header of an object (nil if the
+// object is not encrypted)
+func (app *App) rebuildReadHeader(container string, objectPath string) (*common.EncryptionHeader, error) {
+	state, _, err := app.Storage.ObjectAvailability(container, objectPath)
+	if err != nil {
+		return nil, err
+	}
+	if state != ObjectUnsealed {
+		return nil, fmt.Errorf("object is %s", state)
+	}
+
+	reader, err := app.Storage.ObjectOpen(container, objectPath)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	header, err := common.ReadEncryptionHeader(reader)
+	if err != nil {
+		// too short, invalid signature, …
+		return nil, nil
+	}
+	return header, nil
+}
+
+// rebuildLocalState checks if the local copy of a file is still there,
+// and whether it's encrypted or not
+func (app *App) rebuildLocalState(file *File) error {
+	localPath, err := app.LocalStoragePath(FileStorageName, file.Path)
+	if err != nil {
+		return err
+	}
+
+	if !common.PathExist(localPath) {
+		file.ExpiredLocal = true
+		return nil
+	}
+
+	// the local copy was decrypted, it will be encrypted again (at startup)
+	if file.Encrypted {
+		encrypted, err := common.IsFileEncrypted(localPath)
+		if err != nil {
+			return err
+		}
+		if !encrypted {
+			file.Encrypted = false
+			file.ReEncryptDate = time.Now()
+		} else {
+			file.LocalEncryptionKey = localEncryptionKey(localPath)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/OnitiFR/barry/common"
+)
+
+// retrievalMaxTries is the number of consecutive errors before a retrieval
+// request is abandoned
+const retrievalMaxTries = 3
+
+// Retrieval is the (persistent) queue of files to make available: barryd
+// unseals and downloads them by itself, then sends an alert when each file
+// is ready (files are decrypted when downloaded, see OpenFile). Unfinished requests are resumed when barryd starts.
+type Retrieval struct {
+	filename string
+	mutex    sync.Mutex
+	requests []*RetrievalRequest
+	wake     chan bool
+
+	// MakeFileAvailable must not run twice at the same time for a file
+	locksMutex sync.Mutex
+	locks      map[string]*sync.Mutex
+}
+
+// RetrievalRequest is a file waiting to be available (Path is project/filename)
+type RetrievalRequest struct {
+	Path        string
+	RequestedAt time.Time
+	RequestedBy string
+	Status      string
+	ETA         time.Duration
+	Tries       int
+	Error       string
+}
+
+// NewRetrieval loads the retrieval queue from the given file, if any
+func NewRetrieval(filename string, log *Log) (*Retrieval, error) {
+	retrieval := &Retrieval{
+		filename: filename,
+		requests: make([]*RetrievalRequest, 0),
+		wake:     make(chan bool, 1),
+		locks:    make(map[string]*sync.Mutex),
+	}
+
+	// if the file exists, load it
+	if _, err := os.Stat(retrieval.filename); err == nil {
+		f, err := os.Open(retrieval.filename)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		dec := json.NewDecoder(f)
+		err = dec.Decode(&retrieval.requests)
+		if err != nil {
+			return nil, fmt.Errorf("decoding %s: %s", retrieval.filename, err)
+		}
+
+		if len(retrieval.requests) > 0 {
+			log.Infof(MsgGlob, "%d file retrieval(s) found, will be resumed", len(retrieval.requests))
+		}
+	}
+
+	// save the file to check if it's writable
+	err := retrieval.save()
+	if err != nil {
+		return nil, err
+	}
+
+	return retrieval, nil
+}
+
+// you should lock the mutex before calling save()
+func (retrieval *Retrieval) save() error {
+	f, err := os.Create(retrieval.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	return enc.Encode(retrieval.requests)
+}
+
+// lockFile locks a file path, returning the unlock function
+func (retrieval *Retrieval) lockFile(filePath string) func() {
+	retrieval.locksMutex.Lock()
+	lock, exists := retrieval.locks[filePath]
+	if !exists {
+		lock = &sync.Mutex{}
+		retrieval.locks[filePath] = lock
+	}
+	retrieval.locksMutex.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+// List returns the pending requests
+func (retrieval *Retrieval) List() []common.APIRetrieval {
+	retrieval.mutex.Lock()
+	defer retrieval.mutex.Unlock()
+
+	res := make([]common.APIRetrieval, 0, len(retrieval.requests))
+	for _, request := range retrieval.requests {
+		res = append(res, request.toAPI())
+	}
+	return res
+}
+
+func (request *RetrievalRequest) toAPI() common.APIRetrieval {
+	return common.APIRetrieval{
+		Path:        request.Path,
+		RequestedAt: request.RequestedAt,
+		RequestedBy: request.RequestedBy,
+		Status:      request.Status,
+		ETA:         request.ETA,
+		Error:       request.Error,
+	}
+}
+
+// remove a request from the queue
+func (retrieval *Retrieval) remove(request *RetrievalRequest) {
+	retrieval.mutex.Lock()
+	defer retrieval.mutex.Unlock()
+
+	for i, r := range retrieval.requests {
+		if r == request {
+			retrieval.requests = append(retrieval.requests[:i], retrieval.requests[i+1:]...)
+			break
+		}
+	}
+	retrieval.save()
+}
+
+// RequestRetrieval queues a file for retrieval (if it's not already
+// available), barryd will send an alert when it's ready
+func (app *App) RequestRetrieval(file *File, requestedBy string) (common.APIRetrieval, error) {
+	status, err := app.MakeFileAvailable(file)
+	if err != nil {
+		return common.APIRetrieval{}, err
+	}
+
+	if status.Status == common.APIFileStatusAvailable {
+		return common.APIRetrieval{
+			Path:        file.Path,
+			RequestedAt: time.Now(),
+			RequestedBy: requestedBy,
+			Status:      status.Status,
+		}, nil
+	}
+
+	app.Retrieval.mutex.Lock()
+	for _, request := range app.Retrieval.requests {
+		if request.Path == file.Path {
+			app.Retrieval.mutex.Unlock()
+			return request.toAPI(), nil
+		}
+	}
+
+	request := &RetrievalRequest{
+		Path:        file.Path,
+		RequestedAt: time.Now(),
+		RequestedBy: requestedBy,
+		Status:      status.Status,
+		ETA:         status.ETA,
+	}
+	app.Retrieval.requests = append(app.Retrieval.requests, request)
+	err = app.Retrieval.save()
+	res := request.toAPI()
+	app.Retrieval.mutex.Unlock()
+
+	if err != nil {
+		return res, err
+	}
+
+	app.Log.Infof(file.ProjectName(), "retrieval of '%s' queued by '%s'", file.Filename, requestedBy)
+
+	select {
+	case app.Retrieval.wake <- true:
+	default:
+	}
+
+	return res, nil
+}
+
+// ScheduleRetrieval drives queued retrievals to completion: unsealing,
+// download.
+func (app *App) ScheduleRetrieval() {
+	for {
+		app.Retrieval.mutex.Lock()
+		requests := append([]*RetrievalRequest{}, app.Retrieval.requests...)
+		app.Retrieval.mutex.Unlock()
+
+		if len(requests) == 0 {
+			<-app.Retrieval.wake
+			continue
+		}
+
+		for _, request := range requests {
+			app.retrievalStep(request)
+		}
+
+		select {
+		case <-app.Retrieval.wake:
+		case <-time.After(RetrievalCheckDelay):
+		}
+	}
+}
+
+// retrievalStep makes progress on a request, removing it from the queue
+// once the file is available (or when giving up)
+func (app *App) retrievalStep(request *RetrievalRequest) {
+	projectName := path.Dir(request.Path)
+	fileName := path.Base(request.Path)
+
+	file := app.ProjectDB.FindFile(projectName, fileName)
+	if file == nil {
+		app.Log.Warningf(projectName, "retrieval: file '%s' does not exist anymore", request.Path)
+		app.Retrieval.remove(request)
+		return
+	}
+
+	status, err := app.MakeFileAvailable(file)
+	if err != nil {
+		app.Retrieval.mutex.Lock()
+		request.Tries++
+		request.Error = err.Error()
+		tries := request.Tries
+		app.Retrieval.save()
+		app.Retrieval.mutex.Unlock()
+
+		app.Log.Errorf(projectName, "retrieval of '%s' (try %d/%d): %s", request.Path, tries, retrievalMaxTries, err)
+		if tries < retrievalMaxTries {
+			return
+		}
+
+		app.Retrieval.remove(request)
+		app.AlertSender.Send(&Alert{
+			Type:    AlertTypeBad,
+			Subject: "Retrieval",
+			Content: fmt.Sprintf("retrieval of '%s' (requested by '%s') failed: %s", request.Path, request.RequestedBy, err),
+		})
+		return
+	}
+
+	if status.Status != common.APIFileStatusAvailable {
+		app.Retrieval.mutex.Lock()
+		request.Status = status.Status
+		request.ETA = status.ETA
+		request.Tries = 0
+		request.Error = ""
+		app.Retrieval.save()
+		app.Retrieval.mutex.Unlock()
+		return
+	}
+
+	app.Retrieval.remove(request)
+
+	msg := fmt.Sprintf("file '%s' (requested by '%s') is available", request.Path, request.RequestedBy)
+	app.Log.Info(projectName, msg)
+	app.AlertSender.Send(&Alert{
+		Type:    AlertTypeGood,
+		Subject: "Retrieval",
+		Content: msg,
+	})
+}
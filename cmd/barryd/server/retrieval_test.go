@@ -0,0 +1,166 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OnitiFR/barry/common"
+)
+
+// testSealedBackend stores cold objects, readable only once unsealed
+// (see Unseal and unseal), or fails with err if set
+type testSealedBackend struct {
+	Backend
+	mutex   sync.Mutex
+	state   string
+	unseals int
+	err     error
+}
+
+func (b *testSealedBackend) ObjectAvailability(container string, path string) (string, time.Duration, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.err != nil {
+		return "", 0, b.err
+	}
+	return b.state, time.Hour, nil
+}
+
+func (b *testSealedBackend) Unseal(container string, path string) (time.Duration, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.unseals++
+	b.state = ObjectUnsealing
+	return time.Hour, nil
+}
+
+// unseal ends the unsealing of objects
+func (b *testSealedBackend) unseal() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.state = ObjectUnsealed
+}
+
+// testExpireLocal deletes the local copy of a file, like expireLocalFiles
+func testExpireLocal(t *testing.T, app *App, file *File) *File {
+	localPath, err := app.LocalStoragePath(FileStorageName, file.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Remove(localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired := app.ProjectDB.FindFile(file.ProjectName(), file.Filename)
+	expired.ExpiredLocal = true
+	return expired
+}
+
+func TestRetrieval(t *testing.T) {
+	app := testApp(t, testLocalSettings)
+	sealed := &testSealedBackend{Backend: app.Storage.containerBackend["cold"], state: ObjectSealed}
+	app.Storage.containerBackend["cold"] = sealed
+
+	file := testStoreFile(t, app, "project", "file.tar", []byte("content"))
+
+	// still stored locally
+	res, err := app.RequestRetrieval(file, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != common.APIFileStatusAvailable || len(app.Retrieval.List()) != 0 {
+		t.Fatalf("retrieval of a local file is %+v", res)
+	}
+
+	file = testExpireLocal(t, app, file)
+	res, err = app.RequestRetrieval(file, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != common.APIFileStatusUnsealing || sealed.unseals != 1 {
+		t.Fatalf("retrieval is %+v, %d unseal(s)", res, sealed.unseals)
+	}
+
+	// requested again: same request
+	_, err = app.RequestRetrieval(file, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := app.Retrieval.List()
+	if len(list) != 1 || list[0].RequestedBy != "alice" {
+		t.Fatalf("retrieval queue is %+v", list)
+	}
+
+	// the queue survives a restart
+	reloaded, err := NewRetrieval(app.Retrieval.filename, testLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reloaded.List()) != 1 {
+		t.Errorf("reloaded retrieval queue is %+v", reloaded.List())
+	}
+
+	request := app.Retrieval.requests[0]
+	app.retrievalStep(request)
+	if request.Status != common.APIFileStatusUnsealing || sealed.unseals != 1 {
+		t.Fatalf("retrieval is %+v, %d unseal(s)", request, sealed.unseals)
+	}
+
+	sealed.unseal()
+	deadline := time.Now().Add(30 * time.Second)
+	for len(app.Retrieval.List()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("retrieval not finished: %+v", app.Retrieval.List())
+		}
+		app.retrievalStep(request)
+	}
+
+	retrieved := app.ProjectDB.FindFile("project", "file.tar")
+	expectedPath, err := app.LocalStoragePath(RetrievedStorageName, file.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retrieved.RetrievedPath != expectedPath {
+		t.Fatalf("retrieved path is '%s', expected '%s'", retrieved.RetrievedPath, expectedPath)
+	}
+	content, err := os.ReadFile(retrieved.RetrievedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "content" {
+		t.Errorf("retrieved content is '%s'", content)
+	}
+}
+
+func TestRetrievalError(t *testing.T) {
+	app := testApp(t, testLocalSettings)
+	sealed := &testSealedBackend{Backend: app.Storage.containerBackend["cold"], state: ObjectSealed}
+	app.Storage.containerBackend["cold"] = sealed
+
+	file := testStoreFile(t, app, "project", "file.tar", []byte("content"))
+	file = testExpireLocal(t, app, file)
+
+	_, err := app.RequestRetrieval(file, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed.mutex.Lock()
+	sealed.err = errors.New("connection refused")
+	sealed.mutex.Unlock()
+
+	request := app.Retrieval.requests[0]
+	for try := 1; try <= retrievalMaxTries; try++ {
+		app.retrievalStep(request)
+		if request.Tries != try || request.Error != "connection refused" {
+			t.Errorf("try %d: request is %+v", try, request)
+		}
+	}
+	if len(app.Retrieval.List()) != 0 {
+		t.Errorf("request kept after %d errors", retrievalMaxTries)
+	}
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/OnitiFR/barry/common"
+	"github.com/c2h5oh/datasize"
+)
+
+// retrievedMinAge protects recently used retrieved files from size-based
+// eviction (a single file larger than the cache must still be downloadable)
+const retrievedMinAge = 1 * time.Hour
+
+// retrievedUsedAt returns the last use of the retrieved copy of a file
+func retrievedUsedAt(file *File) time.Time {
+	if file.RetrievedUsedAt.IsZero() {
+		return file.RetrievedDate
+	}
+	return file.RetrievedUsedAt
+}
+
+// RetrievedFiles returns every retrieved copy, least recently used first
+func (app *App) RetrievedFiles() []common.APIRetrievedFile {
+	files := app.ProjectDB.GetRetrievedFiles()
+
+	res := make([]common.APIRetrievedFile, 0, len(files))
+	for i := range files {
+		file := &files[i]
+		var size int64
+		if stat, err := os.Stat(file.RetrievedPath); err == nil {
+			size = stat.Size()
+		}
+		usedAt := retrievedUsedAt(file)
+		res = append(res, common.APIRetrievedFile{
+			Path:        file.Path,
+			Size:        size,
+			RetrievedAt: file.RetrievedDate,
+			UsedAt:      usedAt,
+			ExpireAt:    usedAt.Add(app.Config.RetrievedTTL),
+		})
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].UsedAt.Before(res[j].UsedAt)
+	})
+	return res
+}
+
+// deleteRetrieved deletes the retrieved copy of a file
+func (app *App) deleteRetrieved(projectName string, fileName string, reason string) error {
+	file := app.ProjectDB.FindFile(projectName, fileName)
+	if file == nil {
+		return nil
+	}
+
+	unlock := app.Retrieval.lockFile(file.Path)
+	defer unlock()
+
+	retrievedPath := file.RetrievedPath
+	if retrievedPath == "" {
+		return nil
+	}
+
+	err := app.ProjectDB.ClearRetrieved(projectName, fileName)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(retrievedPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	app.Log.Infof(projectName, "retrieved copy of '%s' deleted (%s)", fileName, reason)
+	return nil
+}
+
+// PurgeRetrieved deletes the retrieved copies of a file, of a project
+// (empty fileName) or all of them (empty projectName), returning how many
+// copies were deleted
+func (app *App) PurgeRetrieved(projectName string, fileName string) (int, error) {
+	count := 0
+	for _, file := range app.ProjectDB.GetRetrievedFiles() {
+		if projectName != "" && file.ProjectName() != projectName {
+			continue
+		}
+		if fileName != "" && file.Filename != fileName {
+			continue
+		}
+
+		err := app.deleteRetrieved(file.ProjectName(), file.Filename, "purge")
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// CleanRetrieved deletes retrieved copies unused for RetrievedTTL, then
+// the least recently used ones while the cache is larger than
+// RetrievedMaxSize
+func (app *App) CleanRetrieved() {
+	now := time.Now()
+	var total int64
+	kept := make([]common.APIRetrievedFile, 0)
+
+	for _, retrieved := range app.RetrievedFiles() {
+		projectName, fileName := path.Dir(retrieved.Path), path.Base(retrieved.Path)
+		if now.After(retrieved.ExpireAt) {
+			err := app.deleteRetrieved(projectName, fileName, "unused since "+retrieved.UsedAt.Format("2006-01-02 15:04"))
+			if err != nil {
+				app.Log.Errorf(projectName, "unable to delete retrieved copy of '%s': %s", fileName, err)
+			}
+			continue
+		}
+		total += retrieved.Size
+		kept = append(kept, retrieved)
+	}
+
+	if app.Config.RetrievedMaxSize == 0 || uint64(total) <= app.Config.RetrievedMaxSize {
+		return
+	}
+
+	// kept is sorted, least recently used first
+	for _, retrieved := range kept {
+		if uint64(total) <= app.Config.RetrievedMaxSize {
+			break
+		}
+		if now.Sub(retrieved.UsedAt) < retrievedMinAge {
+			continue
+		}
+		projectName, fileName := path.Dir(retrieved.Path), path.Base(retrieved.Path)
+		reason := fmt.Sprintf("cache is larger than %s", datasize.ByteSize(app.Config.RetrievedMaxSize).HR())
+		err := app.deleteRetrieved(projectName, fileName, reason)
+		if err != nil {
+			app.Log.Errorf(projectName, "unable to delete retrieved copy of '%s': %s", fileName, err)
+			continue
+		}
+		total -= retrieved.Size
+	}
+}
+
+// ScheduleRetrievedClean will clean retrieved copies on a regular basis
+func (app *App) ScheduleRetrievedClean() {
+	for {
+		app.CleanRetrieved()
+		time.Sleep(CheckExpireEvery)
+	}
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRetrievedCopy stores a remote file and gives it a retrieved copy of
+// size bytes, last used at usedAt
+func testRetrievedCopy(t *testing.T, app *App, projectName string, filename string, size int, usedAt time.Time) *File {
+	file := testStoreFile(t, app, projectName, filename, []byte(filename))
+	file = testExpireLocal(t, app, file)
+
+	retrievedPath, err := app.LocalStoragePath(RetrievedStorageName, file.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(filepath.Dir(retrievedPath), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(retrievedPath, []byte(strings.Repeat("x", size)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file.RetrievedPath = retrievedPath
+	file.RetrievedDate = usedAt.Add(-time.Minute)
+	file.RetrievedUsedAt = usedAt
+	return file
+}
+
+func TestCleanRetrieved(t *testing.T) {
+	app := testApp(t, testLocalSettings)
+	app.Config.RetrievedMaxSize = 5
+
+	now := time.Now()
+	unused := testRetrievedCopy(t, app, "project", "unused.tar", 1, now.Add(-app.Config.RetrievedTTL-time.Hour))
+	oldest := testRetrievedCopy(t, app, "project", "oldest.tar", 6, now.Add(-3*time.Hour))
+	older := testRetrievedCopy(t, app, "other", "older.tar", 6, now.Add(-2*time.Hour))
+	recent := testRetrievedCopy(t, app, "other", "recent.tar", 6, now.Add(-retrievedMinAge/2))
+
+	list := app.RetrievedFiles()
+	order := []*File{unused, oldest, older, recent}
+	if len(list) != len(order) {
+		t.Fatalf("retrieved files: %+v", list)
+	}
+	for i, file := range order {
+		if list[i].Path != file.Path {
+			t.Errorf("retrieved file %d is '%s', expected '%s' (least recently used first)", i, list[i].Path, file.Path)
+		}
+	}
+
+	paths := make(map[*File]string)
+	for _, file := range order {
+		paths[file] = file.RetrievedPath
+	}
+
+	app.CleanRetrieved()
+
+	// unused for the TTL, then the least recently used ones, but the
+	// cache can be larger than its size for recently used files
+	kept := map[*File]bool{unused: false, oldest: false, older: false, recent: true}
+	for file, expected := range kept {
+		current := app.ProjectDB.FindFile(file.ProjectName(), file.Filename)
+		if (current.RetrievedPath != "") != expected {
+			t.Errorf("%s: retrieved path is '%s'", file.Path, current.RetrievedPath)
+		}
+		_, err := os.Stat(paths[file])
+		if (err == nil) != expected {
+			t.Errorf("%s: retrieved copy kept is %t, expected %t", file.Path, err == nil, expected)
+		}
+	}
+}
+
+func TestPurgeRetrieved(t *testing.T) {
+	app := testApp(t, testLocalSettings)
+
+	now := time.Now()
+	first := testRetrievedCopy(t, app, "project", "first.tar", 1, now)
+	second := testRetrievedCopy(t, app, "project", "second.tar", 1, now)
+	other := testRetrievedCopy(t, app, "other", "other.tar", 1, now)
+	paths := []string{first.RetrievedPath, second.RetrievedPath}
+
+	count, err := app.PurgeRetrieved("project", "first.tar")
+	if err != nil || count != 1 {
+		t.Fatalf("%d copies purged (%v)", count, err)
+	}
+	count, err = app.PurgeRetrieved("project", "")
+	if err != nil || count != 1 {
+		t.Fatalf("%d copies purged (%v)", count, err)
+	}
+
+	for _, path := range paths {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s: retrieved copy not deleted (%v)", path, err)
+		}
+	}
+	if first.RetrievedPath != "" || second.RetrievedPath != "" {
+		t.Error("purged copies still in the database")
+	}
+	if _, err := os.Stat(other.RetrievedPath); err != nil {
+		t.Errorf("%s: retrieved copy of another project deleted (%v)", other.Path, err)
+	}
+}
@@ -63,6 +63,7 @@ func (r *Retriever) copy(bufferSize int64) {
 		n, err := r.remoteFile.Read(buf)
 		if err != nil && err != io.EOF {
 			r.close(err)
+			return
 		}
 		if n == 0 {
 			break
@@ -70,6 +71,7 @@ func (r *Retriever) copy(bufferSize int64) {
 
 		if _, err := r.localFile.Write(buf[:n]); err != nil {
 			r.close(err)
+			return
 		}
 
 		// update ETA
@@ -86,6 +88,14 @@ func (r *Retriever) copy(bufferSize int64) {
 	r.close(nil)
 }
 
+// IsFinished returns true when the download is over, with its error (if any)
+func (r *Retriever) IsFinished() (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.Finished, r.Error
+}
+
 // GetETA of download end
 func (r *Retriever) GetETA() time.Duration {
 	r.mutex.Lock()
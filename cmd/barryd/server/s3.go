@@ -0,0 +1,584 @@
+package server
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	"github.com/OnitiFR/barry/common"
+	"github.com/c2h5oh/datasize"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+type tomlS3Config struct {
+	Endpoint     string            `toml:"endpoint"`
+	Region       string            `toml:"region"`
+	AccessKey    string            `toml:"access_key"`
+	SecretKey    string            `toml:"secret_key"`
+	PathStyle    bool              `toml:"path_style"`
+	ChunkSize    datasize.ByteSize `toml:"chunk_size"`
+	StorageClass string            `toml:"storage_class"`
+	RestoreDays  int               `toml:"restore_days"`
+	RestoreTier  string            `toml:"restore_tier"`
+}
+
+// S3Config stores final settings for S3
+type S3Config struct {
+	Endpoint     string // host[:port], without scheme
+	Secure       bool   // https
+	Region       string
+	AccessKey    string
+	SecretKey    string
+	PathStyle    bool
+	ChunkSize    uint64
+	StorageClass string
+	RestoreDays  int
+	RestoreTier  minio.TierType
+}
+
+// s3MaxParts is the maximum number of parts of a multipart upload
+const s3MaxParts = 10000
+
+// S3 storage classes that must be restored before being read ("sealed")
+var s3ArchiveClasses = map[string]bool{
+	"GLACIER":      true,
+	"DEEP_ARCHIVE": true,
+}
+
+// S3 is a connection to an S3-compatible provider (AWS, MinIO, …). It
+// implements the Backend interface, containers being S3 buckets.
+type S3 struct {
+	Config    *S3Config
+	QueuePath string
+	Client    *minio.Client
+	limiter   *rateLimiter // upload bandwidth (nil: unlimited)
+}
+
+// NewS3 will create a new S3 instance from a connection config
+func NewS3(config *S3Config, queuePath string, limiter *rateLimiter) (*S3, error) {
+	lookup := minio.BucketLookupAuto
+	if config.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:        credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+		Secure:       config.Secure,
+		Region:       config.Region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3{
+		Config:    config,
+		QueuePath: queuePath,
+		Client:    client,
+		limiter:   limiter,
+	}, nil
+}
+
+// NewS3ConfigFromToml will check tomlS3Config and create a S3Config
+func NewS3ConfigFromToml(tConfig *tomlS3Config) (*S3Config, error) {
+	config := &S3Config{}
+
+	// defaults (per-connection, since [[storage]] is an array)
+	if tConfig.ChunkSize == 0 {
+		tConfig.ChunkSize = 512 * datasize.MB
+	}
+	if tConfig.RestoreDays == 0 {
+		tConfig.RestoreDays = 7
+	}
+	if tConfig.RestoreTier == "" {
+		tConfig.RestoreTier = string(minio.TierStandard)
+	}
+
+	if tConfig.Endpoint == "" {
+		return nil, errors.New("s3 endpoint setting cannot be empty")
+	}
+	endpoint, err := url.Parse(tConfig.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("s3 endpoint: %s", err)
+	}
+	switch endpoint.Scheme {
+	case "https":
+		config.Secure = true
+	case "http":
+		config.Secure = false
+	default:
+		return nil, fmt.Errorf("s3 endpoint must start with https:// or http:// (was '%s')", tConfig.Endpoint)
+	}
+	if endpoint.Host == "" || (endpoint.Path != "" && endpoint.Path != "/") {
+		return nil, fmt.Errorf("s3 endpoint must be a base URL, like https://s3.example.com (was '%s')", tConfig.Endpoint)
+	}
+	config.Endpoint = endpoint.Host
+
+	if tConfig.AccessKey == "" {
+		return nil, errors.New("s3 access_key setting cannot be empty")
+	}
+	config.AccessKey = tConfig.AccessKey
+
+	if tConfig.SecretKey == "" {
+		return nil, errors.New("s3 secret_key setting cannot be empty")
+	}
+	config.SecretKey = tConfig.SecretKey
+
+	config.Region = tConfig.Region
+	config.PathStyle = tConfig.PathStyle
+	config.StorageClass = tConfig.StorageClass
+
+	// S3 multipart: parts of 5MB to 5GB, 10000 parts maximum (see partSize)
+	if tConfig.ChunkSize < 5*datasize.MB {
+		return nil, fmt.Errorf("chunk_size is to small (%s), use at least 5MB", tConfig.ChunkSize)
+	}
+	if tConfig.ChunkSize > 5*datasize.GB {
+		return nil, fmt.Errorf("chunk_size is to big (%s), use at most 5GB", tConfig.ChunkSize)
+	}
+	config.ChunkSize = tConfig.ChunkSize.Bytes()
+
+	if tConfig.RestoreDays < 1 {
+		return nil, fmt.Errorf("invalid restore_days value %d", tConfig.RestoreDays)
+	}
+	config.RestoreDays = tConfig.RestoreDays
+
+	switch minio.TierType(tConfig.RestoreTier) {
+	case minio.TierStandard, minio.TierBulk, minio.TierExpedited:
+		config.RestoreTier = minio.TierType(tConfig.RestoreTier)
+	default:
+		return nil, fmt.Errorf("invalid restore_tier '%s' (Standard, Bulk or Expedited)", tConfig.RestoreTier)
+	}
+
+	return config, nil
+}
+
+// partSize returns the part size of a size bytes upload: the configured
+// chunk size, enlarged (by multiples of itself) when the object would need
+// more than s3MaxParts parts
+func (s *S3) partSize(size int64) uint64 {
+	partSize := s.Config.ChunkSize
+	if size <= int64(partSize)*s3MaxParts {
+		return partSize
+	}
+	minSize := (uint64(size) + s3MaxParts - 1) / s3MaxParts
+	return (minSize + partSize - 1) / partSize * partSize
+}
+
+// restoreETA is a rough estimate of a Glacier-style restore duration, since
+// S3 does not give any progress information about ongoing restores.
+func (s *S3) restoreETA(storageClass string) time.Duration {
+	deep := storageClass == "DEEP_ARCHIVE"
+	switch s.Config.RestoreTier {
+	case minio.TierExpedited:
+		return 5 * time.Minute
+	case minio.TierBulk:
+		if deep {
+			return 48 * time.Hour
+		}
+		return 12 * time.Hour
+	default:
+		if deep {
+			return 12 * time.Hour
+		}
+		return 5 * time.Hour
+	}
+}
+
+// isS3NotFound returns true if the error is a "no such key" S3 error
+func isS3NotFound(err error) bool {
+	return minio.ToErrorResponse(err).Code == "NoSuchKey"
+}
+
+// CheckContainer will return nil if the bucket exists. S3 has no segment
+// containers (multipart uploads are assembled by the provider), so
+// checkSegments is ignored.
+func (s *S3) CheckContainer(name string, checkSegments bool) error {
+	exists, err := s.Client.BucketExists(context.Background(), name)
+	if err != nil {
+		return fmt.Errorf("bucket '%s': %s", name, err)
+	}
+	if !exists {
+		return fmt.Errorf("bucket '%s' does not exists", name)
+	}
+	return nil
+}
+
+// Upload a local file to S3 (multipart, chunk_size parts). If written is
+// not nil, it is atomically updated with the number of bytes read from the
+// source file, so callers can track upload progress.
+func (s *S3) Upload(file *File, written *int64) error {
+	sourcePath := path.Clean(s.QueuePath + "/" + file.Path)
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	stat, err := source.Stat()
+	if err != nil {
+		return err
+	}
+
+	reader := uploadReader(source, written, s.limiter)
+
+	// one part at a time: the part buffer is the memory cost of an upload
+	_, err = s.Client.PutObject(context.Background(), file.Container, file.Path, reader, stat.Size(), minio.PutObjectOptions{
+		ContentType:  "application/octet-stream",
+		PartSize:     s.partSize(stat.Size()),
+		NumThreads:   1,
+		StorageClass: s.Config.StorageClass,
+		UserMetadata: NewObjectMetadata(file),
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// AbandonUpload: nothing to do, failed multipart uploads are aborted by
+// the client (and not resumed)
+func (s *S3) AbandonUpload(container string, path string) error {
+	return nil
+}
+
+// UploadStream uploads size bytes read from source as an object. Each
+// part is sent with its MD5 (Content-MD5), checked by the server.
+func (s *S3) UploadStream(container string, path string, size int64, source io.Reader, meta ObjectMetadata, written *int64) error {
+	reader := uploadReader(source, written, s.limiter)
+
+	info, err := s.Client.PutObject(context.Background(), container, path, newSizedReader(reader, size), size, minio.PutObjectOptions{
+		ContentType:    "application/octet-stream",
+		PartSize:       s.partSize(size),
+		NumThreads:     1,
+		StorageClass:   s.Config.StorageClass,
+		UserMetadata:   meta,
+		SendContentMd5: true,
+	})
+	if err != nil {
+		return err
+	}
+	if info.Size != size {
+		return fmt.Errorf("uploaded %d bytes instead of %d", info.Size, size)
+	}
+	return nil
+}
+
+// s3ETag computes the ETag S3 gives to an object uploaded by Upload: the
+// MD5 of the content for a single PUT, or the MD5 of all parts MD5, with
+// a "-<parts>" suffix, for multipart uploads (no SSE-C/SSE-KMS). Parts are
+// cut the way minio-go cuts them for the given part size.
+func s3ETag(source io.ReaderAt, size int64, partSize uint64) (string, error) {
+	if size < int64(partSize) {
+		return md5Hex(io.NewSectionReader(source, 0, size))
+	}
+
+	parts, length, _, err := minio.OptimalPartInfo(size, partSize)
+	if err != nil {
+		return "", err
+	}
+
+	sums := md5.New()
+	for part := 0; part < parts; part++ {
+		hash := md5.New()
+		_, err := io.Copy(hash, io.NewSectionReader(source, int64(part)*length, length))
+		if err != nil {
+			return "", err
+		}
+		sums.Write(hash.Sum(nil))
+	}
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(sums.Sum(nil)), parts), nil
+}
+
+// Verify the remote object against the local file (size and ETag)
+func (s *S3) Verify(file *File) error {
+	sourcePath := path.Clean(s.QueuePath + "/" + file.Path)
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	stat, err := source.Stat()
+	if err != nil {
+		return err
+	}
+
+	info, err := s.Client.StatObject(context.Background(), file.Container, file.Path, minio.StatObjectOptions{})
+	if err != nil {
+		if isS3NotFound(err) {
+			return ErrObjectNotFound
+		}
+		return err
+	}
+
+	if info.Size != stat.Size() {
+		return fmt.Errorf("remote size is %d, local size is %d", info.Size, stat.Size())
+	}
+
+	localETag, err := s3ETag(source, stat.Size(), s.partSize(stat.Size()))
+	if err != nil {
+		return err
+	}
+
+	if info.ETag != localETag {
+		return fmt.Errorf("remote ETag is %s, local ETag is %s", info.ETag, localETag)
+	}
+
+	return nil
+}
+
+// Delete a File
+func (s *S3) Delete(file *File) error {
+	ctx := context.Background()
+
+	// S3 deletion is idempotent, so check existence ourselves
+	_, err := s.Client.StatObject(ctx, file.Container, file.Path, minio.StatObjectOptions{})
+	if err != nil {
+		if isS3NotFound(err) {
+			return ErrObjectNotFound
+		}
+		return err
+	}
+
+	return s.Client.RemoveObject(ctx, file.Container, file.Path, minio.RemoveObjectOptions{})
+}
+
+// ObjectSize returns the size of an object
+func (s *S3) ObjectSize(container string, path string) (int64, error) {
+	info, err := s.Client.StatObject(context.Background(), container, path, minio.StatObjectOptions{})
+	if err != nil {
+		if isS3NotFound(err) {
+			return 0, ErrObjectNotFound
+		}
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+// ObjectAvailability translates S3 storage class and x-amz-restore header
+// to availability states:
+// - archive class, no restore requested: sealed
+// - archive class, ongoing restore: unsealing (with an estimated delay)
+// - archive class, restored copy available (or any other class): unsealed
+func (s *S3) ObjectAvailability(container string, path string) (string, time.Duration, error) {
+	info, err := s.Client.StatObject(context.Background(), container, path, minio.StatObjectOptions{})
+	if err != nil {
+		if isS3NotFound(err) {
+			return "", 0, ErrObjectNotFound
+		}
+		return "", 0, err
+	}
+
+	storageClass := info.Metadata.Get("X-Amz-Storage-Class")
+	if !s3ArchiveClasses[storageClass] {
+		return ObjectUnsealed, 0, nil
+	}
+
+	if info.Restore == nil {
+		return ObjectSealed, 0, nil
+	}
+
+	if info.Restore.OngoingRestore {
+		return ObjectUnsealing, s.restoreETA(storageClass), nil
+	}
+
+	// restored copy expired? (should not happen, S3 removes the header)
+	if !info.Restore.ExpiryTime.IsZero() && time.Now().After(info.Restore.ExpiryTime) {
+		return ObjectSealed, 0, nil
+	}
+
+	return ObjectUnsealed, 0, nil
+}
+
+// Unseal a "cold" file (restore request), return availability ETA
+func (s *S3) Unseal(container string, path string) (time.Duration, error) {
+	state, delay, err := s.ObjectAvailability(container, path)
+	if err != nil {
+		return 0, err
+	}
+
+	switch state {
+	case ObjectUnsealed, ObjectUnsealing:
+		return delay, nil
+	}
+
+	info, err := s.Client.StatObject(context.Background(), container, path, minio.StatObjectOptions{})
+	if err != nil {
+		return 0, err
+	}
+	eta := s.restoreETA(info.Metadata.Get("X-Amz-Storage-Class"))
+
+	req := minio.RestoreRequest{}
+	req.SetDays(s.Config.RestoreDays)
+	req.SetGlacierJobParameters(minio.GlacierJobParameters{Tier: s.Config.RestoreTier})
+
+	err = s.Client.RestoreObject(context.Background(), container, path, "", req)
+	if err != nil {
+		// a restore may have been requested concurrently
+		if minio.ToErrorResponse(err).Code == "RestoreAlreadyInProgress" {
+			return eta, nil
+		}
+		return 0, err
+	}
+
+	return eta, nil
+}
+
+// ObjectOpen a S3 object, returning a ReadCloser
+func (s *S3) ObjectOpen(container string, path string) (io.ReadCloser, error) {
+	availability, _, err := s.ObjectAvailability(container, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if availability != ObjectUnsealed {
+		return nil, errors.New("file is not unsealed")
+	}
+
+	object, err := s.Client.GetObject(context.Background(), container, path, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return object, nil
+}
+
+// FilePutContent will create / overwrite a file with a content
+func (s *S3) FilePutContent(container string, path string, content io.Reader) error {
+	_, err := s.Client.PutObject(context.Background(), container, path, content, -1, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+		PartSize:    s.Config.ChunkSize,
+		NumThreads:  1,
+	})
+	return err
+}
+
+// FileGetContent will read a file to io.Writer
+func (s *S3) FileGetContent(container string, path string, output io.Writer) error {
+	source, err := s.ObjectOpen(container, path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	_, err = io.Copy(output, source)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ListObjects returns every object of a bucket
+func (s *S3) ListObjects(container string) ([]RemoteObject, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	res := make([]RemoteObject, 0)
+	for object := range s.Client.ListObjects(ctx, container, minio.ListObjectsOptions{Recursive: true}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		res = append(res, RemoteObject{
+			Path:    object.Key,
+			Size:    object.Size,
+			ModTime: object.LastModified,
+		})
+	}
+	return res, nil
+}
+
+// ListLeftovers returns incomplete multipart uploads of the buckets
+func (s *S3) ListLeftovers(containers []string) ([]Leftover, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	res := make([]Leftover, 0)
+	for _, container := range containers {
+		for upload := range s.Client.ListIncompleteUploads(ctx, container, "", true) {
+			if upload.Err != nil {
+				return nil, upload.Err
+			}
+			res = append(res, Leftover{
+				Kind:          common.GCItemMultipart,
+				Container:     container,
+				DataContainer: container,
+				Path:          upload.Key,
+				UploadID:      upload.UploadID,
+				Objects:       1,
+				Size:          upload.Size,
+				ModTime:       upload.Initiated,
+			})
+		}
+	}
+	return res, nil
+}
+
+// DeleteLeftover aborts an incomplete multipart upload (parts are freed)
+func (s *S3) DeleteLeftover(leftover *Leftover) error {
+	if leftover.Kind != common.GCItemMultipart {
+		return fmt.Errorf("unsupported leftover type '%s'", leftover.Kind)
+	}
+	core := minio.Core{Client: s.Client}
+	return core.AbortMultipartUpload(context.Background(), leftover.Container, leftover.Path, leftover.UploadID)
+}
+
+// ContainerUsage returns the total size of the objects of a container
+func (s *S3) ContainerUsage(container string) (int64, error) {
+	return containerUsageFromListing(s, container)
+}
+
+// SetMetadata replaces the barry metadata of an object, copying it onto
+// itself (server-side, multipart for large objects). Other user metadata
+// and the storage class are kept. Archived objects must be restored first.
+func (s *S3) SetMetadata(container string, path string, meta ObjectMetadata) error {
+	ctx := context.Background()
+
+	info, err := s.Client.StatObject(ctx, container, path, minio.StatObjectOptions{})
+	if err != nil {
+		return err
+	}
+
+	userMeta := make(map[string]string)
+	for key, value := range info.UserMetadata {
+		userMeta[key] = value
+	}
+	for key, value := range meta {
+		userMeta[key] = value
+	}
+	// a copy is stored with the default class, unless told otherwise
+	if storageClass := info.Metadata.Get("X-Amz-Storage-Class"); storageClass != "" {
+		userMeta["X-Amz-Storage-Class"] = storageClass
+	}
+
+	_, err = s.Client.ComposeObject(ctx, minio.CopyDestOptions{
+		Bucket:          container,
+		Object:          path,
+		ReplaceMetadata: true,
+		UserMetadata:    userMeta,
+	}, minio.CopySrcOptions{
+		Bucket: container,
+		Object: path,
+	})
+	return err
+}
+
+// GetMetadata returns the barry metadata of an object
+func (s *S3) GetMetadata(container string, path string) (ObjectMetadata, error) {
+	info, err := s.Client.StatObject(context.Background(), container, path, minio.StatObjectOptions{})
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, err
+	}
+	return filterObjectMetadata(info.UserMetadata), nil
+}
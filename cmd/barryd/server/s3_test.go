@@ -0,0 +1,191 @@
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/minio/minio-go/v7"
+)
+
+func TestS3PartSize(t *testing.T) {
+	chunk := uint64(5 * datasize.MB)
+	s := &S3{Config: &S3Config{ChunkSize: chunk}}
+
+	cases := map[int64]uint64{
+		0:                                chunk,
+		int64(chunk) - 1:                 chunk,
+		int64(chunk) * s3MaxParts:        chunk,
+		int64(chunk)*s3MaxParts + 1:      2 * chunk,
+		int64(chunk) * s3MaxParts * 3:    3 * chunk,
+		int64(chunk)*s3MaxParts*3 + 1000: 4 * chunk,
+	}
+	for size, expected := range cases {
+		if partSize := s.partSize(size); partSize != expected {
+			t.Errorf("size %d: part size is %d, expected %d", size, partSize, expected)
+		}
+	}
+
+	// the upload must be accepted by minio-go, with the same parts
+	for _, size := range []int64{int64(chunk), int64(chunk)*s3MaxParts + 1, 5 * int64(datasize.TB)} {
+		partSize := s.partSize(size)
+		parts, length, _, err := minio.OptimalPartInfo(size, partSize)
+		if err != nil {
+			t.Fatalf("size %d: %s", size, err)
+		}
+		if parts > s3MaxParts || uint64(length) != partSize {
+			t.Errorf("size %d: %d parts of %d bytes", size, parts, length)
+		}
+	}
+}
+
+func TestS3ETag(t *testing.T) {
+	partSize := uint64(5 * datasize.MB)
+	content := make([]byte, 2*partSize+1)
+	rand.New(rand.NewSource(1)).Read(content)
+
+	single := md5.Sum(content[:partSize-1])
+	etag, err := s3ETag(bytes.NewReader(content), int64(partSize-1), partSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if etag != hex.EncodeToString(single[:]) {
+		t.Errorf("single part ETag is %s", etag)
+	}
+
+	sums := md5.New()
+	for _, part := range [][]byte{content[:partSize], content[partSize : 2*partSize], content[2*partSize:]} {
+		sum := md5.Sum(part)
+		sums.Write(sum[:])
+	}
+	expected := fmt.Sprintf("%s-3", hex.EncodeToString(sums.Sum(nil)))
+
+	etag, err = s3ETag(bytes.NewReader(content), int64(len(content)), partSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if etag != expected {
+		t.Errorf("multipart ETag is %s, expected %s", etag, expected)
+	}
+}
+
+// testS3 returns a S3 backend using the MinIO (or any S3-compatible)
+// server given by BARRY_TEST_S3_ENDPOINT (http://host:port),
+// BARRY_TEST_S3_ACCESS_KEY, BARRY_TEST_S3_SECRET_KEY and
+// BARRY_TEST_S3_BUCKET (an existing bucket), or skips the test
+func testS3(t *testing.T, queuePath string) (*S3, string) {
+	endpoint := os.Getenv("BARRY_TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("BARRY_TEST_S3_ENDPOINT is not set")
+	}
+
+	config, err := NewS3ConfigFromToml(&tomlS3Config{
+		Endpoint:  endpoint,
+		AccessKey: os.Getenv("BARRY_TEST_S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("BARRY_TEST_S3_SECRET_KEY"),
+		PathStyle: true,
+		ChunkSize: 5 * datasize.MB,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewS3(config, queuePath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := os.Getenv("BARRY_TEST_S3_BUCKET")
+	err = s.CheckContainer(bucket, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, bucket
+}
+
+func TestS3MinIO(t *testing.T) {
+	queuePath := t.TempDir()
+	s, bucket := testS3(t, queuePath)
+
+	project := fmt.Sprintf("barry-test-%d", time.Now().UnixNano())
+	for _, size := range []int{0, 1000, 11 * int(datasize.MB)} {
+		content := make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(content)
+
+		file := &File{
+			Filename:  fmt.Sprintf("file-%d.bin", size),
+			Path:      fmt.Sprintf("%s/file-%d.bin", project, size),
+			Container: bucket,
+			Size:      int64(size),
+			ModTime:   time.Now(),
+		}
+		err := os.MkdirAll(filepath.Join(queuePath, project), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(queuePath, file.Path), content, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var written int64
+		err = s.Upload(file, &written)
+		if err != nil {
+			t.Fatalf("%s: upload: %s", file.Path, err)
+		}
+		if written != int64(size) {
+			t.Errorf("%s: %d bytes written", file.Path, written)
+		}
+
+		err = s.Verify(file)
+		if err != nil {
+			t.Errorf("%s: verify: %s", file.Path, err)
+		}
+
+		objectSize, err := s.ObjectSize(bucket, file.Path)
+		if err != nil || objectSize != int64(size) {
+			t.Errorf("%s: object size is %d (%v)", file.Path, objectSize, err)
+		}
+
+		// streamed copy, as done by migrations
+		copyPath := file.Path + ".copy"
+		err = s.UploadStream(bucket, copyPath, int64(size), bytes.NewReader(content), NewObjectMetadata(file), nil)
+		if err != nil {
+			t.Fatalf("%s: stream upload: %s", copyPath, err)
+		}
+
+		remote, err := s.ObjectOpen(bucket, copyPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		remoteContent, err := io.ReadAll(remote)
+		remote.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(remoteContent, content) {
+			t.Errorf("%s: remote content differs", copyPath)
+		}
+
+		for _, path := range []string{file.Path, copyPath} {
+			err = s.Delete(&File{Container: bucket, Path: path})
+			if err != nil {
+				t.Errorf("%s: delete: %s", path, err)
+			}
+		}
+
+		err = s.Verify(file)
+		if !errors.Is(err, ErrObjectNotFound) {
+			t.Errorf("%s: verify of a deleted object returned %v", file.Path, err)
+		}
+	}
+}
@@ -0,0 +1,542 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OnitiFR/barry/common"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+type tomlSFTPConfig struct {
+	Host           string `toml:"host"`
+	User           string `toml:"user"`
+	PrivateKeyFile string `toml:"private_key_file"`
+	KnownHosts     string `toml:"known_hosts"`
+	Path           string `toml:"path"`
+}
+
+// SFTPConfig stores final settings for SFTP
+type SFTPConfig struct {
+	Host            string // host:port
+	User            string
+	Signer          ssh.Signer
+	HostKeyCallback ssh.HostKeyCallback
+	Path            string
+}
+
+// sftpConnectTimeout is the TCP connection + SSH handshake timeout
+const sftpConnectTimeout = 30 * time.Second
+
+// SFTP is a storage on a remote host, reachable over SSH. It implements the
+// Backend interface, each container being a sub-directory of the configured
+// path. The connection is established on first use, and again after a
+// connection error: an unreachable host is a storage error (see
+// storageError), not a startup failure.
+type SFTP struct {
+	Config    *SFTPConfig
+	QueuePath string
+	limiter   *rateLimiter // upload bandwidth (nil: unlimited)
+
+	mutex     sync.Mutex
+	sshClient *ssh.Client
+	client    *sftp.Client
+}
+
+// NewSFTP will create a new SFTP instance from a connection config (the
+// host is not contacted yet)
+func NewSFTP(config *SFTPConfig, queuePath string, limiter *rateLimiter) (*SFTP, error) {
+	return &SFTP{
+		Config:    config,
+		QueuePath: queuePath,
+		limiter:   limiter,
+	}, nil
+}
+
+// NewSFTPConfigFromToml will check tomlSFTPConfig and create a SFTPConfig,
+// relative key and known_hosts files are searched in configPath
+func NewSFTPConfigFromToml(tConfig *tomlSFTPConfig, configPath string) (*SFTPConfig, error) {
+	config := &SFTPConfig{}
+
+	if tConfig.Host == "" {
+		return nil, errors.New("sftp host setting cannot be empty")
+	}
+	config.Host = tConfig.Host
+	if _, _, err := net.SplitHostPort(tConfig.Host); err != nil {
+		config.Host = net.JoinHostPort(tConfig.Host, "22")
+	}
+
+	if tConfig.User == "" {
+		return nil, errors.New("sftp user setting cannot be empty")
+	}
+	config.User = tConfig.User
+
+	if tConfig.PrivateKeyFile == "" {
+		return nil, errors.New("sftp private_key_file setting cannot be empty")
+	}
+	keyData, err := ioutil.ReadFile(sftpConfigFilePath(tConfig.PrivateKeyFile, configPath))
+	if err != nil {
+		return nil, fmt.Errorf("sftp private_key_file: %s", err)
+	}
+	signer, err := ssh.ParsePrivateKey(keyData)
+	if err != nil {
+		return nil, fmt.Errorf("sftp private_key_file: %s", err)
+	}
+	config.Signer = signer
+
+	// we never accept an unknown host key
+	if tConfig.KnownHosts == "" {
+		return nil, errors.New("sftp known_hosts setting cannot be empty")
+	}
+	hostKeyCallback, err := knownhosts.New(sftpConfigFilePath(tConfig.KnownHosts, configPath))
+	if err != nil {
+		return nil, fmt.Errorf("sftp known_hosts: %s", err)
+	}
+	config.HostKeyCallback = hostKeyCallback
+
+	if tConfig.Path == "" {
+		return nil, errors.New("sftp path setting cannot be empty")
+	}
+	config.Path = path.Clean(tConfig.Path)
+
+	return config, nil
+}
+
+// sftpConfigFilePath resolves a (possibly relative) file path from config
+func sftpConfigFilePath(filename string, configPath string) string {
+	if path.IsAbs(filename) {
+		return filename
+	}
+	return path.Clean(configPath + "/" + filename)
+}
+
+// getClient returns the current SFTP client, connecting if needed
+func (s *SFTP) getClient() (*sftp.Client, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	sshClient, err := ssh.Dial("tcp", s.Config.Host, &ssh.ClientConfig{
+		User:            s.Config.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(s.Config.Signer)},
+		HostKeyCallback: s.Config.HostKeyCallback,
+		Timeout:         sftpConnectTimeout,
+	})
+	if err != nil {
+		return nil, &storageError{fmt.Errorf("ssh connection to %s: %s", s.Config.Host, err)}
+	}
+
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, &storageError{fmt.Errorf("sftp session on %s: %s", s.Config.Host, err)}
+	}
+
+	s.sshClient = sshClient
+	s.client = client
+
+	// forget the client when the connection is lost, next call will reconnect
+	go func() {
+		client.Wait()
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if s.client == client {
+			s.client = nil
+			s.sshClient.Close()
+			s.sshClient = nil
+		}
+	}()
+
+	return client, nil
+}
+
+// checkError handles an error of an operation made with client: unless it
+// was reported by the server (missing file, permission, …), the connection
+// is dropped, so the next operation reconnects, and err is returned as a
+// storage error
+func (s *SFTP) checkError(client *sftp.Client, err error) error {
+	var status *sftp.StatusError
+	if err == nil || errors.As(err, &status) || errors.Is(err, os.ErrNotExist) ||
+		errors.Is(err, os.ErrPermission) || errors.Is(err, io.EOF) {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.client != nil && s.client == client {
+		s.client = nil
+		s.sshClient.Close()
+		s.sshClient = nil
+	}
+	return &storageError{err}
+}
+
+// objectPath returns the remote path of an object (path is anchored
+// in the container directory, it can't escape it)
+func (s *SFTP) objectPath(container string, objectPath string) string {
+	return path.Join(s.Config.Path, container, path.Clean("/"+objectPath))
+}
+
+// writeObject will atomically create / overwrite an object: content is
+// written to a temporary file in the same directory, then renamed, so a
+// partial upload is never visible under the final name.
+func (s *SFTP) writeObject(container string, objectPath string, content io.Reader) error {
+	client, err := s.getClient()
+	if err != nil {
+		return err
+	}
+
+	destPath := s.objectPath(container, objectPath)
+	err = client.MkdirAll(path.Dir(destPath))
+	if err != nil {
+		return s.checkError(client, err)
+	}
+
+	tmpPath := path.Join(path.Dir(destPath), "."+path.Base(destPath)+".part")
+	dest, err := client.Create(tmpPath)
+	if err != nil {
+		return s.checkError(client, err)
+	}
+
+	_, err = dest.ReadFrom(content)
+	if err != nil {
+		dest.Close()
+		client.Remove(tmpPath)
+		return s.checkError(client, err)
+	}
+
+	err = dest.Close()
+	if err != nil {
+		client.Remove(tmpPath)
+		return s.checkError(client, err)
+	}
+
+	// posix-rename@openssh.com: atomic and overwrites destination
+	err = client.PosixRename(tmpPath, destPath)
+	if err != nil {
+		client.Remove(tmpPath)
+		return s.checkError(client, err)
+	}
+
+	return nil
+}
+
+// CheckContainer will return nil if the container directory exists. There's
+// no segment container with SFTP storage, so checkSegments is ignored.
+func (s *SFTP) CheckContainer(name string, checkSegments bool) error {
+	client, err := s.getClient()
+	if err != nil {
+		return err
+	}
+
+	stat, err := client.Stat(path.Join(s.Config.Path, name))
+	if err != nil {
+		return fmt.Errorf("container '%s': %w", name, s.checkError(client, err))
+	}
+	if !stat.IsDir() {
+		return fmt.Errorf("container '%s' is not a directory", name)
+	}
+	return nil
+}
+
+// Upload a local file to the SFTP host. If written is not nil, it is
+// atomically updated with the number of bytes read from the source file,
+// so callers can track upload progress.
+func (s *SFTP) Upload(file *File, written *int64) error {
+	sourcePath := path.Clean(s.QueuePath + "/" + file.Path)
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	reader := uploadReader(source, written, s.limiter)
+
+	err = s.writeObject(file.Container, file.Path, reader)
+	if err != nil {
+		return err
+	}
+	return s.writeMetadata(file.Container, file.Path, NewObjectMetadata(file))
+}
+
+// AbandonUpload: nothing to do, failed writes are not resumed
+func (s *SFTP) AbandonUpload(container string, path string) error {
+	return nil
+}
+
+// UploadStream writes size bytes read from source as an object
+func (s *SFTP) UploadStream(container string, path string, size int64, source io.Reader, meta ObjectMetadata, written *int64) error {
+	reader := uploadReader(source, written, s.limiter)
+	err := s.writeObject(container, path, newSizedReader(reader, size))
+	if err != nil {
+		return err
+	}
+	return s.writeMetadata(container, path, meta)
+}
+
+// writeMetadata writes the metadata file of an object (see metaObjectName)
+func (s *SFTP) writeMetadata(container string, objectPath string, meta ObjectMetadata) error {
+	content, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return s.writeObject(container, metaObjectName(objectPath), bytes.NewReader(content))
+}
+
+// GetMetadata reads the metadata file of an object (if any)
+func (s *SFTP) GetMetadata(container string, path string) (ObjectMetadata, error) {
+	client, err := s.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = client.Stat(s.objectPath(container, path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, s.checkError(client, err)
+	}
+
+	f, err := client.Open(s.objectPath(container, metaObjectName(path)))
+	if errors.Is(err, os.ErrNotExist) {
+		return make(ObjectMetadata), nil
+	}
+	if err != nil {
+		return nil, s.checkError(client, err)
+	}
+	defer f.Close()
+
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, s.checkError(client, err)
+	}
+	return parseObjectMetadata(content)
+}
+
+// SetMetadata replaces the metadata file of an object
+func (s *SFTP) SetMetadata(container string, path string, meta ObjectMetadata) error {
+	client, err := s.getClient()
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Stat(s.objectPath(container, path))
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrObjectNotFound
+	}
+	if err != nil {
+		return s.checkError(client, err)
+	}
+	return s.writeMetadata(container, path, meta)
+}
+
+// Delete a File (and its metadata file)
+func (s *SFTP) Delete(file *File) error {
+	client, err := s.getClient()
+	if err != nil {
+		return err
+	}
+
+	err = client.Remove(s.objectPath(file.Container, file.Path))
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrObjectNotFound
+	}
+	if err != nil {
+		return s.checkError(client, err)
+	}
+
+	err = client.Remove(s.objectPath(file.Container, metaObjectName(file.Path)))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return s.checkError(client, err)
+	}
+	return nil
+}
+
+// Verify the remote object against the local file (size and checksum). The
+// object is read back for this, doubling the transfer.
+func (s *SFTP) Verify(file *File) error {
+	return verifyByContent(file, s.QueuePath, s)
+}
+
+// ObjectSize returns the size of a SFTP object
+func (s *SFTP) ObjectSize(container string, path string) (int64, error) {
+	client, err := s.getClient()
+	if err != nil {
+		return 0, err
+	}
+
+	stat, err := client.Stat(s.objectPath(container, path))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, ErrObjectNotFound
+	}
+	if err != nil {
+		return 0, s.checkError(client, err)
+	}
+	return stat.Size(), nil
+}
+
+// ObjectAvailability of a SFTP object: always unsealed
+func (s *SFTP) ObjectAvailability(container string, path string) (string, time.Duration, error) {
+	client, err := s.getClient()
+	if err != nil {
+		return "", 0, err
+	}
+
+	_, err = client.Stat(s.objectPath(container, path))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", 0, ErrObjectNotFound
+	}
+	if err != nil {
+		return "", 0, s.checkError(client, err)
+	}
+	return ObjectUnsealed, 0, nil
+}
+
+// Unseal a file: nothing to do with SFTP storage
+func (s *SFTP) Unseal(container string, path string) (time.Duration, error) {
+	_, _, err := s.ObjectAvailability(container, path)
+	if err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// ObjectOpen a SFTP object, returning a ReadCloser
+func (s *SFTP) ObjectOpen(container string, path string) (io.ReadCloser, error) {
+	client, err := s.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := client.Open(s.objectPath(container, path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, s.checkError(client, err)
+	}
+	return file, nil
+}
+
+// FilePutContent will create / overwrite a file with a content
+func (s *SFTP) FilePutContent(container string, path string, content io.Reader) error {
+	return s.writeObject(container, path, content)
+}
+
+// FileGetContent will read a file to io.Writer
+func (s *SFTP) FileGetContent(container string, path string, output io.Writer) error {
+	source, err := s.ObjectOpen(container, path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	_, err = io.Copy(output, source)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ListObjects returns every file of a container directory
+func (s *SFTP) ListObjects(container string) ([]RemoteObject, error) {
+	client, err := s.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	root := path.Join(s.Config.Path, container)
+	res := make([]RemoteObject, 0)
+
+	walker := client.Walk(root)
+	for walker.Step() {
+		if walker.Err() != nil {
+			return nil, s.checkError(client, walker.Err())
+		}
+		info := walker.Stat()
+		if !info.Mode().IsRegular() || isTempObjectName(info.Name()) || isMetaObjectName(info.Name()) {
+			continue
+		}
+		res = append(res, RemoteObject{
+			Path:    strings.TrimPrefix(walker.Path(), root+"/"),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+
+	return res, nil
+}
+
+// ListLeftovers returns temporary files left by interrupted writes
+func (s *SFTP) ListLeftovers(containers []string) ([]Leftover, error) {
+	client, err := s.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]Leftover, 0)
+	for _, container := range containers {
+		root := path.Join(s.Config.Path, container)
+		walker := client.Walk(root)
+		for walker.Step() {
+			if walker.Err() != nil {
+				return nil, s.checkError(client, walker.Err())
+			}
+			info := walker.Stat()
+			if !info.Mode().IsRegular() || !isTempObjectName(info.Name()) {
+				continue
+			}
+			res = append(res, Leftover{
+				Kind:          common.GCItemTempFile,
+				Container:     container,
+				DataContainer: container,
+				Path:          strings.TrimPrefix(walker.Path(), root+"/"),
+				Objects:       1,
+				Size:          info.Size(),
+				ModTime:       info.ModTime(),
+			})
+		}
+	}
+
+	return res, nil
+}
+
+// DeleteLeftover removes a temporary file
+func (s *SFTP) DeleteLeftover(leftover *Leftover) error {
+	if leftover.Kind != common.GCItemTempFile || !isTempObjectName(path.Base(leftover.Path)) {
+		return fmt.Errorf("'%s' is not a temporary file", leftover.Path)
+	}
+
+	client, err := s.getClient()
+	if err != nil {
+		return err
+	}
+
+	err = client.Remove(s.objectPath(leftover.Container, leftover.Path))
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrObjectNotFound
+	}
+	return s.checkError(client, err)
+}
+
+// ContainerUsage returns the total size of the objects of a container
+func (s *SFTP) ContainerUsage(container string) (int64, error) {
+	return containerUsageFromListing(s, container)
+}
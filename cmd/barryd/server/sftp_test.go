@@ -0,0 +1,72 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testSFTPDown returns a SFTP backend on a host where nothing listens
+func testSFTPDown(t *testing.T) *SFTP {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := listener.Addr().String()
+	listener.Close()
+
+	s, err := NewSFTP(&SFTPConfig{
+		Host:            host,
+		User:            "barry",
+		Signer:          signer,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Path:            "/backups",
+	}, t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("host is contacted by NewSFTP: %s", err)
+	}
+	return s
+}
+
+func TestSFTPHostDown(t *testing.T) {
+	s := testSFTPDown(t)
+
+	err := s.CheckContainer("test", true)
+	if err == nil || !isStorageError(err) {
+		t.Errorf("CheckContainer returned %v, a storage error was expected", err)
+	}
+
+	_, err = s.ObjectSize("test", "project/file")
+	if err == nil || !isStorageError(err) {
+		t.Errorf("ObjectSize returned %v, a storage error was expected", err)
+	}
+}
+
+func TestSFTPCheckError(t *testing.T) {
+	s := testSFTPDown(t)
+
+	for _, err := range []error{nil, os.ErrNotExist, os.ErrPermission} {
+		if res := s.checkError(nil, err); res != err {
+			t.Errorf("server error %v returned as %v", err, res)
+		}
+	}
+
+	err := s.checkError(nil, errors.New("connection lost"))
+	if !isStorageError(err) {
+		t.Errorf("transport error returned as %v", err)
+	}
+}
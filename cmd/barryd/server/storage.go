@@ -1,8 +1,11 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"os"
+	"sync"
 	"time"
 )
 
@@ -10,16 +13,23 @@ import (
 // the right Backend, based on the container a file lives in. It implements
 // the Backend interface itself (routing by container).
 type Storage struct {
-	backends         map[string]Backend // by connection name
-	containerBackend map[string]Backend // by container name
+	backends         map[string]Backend        // by connection name
+	containerBackend map[string]Backend        // by container name
+	containerConfig  map[string]*StorageConfig // by container name
+
+	healthMutex sync.Mutex
+	unhealthy   map[string]time.Time // storage name -> end of cool-down
 }
 
-// NewStorage authenticates every [[storage]] connection and builds the
-// container -> backend routing map.
-func NewStorage(config *AppConfig) (*Storage, error) {
+// NewStorage authenticates every [[storage]] connection (SFTP ones connect
+// on demand) and builds the container -> backend routing map. The journal records uploads in
+// progress, for backends able to resume them.
+func NewStorage(config *AppConfig, journal *UploadJournal, log *Log) (*Storage, error) {
 	s := &Storage{
 		backends:         make(map[string]Backend),
 		containerBackend: make(map[string]Backend),
+		containerConfig:  make(map[string]*StorageConfig),
+		unhealthy:        make(map[string]time.Time),
 	}
 
 	// explicit segment container names, declared on [[upload_container]]
@@ -34,9 +44,18 @@ func NewStorage(config *AppConfig) (*Storage, error) {
 		var backend Backend
 		var err error
 
+		// shared by all uploads of this storage
+		limiter := newRateLimiter(sc.MaxUploadRate)
+
 		switch sc.Type {
 		case StorageTypeSwift:
-			backend, err = NewSwift(sc.Swift, config.QueuePath, segmentOverrides)
+			backend, err = NewSwift(sc.Swift, config.QueuePath, segmentOverrides, journal, limiter, log)
+		case StorageTypeS3:
+			backend, err = NewS3(sc.S3, config.QueuePath, limiter)
+		case StorageTypeLocal:
+			backend, err = NewLocal(sc.Local, config.QueuePath, limiter)
+		case StorageTypeSFTP:
+			backend, err = NewSFTP(sc.SFTP, config.QueuePath, limiter)
 		default:
 			return nil, fmt.Errorf("storage '%s': unknown type '%s'", sc.Name, sc.Type)
 		}
@@ -47,6 +66,7 @@ func NewStorage(config *AppConfig) (*Storage, error) {
 		s.backends[sc.Name] = backend
 		for _, container := range sc.Containers {
 			s.containerBackend[container] = backend
+			s.containerConfig[container] = sc
 		}
 	}
 
@@ -62,6 +82,93 @@ func (s *Storage) backendForContainer(container string) (Backend, error) {
 	return backend, nil
 }
 
+// NextUploadWindow returns when an upload to container is allowed by its
+// storage upload windows (now, if inside one of them or if there's no
+// window), with the matching window (nil if there's no window)
+func (s *Storage) NextUploadWindow(container string, now time.Time) (time.Time, *UploadWindow) {
+	config, ok := s.containerConfig[container]
+	if !ok {
+		return now, nil
+	}
+	return uploadWindowsNext(config.UploadWindows, now)
+}
+
+// MaxUploadRate returns the upload bandwidth limit of the storage hosting
+// container (bytes per second, 0 = unlimited)
+func (s *Storage) MaxUploadRate(container string) uint64 {
+	config, ok := s.containerConfig[container]
+	if !ok {
+		return 0
+	}
+	return config.MaxUploadRate
+}
+
+// StorageName returns the name of the storage hosting container
+func (s *Storage) StorageName(container string) string {
+	config, ok := s.containerConfig[container]
+	if !ok {
+		return ""
+	}
+	return config.Name
+}
+
+// storageError is a failure of the storage itself (transport, backend),
+// as opposed to local (source file, encryption) or verification errors.
+// Only those mark a storage unhealthy.
+type storageError struct {
+	err error
+}
+
+func (e *storageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *storageError) Unwrap() error {
+	return e.err
+}
+
+// isStorageError returns true if err is (or wraps) a storageError
+func isStorageError(err error) bool {
+	var sErr *storageError
+	return errors.As(err, &sErr)
+}
+
+// isSourceError returns true if err comes from the local source file
+// (opening or reading it)
+func isSourceError(err error, sourcePath string) bool {
+	var pathErr *os.PathError
+	return errors.As(err, &pathErr) && pathErr.Path == sourcePath
+}
+
+// MarkUnhealthy flags the storage hosting container as failing, until
+// the returned time (it won't be used as an upload target meanwhile)
+func (s *Storage) MarkUnhealthy(container string) time.Time {
+	until := time.Now().Add(StorageUnhealthyDelay)
+
+	s.healthMutex.Lock()
+	defer s.healthMutex.Unlock()
+	s.unhealthy[s.StorageName(container)] = until
+	return until
+}
+
+// IsHealthy returns false if the storage hosting container failed
+// recently (see MarkUnhealthy)
+func (s *Storage) IsHealthy(container string) bool {
+	s.healthMutex.Lock()
+	defer s.healthMutex.Unlock()
+
+	name := s.StorageName(container)
+	until, exists := s.unhealthy[name]
+	if !exists {
+		return true
+	}
+	if time.Now().After(until) {
+		delete(s.unhealthy, name)
+		return true
+	}
+	return false
+}
+
 // CheckContainer returns nil if the container is usable. checkSegments
 // requires the segment container to exist too (upload targets only).
 func (s *Storage) CheckContainer(name string, checkSegments bool) error {
@@ -81,6 +188,43 @@ func (s *Storage) Upload(file *File, written *int64) error {
 	return backend.Upload(file, written)
 }
 
+// AbandonUpload drops what a failed upload left to be resumed (see the
+// Backend interface)
+func (s *Storage) AbandonUpload(container string, path string) error {
+	backend, err := s.backendForContainer(container)
+	if err != nil {
+		return err
+	}
+	return backend.AbandonUpload(container, path)
+}
+
+// UploadStream uploads a stream to the backend hosting container
+func (s *Storage) UploadStream(container string, path string, size int64, source io.Reader, meta ObjectMetadata, written *int64) error {
+	backend, err := s.backendForContainer(container)
+	if err != nil {
+		return err
+	}
+	return backend.UploadStream(container, path, size, source, meta, written)
+}
+
+// GetMetadata of an object of the backend hosting container
+func (s *Storage) GetMetadata(container string, path string) (ObjectMetadata, error) {
+	backend, err := s.backendForContainer(container)
+	if err != nil {
+		return nil, err
+	}
+	return backend.GetMetadata(container, path)
+}
+
+// SetMetadata of an object of the backend hosting container
+func (s *Storage) SetMetadata(container string, path string, meta ObjectMetadata) error {
+	backend, err := s.backendForContainer(container)
+	if err != nil {
+		return err
+	}
+	return backend.SetMetadata(container, path, meta)
+}
+
 // Delete a File from the backend hosting file.Container
 func (s *Storage) Delete(file *File) error {
 	backend, err := s.backendForContainer(file.Container)
@@ -90,6 +234,24 @@ func (s *Storage) Delete(file *File) error {
 	return backend.Delete(file)
 }
 
+// Verify a freshly uploaded file against the backend hosting file.Container
+func (s *Storage) Verify(file *File) error {
+	backend, err := s.backendForContainer(file.Container)
+	if err != nil {
+		return err
+	}
+	return backend.Verify(file)
+}
+
+// ObjectSize returns the full size of an object
+func (s *Storage) ObjectSize(container string, path string) (int64, error) {
+	backend, err := s.backendForContainer(container)
+	if err != nil {
+		return 0, err
+	}
+	return backend.ObjectSize(container, path)
+}
+
 // ObjectAvailability returns availability state and delay for an object
 func (s *Storage) ObjectAvailability(container string, path string) (string, time.Duration, error) {
 	backend, err := s.backendForContainer(container)
@@ -134,3 +296,57 @@ func (s *Storage) FileGetContent(container string, path string, output io.Writer
 	}
 	return backend.FileGetContent(container, path, output)
 }
+
+// ListObjects returns every object of a container
+func (s *Storage) ListObjects(container string) ([]RemoteObject, error) {
+	backend, err := s.backendForContainer(container)
+	if err != nil {
+		return nil, err
+	}
+	return backend.ListObjects(container)
+}
+
+// ContainerUsage returns the size used by a container, as seen by the storage
+func (s *Storage) ContainerUsage(container string) (int64, error) {
+	backend, err := s.backendForContainer(container)
+	if err != nil {
+		return 0, err
+	}
+	return backend.ContainerUsage(container)
+}
+
+// ListLeftovers returns upload residues of the given containers, asking
+// each backend once with all of its containers
+func (s *Storage) ListLeftovers(containers []string) ([]Leftover, error) {
+	backends := make([]Backend, 0)
+	backendContainers := make(map[Backend][]string)
+	for _, container := range containers {
+		backend, err := s.backendForContainer(container)
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := backendContainers[backend]; !exists {
+			backends = append(backends, backend)
+		}
+		backendContainers[backend] = append(backendContainers[backend], container)
+	}
+
+	res := make([]Leftover, 0)
+	for _, backend := range backends {
+		leftovers, err := backend.ListLeftovers(backendContainers[backend])
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, leftovers...)
+	}
+	return res, nil
+}
+
+// DeleteLeftover deletes a leftover, using the backend of its DataContainer
+func (s *Storage) DeleteLeftover(leftover *Leftover) error {
+	backend, err := s.backendForContainer(leftover.DataContainer)
+	if err != nil {
+		return err
+	}
+	return backend.DeleteLeftover(leftover)
+}
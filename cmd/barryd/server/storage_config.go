@@ -2,16 +2,23 @@ package server
 
 import (
 	"fmt"
+
+	"github.com/c2h5oh/datasize"
 )
 
 // tomlStorage is the [[storage]] TOML block: a named, typed connection with
 // the list of containers reachable through it. Backend-specific credentials
 // live in a sub-table ([storage.swift], [storage.s3], …).
 type tomlStorage struct {
-	Name       string
-	Type       string
-	Containers []string
-	Swift      *tomlSwiftConfig
+	Name          string
+	Type          string
+	Containers    []string
+	MaxUploadRate datasize.ByteSize `toml:"max_upload_rate"`
+	UploadWindows []string          `toml:"upload_windows"`
+	Swift         *tomlSwiftConfig
+	S3            *tomlS3Config
+	Local         *tomlLocalConfig
+	SFTP          *tomlSFTPConfig
 }
 
 // StorageConfig is the validated configuration of a named storage connection
@@ -19,12 +26,21 @@ type StorageConfig struct {
 	Name       string
 	Type       string
 	Containers []string
-	Swift      *SwiftConfig
+	// MaxUploadRate is shared by all uploads to this storage (bytes per
+	// second, 0 = unlimited). Uploads only start inside UploadWindows
+	// (if any).
+	MaxUploadRate uint64
+	UploadWindows []*UploadWindow
+	Swift         *SwiftConfig
+	S3            *S3Config
+	Local         *LocalConfig
+	SFTP          *SFTPConfig
 }
 
 // NewStoragesConfigFromToml validates [[storage]] blocks and builds the list
 // of StorageConfig. It performs pure config validation (no network access).
-func NewStoragesConfigFromToml(tStorages []*tomlStorage) ([]*StorageConfig, error) {
+// Relative files (ex: SSH keys) are searched in configPath.
+func NewStoragesConfigFromToml(tStorages []*tomlStorage, configPath string) ([]*StorageConfig, error) {
 	if len(tStorages) == 0 {
 		return nil, fmt.Errorf("you must provide at least one [[storage]] config")
 	}
@@ -47,9 +63,19 @@ func NewStoragesConfigFromToml(tStorages []*tomlStorage) ([]*StorageConfig, erro
 		}
 
 		storage := &StorageConfig{
-			Name:       tStorage.Name,
-			Type:       tStorage.Type,
-			Containers: tStorage.Containers,
+			Name:          tStorage.Name,
+			Type:          tStorage.Type,
+			Containers:    tStorage.Containers,
+			MaxUploadRate: tStorage.MaxUploadRate.Bytes(),
+			UploadWindows: make([]*UploadWindow, 0),
+		}
+
+		for _, str := range tStorage.UploadWindows {
+			window, err := NewUploadWindow(str)
+			if err != nil {
+				return nil, fmt.Errorf("storage '%s': %s", tStorage.Name, err)
+			}
+			storage.UploadWindows = append(storage.UploadWindows, window)
 		}
 
 		switch tStorage.Type {
@@ -62,8 +88,35 @@ func NewStoragesConfigFromToml(tStorages []*tomlStorage) ([]*StorageConfig, erro
 				return nil, fmt.Errorf("storage '%s': %s", tStorage.Name, err)
 			}
 			storage.Swift = swiftConfig
+		case StorageTypeS3:
+			if tStorage.S3 == nil {
+				return nil, fmt.Errorf("storage '%s' is of type 's3' but has no [storage.s3] sub-table", tStorage.Name)
+			}
+			s3Config, err := NewS3ConfigFromToml(tStorage.S3)
+			if err != nil {
+				return nil, fmt.Errorf("storage '%s': %s", tStorage.Name, err)
+			}
+			storage.S3 = s3Config
+		case StorageTypeLocal:
+			if tStorage.Local == nil {
+				return nil, fmt.Errorf("storage '%s' is of type 'local' but has no [storage.local] sub-table", tStorage.Name)
+			}
+			localConfig, err := NewLocalConfigFromToml(tStorage.Local)
+			if err != nil {
+				return nil, fmt.Errorf("storage '%s': %s", tStorage.Name, err)
+			}
+			storage.Local = localConfig
+		case StorageTypeSFTP:
+			if tStorage.SFTP == nil {
+				return nil, fmt.Errorf("storage '%s' is of type 'sftp' but has no [storage.sftp] sub-table", tStorage.Name)
+			}
+			sftpConfig, err := NewSFTPConfigFromToml(tStorage.SFTP, configPath)
+			if err != nil {
+				return nil, fmt.Errorf("storage '%s': %s", tStorage.Name, err)
+			}
+			storage.SFTP = sftpConfig
 		case "":
-			return nil, fmt.Errorf("storage '%s' must have a 'type' setting (ex: 'swift')", tStorage.Name)
+			return nil, fmt.Errorf("storage '%s' must have a 'type' setting (ex: 'swift', 's3', 'local', 'sftp')", tStorage.Name)
 		default:
 			return nil, fmt.Errorf("storage '%s': unknown type '%s'", tStorage.Name, tStorage.Type)
 		}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OnitiFR/barry/common"
+)
+
+// cold and archive are on the "near" storage, hot on the "far" one
+const testFailoverSettings = `
+[[storage]]
+name = "near"
+type = "local"
+containers = ["cold", "archive"]
+  [storage.local]
+  path = "$DIR/remote"
+
+[[storage]]
+name = "far"
+type = "local"
+containers = ["hot"]
+  [storage.local]
+  path = "$DIR/remote"
+
+[[upload_container]]
+name = "hot"
+cost = "2 * size"
+
+[[upload_container]]
+name = "cold"
+cost = "size"
+`
+
+// testDownBackend fails every upload like an unreachable storage, and
+// records abandoned uploads (container/path)
+type testDownBackend struct {
+	Backend
+	uploads   int
+	abandoned []string
+}
+
+func (b *testDownBackend) Upload(file *File, written *int64) error {
+	b.uploads++
+	return errors.New("connection refused")
+}
+
+func (b *testDownBackend) UploadStream(container string, path string, size int64, source io.Reader, meta ObjectMetadata, written *int64) error {
+	b.uploads++
+	return errors.New("connection refused")
+}
+
+func (b *testDownBackend) AbandonUpload(container string, path string) error {
+	b.abandoned = append(b.abandoned, container+"/"+path)
+	return nil
+}
+
+// testWrongBackend stores something else than the uploaded file
+type testWrongBackend struct {
+	Backend
+}
+
+func (b *testWrongBackend) Upload(file *File, written *int64) error {
+	return b.Backend.FilePutContent(file.Container, file.Path, strings.NewReader("wrong content"))
+}
+
+func TestStorageHealth(t *testing.T) {
+	app := testApp(t, testFailoverSettings)
+
+	until := app.Storage.MarkUnhealthy("cold")
+	if time.Until(until) <= 0 || time.Until(until) > StorageUnhealthyDelay {
+		t.Errorf("storage unhealthy until %s", until)
+	}
+
+	// the whole storage is unhealthy, not only the container
+	health := map[string]bool{"cold": false, "archive": false, "hot": true}
+	for container, healthy := range health {
+		if app.Storage.IsHealthy(container) != healthy {
+			t.Errorf("container '%s': healthy is %t, expected %t", container, !healthy, healthy)
+		}
+	}
+
+	status := strings.Join(app.QuotaStatus(), "\n")
+	if !strings.Contains(status, "cold: 0 B (no quota), storage unhealthy") {
+		t.Errorf("quota status is:\n%s", status)
+	}
+
+	// end of the cool-down
+	app.Storage.unhealthy["near"] = time.Now().Add(-time.Second)
+	if !app.Storage.IsHealthy("archive") {
+		t.Error("storage still unhealthy after its cool-down")
+	}
+	if len(app.Storage.unhealthy) != 0 {
+		t.Errorf("unhealthy storages: %v", app.Storage.unhealthy)
+	}
+}
+
+func TestUploadFailover(t *testing.T) {
+	app := testApp(t, testFailoverSettings)
+
+	down := &testDownBackend{Backend: app.Storage.containerBackend["cold"]}
+	app.Storage.containerBackend["cold"] = down
+
+	first := testStoreFile(t, app, "project", "first.tar", []byte("first"))
+	if first.Container != "hot" {
+		t.Fatalf("file stored in '%s', expected 'hot'", first.Container)
+	}
+	if down.uploads != 1 {
+		t.Errorf("%d upload(s) to the unhealthy storage", down.uploads)
+	}
+	if app.Storage.IsHealthy("cold") {
+		t.Error("storage still healthy after an upload failure")
+	}
+	if len(down.abandoned) != 1 || down.abandoned[0] != "cold/"+first.Path {
+		t.Errorf("abandoned uploads: %s", down.abandoned)
+	}
+
+	// the unhealthy storage is skipped
+	second := testStoreFile(t, app, "project", "second.tar", []byte("second"))
+	if second.Container != "hot" || down.uploads != 1 {
+		t.Errorf("file stored in '%s', %d upload(s) to the unhealthy storage", second.Container, down.uploads)
+	}
+
+	// no storage left, the file stays in the queue
+	app.Storage.MarkUnhealthy("hot")
+	third := testQueueFile(t, app, "project", "third.tar", []byte("third"))
+	err := app.UploadAndStore("project", third)
+	if err == nil || !strings.Contains(err.Error(), "no healthy upload container") {
+		t.Errorf("upload without healthy storage returned %v", err)
+	}
+	if app.ProjectDB.FileExists("project", "third.tar") {
+		t.Error("file added to the database")
+	}
+}
+
+func TestUploadVerifyNoFailover(t *testing.T) {
+	app := testApp(t, testFailoverSettings)
+	app.Config.VerifyUploads = true
+	app.Storage.containerBackend["cold"] = &testWrongBackend{app.Storage.containerBackend["cold"]}
+
+	// a bad upload is not a storage failure: no failover, retried later
+	file := testQueueFile(t, app, "project", "file.tar", []byte("content"))
+	err := app.UploadAndStore("project", file)
+	if err == nil || !strings.Contains(err.Error(), "upload verification error") {
+		t.Fatalf("upload returned %v", err)
+	}
+	if testRemoteExists(t, app, "hot", file.Path) {
+		t.Error("file uploaded to another container")
+	}
+	if !app.Storage.IsHealthy("cold") {
+		t.Error("storage marked unhealthy")
+	}
+}
+
+func TestUploadRetryAfterEncryption(t *testing.T) {
+	app := testApp(t, "compression = \"gzip\"\n"+testKeySettings)
+	backends := make(map[string]Backend)
+	for _, container := range []string{"hot", "cold"} {
+		backends[container] = app.Storage.containerBackend[container]
+		app.Storage.containerBackend[container] = &testDownBackend{Backend: backends[container]}
+	}
+
+	content := []byte(strings.Repeat("compressible ", 100))
+	file := testQueueFile(t, app, "project", "file.tar", content)
+	queued := *file
+
+	// compressed and encrypted, but not uploaded
+	err := app.UploadAndStore("project", file)
+	if err == nil {
+		t.Fatal("upload without storage returned no error")
+	}
+	queuePath := filepath.Join(app.Config.QueuePath, "project", "file.tar")
+	plainPath := filepath.Join(app.Config.QueuePath, "project", ".file.tar.plain")
+	current, err := os.ReadFile(queuePath)
+	if err != nil || !bytes.Equal(current, content) {
+		t.Fatalf("queue file not restored (%v)", err)
+	}
+	if _, err := os.Stat(plainPath); !os.IsNotExist(err) {
+		t.Errorf("plaintext copy left in the queue (%v)", err)
+	}
+
+	// interrupted try (barryd stopped), queued again once encrypted
+	err = os.Link(queuePath, plainPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = app.Config.GetDefaultEncryption().EncryptFileInPlace(queuePath, common.CompressionGzip, app.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(queuePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued.Size = stat.Size()
+
+	for container, backend := range backends {
+		app.Storage.containerBackend[container] = backend
+	}
+	app.Storage.unhealthy = make(map[string]time.Time)
+
+	err = app.UploadAndStore("project", &queued)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := app.ProjectDB.FindFile("project", "file.tar")
+	if !stored.Encrypted || stored.Compression != common.CompressionGzip || stored.OriginalSize != int64(len(content)) || stored.Size >= stored.OriginalSize {
+		t.Errorf("stored file is %+v", stored)
+	}
+
+	reader, err := app.OpenFile(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	current, err = io.ReadAll(reader)
+	if err != nil || !bytes.Equal(current, content) {
+		t.Errorf("stored content is not the original one (%v)", err)
+	}
+}
@@ -5,8 +5,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"os"
-	"path"
 	"strconv"
 	"time"
 
@@ -15,12 +13,15 @@ import (
 )
 
 type tomlSwiftConfig struct {
-	UserName  string            `toml:"username"`
-	APIKey    string            `toml:"api_key"`
-	AuthURL   string            `toml:"auth_url"`
-	Domain    string            `toml:"domain"`
-	Region    string            `toml:"region"`
-	ChunkSize datasize.ByteSize `toml:"chunk_size"`
+	UserName       string            `toml:"username"`
+	APIKey         string            `toml:"api_key"`
+	AuthURL        string            `toml:"auth_url"`
+	Domain         string            `toml:"domain"`
+	Region         string            `toml:"region"`
+	ChunkSize      datasize.ByteSize `toml:"chunk_size"`
+	LargeObject    string            `toml:"large_object"`
+	UploadMemory   datasize.ByteSize `toml:"upload_memory"`
+	SegmentWorkers int               `toml:"segment_workers"`
 }
 
 // SwiftConfig stores final settings for Swift
@@ -31,25 +32,49 @@ type SwiftConfig struct {
 	Domain     string
 	Region     string
 	ChunckSize uint64
+	SLO        bool // upload as Static Large Objects (instead of DLO)
+	// UploadMemory bounds the memory used by all uploads of the connection
+	// (buffer pool), SegmentWorkers is the number of parallel segment PUTs
+	// for each upload
+	UploadMemory   uint64
+	SegmentWorkers int
 }
 
+// Swift large object kinds ("large_object" setting)
+const (
+	SwiftLargeObjectDLO = "dlo"
+	SwiftLargeObjectSLO = "slo"
+)
+
 // Swift host connection and configuration. It implements the Backend
 // interface. QueuePath is the app-level queue path (source of uploads).
 type Swift struct {
 	Config    *SwiftConfig
 	QueuePath string
 	Conn      swift.Connection
+	// bufferPool is shared by all uploads, see UploadMemory
+	bufferPool *swiftBufferPool
+	journal    *UploadJournal
+	limiter    *rateLimiter // upload bandwidth (nil: unlimited)
+	log        *Log
 	// segmentOverrides maps a container name to an explicit segment container
 	// name. Empty/missing means the default "<name>_segments" convention.
 	segmentOverrides map[string]string
 }
 
 // NewSwift will create a new Swift instance from a connection config
-func NewSwift(config *SwiftConfig, queuePath string, segmentOverrides map[string]string) (*Swift, error) {
+func NewSwift(config *SwiftConfig, queuePath string, segmentOverrides map[string]string, journal *UploadJournal, limiter *rateLimiter, log *Log) (*Swift, error) {
 	swift := &Swift{
+		limiter:          limiter,
 		Config:           config,
 		QueuePath:        queuePath,
 		segmentOverrides: segmentOverrides,
+		journal:          journal,
+		log:              log,
+		bufferPool: newSwiftBufferPool(
+			int(config.UploadMemory/swiftUploadBufferSize.Bytes()),
+			int(swiftUploadBufferSize.Bytes()),
+		),
 	}
 	err := swift.connect()
 	if err != nil {
@@ -79,6 +104,15 @@ func NewSwiftConfigFromToml(tConfig *tomlSwiftConfig) (*SwiftConfig, error) {
 	if tConfig.ChunkSize == 0 {
 		tConfig.ChunkSize = 512 * datasize.MB
 	}
+	if tConfig.LargeObject == "" {
+		tConfig.LargeObject = SwiftLargeObjectDLO
+	}
+	if tConfig.UploadMemory == 0 {
+		tConfig.UploadMemory = 64 * datasize.MB
+	}
+	if tConfig.SegmentWorkers == 0 {
+		tConfig.SegmentWorkers = 1
+	}
 
 	if tConfig.UserName == "" {
 		return nil, errors.New("swift username setting cannot be empty")
@@ -110,6 +144,25 @@ func NewSwiftConfigFromToml(tConfig *tomlSwiftConfig) (*SwiftConfig, error) {
 	}
 	config.ChunckSize = tConfig.ChunkSize.Bytes()
 
+	switch tConfig.LargeObject {
+	case SwiftLargeObjectDLO:
+		config.SLO = false
+	case SwiftLargeObjectSLO:
+		config.SLO = true
+	default:
+		return nil, fmt.Errorf("invalid large_object '%s' (%s or %s)", tConfig.LargeObject, SwiftLargeObjectDLO, SwiftLargeObjectSLO)
+	}
+
+	if tConfig.UploadMemory < swiftUploadBufferSize {
+		return nil, fmt.Errorf("upload_memory is to small (%s), use at least %s", tConfig.UploadMemory, swiftUploadBufferSize)
+	}
+	config.UploadMemory = tConfig.UploadMemory.Bytes()
+
+	if tConfig.SegmentWorkers < 1 {
+		return nil, fmt.Errorf("invalid segment_workers value %d", tConfig.SegmentWorkers)
+	}
+	config.SegmentWorkers = tConfig.SegmentWorkers
+
 	return config, nil
 }
 
@@ -127,6 +180,16 @@ func (s *Swift) connect() error {
 	if err != nil {
 		return err
 	}
+
+	if s.Config.SLO {
+		info, err := s.Conn.QueryInfo(context.Background())
+		if err != nil {
+			return fmt.Errorf("unable to check SLO support: %s", err)
+		}
+		if !info.SupportsSLO() {
+			return errors.New("this Swift cluster does not support Static Large Objects (large_object setting)")
+		}
+	}
 	return nil
 }
 
@@ -152,60 +215,29 @@ func (s *Swift) CheckContainer(name string, checkSegments bool) error {
 	return nil
 }
 
-// Upload a local file to Swift provider. If written is not nil, it is
-// atomically updated with the number of bytes read from the source file,
-// so callers can track upload progress.
-func (s *Swift) Upload(file *File, written *int64) error {
-	sourcePath := path.Clean(s.QueuePath + "/" + file.Path)
-	source, err := os.Open(sourcePath)
-	if err != nil {
-		return err
-	}
-	defer source.Close()
-
-	var reader io.Reader = source
-	if written != nil {
-		reader = &progressReader{reader: source, written: written}
-	}
-
-	// Currently, with Openstack object expiration + ncw/swift, only the
-	// manifest will expire, not the segments. We now schedule deletion on
-	// our side.
-	// expireDuration := file.ExpireRemote.Sub(time.Now())
-	// deleteAfterSeconds := int(expireDuration / time.Second)
-
-	// NoBuffer kills throughput (down to a few KB/s) and a CopyBuffer()
-	// make things very unstable with OVH. Back to memory-hungry-mode.
-
-	dest, err := s.Conn.DynamicLargeObjectCreate(context.Background(), &swift.LargeObjectOpts{
-		Container:        file.Container,
-		ObjectName:       file.Path,
-		ChunkSize:        int64(s.Config.ChunckSize),
-		SegmentContainer: s.segmentContainer(file.Container),
-		// NoBuffer:   true,
-		// Headers: swift.Headers{
-		// 	"X-Delete-After": strconv.Itoa(deleteAfterSeconds),
-		// },
-	})
-	if err != nil {
-		return err
+// Delete a File (and its segments, DLO or SLO)
+func (s *Swift) Delete(file *File) error {
+	err := s.Conn.LargeObjectDelete(context.Background(), file.Container, file.Path)
+	if err == swift.ObjectNotFound {
+		return ErrObjectNotFound
 	}
-	defer dest.Close()
-
-	_, err = io.Copy(dest, reader)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// Delete a File
-func (s *Swift) Delete(file *File) error {
-	err := s.Conn.DynamicLargeObjectDelete(context.Background(), file.Container, file.Path)
+// ObjectSize returns the size of an object (the whole content, for large
+// object manifests)
+func (s *Swift) ObjectSize(container string, path string) (int64, error) {
+	info, _, err := s.Conn.Object(context.Background(), container, path)
+	if err == swift.ObjectNotFound {
+		return 0, ErrObjectNotFound
+	}
 	if err != nil {
-		return err
+		return 0, err
 	}
-	return nil
+	return info.Bytes, nil
 }
 
 // ObjectAvailability returns availability, explained with two values:
@@ -214,25 +246,31 @@ func (s *Swift) Delete(file *File) error {
 func (s *Swift) ObjectAvailability(container string, path string) (string, time.Duration, error) {
 	ctx := context.Background()
 	_, headers, err := s.Conn.Object(ctx, container, path)
+	if err == swift.ObjectNotFound {
+		return "", 0, ErrObjectNotFound
+	}
 	if err != nil {
 		return "", 0, err
 	}
 
 	state, stateExists := headers["X-Ovh-Retrieval-State"]
 	if !stateExists {
-		// let's check that all chunks are available, with some providers
-		// it can take a few seconds
+		// DLO only: let's check that all chunks are available, with some
+		// providers it can take a few seconds (SLO manifests are consistent)
 		file, headers, err := s.Conn.ObjectOpen(ctx, container, path, false, nil)
+		if err == swift.ObjectNotFound {
+			return "", 0, ErrObjectNotFound
+		}
 		if err != nil {
 			return "", 0, err
 		}
+		defer file.Close()
 		size, err := file.Length(ctx)
 		if err != nil {
 			return "", 0, err
 		}
 
-		_, isDLO := headers["X-Object-Manifest"]
-		if isDLO && size == 0 {
+		if headers.IsLargeObjectDLO() && size == 0 {
 			return ObjectUnsealing, 10 * time.Second, nil // wait a bit
 		}
 		return ObjectUnsealed, 0, nil
@@ -271,7 +309,7 @@ func (s *Swift) Unseal(container string, path string) (time.Duration, error) {
 	}
 
 	if err == swift.ObjectNotFound {
-		return 0, err
+		return 0, ErrObjectNotFound
 	}
 
 	// TooManyRequests = sealed
@@ -347,3 +385,92 @@ func (s *Swift) FileGetContent(container string, path string, output io.Writer)
 
 	return nil
 }
+
+// ListObjects returns every object of a container. DLO manifests are
+// listed with a zero size, so their real size is requested.
+func (s *Swift) ListObjects(container string) ([]RemoteObject, error) {
+	ctx := context.Background()
+	objects, err := s.Conn.ObjectsAll(ctx, container, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]RemoteObject, 0, len(objects))
+	for _, object := range objects {
+		if object.Bytes == 0 {
+			info, _, err := s.Conn.Object(ctx, container, object.Name)
+			if err != nil && err != swift.ObjectNotFound {
+				return nil, err
+			}
+			if err == nil {
+				object.Bytes = info.Bytes
+			}
+		}
+		res = append(res, RemoteObject{
+			Path:    object.Name,
+			Size:    object.Bytes,
+			ModTime: object.LastModified,
+		})
+	}
+	return res, nil
+}
+
+// ContainerUsage returns the size used by a container and its segment
+// container (if shared with other containers, the size is overestimated)
+func (s *Swift) ContainerUsage(container string) (int64, error) {
+	ctx := context.Background()
+
+	info, _, err := s.Conn.Container(ctx, container)
+	if err != nil {
+		return 0, err
+	}
+	total := info.Bytes
+
+	segInfo, _, err := s.Conn.Container(ctx, s.segmentContainer(container))
+	if err != nil && err != swift.ContainerNotFound {
+		return 0, err
+	}
+	if err == nil {
+		total += segInfo.Bytes
+	}
+
+	return total, nil
+}
+
+// SetMetadata replaces the barry metadata of an object. A POST replaces all
+// user metadata, so other metadata (and the manifest of a DLO) are kept.
+func (s *Swift) SetMetadata(container string, path string, meta ObjectMetadata) error {
+	ctx := context.Background()
+
+	_, headers, err := s.Conn.Object(ctx, container, path)
+	if err == swift.ObjectNotFound {
+		return ErrObjectNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	metadata := headers.ObjectMetadata()
+	for key, value := range meta {
+		metadata[key] = value
+	}
+
+	update := metadata.ObjectHeaders()
+	if headers.IsLargeObjectDLO() {
+		update["X-Object-Manifest"] = headers["X-Object-Manifest"]
+	}
+
+	return s.Conn.ObjectUpdate(ctx, container, path, update)
+}
+
+// GetMetadata returns the barry metadata of an object
+func (s *Swift) GetMetadata(container string, path string) (ObjectMetadata, error) {
+	_, headers, err := s.Conn.Object(context.Background(), container, path)
+	if err == swift.ObjectNotFound {
+		return nil, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return filterObjectMetadata(headers.ObjectMetadata()), nil
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/OnitiFR/barry/common"
+	"github.com/ncw/swift/v2"
+)
+
+// ListLeftovers returns orphan segments, grouped by prefix: segments of
+// the segment containers not referenced by any large object manifest of
+// the given containers, nor by an upload in progress.
+func (s *Swift) ListLeftovers(containers []string) ([]Leftover, error) {
+	ctx := context.Background()
+
+	// "segment container/prefix" of DLO manifests and of SLO segments
+	referenced := make(map[string]bool)
+
+	for _, container := range containers {
+		objects, err := s.Conn.ObjectsAll(ctx, container, nil)
+		if err != nil {
+			return nil, fmt.Errorf("container '%s': %s", container, err)
+		}
+		for _, object := range objects {
+			_, headers, err := s.Conn.Object(ctx, container, object.Name)
+			if err == swift.ObjectNotFound {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case headers.IsLargeObjectDLO():
+				referenced[strings.TrimSuffix(headers["X-Object-Manifest"], "/")] = true
+			case headers.IsLargeObjectSLO():
+				segmentContainer, segments, err := s.Conn.LargeObjectGetSegments(ctx, container, object.Name)
+				if err != nil {
+					return nil, err
+				}
+				for _, segment := range segments {
+					referenced[segmentContainer+"/"+path.Dir(segment.Name)] = true
+				}
+			}
+		}
+	}
+
+	res := make([]Leftover, 0)
+	seen := make(map[string]bool)
+	for _, container := range containers {
+		segmentContainer := s.segmentContainer(container)
+		if seen[segmentContainer] {
+			continue
+		}
+		seen[segmentContainer] = true
+
+		segments, err := s.Conn.ObjectsAll(ctx, segmentContainer, nil)
+		if err == swift.ContainerNotFound {
+			continue // read-only container, no segment container
+		}
+		if err != nil {
+			return nil, fmt.Errorf("container '%s': %s", segmentContainer, err)
+		}
+
+		groups := make(map[string]*Leftover) // by prefix
+		for _, segment := range segments {
+			// segments are always named "<prefix>/<number>"
+			if !strings.Contains(segment.Name, "/") {
+				continue
+			}
+			prefix := path.Dir(segment.Name)
+			group, exists := groups[prefix]
+			if !exists {
+				group = &Leftover{
+					Kind:          common.GCItemSegments,
+					Container:     segmentContainer,
+					DataContainer: container,
+					Path:          prefix,
+				}
+				groups[prefix] = group
+			}
+			group.Objects++
+			group.Size += segment.Bytes
+			if segment.LastModified.After(group.ModTime) {
+				group.ModTime = segment.LastModified
+			}
+		}
+
+		// a DLO prefix is not required to be a "directory", let's be
+		// conservative with any unusual one
+		unusual := make([]string, 0)
+		for ref := range referenced {
+			if !strings.HasPrefix(ref, segmentContainer+"/") {
+				continue
+			}
+			prefix := strings.TrimPrefix(ref, segmentContainer+"/")
+			if _, exists := groups[prefix]; !exists {
+				unusual = append(unusual, prefix)
+			}
+		}
+
+		for prefix, group := range groups {
+			if referenced[segmentContainer+"/"+prefix] {
+				continue
+			}
+			if s.journal.HasSegmentPrefix(segmentContainer, prefix) {
+				continue
+			}
+			overlaps := false
+			for _, other := range unusual {
+				if strings.HasPrefix(prefix, other) || strings.HasPrefix(other, prefix+"/") {
+					overlaps = true
+					break
+				}
+			}
+			if overlaps {
+				continue
+			}
+			res = append(res, *group)
+		}
+	}
+
+	return res, nil
+}
+
+// DeleteLeftover deletes all segments of an orphan prefix
+func (s *Swift) DeleteLeftover(leftover *Leftover) error {
+	if leftover.Kind != common.GCItemSegments {
+		return fmt.Errorf("unsupported leftover type '%s'", leftover.Kind)
+	}
+	if s.journal.HasSegmentPrefix(leftover.Container, leftover.Path) {
+		return fmt.Errorf("segments '%s' are used by an upload in progress", leftover.Path)
+	}
+
+	ctx := context.Background()
+	names, err := s.Conn.ObjectNamesAll(ctx, leftover.Container, &swift.ObjectsOpts{
+		Prefix: leftover.Path + "/",
+	})
+	if err != nil {
+		return err
+	}
+
+	deleted := 0
+	for _, name := range names {
+		if path.Dir(name) != leftover.Path {
+			continue // deeper prefix, another group
+		}
+		err = s.Conn.ObjectDelete(ctx, leftover.Container, name)
+		if err != nil && err != swift.ObjectNotFound {
+			return err
+		}
+		deleted++
+	}
+
+	if deleted == 0 {
+		return ErrObjectNotFound
+	}
+	return nil
+}
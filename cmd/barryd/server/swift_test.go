@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/ncw/swift/v2/swifttest"
+)
+
+// testSwift returns a Swift backend connected to an in-memory Swift
+// server, with a "test" container (and its segment container)
+func testSwift(t *testing.T, slo bool) *Swift {
+	server, err := swifttest.NewSwiftServer("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+
+	s, err := NewSwift(&SwiftConfig{
+		UserName:       swifttest.TEST_ACCOUNT,
+		APIKey:         swifttest.TEST_ACCOUNT,
+		AuthURL:        server.AuthURL,
+		ChunckSize:     1024,
+		SLO:            slo,
+		UploadMemory:   4 * swiftUploadBufferSize.Bytes(),
+		SegmentWorkers: 1,
+	}, t.TempDir(), nil, testUploadJournal(t), nil, testLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, container := range []string{"test", "test_segments"} {
+		err = s.Conn.ContainerCreate(context.Background(), container, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func TestSwiftObjectNotFound(t *testing.T) {
+	s := testSwift(t, false)
+
+	_, err := s.ObjectSize("test", "project/missing")
+	if !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("ObjectSize returned %v", err)
+	}
+
+	_, _, err = s.ObjectAvailability("test", "project/missing")
+	if !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("ObjectAvailability returned %v", err)
+	}
+
+	_, err = s.Unseal("test", "project/missing")
+	if !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("Unseal returned %v", err)
+	}
+}
+
+func TestSwiftAbandonUpload(t *testing.T) {
+	s := testSwift(t, false)
+	ctx := context.Background()
+
+	err := s.AbandonUpload("test", "project/unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an interrupted upload (first segment done), and another one
+	entry := &UploadJournalEntry{
+		Container:        "test",
+		Path:             "project/file",
+		Size:             2048,
+		ModTime:          time.Now(),
+		ChunkSize:        1024,
+		SegmentContainer: "test_segments",
+		SegmentPrefix:    "segments/abc/interrupted",
+		StartedAt:        time.Now(),
+	}
+	err = s.journal.Start(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"segments/abc/interrupted/0000000000000001", "segments/abc/other/0000000000000001"} {
+		_, err = s.Conn.ObjectPut(ctx, "test_segments", name, strings.NewReader("segment"), true, "", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = s.journal.SegmentDone("test", "project/file", 1, "etag")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.AbandonUpload("test", "project/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.journal.Get("test", "project/file") != nil {
+		t.Error("abandoned upload still in the journal")
+	}
+
+	names, err := s.Conn.ObjectNamesAll(ctx, "test_segments", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "segments/abc/other/0000000000000001" {
+		t.Errorf("segments left: %s", names)
+	}
+}
+
+func TestSwiftUploadStreamReplace(t *testing.T) {
+	for _, slo := range []bool{false, true} {
+		s := testSwift(t, slo)
+		ctx := context.Background()
+
+		previous := strings.Repeat("p", 3000)
+		err := s.UploadStream("test", "project/file", int64(len(previous)), strings.NewReader(previous), ObjectMetadata{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// failure after the first segment: previous object still there
+		failing := io.MultiReader(strings.NewReader(strings.Repeat("f", 1500)), iotest.ErrReader(errors.New("read error")))
+		err = s.UploadStream("test", "project/file", 3000, failing, ObjectMetadata{}, nil)
+		if err == nil {
+			t.Fatal("failed upload returned no error")
+		}
+		content, err := s.Conn.ObjectGetString(ctx, "test", "project/file")
+		if err != nil || content != previous {
+			t.Fatalf("slo=%t: previous object lost after a failed upload (%v)", slo, err)
+		}
+
+		// replaced: only the segments of the new object are left
+		next := strings.Repeat("n", 2000)
+		err = s.UploadStream("test", "project/file", int64(len(next)), strings.NewReader(next), ObjectMetadata{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err = s.Conn.ObjectGetString(ctx, "test", "project/file")
+		if err != nil || content != next {
+			t.Fatalf("slo=%t: object not replaced (%v)", slo, err)
+		}
+		names, err := s.Conn.ObjectNamesAll(ctx, "test_segments", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(names) != 2 {
+			t.Errorf("slo=%t: segments left: %s", slo, names)
+		}
+	}
+}
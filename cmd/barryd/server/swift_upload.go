@@ -0,0 +1,566 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/ncw/swift/v2"
+)
+
+// swiftUploadBufferSize is the size of each buffer of the upload pool. A
+// buffer is held by every segment PUT in progress.
+const swiftUploadBufferSize = 8 * datasize.MB
+
+// swiftSegmentTries is the number of attempts for each segment PUT
+const swiftSegmentTries = 3
+
+// swiftBufferPool is a bounded pool of reusable read buffers, shared by all
+// uploads of a Swift connection. Buffers are allocated on first use.
+type swiftBufferPool struct {
+	buffers chan *bufio.Reader
+	size    int
+}
+
+// swiftSegment is a part of a file, uploaded as a segment object
+type swiftSegment struct {
+	Num    int
+	Name   string
+	Offset int64
+	Size   int64
+	Etag   string
+}
+
+// swiftSLOSegment is a segment, as described in a SLO manifest
+type swiftSLOSegment struct {
+	Path string `json:"path"`
+	Etag string `json:"etag"`
+	Size int64  `json:"size_bytes"`
+}
+
+func newSwiftBufferPool(count int, size int) *swiftBufferPool {
+	pool := &swiftBufferPool{
+		buffers: make(chan *bufio.Reader, count),
+		size:    size,
+	}
+	for i := 0; i < count; i++ {
+		pool.buffers <- nil
+	}
+	return pool
+}
+
+// get a buffer from the pool, waiting for one to be available
+func (p *swiftBufferPool) get() *bufio.Reader {
+	br := <-p.buffers
+	if br == nil {
+		br = bufio.NewReaderSize(nil, p.size)
+	}
+	return br
+}
+
+// put a buffer back in the pool
+func (p *swiftBufferPool) put(br *bufio.Reader) {
+	br.Reset(nil)
+	p.buffers <- br
+}
+
+// swiftSegmentPrefix returns a new random segment prefix for an object,
+// using the same "segments/xxx/yyyy…" layout as ncw/swift
+func swiftSegmentPrefix() (string, error) {
+	random := make([]byte, 20)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+	name := hex.EncodeToString(random)
+	return "segments/" + name[0:3] + "/" + name[3:], nil
+}
+
+// swiftSplitSegments splits size bytes in chunkSize segments
+func swiftSplitSegments(prefix string, size int64, chunkSize int64) []*swiftSegment {
+	segments := make([]*swiftSegment, 0, size/chunkSize+1)
+	for offset := int64(0); offset < size; offset += chunkSize {
+		segmentSize := chunkSize
+		if offset+segmentSize > size {
+			segmentSize = size - offset
+		}
+		num := len(segments) + 1
+		segments = append(segments, &swiftSegment{
+			Num:    num,
+			Name:   fmt.Sprintf("%s/%016d", prefix, num),
+			Offset: offset,
+			Size:   segmentSize,
+		})
+	}
+	return segments
+}
+
+// Upload a local file to Swift provider. If written is not nil, it is
+// atomically updated with the number of bytes read from the source file,
+// so callers can track upload progress.
+//
+// Segments are streamed from the file (no need to hold a whole chunk in
+// memory), using buffers from the connection pool (upload_memory setting),
+// up to segment_workers segments in parallel. Each segment PUT is checked
+// against its ETag, then the DLO or SLO manifest is created.
+//
+// Uploaded segments are recorded in the upload journal: if the upload
+// fails (even if barryd is restarted), the next try will only send
+// segments that are missing remotely.
+func (s *Swift) Upload(file *File, written *int64) error {
+	ctx := context.Background()
+
+	sourcePath := path.Clean(s.QueuePath + "/" + file.Path)
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	stat, err := source.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Currently, with Openstack object expiration + ncw/swift, only the
+	// manifest will expire, not the segments. We now schedule deletion on
+	// our side.
+
+	segmentContainer := s.segmentContainer(file.Container)
+	chunkSize := int64(s.Config.ChunckSize)
+
+	entry := s.journal.Get(file.Container, file.Path)
+	if entry != nil && (entry.Size != stat.Size() ||
+		!entry.ModTime.Equal(stat.ModTime()) ||
+		entry.ChunkSize != chunkSize ||
+		entry.SegmentContainer != segmentContainer) {
+		// local file (or settings) changed since the interrupted upload
+		s.log.Warningf(file.ProjectName(), "upload of '%s' can't be resumed (file or settings changed), restarting", file.Path)
+		s.deleteSegments(ctx, entry.SegmentContainer, entry.SegmentPrefix)
+		entry = nil
+	}
+
+	if entry == nil {
+		// empty file: no segments, a simple object is enough
+		if stat.Size() == 0 {
+			return s.replaceObject(ctx, file.Container, file.Path, "", func() error {
+				_, err := s.Conn.ObjectPut(ctx, file.Container, file.Path, source, true, "", "application/octet-stream", swiftMetadataHeaders(NewObjectMetadata(file)))
+				return err
+			})
+		}
+
+		prefix, err := swiftSegmentPrefix()
+		if err != nil {
+			return err
+		}
+
+		entry = &UploadJournalEntry{
+			Container:        file.Container,
+			Path:             file.Path,
+			Size:             stat.Size(),
+			ModTime:          stat.ModTime(),
+			ChunkSize:        chunkSize,
+			SegmentContainer: segmentContainer,
+			SegmentPrefix:    prefix,
+			StartedAt:        time.Now(),
+		}
+		err = s.journal.Start(entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	segments := swiftSplitSegments(entry.SegmentPrefix, stat.Size(), chunkSize)
+
+	if len(entry.Segments) > 0 {
+		err = s.skipUploadedSegments(ctx, segmentContainer, entry, segments, written)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.putSegments(ctx, source, file, segmentContainer, segments, written)
+	if err != nil {
+		return err
+	}
+
+	meta := NewObjectMetadata(file)
+	err = s.replaceObject(ctx, file.Container, file.Path, entry.SegmentPrefix, func() error {
+		if s.Config.SLO {
+			return s.putSLOManifest(ctx, file.Container, file.Path, segmentContainer, segments, meta)
+		}
+		return s.putDLOManifest(ctx, file.Container, file.Path, segmentContainer, entry.SegmentPrefix, meta)
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.journal.Remove(file.Container, file.Path)
+}
+
+// AbandonUpload deletes the segments of an interrupted upload (best
+// effort) and removes it from the journal: if the segments can't be
+// deleted now, they are upload leftovers for the GC
+func (s *Swift) AbandonUpload(container string, path string) error {
+	entry := s.journal.Get(container, path)
+	if entry == nil {
+		return nil
+	}
+
+	s.deleteSegments(context.Background(), entry.SegmentContainer, entry.SegmentPrefix)
+	return s.journal.Remove(container, path)
+}
+
+// skipUploadedSegments lists remote segments of an interrupted upload and
+// marks as done (Etag set) those matching the journal (size and checksum)
+func (s *Swift) skipUploadedSegments(ctx context.Context, segmentContainer string, entry *UploadJournalEntry, segments []*swiftSegment, written *int64) error {
+	objects, err := s.Conn.ObjectsAll(ctx, segmentContainer, &swift.ObjectsOpts{
+		Prefix: entry.SegmentPrefix + "/",
+	})
+	if err != nil {
+		return err
+	}
+
+	remote := make(map[string]swift.Object, len(objects))
+	for _, object := range objects {
+		remote[object.Name] = object
+	}
+
+	skipped := 0
+	var skippedSize int64
+	for _, segment := range segments {
+		etag, done := entry.Segments[segment.Num]
+		object, exists := remote[segment.Name]
+		if !done || !exists || object.Bytes != segment.Size || object.Hash != etag {
+			continue
+		}
+		segment.Etag = etag
+		skipped++
+		skippedSize += segment.Size
+	}
+
+	if written != nil {
+		atomic.AddInt64(written, skippedSize)
+	}
+
+	s.log.Infof(path.Dir(entry.Path), "resuming upload of '%s': %d/%d segments already uploaded", entry.Path, skipped, len(segments))
+	return nil
+}
+
+// UploadStream uploads size bytes read from source as an object. Since a
+// stream can't be read twice, segments are sent sequentially without
+// retry and the upload is not journaled. Each segment PUT is checked
+// against its ETag. The stream is read through a buffer of the pool.
+func (s *Swift) UploadStream(container string, objectPath string, size int64, source io.Reader, meta ObjectMetadata, written *int64) error {
+	ctx := context.Background()
+
+	br := s.bufferPool.get()
+	defer s.bufferPool.put(br)
+	br.Reset(newSizedReader(source, size))
+
+	reader := uploadReader(br, written, s.limiter)
+
+	chunkSize := int64(s.Config.ChunckSize)
+	if size <= chunkSize {
+		return s.replaceObject(ctx, container, objectPath, "", func() error {
+			_, err := s.Conn.ObjectPut(ctx, container, objectPath, io.LimitReader(reader, size), true, "", "application/octet-stream", swiftMetadataHeaders(meta))
+			return err
+		})
+	}
+
+	segmentContainer := s.segmentContainer(container)
+	prefix, err := swiftSegmentPrefix()
+	if err != nil {
+		return err
+	}
+
+	segments := swiftSplitSegments(prefix, size, chunkSize)
+	for _, segment := range segments {
+		headers, err := s.Conn.ObjectPut(ctx, segmentContainer, segment.Name, io.LimitReader(reader, segment.Size), true, "", "application/octet-stream", nil)
+		if err != nil {
+			s.deleteSegments(ctx, segmentContainer, prefix)
+			return fmt.Errorf("segment '%s': %s", segment.Name, err)
+		}
+		segment.Etag = headers["Etag"]
+	}
+
+	err = s.replaceObject(ctx, container, objectPath, prefix, func() error {
+		if s.Config.SLO {
+			return s.putSLOManifest(ctx, container, objectPath, segmentContainer, segments, meta)
+		}
+		return s.putDLOManifest(ctx, container, objectPath, segmentContainer, prefix, meta)
+	})
+	if err != nil {
+		s.deleteSegments(ctx, segmentContainer, prefix)
+		return err
+	}
+
+	return nil
+}
+
+// putSegments uploads all segments not already uploaded, using up to
+// SegmentWorkers goroutines, and stops at the first error
+func (s *Swift) putSegments(ctx context.Context, source io.ReaderAt, file *File, segmentContainer string, allSegments []*swiftSegment, written *int64) error {
+	segments := make([]*swiftSegment, 0, len(allSegments))
+	for _, segment := range allSegments {
+		if segment.Etag == "" {
+			segments = append(segments, segment)
+		}
+	}
+
+	workers := s.Config.SegmentWorkers
+	if workers > len(segments) {
+		workers = len(segments)
+	}
+
+	jobs := make(chan *swiftSegment)
+	var firstErr error
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+
+	failed := func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return firstErr != nil
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for segment := range jobs {
+				if failed() {
+					continue
+				}
+				err := s.putSegment(ctx, source, segmentContainer, segment, written)
+				if err == nil {
+					err = s.journal.SegmentDone(file.Container, file.Path, segment.Num, segment.Etag)
+				}
+				if err != nil {
+					mutex.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, segment := range segments {
+		if failed() {
+			break
+		}
+		jobs <- segment
+	}
+	close(jobs)
+	wg.Wait()
+
+	return firstErr
+}
+
+// putSegment uploads a segment (with retries), checking its ETag
+func (s *Swift) putSegment(ctx context.Context, source io.ReaderAt, segmentContainer string, segment *swiftSegment, written *int64) error {
+	var err error
+	for try := 1; try <= swiftSegmentTries; try++ {
+		var segmentWritten int64
+
+		br := s.bufferPool.get()
+		br.Reset(io.NewSectionReader(source, segment.Offset, segment.Size))
+
+		var reader io.Reader = &progressReader{reader: br, written: &segmentWritten, limiter: s.limiter}
+		if written != nil {
+			reader = &progressReader{reader: reader, written: written}
+		}
+
+		var headers swift.Headers
+		headers, err = s.Conn.ObjectPut(ctx, segmentContainer, segment.Name, reader, true, "", "application/octet-stream", nil)
+		s.bufferPool.put(br)
+
+		if err == nil {
+			segment.Etag = headers["Etag"]
+			return nil
+		}
+
+		// this segment will be sent again
+		if written != nil {
+			atomic.AddInt64(written, -segmentWritten)
+		}
+	}
+	return fmt.Errorf("segment '%s': %s", segment.Name, err)
+}
+
+// swiftMetadataHeaders returns object metadata as Swift headers
+func swiftMetadataHeaders(meta ObjectMetadata) swift.Headers {
+	return swift.Metadata(meta).ObjectHeaders()
+}
+
+// putDLOManifest creates a DLO manifest for all objects with prefix
+func (s *Swift) putDLOManifest(ctx context.Context, container string, objectName string, segmentContainer string, prefix string, meta ObjectMetadata) error {
+	headers := swiftMetadataHeaders(meta)
+	headers["X-Object-Manifest"] = segmentContainer + "/" + prefix
+	_, err := s.Conn.ObjectPut(ctx, container, objectName, bytes.NewReader(nil), false, "", "application/octet-stream", headers)
+	return err
+}
+
+// putSLOManifest creates a SLO manifest, listing each segment with its ETag
+// and size (the cluster checks them before accepting the manifest)
+func (s *Swift) putSLOManifest(ctx context.Context, container string, objectName string, segmentContainer string, segments []*swiftSegment, meta ObjectMetadata) error {
+	sloSegments := make([]swiftSLOSegment, len(segments))
+	for i, segment := range segments {
+		sloSegments[i] = swiftSLOSegment{
+			Path: segmentContainer + "/" + segment.Name,
+			Etag: segment.Etag,
+			Size: segment.Size,
+		}
+	}
+
+	content, err := json.Marshal(sloSegments)
+	if err != nil {
+		return err
+	}
+
+	headers := swiftMetadataHeaders(meta)
+	headers["Content-Type"] = "application/octet-stream"
+
+	// same as the storage requests of the swift library: the storage URL
+	// is read again after a re-authentication
+	_, _, err = s.Conn.Call(ctx, s.Conn.StorageUrl, swift.RequestOpts{
+		Container:  container,
+		ObjectName: objectName,
+		Operation:  "PUT",
+		Parameters: url.Values{"multipart-manifest": []string{"put"}},
+		Headers:    headers,
+		Body:       bytes.NewReader(content),
+		NoResponse: true,
+		OnReAuth: func() (string, error) {
+			return s.Conn.StorageUrl, nil
+		},
+	})
+	return err
+}
+
+// replaceObject calls put to write the object (or manifest) at objectPath,
+// then deletes the segments of the large object it replaced, if any, so
+// the previous object stays available until the new one is written. The
+// segments of the new object (prefix) are never deleted, since a resumed
+// upload may have written its manifest before.
+func (s *Swift) replaceObject(ctx context.Context, container string, objectPath string, prefix string, put func() error) error {
+	segmentContainer, segments, err := s.Conn.LargeObjectGetSegments(ctx, container, objectPath)
+	if err != nil && err != swift.ObjectNotFound && err != swift.NotLargeObject {
+		return err
+	}
+
+	err = put()
+	if err != nil {
+		return err
+	}
+
+	// best effort, leftovers are found by the GC
+	for _, segment := range segments {
+		if prefix != "" && strings.HasPrefix(segment.Name, prefix+"/") {
+			continue
+		}
+		s.Conn.ObjectDelete(ctx, segmentContainer, segment.Name)
+	}
+	return nil
+}
+
+// deleteSegments removes segments of an abandoned upload (best effort)
+func (s *Swift) deleteSegments(ctx context.Context, segmentContainer string, prefix string) {
+	names, err := s.Conn.ObjectNamesAll(ctx, segmentContainer, &swift.ObjectsOpts{
+		Prefix: prefix + "/",
+	})
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		s.Conn.ObjectDelete(ctx, segmentContainer, name)
+	}
+}
+
+// Verify the remote object against the local file: each segment size and
+// ETag (MD5) must match the corresponding part of the local file.
+func (s *Swift) Verify(file *File) error {
+	ctx := context.Background()
+
+	sourcePath := path.Clean(s.QueuePath + "/" + file.Path)
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	stat, err := source.Stat()
+	if err != nil {
+		return err
+	}
+
+	info, headers, err := s.Conn.Object(ctx, file.Container, file.Path)
+	if err == swift.ObjectNotFound {
+		return ErrObjectNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	// simple object
+	if !headers.IsLargeObject() {
+		if info.Bytes != stat.Size() {
+			return fmt.Errorf("remote size is %d, local size is %d", info.Bytes, stat.Size())
+		}
+		localHash, err := md5Hex(source)
+		if err != nil {
+			return err
+		}
+		if info.Hash != localHash {
+			return fmt.Errorf("remote checksum is %s, local checksum is %s", info.Hash, localHash)
+		}
+		return nil
+	}
+
+	// large object (DLO size may be wrong for a few seconds, so let's
+	// check the sum of the segments sizes instead)
+	if headers.IsLargeObjectSLO() && info.Bytes != stat.Size() {
+		return fmt.Errorf("remote size is %d, local size is %d", info.Bytes, stat.Size())
+	}
+
+	_, segments, err := s.Conn.LargeObjectGetSegments(ctx, file.Container, file.Path)
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	for num, segment := range segments {
+		if offset+segment.Bytes > stat.Size() {
+			return fmt.Errorf("remote size is larger than local size (%d)", stat.Size())
+		}
+		localHash, err := md5Hex(io.NewSectionReader(source, offset, segment.Bytes))
+		if err != nil {
+			return err
+		}
+		if segment.Hash != localHash {
+			return fmt.Errorf("segment %d: remote checksum is %s, local checksum is %s", num+1, segment.Hash, localHash)
+		}
+		offset += segment.Bytes
+	}
+
+	if offset != stat.Size() {
+		return fmt.Errorf("remote size is %d, local size is %d", offset, stat.Size())
+	}
+
+	return nil
+}
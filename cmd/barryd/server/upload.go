@@ -1,25 +1,74 @@
 package server
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"io"
+	"os"
+	"path"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/OnitiFR/barry/common"
 	"github.com/c2h5oh/datasize"
 )
 
 // progressReader wraps an io.Reader and atomically counts the bytes read,
-// allowing upload progress to be reported concurrently.
+// allowing upload progress to be reported concurrently. If limiter is set,
+// reads are throttled (see uploadReader).
 type progressReader struct {
 	reader  io.Reader
 	written *int64
+	limiter *rateLimiter
 }
 
 func (pr *progressReader) Read(p []byte) (int, error) {
 	n, err := pr.reader.Read(p)
-	atomic.AddInt64(pr.written, int64(n))
+	if pr.written != nil {
+		atomic.AddInt64(pr.written, int64(n))
+	}
+	pr.limiter.wait(n)
+	return n, err
+}
+
+// sizedReader wraps a stream expected to be exactly size bytes long: an
+// early EOF is reported as io.ErrUnexpectedEOF, and reading past size (at
+// the first Read after size bytes) returns an error if the stream goes on.
+type sizedReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func newSizedReader(reader io.Reader, size int64) *sizedReader {
+	return &sizedReader{reader: reader, remaining: size}
+}
+
+func (sr *sizedReader) Read(p []byte) (int, error) {
+	if sr.remaining <= 0 {
+		var extra [1]byte
+		n, err := io.ReadFull(sr.reader, extra[:])
+		if n > 0 {
+			return 0, errors.New("stream is longer than expected")
+		}
+		if err == io.EOF {
+			return 0, io.EOF
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > sr.remaining {
+		p = p[:sr.remaining]
+	}
+	n, err := sr.reader.Read(p)
+	sr.remaining -= int64(n)
+	if err == io.EOF {
+		if sr.remaining > 0 {
+			return n, io.ErrUnexpectedEOF
+		}
+		err = nil // next Read will check the end of the stream
+	}
 	return n, err
 }
 
@@ -36,6 +85,11 @@ type Upload struct {
 	ProjectName string
 	File        *File
 
+	// if set, the file is encrypted during the upload (stream encryption
+	// modes), and the ciphertext is also written to LocalCopy (if set)
+	Encryption *EncryptionConfig
+	LocalCopy  string
+
 	// output chan
 	Result chan error
 
@@ -45,24 +99,32 @@ type Upload struct {
 	// LastError error
 }
 
-// Uploader will manage workers
+// Uploader will manage workers. Uploads sent to Channel are handed to the
+// workers by a dispatcher, holding those outside the upload windows of
+// their container (workers are never parked waiting for a window).
 type Uploader struct {
 	NumWorkers int
 	Channel    chan *Upload
 	Storage    *Storage
 	Log        *Log
+	QueuePath  string
+
+	ready chan *Upload
+	held  int32
 
 	statusMutex sync.Mutex
 	status      []string
 }
 
 // NewUploader initialize a new instance
-func NewUploader(numWorkers int, storage *Storage, log *Log) *Uploader {
+func NewUploader(numWorkers int, storage *Storage, log *Log, queuePath string) *Uploader {
 	return &Uploader{
 		NumWorkers: numWorkers,
 		Channel:    make(chan *Upload),
+		ready:      make(chan *Upload),
 		Storage:    storage,
 		Log:        log,
+		QueuePath:  queuePath,
 		status:     make([]string, numWorkers),
 	}
 }
@@ -83,6 +145,12 @@ func (up *Uploader) StatusSnapshot() []string {
 	return out
 }
 
+// HeldCount returns the number of uploads waiting for a worker or for an
+// upload window
+func (up *Uploader) HeldCount() int {
+	return int(atomic.LoadInt32(&up.held))
+}
+
 // NewUpload initialize a new instance
 func NewUpload(projectName string, file *File) *Upload {
 	return &Upload{
@@ -92,8 +160,9 @@ func NewUpload(projectName string, file *File) *Upload {
 	}
 }
 
-// Start the Uploader (run workers)
+// Start the Uploader (run dispatcher and workers)
 func (up *Uploader) Start() {
+	go up.dispatcher()
 	for i := 0; i < up.NumWorkers; i++ {
 		go func(id int) {
 			for {
@@ -103,12 +172,75 @@ func (up *Uploader) Start() {
 	}
 }
 
+// dispatcher receives uploads and hands them to the workers, in order,
+// skipping those whose container is outside its upload windows. Those are
+// held until their window opens.
+func (up *Uploader) dispatcher() {
+	var held []*Upload
+
+	for {
+		// first upload allowed to start now, or else the next opening
+		now := time.Now()
+		var ready chan *Upload
+		var candidate int
+		var wakeUp time.Time
+		for i, upload := range held {
+			next, _ := up.Storage.NextUploadWindow(upload.File.Container, now)
+			if !next.After(now) {
+				ready = up.ready
+				candidate = i
+				break
+			}
+			if wakeUp.IsZero() || next.Before(wakeUp) {
+				wakeUp = next
+			}
+		}
+
+		var timer *time.Timer
+		var wake <-chan time.Time
+		if ready == nil && !wakeUp.IsZero() {
+			timer = time.NewTimer(time.Until(wakeUp))
+			wake = timer.C
+		}
+
+		var first *Upload
+		if ready != nil {
+			first = held[candidate]
+		}
+
+		select {
+		case upload := <-up.Channel:
+			atomic.AddInt32(&up.held, 1)
+			next, window := up.Storage.NextUploadWindow(upload.File.Container, time.Now())
+			if next.After(time.Now()) {
+				up.Log.Infof(upload.File.ProjectName(), "%s is outside upload window %s of %s, held until %s",
+					upload.File.Filename, window.Str, upload.File.Container, next.Format("2006-01-02 15:04"))
+			}
+			held = append(held, upload)
+		case ready <- first:
+			held = append(held[:candidate], held[candidate+1:]...)
+		case <-wake:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
 func (up *Uploader) worker(id int) {
 	var err error
 
 	up.setStatus(id, "idle")
 	up.Log.Tracef(MsgGlob, "upload worker %d: waiting", id)
-	upload := <-up.Channel
+	upload := <-up.ready
+	atomic.AddInt32(&up.held, -1)
+
+	// the window may have closed while the upload was waiting for a worker
+	if next, _ := up.Storage.NextUploadWindow(upload.File.Container, time.Now()); next.After(time.Now()) {
+		up.Channel <- upload
+		return
+	}
 
 	// make sure we always fill result chan
 	defer func() {
@@ -118,6 +250,11 @@ func (up *Uploader) worker(id int) {
 	upload.Tries++
 	upload.LastTry = time.Now()
 
+	rateInfo := ""
+	if rate := up.Storage.MaxUploadRate(upload.File.Container); rate > 0 {
+		rateInfo = fmt.Sprintf(" (limited to %s/s)", datasize.ByteSize(rate).HR())
+	}
+
 	up.setStatus(id, fmt.Sprintf("uploading %s (%s)", upload.File.Filename, upload.File.Container))
 	up.Log.Infof(upload.File.ProjectName(), "worker %d: uploading %s", id, upload.File.Filename)
 
@@ -167,12 +304,20 @@ func (up *Uploader) worker(id int) {
 						}
 					}
 				}
-				up.setStatus(id, status)
+				up.setStatus(id, status+rateInfo)
 			}
 		}
 	}()
 
-	err = up.Storage.Upload(upload.File, &written)
+	if upload.Encryption != nil {
+		err = up.uploadEncrypted(upload, &written)
+	} else {
+		err = up.Storage.Upload(upload.File, &written)
+		sourcePath := path.Clean(up.QueuePath + "/" + upload.File.Path)
+		if err != nil && !isSourceError(err, sourcePath) {
+			err = &storageError{err}
+		}
+	}
 	close(done)
 	<-finished
 	if err != nil {
@@ -181,3 +326,66 @@ func (up *Uploader) worker(id int) {
 		up.Log.Infof(upload.File.ProjectName(), "worker %d: done uploading %s", id, upload.File.Filename)
 	}
 }
+
+// uploadEncrypted encrypts the queue file while uploading it (no temporary
+// file), writing the same ciphertext to the local copy if requested
+func (up *Uploader) uploadEncrypted(upload *Upload, written *int64) error {
+	file := upload.File
+	sourcePath := path.Clean(up.QueuePath + "/" + file.Path)
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	stat, err := source.Stat()
+	if err != nil {
+		return err
+	}
+
+	var localCopy *os.File
+	if upload.LocalCopy != "" {
+		localCopy, err = os.OpenFile(upload.LocalCopy, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, stat.Mode())
+		if err != nil {
+			return err
+		}
+		defer localCopy.Close()
+	}
+
+	errInterrupted := errors.New("upload interrupted")
+	reader, writer := io.Pipe()
+	encrypted := make(chan error, 1)
+	go func() {
+		var output io.Writer = writer
+		if localCopy != nil {
+			output = io.MultiWriter(writer, localCopy)
+		}
+		err := common.EncryptStream(bufio.NewReader(source), output, upload.Encryption.MasterKeys())
+		writer.CloseWithError(err)
+		encrypted <- err
+	}()
+
+	size := common.EncryptedSize(common.EncryptionV3, upload.Encryption.MasterKeys(), stat.Size())
+	err = up.Storage.UploadStream(file.Container, file.Path, size, reader, NewObjectMetadata(file), written)
+
+	// unblock the encryption if the upload stopped early
+	reader.CloseWithError(errInterrupted)
+	errE := <-encrypted
+
+	// a local failure (source, local copy) also fails the upload
+	if errE != nil && errE != errInterrupted {
+		return fmt.Errorf("encryption error: %s", errE)
+	}
+	if err != nil {
+		return &storageError{err}
+	}
+
+	if localCopy != nil {
+		err = localCopy.Close()
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(upload.LocalCopy, stat.ModTime(), stat.ModTime())
+	}
+	return nil
+}
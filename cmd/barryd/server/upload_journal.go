@@ -0,0 +1,164 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// UploadJournal is a persistent record of uploads in progress: for each of
+// them, the segments already uploaded with their checksums. It allows an
+// interrupted upload (network failure, barryd restart, …) to be resumed,
+// sending only the missing segments.
+type UploadJournal struct {
+	filename string
+	mutex    sync.Mutex
+	uploads  map[string]*UploadJournalEntry
+}
+
+// UploadJournalEntry describes an upload in progress. Segments maps a
+// segment number (starting at 1) to its MD5 checksum (ETag).
+type UploadJournalEntry struct {
+	Container        string
+	Path             string
+	Size             int64
+	ModTime          time.Time
+	ChunkSize        int64
+	SegmentContainer string
+	SegmentPrefix    string
+	StartedAt        time.Time
+	Segments         map[int]string
+}
+
+// NewUploadJournal loads the journal from the given file, or creates an
+// empty one if it does not exist yet.
+func NewUploadJournal(filename string, log *Log) (*UploadJournal, error) {
+	journal := &UploadJournal{
+		filename: filename,
+		uploads:  make(map[string]*UploadJournalEntry),
+	}
+
+	// if the file exists, load it
+	if _, err := os.Stat(journal.filename); err == nil {
+		err = journal.load()
+		if err != nil {
+			return nil, err
+		}
+		if len(journal.uploads) > 0 {
+			log.Infof(MsgGlob, "found %d interrupted upload(s) in journal, will be resumed", len(journal.uploads))
+		}
+	}
+
+	// save the file to check if it's writable
+	err := journal.save()
+	if err != nil {
+		return nil, err
+	}
+
+	return journal, nil
+}
+
+func uploadJournalKey(container string, path string) string {
+	return container + "/" + path
+}
+
+func (journal *UploadJournal) load() error {
+	f, err := os.Open(journal.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	err = dec.Decode(&journal.uploads)
+	if err != nil {
+		return fmt.Errorf("decoding %s: %s", journal.filename, err)
+	}
+
+	return nil
+}
+
+// you should lock the mutex before calling save()
+func (journal *UploadJournal) save() error {
+	f, err := os.Create(journal.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return journal.saveToWriter(f)
+}
+
+func (journal *UploadJournal) saveToWriter(writer io.Writer) error {
+	enc := json.NewEncoder(writer)
+	return enc.Encode(&journal.uploads)
+}
+
+// Get returns a copy of the entry for an object, or nil if there's none
+func (journal *UploadJournal) Get(container string, path string) *UploadJournalEntry {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	entry, exists := journal.uploads[uploadJournalKey(container, path)]
+	if !exists {
+		return nil
+	}
+
+	res := *entry
+	res.Segments = make(map[int]string, len(entry.Segments))
+	for num, etag := range entry.Segments {
+		res.Segments[num] = etag
+	}
+	return &res
+}
+
+// Start records a new upload (replacing any previous entry for the object)
+func (journal *UploadJournal) Start(entry *UploadJournalEntry) error {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	if entry.Segments == nil {
+		entry.Segments = make(map[int]string)
+	}
+	journal.uploads[uploadJournalKey(entry.Container, entry.Path)] = entry
+	return journal.save()
+}
+
+// SegmentDone records a successfully uploaded segment
+func (journal *UploadJournal) SegmentDone(container string, path string, num int, etag string) error {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	entry, exists := journal.uploads[uploadJournalKey(container, path)]
+	if !exists {
+		return fmt.Errorf("no upload journal entry for '%s'", uploadJournalKey(container, path))
+	}
+	entry.Segments[num] = etag
+	return journal.save()
+}
+
+// Remove the entry of an object (upload is complete or abandoned)
+func (journal *UploadJournal) Remove(container string, path string) error {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	delete(journal.uploads, uploadJournalKey(container, path))
+	return journal.save()
+}
+
+// HasSegmentPrefix returns true if an upload in progress uses this
+// segment prefix
+func (journal *UploadJournal) HasSegmentPrefix(segmentContainer string, prefix string) bool {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	for _, entry := range journal.uploads {
+		if entry.SegmentContainer == segmentContainer && entry.SegmentPrefix == prefix {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiterBurst is the maximum amount of "unused" bandwidth time a
+// limiter can accumulate (idle time does not allow unlimited bursts)
+const rateLimiterBurst = 1 * time.Second
+
+// rateLimiter limits a bandwidth (bytes per second) shared by all readers
+// using it: each read reserves its transfer time, and waits for it.
+type rateLimiter struct {
+	mutex sync.Mutex
+	rate  float64
+	next  time.Time // when the reserved bandwidth ends
+}
+
+func newRateLimiter(bytesPerSecond uint64) *rateLimiter {
+	if bytesPerSecond == 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(bytesPerSecond)}
+}
+
+// wait for n bytes to be allowed (nil limiter: no limit)
+func (rl *rateLimiter) wait(n int) {
+	if rl == nil || n <= 0 {
+		return
+	}
+
+	rl.mutex.Lock()
+	now := time.Now()
+	if rl.next.Before(now.Add(-rateLimiterBurst)) {
+		rl.next = now.Add(-rateLimiterBurst)
+	}
+	rl.next = rl.next.Add(time.Duration(float64(n) / rl.rate * float64(time.Second)))
+	delay := rl.next.Sub(now)
+	rl.mutex.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// uploadReader wraps an upload source to count progress (if written is
+// not nil) and to limit bandwidth (if limiter is not nil)
+func uploadReader(reader io.Reader, written *int64, limiter *rateLimiter) io.Reader {
+	if written == nil && limiter == nil {
+		return reader
+	}
+	return &progressReader{reader: reader, written: written, limiter: limiter}
+}
+
+// UploadWindow is a daily time range (server local time) where uploads
+// are allowed. End may be before Start, for a window crossing midnight.
+type UploadWindow struct {
+	Start time.Duration // since midnight
+	End   time.Duration
+	Str   string
+}
+
+// parseClock parses a "15:04" time as a duration since midnight
+func parseClock(str string) (time.Duration, error) {
+	parts := strings.Split(str, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid time '%s' (ex: 22:00)", str)
+	}
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil || hours < 0 || hours > 24 {
+		return 0, fmt.Errorf("invalid hours in '%s'", str)
+	}
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil || minutes < 0 || minutes > 59 || (hours == 24 && minutes != 0) {
+		return 0, fmt.Errorf("invalid minutes in '%s'", str)
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+}
+
+// NewUploadWindow parses a "22:00-06:00" window
+func NewUploadWindow(str string) (*UploadWindow, error) {
+	parts := strings.Split(strings.TrimSpace(str), "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid upload window '%s' (ex: 22:00-06:00)", str)
+	}
+
+	start, err := parseClock(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return nil, fmt.Errorf("upload window '%s': %s", str, err)
+	}
+	end, err := parseClock(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return nil, fmt.Errorf("upload window '%s': %s", str, err)
+	}
+	if start == end {
+		return nil, fmt.Errorf("upload window '%s' is empty", str)
+	}
+
+	return &UploadWindow{
+		Start: start,
+		End:   end,
+		Str:   str,
+	}, nil
+}
+
+// Contains returns true if t is inside the window
+func (w *UploadWindow) Contains(t time.Time) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	clock := t.Sub(midnight)
+	if w.Start < w.End {
+		return clock >= w.Start && clock < w.End
+	}
+	return clock >= w.Start || clock < w.End
+}
+
+// NextStart returns the next time the window opens, after t
+func (w *UploadWindow) NextStart(t time.Time) time.Time {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	start := midnight.Add(w.Start)
+	if !start.After(t) {
+		start = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location()).Add(w.Start)
+	}
+	return start
+}
+
+// uploadWindowsNext returns when uploads are allowed given a list of
+// windows: t itself if t is inside one of them (or if there's no window),
+// otherwise the next opening, and the matching window
+func uploadWindowsNext(windows []*UploadWindow, t time.Time) (time.Time, *UploadWindow) {
+	if len(windows) == 0 {
+		return t, nil
+	}
+
+	var next time.Time
+	var nextWindow *UploadWindow
+	for _, window := range windows {
+		if window.Contains(t) {
+			return t, window
+		}
+		start := window.NextStart(t)
+		if nextWindow == nil || start.Before(next) {
+			next = start
+			nextWindow = window
+		}
+	}
+	return next, nextWindow
+}
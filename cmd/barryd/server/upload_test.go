@@ -0,0 +1,123 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testUploadWindowIn returns a one hour window opening after delay
+func testUploadWindowIn(delay time.Duration) *UploadWindow {
+	now := time.Now()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	start := (now.Sub(midnight) + delay) % (24 * time.Hour)
+	return &UploadWindow{
+		Start: start,
+		End:   (start + time.Hour) % (24 * time.Hour),
+		Str:   "test",
+	}
+}
+
+func TestUploaderWindows(t *testing.T) {
+	queuePath := t.TempDir()
+	storagePath := t.TempDir()
+
+	config := &AppConfig{
+		QueuePath: queuePath,
+		Storages: []*StorageConfig{
+			{
+				Name:       "closed",
+				Type:       StorageTypeLocal,
+				Containers: []string{"night"},
+				Local:      &LocalConfig{Path: storagePath},
+				// opens while the test is running
+				UploadWindows: []*UploadWindow{testUploadWindowIn(2 * time.Second)},
+			},
+			{
+				Name:       "open",
+				Type:       StorageTypeLocal,
+				Containers: []string{"day"},
+				Local:      &LocalConfig{Path: storagePath},
+			},
+		},
+	}
+	storage, err := NewStorage(config, testUploadJournal(t), testLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, container := range []string{"night", "day"} {
+		err = os.Mkdir(filepath.Join(storagePath, container), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = storage.CheckContainer(container, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = os.Mkdir(filepath.Join(queuePath, "project"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newUpload := func(filename string, container string) *Upload {
+		file := &File{
+			Filename:  filename,
+			Path:      "project/" + filename,
+			Container: container,
+			Size:      4,
+			ModTime:   time.Now(),
+		}
+		err := os.WriteFile(filepath.Join(queuePath, file.Path), []byte("test"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewUpload("project", file)
+	}
+
+	// a single worker: the held upload must not block the other one
+	uploader := NewUploader(1, storage, testLog(), queuePath)
+	uploader.Start()
+
+	held := newUpload("held.txt", "night")
+	uploader.Channel <- held
+	direct := newUpload("direct.txt", "day")
+	uploader.Channel <- direct
+
+	select {
+	case err := <-direct.Result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("upload to an open container was blocked by a held upload")
+	}
+
+	select {
+	case err := <-held.Result:
+		t.Fatalf("upload started outside of its upload window (%v)", err)
+	default:
+	}
+	if count := uploader.HeldCount(); count != 1 {
+		t.Errorf("held count is %d, expected 1", count)
+	}
+	if status := uploader.StatusSnapshot()[0]; status != "idle" {
+		t.Errorf("worker status is '%s', expected 'idle'", status)
+	}
+
+	select {
+	case err := <-held.Result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("held upload not started when its upload window opened")
+	}
+
+	for _, path := range []string{"night/project/held.txt", "day/project/direct.txt"} {
+		if _, err := os.Stat(filepath.Join(storagePath, path)); err != nil {
+			t.Error(err)
+		}
+	}
+}
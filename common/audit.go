@@ -0,0 +1,30 @@
+package common
+
+import "time"
+
+// Audit problem types
+const (
+	AuditProblemMissing    = "missing"
+	AuditProblemWrongSize  = "wrong-size"
+	AuditProblemUnexpected = "unexpected"
+)
+
+// APIAuditReport is the result of a remote audit (DB files vs containers)
+type APIAuditReport struct {
+	StartedAt  time.Time
+	Duration   time.Duration
+	Containers int
+	Objects    int
+	Files      int
+	Problems   []APIAuditProblem
+	Errors     []string
+}
+
+// APIAuditProblem is a file or an object failing the audit
+type APIAuditProblem struct {
+	Type         string
+	Container    string
+	Path         string
+	ExpectedSize int64
+	RemoteSize   int64
+}
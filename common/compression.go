@@ -0,0 +1,68 @@
+package common
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression algorithms of BARRY4 files (the content is compressed
+// before encryption)
+const (
+	CompressionNone = ""
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// compressionIDs are the header values of compression algorithms
+var compressionIDs = map[string]byte{
+	CompressionNone: 0,
+	CompressionGzip: 1,
+	CompressionZstd: 2,
+}
+
+// CheckCompression returns an error if the compression algorithm is unknown
+func CheckCompression(compression string) error {
+	if _, exists := compressionIDs[compression]; !exists {
+		return fmt.Errorf("unknown compression '%s' (%s or %s)", compression, CompressionGzip, CompressionZstd)
+	}
+	return nil
+}
+
+// compressionName returns the compression algorithm of a header value
+func compressionName(id byte) (string, error) {
+	for name, value := range compressionIDs {
+		if value == id {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("unknown compression (%d)", id)
+}
+
+// newCompressor returns a writer compressing to w (close it to flush)
+func newCompressor(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unknown compression '%s'", compression)
+}
+
+// newDecompressor returns a reader decompressing r
+func newDecompressor(r io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionZstd:
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unknown compression '%s'", compression)
+}
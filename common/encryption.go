@@ -1,98 +1,935 @@
 package common
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	cryptorand "crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
 )
 
 // This feature is common to both the server and the client, for emergency decryption
 
+// Encryption formats:
+//   - BARRY1: AES-CTR, SHA-256 of the plaintext in the header (checked
+//     after the whole file is decrypted)
+//   - BARRY2: AES-GCM by chunks, the chunk index and a final marker are
+//     bound into each nonce, the header is authenticated with every chunk.
+//     The SHA-256 of the plaintext is stored (authenticated) after the last
+//     chunk, so the file can be written without seeking.
+//   - BARRY3: BARRY2 chunks, encrypted with a random data key per file.
+//     The data key is stored in the header, wrapped (AES-GCM) by one or
+//     more master keys: key rotation only rewrites the header, since it's
+//     not part of the chunks authenticated data (except its fixed part).
+//   - BARRY4: BARRY3 with a compressed content (the algorithm is in the
+//     authenticated part of the header). The trailer checksum is the one of
+//     the original (uncompressed) content.
+const (
+	EncryptionV1 = 1
+	EncryptionV2 = 2
+	EncryptionV3 = 3
+	EncryptionV4 = 4
+)
+
 const EncryptionIvSize = 16
 const BarrySignature = "BARRY1"
+const BarryComment = "Barry Encryption v1"
+const BarrySignatureV2 = "BARRY2"
+const BarryCommentV2 = "Barry Encryption v2"
+const BarrySignatureV3 = "BARRY3"
+const BarryCommentV3 = "Barry Encryption v3"
+const BarrySignatureV4 = "BARRY4"
+const BarryCommentV4 = "Barry Encryption v4"
+
+// EncryptionKeyNameMaxLen is the maximum length of a key name in a header
+const EncryptionKeyNameMaxLen = 64
+
+// EncryptionChunkSize is the plaintext size of each BARRY2 chunk
+const EncryptionChunkSize = 64 * 1024
+
+// encryptionNoncePrefixSize is the random part of BARRY2 nonces (the rest
+// is the chunk index and the final marker)
+const encryptionNoncePrefixSize = 7
+
+// encryptionTagSize is the size of an AES-GCM authentication tag
+const encryptionTagSize = 16
+
+// EncryptionMaxKeys is the maximum number of master keys of a BARRY3 file
+const EncryptionMaxKeys = 8
+
+// encryptionDataKeySize is the size of BARRY3 data keys (AES-256)
+const encryptionDataKeySize = 32
+
+// encryptionSlotAESGCM is the type of a data key wrapped with AES-GCM: a
+// random nonce followed by the sealed data key
+const encryptionSlotAESGCM = 1
+
+// encryptionSlotX25519 is the type of a data key wrapped for an X25519
+// recipient: an ephemeral public key, a nonce, then the data key sealed
+// (AES-GCM) with a key derived from the shared secret
+const encryptionSlotX25519 = 2
+
+// encryptionWrapNonceSize is the size of the AES-GCM data key wrapping nonce
+const encryptionWrapNonceSize = 12
+
+// encryptionX25519Info is the HKDF context of X25519 wrapping keys
+const encryptionX25519Info = "barry x25519 data key wrapping"
+
+// encryptionTrailerSize is the size of the BARRY2 trailer: SHA-256 of the
+// plaintext and its authentication tag
+const encryptionTrailerSize = sha256.Size + encryptionTagSize
+
+// EncryptionKey is a named master key: a symmetric Key, or the PublicKey
+// of an X25519 recipient (encryption only, the private key, or identity,
+// is needed to decrypt)
+type EncryptionKey struct {
+	Name      string
+	Key       []byte
+	PublicKey []byte
+}
+
+// EncryptionKeySlot is a BARRY3 data key, wrapped by a master key
+type EncryptionKeySlot struct {
+	Type    byte
+	KeyName string
+	Wrapped []byte
+}
+
+// EncryptionHeader is the header of an encrypted file
+type EncryptionHeader struct {
+	Version int
+	KeyName string // first (BARRY3) key name
+	Hash    []byte // SHA-256 of the plaintext, BARRY1 only (see ReadEncryptionChecksum)
+
+	// BARRY1
+	IV         []byte
+	BufferSize uint32
+
+	// BARRY2 and BARRY3
+	NoncePrefix []byte
+	ChunkSize   uint32
+
+	// BARRY3 and BARRY4
+	Slots []EncryptionKeySlot
+
+	// BARRY4
+	Compression string
+
+	raw  []byte // authenticated data of BARRY2/BARRY3 chunks
+	size int64
+}
+
+// encryptionHeaderSize returns the size of a header for the given keys
+// (only BARRY3 headers may have more than one, their slot size depends on
+// the key type)
+func encryptionHeaderSize(version int, keys []EncryptionKey) int64 {
+	switch version {
+	case EncryptionV1:
+		return int64(len(BarrySignature) + len(BarryComment) + 1 + len(keys[0].Name) + 1 + sha256.Size + EncryptionIvSize + 4)
+	case EncryptionV2:
+		return int64(len(BarrySignatureV2) + len(BarryCommentV2) + 1 + len(keys[0].Name) + 1 + encryptionNoncePrefixSize + 4)
+	}
+	size := int64(len(BarrySignatureV3) + len(BarryCommentV3) + 1 + encryptionNoncePrefixSize + 4 + 1)
+	if version == EncryptionV4 {
+		size++ // compression
+	}
+	for _, key := range keys {
+		size += int64(1 + len(key.Name) + 1 + 2 + encryptionWrapNonceSize + encryptionDataKeySize + encryptionTagSize)
+		if key.PublicKey != nil {
+			size += curve25519.PointSize
+		}
+	}
+	return size
+}
+
+// EncryptedSize returns the size of a file of size bytes once encrypted
+// with the given format and keys (only names and types are used)
+func EncryptedSize(version int, keys []EncryptionKey, size int64) int64 {
+	header := encryptionHeaderSize(version, keys)
+	if version == EncryptionV1 {
+		return header + size
+	}
+	chunks := (size + EncryptionChunkSize - 1) / EncryptionChunkSize
+	return header + size + chunks*encryptionTagSize + encryptionTrailerSize
+}
+
+// Size returns the size of the header
+func (header *EncryptionHeader) Size() int64 {
+	return header.size
+}
+
+// KeyNames returns the names of the keys able to decrypt the file
+func (header *EncryptionHeader) KeyNames() []string {
+	if header.Version < EncryptionV3 {
+		return []string{header.KeyName}
+	}
+	names := make([]string, 0, len(header.Slots))
+	for _, slot := range header.Slots {
+		names = append(names, slot.KeyName)
+	}
+	return names
+}
+
+// PlainSize returns the size of the content of an encrypted file (the
+// compressed content, for BARRY4)
+func (header *EncryptionHeader) PlainSize(encryptedSize int64) int64 {
+	body := encryptedSize - header.Size()
+	if header.Version == EncryptionV1 {
+		return body
+	}
+	body -= encryptionTrailerSize
+	record := int64(header.ChunkSize) + encryptionTagSize
+	chunks := (body + record - 1) / record
+	return body - chunks*encryptionTagSize
+}
+
+// ReadEncryptionHeader reads the header of an encrypted file
+func ReadEncryptionHeader(infile io.Reader) (*EncryptionHeader, error) {
+	var raw bytes.Buffer
+	reader := io.TeeReader(infile, &raw)
 
-// DecryptFile will decrypt a file, where you must provide a callback to return the key
-func DecryptFile(infile *os.File, outfile *os.File, keyCallback func(string) ([]byte, error)) error {
 	sig := make([]byte, len(BarrySignature))
-	_, err := infile.Read(sig)
+	_, err := io.ReadFull(reader, sig)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if string(sig) != BarrySignature {
-		return fmt.Errorf("invalid signature")
+	header := &EncryptionHeader{}
+	switch string(sig) {
+	case BarrySignature:
+		header.Version = EncryptionV1
+	case BarrySignatureV2:
+		header.Version = EncryptionV2
+	case BarrySignatureV3:
+		header.Version = EncryptionV3
+	case BarrySignatureV4:
+		header.Version = EncryptionV4
+	default:
+		return nil, fmt.Errorf("invalid signature")
 	}
 
 	// read comment string
-	_, err = ReadString(infile, 128)
+	_, err = ReadString(reader, 128)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if header.Version >= EncryptionV3 {
+		err = readEncryptionHeaderV3(header, reader, &raw)
+		if err != nil {
+			return nil, err
+		}
+		header.size = int64(raw.Len())
+		return header, nil
 	}
 
 	// read key name string
-	keyName, err := ReadString(infile, 64)
+	header.KeyName, err = ReadString(reader, EncryptionKeyNameMaxLen)
+	if err != nil {
+		return nil, err
+	}
+
+	if header.Version == EncryptionV1 {
+		header.Hash = make([]byte, sha256.Size)
+		_, err = io.ReadFull(reader, header.Hash)
+		if err != nil {
+			return nil, err
+		}
+
+		header.IV = make([]byte, EncryptionIvSize)
+		_, err = io.ReadFull(reader, header.IV)
+		if err != nil {
+			return nil, err
+		}
+
+		err = binary.Read(reader, binary.LittleEndian, &header.BufferSize)
+		if err != nil {
+			return nil, err
+		}
+
+		if header.BufferSize < 16 || header.BufferSize > 100*1024*1024 {
+			return nil, fmt.Errorf("invalid buffer size (out of range)")
+		}
+
+		if header.BufferSize%16 != 0 {
+			return nil, fmt.Errorf("invalid buffer size (must be multiple of 16)")
+		}
+	} else {
+		header.NoncePrefix = make([]byte, encryptionNoncePrefixSize)
+		_, err = io.ReadFull(reader, header.NoncePrefix)
+		if err != nil {
+			return nil, err
+		}
+
+		err = binary.Read(reader, binary.LittleEndian, &header.ChunkSize)
+		if err != nil {
+			return nil, err
+		}
+
+		if header.ChunkSize < 16 || header.ChunkSize > 16*1024*1024 {
+			return nil, fmt.Errorf("invalid chunk size (out of range)")
+		}
+	}
+
+	header.raw = raw.Bytes()
+	header.size = int64(raw.Len())
+	return header, nil
+}
+
+// readEncryptionHeaderV3 reads the rest of a BARRY3 (or BARRY4) header:
+// nonce prefix, chunk size, compression (the authenticated part) then the
+// key slots
+func readEncryptionHeaderV3(header *EncryptionHeader, reader io.Reader, raw *bytes.Buffer) error {
+	header.NoncePrefix = make([]byte, encryptionNoncePrefixSize)
+	_, err := io.ReadFull(reader, header.NoncePrefix)
+	if err != nil {
+		return err
+	}
+
+	err = binary.Read(reader, binary.LittleEndian, &header.ChunkSize)
 	if err != nil {
 		return err
 	}
 
-	key, err := keyCallback(keyName)
+	if header.ChunkSize < 16 || header.ChunkSize > 16*1024*1024 {
+		return fmt.Errorf("invalid chunk size (out of range)")
+	}
+
+	if header.Version == EncryptionV4 {
+		var compression byte
+		err = binary.Read(reader, binary.LittleEndian, &compression)
+		if err != nil {
+			return err
+		}
+
+		header.Compression, err = compressionName(compression)
+		if err != nil {
+			return err
+		}
+	}
+
+	header.raw = append([]byte{}, raw.Bytes()...)
+
+	var count uint8
+	err = binary.Read(reader, binary.LittleEndian, &count)
 	if err != nil {
 		return err
 	}
 
+	if count == 0 || count > EncryptionMaxKeys {
+		return fmt.Errorf("invalid key count (out of range)")
+	}
+
+	for i := 0; i < int(count); i++ {
+		var slot EncryptionKeySlot
+		err = binary.Read(reader, binary.LittleEndian, &slot.Type)
+		if err != nil {
+			return err
+		}
+
+		slot.KeyName, err = ReadString(reader, EncryptionKeyNameMaxLen)
+		if err != nil {
+			return err
+		}
+
+		var size uint16
+		err = binary.Read(reader, binary.LittleEndian, &size)
+		if err != nil {
+			return err
+		}
+
+		slot.Wrapped = make([]byte, size)
+		_, err = io.ReadFull(reader, slot.Wrapped)
+		if err != nil {
+			return err
+		}
+
+		header.Slots = append(header.Slots, slot)
+	}
+
+	header.KeyName = header.Slots[0].KeyName
+	return nil
+}
+
+// writeEncryptionHeaderV3 builds a BARRY3 header (BARRY4 if compressed),
+// the data key being wrapped by each master key. The authenticated part is
+// returned too.
+func writeEncryptionHeaderV3(prefix []byte, chunkSize uint32, compression string, dataKey []byte, keys []EncryptionKey) ([]byte, []byte, error) {
+	if len(keys) == 0 || len(keys) > EncryptionMaxKeys {
+		return nil, nil, fmt.Errorf("a file needs 1 to %d keys", EncryptionMaxKeys)
+	}
+
+	compressionID, exists := compressionIDs[compression]
+	if !exists {
+		return nil, nil, fmt.Errorf("unknown compression '%s'", compression)
+	}
+
+	var header bytes.Buffer
+	if compression == CompressionNone {
+		header.WriteString(BarrySignatureV3)
+		header.WriteString(BarryCommentV3)
+	} else {
+		header.WriteString(BarrySignatureV4)
+		header.WriteString(BarryCommentV4)
+	}
+	header.WriteByte(0)
+	header.Write(prefix)
+	binary.Write(&header, binary.LittleEndian, chunkSize)
+	if compression != CompressionNone {
+		header.WriteByte(compressionID)
+	}
+	raw := append([]byte{}, header.Bytes()...)
+
+	header.WriteByte(byte(len(keys)))
+	for _, key := range keys {
+		if len(key.Name) > EncryptionKeyNameMaxLen {
+			return nil, nil, fmt.Errorf("key name is too long (%d chars max)", EncryptionKeyNameMaxLen)
+		}
+
+		slotType := byte(encryptionSlotAESGCM)
+		wrap := wrapDataKey
+		if key.PublicKey != nil {
+			slotType = encryptionSlotX25519
+			wrap = wrapDataKeyX25519
+		}
+
+		wrapped, err := wrap(dataKey, key, raw)
+		if err != nil {
+			return nil, nil, fmt.Errorf("key '%s': %s", key.Name, err)
+		}
+
+		header.WriteByte(slotType)
+		header.WriteString(key.Name)
+		header.WriteByte(0)
+		binary.Write(&header, binary.LittleEndian, uint16(len(wrapped)))
+		header.Write(wrapped)
+	}
+
+	return header.Bytes(), raw, nil
+}
+
+// wrapDataKey seals a data key with a master key, bound to the header
+// authenticated part and to the key name. Master keys are long-lived: the
+// nonce must never repeat, it comes from crypto/rand.
+func wrapDataKey(dataKey []byte, key EncryptionKey, raw []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, encryptionWrapNonceSize)
+	_, err = io.ReadFull(cryptorand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	aad := append(append([]byte{}, raw...), key.Name...)
+	return aead.Seal(nonce, nonce, dataKey, aad), nil
+}
+
+// wrapDataKeyX25519 seals a data key for an X25519 recipient, using an
+// ephemeral key pair (the private part is never stored)
+func wrapDataKeyX25519(dataKey []byte, key EncryptionKey, raw []byte) ([]byte, error) {
+	ephemeral := make([]byte, curve25519.ScalarSize)
+	_, err := io.ReadFull(cryptorand.Reader, ephemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	ephemeralPublic, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapKey, err := x25519WrapKey(ephemeral, key.PublicKey, ephemeralPublic, key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, err := wrapDataKey(dataKey, EncryptionKey{Name: key.Name, Key: wrapKey}, raw)
+	if err != nil {
+		return nil, err
+	}
+	return append(ephemeralPublic, wrapped...), nil
+}
+
+// x25519WrapKey derives the wrapping key of an X25519 slot
+func x25519WrapKey(private []byte, peer []byte, ephemeralPublic []byte, recipient []byte) ([]byte, error) {
+	shared, err := curve25519.X25519(private, peer)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := append(append([]byte{}, ephemeralPublic...), recipient...)
+	wrapKey := make([]byte, encryptionDataKeySize)
+	_, err = io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(encryptionX25519Info)), wrapKey)
+	if err != nil {
+		return nil, err
+	}
+	return wrapKey, nil
+}
+
+// GenerateX25519Identity returns a new X25519 identity (private key) and
+// its public key
+func GenerateX25519Identity() ([]byte, []byte, error) {
+	identity := make([]byte, curve25519.ScalarSize)
+	_, err := io.ReadFull(cryptorand.Reader, identity)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	public, err := X25519PublicKey(identity)
+	if err != nil {
+		return nil, nil, err
+	}
+	return identity, public, nil
+}
+
+// X25519PublicKey returns the public key of an X25519 identity
+func X25519PublicKey(identity []byte) ([]byte, error) {
+	if len(identity) != curve25519.ScalarSize {
+		return nil, fmt.Errorf("invalid identity size (%d bytes expected)", curve25519.ScalarSize)
+	}
+	return curve25519.X25519(identity, curve25519.Basepoint)
+}
+
+// unwrapDataKey opens a data key wrapped with wrapDataKey, or with
+// wrapDataKeyX25519 (key is then the recipient identity)
+func unwrapDataKey(slot *EncryptionKeySlot, key []byte, raw []byte) ([]byte, error) {
+	wrapped := slot.Wrapped
+	switch slot.Type {
+	case encryptionSlotAESGCM:
+	case encryptionSlotX25519:
+		if len(wrapped) < curve25519.PointSize {
+			return nil, errors.New("invalid wrapped key size")
+		}
+		recipient, err := X25519PublicKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("key '%s': %s", slot.KeyName, err)
+		}
+		ephemeralPublic := wrapped[:curve25519.PointSize]
+		key, err = x25519WrapKey(key, ephemeralPublic, ephemeralPublic, recipient)
+		if err != nil {
+			return nil, fmt.Errorf("unable to unwrap data key with key '%s', is the identity correct?", slot.KeyName)
+		}
+		wrapped = wrapped[curve25519.PointSize:]
+	default:
+		return nil, fmt.Errorf("unsupported key slot type %d", slot.Type)
+	}
+
+	if len(wrapped) != encryptionWrapNonceSize+encryptionDataKeySize+encryptionTagSize {
+		return nil, errors.New("invalid wrapped key size")
+	}
+
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := wrapped[:encryptionWrapNonceSize]
+	aad := append(append([]byte{}, raw...), slot.KeyName...)
+	dataKey, err := aead.Open(nil, nonce, wrapped[encryptionWrapNonceSize:], aad)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unwrap data key with key '%s', is the key correct?", slot.KeyName)
+	}
+	return dataKey, nil
+}
+
+// dataKey returns the key of the file content: the master key itself
+// before BARRY3, or the data key unwrapped by the first available key
+func (header *EncryptionHeader) dataKey(keyCallback func(string) ([]byte, error)) ([]byte, error) {
+	if header.Version < EncryptionV3 {
+		return keyCallback(header.KeyName)
+	}
+
+	var lastErr error
+	for i := range header.Slots {
+		slot := &header.Slots[i]
+		key, err := keyCallback(slot.KeyName)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		dataKey, err := unwrapDataKey(slot, key, header.raw)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return dataKey, nil
+	}
+	return nil, lastErr
+}
+
+// ReadEncryptionChecksum returns the key name and the SHA-256 hash of the
+// original content of an encrypted file, without decrypting it
+func ReadEncryptionChecksum(infile io.ReadSeeker) (string, []byte, error) {
+	header, err := ReadEncryptionHeader(infile)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if header.Version == EncryptionV1 {
+		return header.KeyName, header.Hash, nil
+	}
+
+	_, err = infile.Seek(-encryptionTrailerSize, io.SeekEnd)
+	if err != nil {
+		return "", nil, err
 	}
 
-	// read sha256 hash
-	expectedHash := make([]byte, 32)
-	_, err = infile.Read(expectedHash)
+	hash := make([]byte, sha256.Size)
+	_, err = io.ReadFull(infile, hash)
+	if err != nil {
+		return "", nil, err
+	}
+	return header.KeyName, hash, nil
+}
+
+// encryptionNonce returns the nonce of a BARRY2 chunk
+func encryptionNonce(prefix []byte, index uint32, final bool) []byte {
+	nonce := make([]byte, 0, encryptionNoncePrefixSize+5)
+	nonce = append(nonce, prefix...)
+	nonce = append(nonce, byte(index>>24), byte(index>>16), byte(index>>8), byte(index))
+	if final {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// EncryptStream encrypts infile to outfile (BARRY3 format) with a random
+// data key, wrapped by each of the given master keys. The data key and
+// every nonce come from crypto/rand.
+func EncryptStream(infile io.Reader, outfile io.Writer, keys []EncryptionKey) error {
+	return EncryptStreamCompressed(infile, outfile, keys, CompressionNone)
+}
+
+// EncryptStreamCompressed is EncryptStream with a compression of the
+// content before encryption (BARRY4 format, unless CompressionNone)
+func EncryptStreamCompressed(infile io.Reader, outfile io.Writer, keys []EncryptionKey, compression string) error {
+	dataKey := make([]byte, encryptionDataKeySize)
+	_, err := io.ReadFull(cryptorand.Reader, dataKey)
 	if err != nil {
 		return err
 	}
 
-	// read the IV
-	iv := make([]byte, block.BlockSize())
-	n, err := infile.Read(iv)
+	prefix := make([]byte, encryptionNoncePrefixSize)
+	_, err = io.ReadFull(cryptorand.Reader, prefix)
 	if err != nil {
 		return err
 	}
 
-	if n != block.BlockSize() {
-		return fmt.Errorf("invalid IV size")
+	header, raw, err := writeEncryptionHeaderV3(prefix, EncryptionChunkSize, compression, dataKey, keys)
+	if err != nil {
+		return err
 	}
 
-	// read buffer size
-	var bufferSize uint32
-	err = binary.Read(infile, binary.LittleEndian, &bufferSize)
+	block, err := aes.NewCipher(dataKey)
 	if err != nil {
 		return err
 	}
 
-	if bufferSize < 16 || bufferSize > 100*1024*1024 {
-		return fmt.Errorf("invalid buffer size (out of range)")
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
 	}
 
-	if bufferSize%16 != 0 {
-		return fmt.Errorf("invalid buffer size (must be multiple of 16)")
+	_, err = outfile.Write(header)
+	if err != nil {
+		return err
 	}
 
+	// checksum of the original content
 	hash := sha256.New()
+	var content io.Reader = io.TeeReader(infile, hash)
+
+	compressed := make(chan error, 1)
+	if compression == CompressionNone {
+		compressed <- nil
+	} else {
+		reader, writer := io.Pipe()
+		defer reader.Close() // unblock the compression if the encryption stopped early
+
+		source := content
+		go func() {
+			err := compress(source, writer, compression)
+			writer.CloseWithError(err)
+			compressed <- err
+		}()
+		content = reader
+	}
 
-	buf := make([]byte, bufferSize)
-	stream := cipher.NewCTR(block, iv)
+	buf := make([]byte, EncryptionChunkSize)
+	sealed := make([]byte, 0, EncryptionChunkSize+encryptionTagSize)
+	var index uint32
+	for {
+		n, err := io.ReadFull(content, buf)
+		if n > 0 {
+			sealed = aead.Seal(sealed[:0], encryptionNonce(prefix, index, false), buf[:n], raw)
+			_, errW := outfile.Write(sealed)
+			if errW != nil {
+				return errW
+			}
+			index++
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// the whole content is hashed once the compression is done
+	err = <-compressed
+	if err != nil {
+		return err
+	}
+
+	// trailer: checksum, authenticated with the final marker
+	sum := hash.Sum(nil)
+	tag := aead.Seal(nil, encryptionNonce(prefix, index, true), nil, append(append([]byte{}, raw...), sum...))
+
+	_, err = outfile.Write(sum)
+	if err != nil {
+		return err
+	}
+	_, err = outfile.Write(tag)
+	return err
+}
+
+// compress copies infile to outfile, compressed
+func compress(infile io.Reader, outfile io.Writer, compression string) error {
+	compressor, err := newCompressor(outfile, compression)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(compressor, infile)
+	if err != nil {
+		compressor.Close()
+		return err
+	}
+	return compressor.Close()
+}
+
+// RewrapFile copies a BARRY3 file, wrapping its data key with new master
+// keys: the content is not decrypted (the key callback is used to unwrap
+// the current data key)
+func RewrapFile(infile io.Reader, outfile io.Writer, keyCallback func(string) ([]byte, error), keys []EncryptionKey) error {
+	header, err := ReadEncryptionHeader(infile)
+	if err != nil {
+		return err
+	}
+
+	if header.Version < EncryptionV3 {
+		return fmt.Errorf("unable to rewrap a BARRY%d file (no data key)", header.Version)
+	}
+
+	return rewrap(header, infile, outfile, keyCallback, keys)
+}
+
+// rewrap writes a new header, then copies the rest of infile as is
+func rewrap(header *EncryptionHeader, infile io.Reader, outfile io.Writer, keyCallback func(string) ([]byte, error), keys []EncryptionKey) error {
+	dataKey, err := header.dataKey(keyCallback)
+	if err != nil {
+		return err
+	}
+
+	newHeader, _, err := writeEncryptionHeaderV3(header.NoncePrefix, header.ChunkSize, header.Compression, dataKey, keys)
+	if err != nil {
+		return err
+	}
+
+	_, err = outfile.Write(newHeader)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(outfile, infile)
+	return err
+}
+
+// RekeyFile copies an encrypted file so it can be decrypted by new master
+// keys: BARRY3/4 files are rewrapped (see RewrapFile), older formats are
+// decrypted and encrypted again on the fly (BARRY3)
+func RekeyFile(infile io.Reader, outfile io.Writer, keyCallback func(string) ([]byte, error), keys []EncryptionKey) error {
+	header, err := ReadEncryptionHeader(infile)
+	if err != nil {
+		return err
+	}
+
+	if header.Version >= EncryptionV3 {
+		return rewrap(header, infile, outfile, keyCallback, keys)
+	}
+
+	// BARRY1 and BARRY2 headers are fully authenticated (raw)
+	reader, writer := io.Pipe()
+	decrypted := make(chan error, 1)
+	go func() {
+		err := DecryptFile(io.MultiReader(bytes.NewReader(header.raw), infile), writer, keyCallback)
+		writer.CloseWithError(err)
+		decrypted <- err
+	}()
+
+	err = EncryptStream(reader, outfile, keys)
+
+	// unblock the decryption if the encryption stopped early
+	reader.CloseWithError(errors.New("encryption interrupted"))
+	errD := <-decrypted
+
+	if errD != nil {
+		return errD
+	}
+	return err
+}
+
+// DecryptFile will decrypt a file, where you must provide a callback to return the key
+func DecryptFile(infile io.Reader, outfile io.Writer, keyCallback func(string) ([]byte, error)) error {
+	header, err := ReadEncryptionHeader(infile)
+	if err != nil {
+		return err
+	}
+
+	block, err := header.cipherBlock(keyCallback)
+	if err != nil {
+		return err
+	}
+
+	return decryptContent(header, block, infile, outfile)
+}
+
+// NewDecryptReader returns a reader of the decrypted content of infile,
+// decrypted on the fly (in a goroutine). The header and the key are
+// checked first, later errors (authentication, checksum) are returned by
+// Read: with BARRY1, the checksum is only known at the end of the file.
+// Close the reader to stop the decryption early.
+func NewDecryptReader(infile io.Reader, keyCallback func(string) ([]byte, error)) (io.ReadCloser, error) {
+	header, err := ReadEncryptionHeader(infile)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := header.cipherBlock(keyCallback)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		err := decryptContent(header, block, infile, writer)
+		writer.CloseWithError(err)
+	}()
+
+	return reader, nil
+}
+
+// cipherBlock returns the cipher of the file content
+func (header *EncryptionHeader) cipherBlock(keyCallback func(string) ([]byte, error)) (cipher.Block, error) {
+	key, err := header.dataKey(keyCallback)
+	if err != nil {
+		return nil, err
+	}
+	return aes.NewCipher(key)
+}
+
+// decryptContent decrypts what follows the header
+func decryptContent(header *EncryptionHeader, block cipher.Block, infile io.Reader, outfile io.Writer) error {
+	if header.Version == EncryptionV1 {
+		return decryptV1(header, block, infile, outfile)
+	}
+
+	// checksum of the original content
+	hash := sha256.New()
+
+	var sum []byte
+	var err error
+	if header.Compression == CompressionNone {
+		sum, err = decryptV2(header, block, infile, io.MultiWriter(outfile, hash))
+	} else {
+		sum, err = decryptCompressed(header, block, infile, io.MultiWriter(outfile, hash))
+	}
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(hash.Sum(nil), sum) {
+		return fmt.Errorf("invalid checksum")
+	}
+
+	return nil
+}
+
+// decryptCompressed decrypts the chunks of a BARRY4 file and decompresses
+// them, returning the checksum of the trailer
+func decryptCompressed(header *EncryptionHeader, block cipher.Block, infile io.Reader, outfile io.Writer) ([]byte, error) {
+	type result struct {
+		sum []byte
+		err error
+	}
+
+	reader, writer := io.Pipe()
+	decrypted := make(chan result, 1)
+	go func() {
+		sum, err := decryptV2(header, block, infile, writer)
+		writer.CloseWithError(err)
+		decrypted <- result{sum, err}
+	}()
+
+	decompressor, err := newDecompressor(reader, header.Compression)
+	if err == nil {
+		_, err = io.Copy(outfile, decompressor)
+		decompressor.Close()
+	}
+
+	// unblock the decryption if the decompression stopped early
+	reader.CloseWithError(errors.New("decompression interrupted"))
+	res := <-decrypted
+
+	if res.err != nil {
+		return nil, res.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res.sum, nil
+}
+
+// decryptV1 decrypts the content of a BARRY1 file
+func decryptV1(header *EncryptionHeader, block cipher.Block, infile io.Reader, outfile io.Writer) error {
+	hash := sha256.New()
+
+	buf := make([]byte, header.BufferSize)
+	stream := cipher.NewCTR(block, header.IV)
 	for {
 		n, err := infile.Read(buf)
 		if n > 0 {
 			stream.XORKeyStream(buf, buf[:n])
-			outfile.Write(buf[:n])
+			_, errW := outfile.Write(buf[:n])
+			if errW != nil {
+				return errW
+			}
 			hash.Write(buf[:n])
 		}
 
@@ -105,14 +942,82 @@ func DecryptFile(infile *os.File, outfile *os.File, keyCallback func(string) ([]
 		}
 	}
 
-	if !bytes.Equal(hash.Sum(nil), expectedHash) {
+	if !bytes.Equal(hash.Sum(nil), header.Hash) {
 		return fmt.Errorf("invalid checksum, is the key correct?")
 	}
 
 	return nil
 }
 
-// IsFileEncrypted checks if a file is encrypted by looking for the Barry signature
+// decryptV2 decrypts and authenticates the chunks of a BARRY2 (or later)
+// file, and returns the (authenticated) checksum of the trailer
+func decryptV2(header *EncryptionHeader, block cipher.Block, infile io.Reader, outfile io.Writer) ([]byte, error) {
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// a chunk is the last one when only the trailer follows it
+	recordSize := int(header.ChunkSize) + encryptionTagSize
+	reader := bufio.NewReaderSize(infile, recordSize+encryptionTrailerSize)
+
+	plain := make([]byte, 0, header.ChunkSize)
+	var index uint32
+	for {
+		peek, err := reader.Peek(recordSize + encryptionTrailerSize)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		last := len(peek) < recordSize+encryptionTrailerSize
+		n := recordSize
+		if last {
+			n = len(peek) - encryptionTrailerSize
+		}
+		if n < 0 || (n > 0 && n <= encryptionTagSize) {
+			return nil, errors.New("truncated file")
+		}
+
+		if n > 0 {
+			plain, err = aead.Open(plain[:0], encryptionNonce(header.NoncePrefix, index, false), peek[:n], header.raw)
+			if err != nil {
+				return nil, fmt.Errorf("invalid data (chunk %d), is the key correct?", index)
+			}
+
+			_, err = outfile.Write(plain)
+			if err != nil {
+				return nil, err
+			}
+
+			_, err = reader.Discard(n)
+			if err != nil {
+				return nil, err
+			}
+			index++
+		}
+
+		if last {
+			break
+		}
+	}
+
+	trailer := make([]byte, encryptionTrailerSize)
+	_, err = io.ReadFull(reader, trailer)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := trailer[:sha256.Size]
+	aad := append(append([]byte{}, header.raw...), sum...)
+	_, err = aead.Open(nil, encryptionNonce(header.NoncePrefix, index, true), trailer[sha256.Size:], aad)
+	if err != nil {
+		return nil, errors.New("invalid trailer, is the file truncated?")
+	}
+
+	return sum, nil
+}
+
+// IsFileEncrypted checks if a file is encrypted by looking for a Barry signature
 func IsFileEncrypted(filename string) (bool, error) {
 	file, err := os.Open(filename)
 	if err != nil {
@@ -126,7 +1031,8 @@ func IsFileEncrypted(filename string) (bool, error) {
 		return false, err
 	}
 
-	if string(sig) == BarrySignature {
+	switch string(sig) {
+	case BarrySignature, BarrySignatureV2, BarrySignatureV3, BarrySignatureV4:
 		return true, nil
 	}
 
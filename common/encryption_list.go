@@ -0,0 +1,23 @@
+package common
+
+import "time"
+
+// APIEncryption is an [[encryption]] key (never the key itself)
+type APIEncryption struct {
+	Name          string
+	Type          string
+	Default       bool
+	Escrow        bool
+	UnlockedUntil time.Time // public keys only, zero if locked
+}
+
+// APIEncryptionUsage describes the stored files using an encryption key
+// (local copies and remote objects), configured or not
+type APIEncryptionUsage struct {
+	Name        string
+	Configured  bool
+	LocalFiles  int
+	LocalSize   int64
+	RemoteFiles int
+	RemoteSize  int64
+}
@@ -0,0 +1,550 @@
+package common
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// testSizes are content sizes around chunk boundaries
+var testSizes = []int{0, 1, EncryptionChunkSize, EncryptionChunkSize + 1, 3*EncryptionChunkSize + 100}
+
+// testFormat writes files of a format, barry itself only writes BARRY3
+// and BARRY4 files (older ones are still read)
+type testFormat struct {
+	name        string
+	version     int
+	compression string
+	keys        []EncryptionKey
+	keyCallback func(string) ([]byte, error)
+	encrypt     func(t *testing.T, plain []byte) []byte
+}
+
+func testRandomBytes(t *testing.T, size int) []byte {
+	b := make([]byte, size)
+	_, err := io.ReadFull(cryptorand.Reader, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// testContent returns size bytes of (deterministic) content
+func testContent(size int) []byte {
+	b := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(b)
+	return b
+}
+
+func testKeyCallback(keys map[string][]byte) func(string) ([]byte, error) {
+	return func(name string) ([]byte, error) {
+		key, exists := keys[name]
+		if !exists {
+			return nil, fmt.Errorf("unknown key '%s'", name)
+		}
+		return key, nil
+	}
+}
+
+// testEncryptV1 writes a BARRY1 file: AES-CTR, checksum in the header
+func testEncryptV1(t *testing.T, plain []byte, keyName string, key []byte) []byte {
+	var out bytes.Buffer
+	out.WriteString(BarrySignature)
+	out.WriteString(BarryComment)
+	out.WriteByte(0)
+	out.WriteString(keyName)
+	out.WriteByte(0)
+	sum := sha256.Sum256(plain)
+	out.Write(sum[:])
+	iv := testRandomBytes(t, EncryptionIvSize)
+	out.Write(iv)
+	binary.Write(&out, binary.LittleEndian, uint32(4096))
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, len(plain))
+	cipher.NewCTR(block, iv).XORKeyStream(body, plain)
+	out.Write(body)
+	return out.Bytes()
+}
+
+// testEncryptV2 writes a BARRY2 file: AES-GCM chunks with the master key,
+// the whole header being authenticated
+func testEncryptV2(t *testing.T, plain []byte, keyName string, key []byte) []byte {
+	prefix := testRandomBytes(t, encryptionNoncePrefixSize)
+
+	var out bytes.Buffer
+	out.WriteString(BarrySignatureV2)
+	out.WriteString(BarryCommentV2)
+	out.WriteByte(0)
+	out.WriteString(keyName)
+	out.WriteByte(0)
+	out.Write(prefix)
+	binary.Write(&out, binary.LittleEndian, uint32(EncryptionChunkSize))
+	raw := append([]byte{}, out.Bytes()...)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var index uint32
+	for start := 0; start < len(plain); start += EncryptionChunkSize {
+		end := start + EncryptionChunkSize
+		if end > len(plain) {
+			end = len(plain)
+		}
+		out.Write(aead.Seal(nil, encryptionNonce(prefix, index, false), plain[start:end], raw))
+		index++
+	}
+
+	sum := sha256.Sum256(plain)
+	out.Write(sum[:])
+	out.Write(aead.Seal(nil, encryptionNonce(prefix, index, true), nil, append(raw, sum[:]...)))
+	return out.Bytes()
+}
+
+func testFormats(t *testing.T) []testFormat {
+	key := testRandomBytes(t, 32)
+	backup := testRandomBytes(t, 32)
+	identity, public, err := GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyCallback := testKeyCallback(map[string][]byte{"test": key, "backup": backup, "escrow": identity})
+	keys := []EncryptionKey{
+		{Name: "test", Key: key},
+		{Name: "backup", Key: backup},
+		{Name: "escrow", PublicKey: public},
+	}
+
+	current := func(keys []EncryptionKey, compression string) func(*testing.T, []byte) []byte {
+		return func(t *testing.T, plain []byte) []byte {
+			var out bytes.Buffer
+			err := EncryptStreamCompressed(bytes.NewReader(plain), &out, keys, compression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return out.Bytes()
+		}
+	}
+
+	return []testFormat{
+		{
+			name:        "BARRY1",
+			version:     EncryptionV1,
+			keys:        keys[:1],
+			keyCallback: keyCallback,
+			encrypt: func(t *testing.T, plain []byte) []byte {
+				return testEncryptV1(t, plain, "test", key)
+			},
+		},
+		{
+			name:        "BARRY2",
+			version:     EncryptionV2,
+			keys:        keys[:1],
+			keyCallback: keyCallback,
+			encrypt: func(t *testing.T, plain []byte) []byte {
+				return testEncryptV2(t, plain, "test", key)
+			},
+		},
+		{
+			name:        "BARRY3",
+			version:     EncryptionV3,
+			keys:        keys,
+			keyCallback: keyCallback,
+			encrypt:     current(keys, CompressionNone),
+		},
+		{
+			name:        "BARRY3-backup",
+			version:     EncryptionV3,
+			keys:        keys[1:2],
+			keyCallback: testKeyCallback(map[string][]byte{"backup": backup}),
+			encrypt:     current(keys[1:2], CompressionNone),
+		},
+		{
+			name:        "BARRY3-x25519",
+			version:     EncryptionV3,
+			keys:        keys[2:],
+			keyCallback: testKeyCallback(map[string][]byte{"escrow": identity}),
+			encrypt:     current(keys[2:], CompressionNone),
+		},
+		{
+			name:        "BARRY4-gzip",
+			version:     EncryptionV4,
+			compression: CompressionGzip,
+			keys:        keys,
+			keyCallback: keyCallback,
+			encrypt:     current(keys, CompressionGzip),
+		},
+		{
+			name:        "BARRY4-zstd",
+			version:     EncryptionV4,
+			compression: CompressionZstd,
+			keys:        keys,
+			keyCallback: keyCallback,
+			encrypt:     current(keys, CompressionZstd),
+		},
+	}
+}
+
+// testDecrypt decrypts with DecryptFile and NewDecryptReader, which must
+// agree
+func testDecrypt(encrypted []byte, keyCallback func(string) ([]byte, error)) ([]byte, error) {
+	var out bytes.Buffer
+	err := DecryptFile(bytes.NewReader(encrypted), &out, keyCallback)
+
+	var streamed []byte
+	reader, errR := NewDecryptReader(bytes.NewReader(encrypted), keyCallback)
+	if errR == nil {
+		streamed, errR = io.ReadAll(reader)
+		reader.Close()
+	}
+
+	if (err == nil) != (errR == nil) {
+		return nil, fmt.Errorf("DecryptFile error: %v, NewDecryptReader error: %v", err, errR)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(out.Bytes(), streamed) {
+		return nil, fmt.Errorf("DecryptFile and NewDecryptReader contents differ")
+	}
+	return out.Bytes(), nil
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	for _, format := range testFormats(t) {
+		for _, size := range testSizes {
+			format, size := format, size
+			t.Run(fmt.Sprintf("%s/%d", format.name, size), func(t *testing.T) {
+				plain := testContent(size)
+				encrypted := format.encrypt(t, plain)
+
+				header, err := ReadEncryptionHeader(bytes.NewReader(encrypted))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if header.Version != format.version {
+					t.Fatalf("version is %d, expected %d", header.Version, format.version)
+				}
+				if header.Compression != format.compression {
+					t.Fatalf("compression is '%s', expected '%s'", header.Compression, format.compression)
+				}
+				if header.KeyName != format.keys[0].Name {
+					t.Fatalf("key name is '%s', expected '%s'", header.KeyName, format.keys[0].Name)
+				}
+
+				decrypted, err := testDecrypt(encrypted, format.keyCallback)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(decrypted, plain) {
+					t.Fatalf("decrypted content differs (%d bytes, expected %d)", len(decrypted), len(plain))
+				}
+
+				_, sum, err := ReadEncryptionChecksum(bytes.NewReader(encrypted))
+				if err != nil {
+					t.Fatal(err)
+				}
+				expected := sha256.Sum256(plain)
+				if !bytes.Equal(sum, expected[:]) {
+					t.Fatal("checksum is not the one of the original content")
+				}
+			})
+		}
+	}
+}
+
+func TestEncryptedSize(t *testing.T) {
+	for _, format := range testFormats(t) {
+		for _, size := range testSizes {
+			format, size := format, size
+			t.Run(fmt.Sprintf("%s/%d", format.name, size), func(t *testing.T) {
+				plain := testContent(size)
+				encrypted := format.encrypt(t, plain)
+
+				header, err := ReadEncryptionHeader(bytes.NewReader(encrypted))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// stored content: the compressed one, for BARRY4
+				stored := int64(size)
+				if format.compression != CompressionNone {
+					var compressed bytes.Buffer
+					err = compress(bytes.NewReader(plain), &compressed, format.compression)
+					if err != nil {
+						t.Fatal(err)
+					}
+					stored = int64(compressed.Len())
+				}
+
+				plainSize := header.PlainSize(int64(len(encrypted)))
+				if plainSize != stored {
+					t.Fatalf("PlainSize is %d, expected %d", plainSize, stored)
+				}
+
+				encryptedSize := EncryptedSize(format.version, format.keys, stored)
+				if encryptedSize != int64(len(encrypted)) {
+					t.Fatalf("EncryptedSize is %d, file is %d bytes", encryptedSize, len(encrypted))
+				}
+			})
+		}
+	}
+}
+
+func TestEncryptionTampering(t *testing.T) {
+	plain := testContent(3*EncryptionChunkSize + 100)
+
+	for _, format := range testFormats(t) {
+		// BARRY1 is not authenticated, see TestEncryptionV1Checksum
+		if format.version == EncryptionV1 {
+			continue
+		}
+
+		encrypted := format.encrypt(t, plain)
+		header, err := ReadEncryptionHeader(bytes.NewReader(encrypted))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		start := int(header.Size())
+		record := int(header.ChunkSize) + encryptionTagSize
+		if len(encrypted) < start+3*record+encryptionTrailerSize {
+			t.Fatalf("%s: at least 3 chunks expected", format.name)
+		}
+		trailer := len(encrypted) - encryptionTrailerSize
+
+		// the nonce prefix is at the end of the authenticated part
+		prefix := len(header.raw) - 4 - encryptionNoncePrefixSize
+		if format.version == EncryptionV4 {
+			prefix--
+		}
+
+		cases := map[string]func(b []byte) []byte{
+			"truncated at first chunk end": func(b []byte) []byte {
+				return b[:start+record]
+			},
+			"truncated at second chunk end": func(b []byte) []byte {
+				return b[:start+2*record]
+			},
+			"truncated before trailer": func(b []byte) []byte {
+				return b[:trailer]
+			},
+			"truncated by one byte": func(b []byte) []byte {
+				return b[:len(b)-1]
+			},
+			"last chunk dropped": func(b []byte) []byte {
+				return append(b[:start+3*record], b[trailer:]...)
+			},
+			"flipped tag": func(b []byte) []byte {
+				b[start+record-1] ^= 1
+				return b
+			},
+			"flipped data": func(b []byte) []byte {
+				b[start+record] ^= 1
+				return b
+			},
+			"flipped checksum": func(b []byte) []byte {
+				b[trailer] ^= 1
+				return b
+			},
+			"reordered chunks": func(b []byte) []byte {
+				first := append([]byte{}, b[start:start+record]...)
+				copy(b[start:], b[start+record:start+2*record])
+				copy(b[start+record:], first)
+				return b
+			},
+			"tampered header comment": func(b []byte) []byte {
+				b[len(BarrySignature)] ^= 1
+				return b
+			},
+			"tampered header nonce prefix": func(b []byte) []byte {
+				b[prefix] ^= 1
+				return b
+			},
+		}
+
+		// other slots are tried when a wrapped key does not open
+		if format.version >= EncryptionV3 && len(format.keys) == 1 {
+			cases["tampered key slot"] = func(b []byte) []byte {
+				b[start-1] ^= 1
+				return b
+			}
+		}
+
+		if format.version == EncryptionV4 {
+			cases["tampered compression"] = func(b []byte) []byte {
+				other := CompressionGzip
+				if format.compression == CompressionGzip {
+					other = CompressionZstd
+				}
+				b[len(header.raw)-1] = compressionIDs[other]
+				return b
+			}
+		}
+
+		for name, tamper := range cases {
+			format, name, tamper := format, name, tamper
+			t.Run(format.name+"/"+name, func(t *testing.T) {
+				tampered := tamper(append([]byte{}, encrypted...))
+				_, err := testDecrypt(tampered, format.keyCallback)
+				if err == nil {
+					t.Fatal("tampered file decrypted without error")
+				}
+			})
+		}
+	}
+}
+
+func TestEncryptionV1Checksum(t *testing.T) {
+	key := testRandomBytes(t, 32)
+	keyCallback := testKeyCallback(map[string][]byte{"test": key})
+	encrypted := testEncryptV1(t, testContent(3*EncryptionChunkSize), "test", key)
+
+	cases := map[string]func(b []byte) []byte{
+		"truncated": func(b []byte) []byte {
+			return b[:len(b)-1]
+		},
+		"flipped data": func(b []byte) []byte {
+			b[len(b)-1] ^= 1
+			return b
+		},
+	}
+
+	for name, tamper := range cases {
+		_, err := testDecrypt(tamper(append([]byte{}, encrypted...)), keyCallback)
+		if err == nil {
+			t.Errorf("%s: tampered file decrypted without error", name)
+		}
+	}
+
+	wrongKey := testKeyCallback(map[string][]byte{"test": testRandomBytes(t, 32)})
+	_, err := testDecrypt(encrypted, wrongKey)
+	if err == nil {
+		t.Error("file decrypted with a wrong key")
+	}
+}
+
+func TestRewrapFile(t *testing.T) {
+	newKey := testRandomBytes(t, 32)
+	newKeys := []EncryptionKey{{Name: "new", Key: newKey}}
+	newKeyCallback := testKeyCallback(map[string][]byte{"new": newKey})
+
+	for _, format := range testFormats(t) {
+		format := format
+		t.Run(format.name, func(t *testing.T) {
+			plain := testContent(2*EncryptionChunkSize + 1)
+			encrypted := format.encrypt(t, plain)
+
+			var rewrapped bytes.Buffer
+			err := RewrapFile(bytes.NewReader(encrypted), &rewrapped, format.keyCallback, newKeys)
+			if format.version < EncryptionV3 {
+				if err == nil {
+					t.Fatal("a file without data key was rewrapped")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// only the header is written again
+			header, err := ReadEncryptionHeader(bytes.NewReader(encrypted))
+			if err != nil {
+				t.Fatal(err)
+			}
+			newHeader, err := ReadEncryptionHeader(bytes.NewReader(rewrapped.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(rewrapped.Bytes()[newHeader.Size():], encrypted[header.Size():]) {
+				t.Fatal("rewrapped file content differs")
+			}
+
+			decrypted, err := testDecrypt(rewrapped.Bytes(), newKeyCallback)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decrypted, plain) {
+				t.Fatal("decrypted content differs")
+			}
+
+			_, err = testDecrypt(rewrapped.Bytes(), format.keyCallback)
+			if err == nil {
+				t.Fatal("rewrapped file decrypted with the previous keys")
+			}
+		})
+	}
+}
+
+func TestRekeyFile(t *testing.T) {
+	newKey := testRandomBytes(t, 32)
+	newKeys := []EncryptionKey{{Name: "new", Key: newKey}}
+	newKeyCallback := testKeyCallback(map[string][]byte{"new": newKey})
+
+	for _, format := range testFormats(t) {
+		format := format
+		t.Run(format.name, func(t *testing.T) {
+			plain := testContent(2*EncryptionChunkSize + 1)
+			encrypted := format.encrypt(t, plain)
+
+			var rekeyed bytes.Buffer
+			err := RekeyFile(bytes.NewReader(encrypted), &rekeyed, format.keyCallback, newKeys)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			header, err := ReadEncryptionHeader(bytes.NewReader(rekeyed.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// older formats are encrypted again, BARRY3/4 are rewrapped
+			version := format.version
+			if version < EncryptionV3 {
+				version = EncryptionV3
+			}
+			if header.Version != version || header.Compression != format.compression {
+				t.Fatalf("rekeyed file is BARRY%d (compression '%s')", header.Version, header.Compression)
+			}
+
+			// see key rotation, the object size is known in advance
+			stored := header.PlainSize(int64(rekeyed.Len()))
+			if format.compression == CompressionNone && stored != int64(len(plain)) {
+				t.Fatalf("PlainSize is %d, expected %d", stored, len(plain))
+			}
+			if size := EncryptedSize(version, newKeys, stored); size != int64(rekeyed.Len()) {
+				t.Fatalf("EncryptedSize is %d, file is %d bytes", size, rekeyed.Len())
+			}
+
+			decrypted, err := testDecrypt(rekeyed.Bytes(), newKeyCallback)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decrypted, plain) {
+				t.Fatal("decrypted content differs")
+			}
+
+			_, err = testDecrypt(rekeyed.Bytes(), format.keyCallback)
+			if err == nil {
+				t.Fatal("rekeyed file decrypted with the previous keys")
+			}
+		})
+	}
+}
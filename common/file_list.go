@@ -9,7 +9,9 @@ type APIFileListEntries []APIFileListEntry
 type APIFileListEntry struct {
 	Filename      string
 	ModTime       time.Time
-	Size          int64
+	Size          int64 // stored size (compressed, see Compression)
+	OriginalSize  int64
+	Compression   string
 	ExpireLocal   time.Time // expiration date
 	ExpireRemote  time.Time // (same)
 	RemoteKeep    time.Duration
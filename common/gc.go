@@ -0,0 +1,43 @@
+package common
+
+import "time"
+
+// Garbage collection item types
+const (
+	GCItemObject    = "object"    // object not referenced by any file
+	GCItemSegments  = "segments"  // orphan Swift segments (one prefix)
+	GCItemMultipart = "multipart" // incomplete S3 multipart upload
+	GCItemTempFile  = "temp-file" // temporary upload file (local, SFTP)
+)
+
+// Garbage collection statuses
+const (
+	GCStatusScanning = "scanning"
+	GCStatusReady    = "ready"
+	GCStatusDeleting = "deleting"
+	GCStatusDone     = "done"
+)
+
+// APIGCReport is a garbage collection report: the dry-run result of a
+// scan, then the deletion result once confirmed using its ID
+type APIGCReport struct {
+	ID        string
+	Status    string
+	StartedAt time.Time
+	Duration  time.Duration
+	MinAge    time.Duration
+	Items     []APIGCItem
+	TooRecent int // items ignored because of MinAge
+	Errors    []string
+	Deleted   int
+}
+
+// APIGCItem is an unreferenced object or an upload leftover
+type APIGCItem struct {
+	Type      string
+	Container string
+	Path      string
+	Objects   int
+	Size      int64
+	ModTime   time.Time
+}
@@ -0,0 +1,32 @@
+package common
+
+import "time"
+
+// Key rotation file statuses
+const (
+	KeyRotationFilePending   = "pending"
+	KeyRotationFileUnsealing = "unsealing"
+	KeyRotationFileDone      = "done"
+	KeyRotationFileSkipped   = "skipped"
+	KeyRotationFileFailed    = "failed"
+)
+
+// APIKeyRotationStatus describes the progress of a key rotation job
+type APIKeyRotationStatus struct {
+	ID             string
+	From           string
+	To             string
+	Remote         bool
+	CreatedAt      time.Time
+	FinishedAt     time.Time
+	FilesTotal     int
+	FilesDone      int
+	FilesSkipped   int
+	FilesFailed    int
+	FilesUnsealing int
+	BytesTotal     int64
+	BytesDone      int64
+	Current        string
+	References     int // files still using the From key, once finished
+	Errors         []string
+}
@@ -0,0 +1,15 @@
+package common
+
+import "time"
+
+// APIMetadataBackfill is the state of the last remote metadata backfill
+// (metadata attached to objects uploaded before this feature)
+type APIMetadataBackfill struct {
+	Running   bool
+	Project   string // empty: all projects
+	StartedAt time.Time
+	Duration  time.Duration
+	Files     int
+	Updated   int
+	Errors    []string
+}
@@ -0,0 +1,33 @@
+package common
+
+import "time"
+
+// Migration file statuses
+const (
+	MigrationFilePending   = "pending"
+	MigrationFileUnsealing = "unsealing"
+	MigrationFileDone      = "done"
+	MigrationFileSkipped   = "skipped"
+	MigrationFileFailed    = "failed"
+)
+
+// APIMigrationStatus describes the progress of a storage migration job
+type APIMigrationStatus struct {
+	ID             string
+	From           string
+	To             string
+	Project        string
+	CreatedAt      time.Time
+	FinishedAt     time.Time
+	FilesTotal     int
+	FilesDone      int
+	FilesSkipped   int
+	FilesFailed    int
+	FilesUnsealing int
+	BytesTotal     int64
+	BytesDone      int64
+	Current        string
+	CurrentSize    int64
+	CurrentWritten int64
+	Errors         []string
+}
@@ -0,0 +1,14 @@
+package common
+
+import "time"
+
+// APIRetrieval is a file queued for retrieval: barryd makes it available
+// (unseal, download, decrypt) and sends an alert when it's ready
+type APIRetrieval struct {
+	Path        string
+	RequestedAt time.Time
+	RequestedBy string
+	Status      string
+	ETA         time.Duration
+	Error       string
+}
@@ -0,0 +1,13 @@
+package common
+
+import "time"
+
+// APIRetrievedFile is a local copy of a remote-only file, downloaded on
+// request (it's deleted after some time without use)
+type APIRetrievedFile struct {
+	Path        string
+	Size        int64
+	RetrievedAt time.Time
+	UsedAt      time.Time
+	ExpireAt    time.Time
+}
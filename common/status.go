@@ -12,6 +12,9 @@ type APIStatus struct {
 	TotalFileCost    float64 `format:"money"`
 	UploadQueueSize  int
 	EncryptQueueSize int
+	Migration        string
+	KeyRotation      string
 	Uploaders        []string `format:"ignore"`
 	Encrypters       []string `format:"ignore"`
+	Containers       []string `format:"ignore"`
 }
@@ -3,6 +3,7 @@ package common
 import (
 	"errors"
 	"fmt"
+	"io"
 	"net/url"
 	"os"
 	"path"
@@ -89,14 +90,14 @@ func CleanURL(urlIn string) (string, error) {
 }
 
 // ReadString read a string from a file, byte by byte, until null (slow but convenient)
-func ReadString(file *os.File, maxLen int) (string, error) {
+func ReadString(file io.Reader, maxLen int) (string, error) {
 	var err error
 	var s []byte
 
 	b := make([]byte, 1)
 
 	for {
-		_, err = file.Read(b)
+		_, err = io.ReadFull(file, b)
 		if err != nil {
 			return "", err
 		}
@@ -9,12 +9,15 @@ require (
 	github.com/briandowns/spinner v1.16.0
 	github.com/c2h5oh/datasize v0.0.0-20200825124411-48ed595a09d2
 	github.com/fatih/color v1.12.0
+	github.com/klauspost/compress v1.13.5
 	github.com/mattn/go-isatty v0.0.13
+	github.com/minio/minio-go/v7 v7.0.23
 	github.com/mitchellh/go-homedir v1.1.0
 	github.com/ncw/swift/v2 v2.0.0
 	github.com/olekukonko/tablewriter v0.0.5
-	github.com/schollz/progressbar v1.0.0
-	github.com/schollz/progressbar/v3 v3.8.1 // indirect
+	github.com/pkg/sftp v1.13.4
+	github.com/schollz/progressbar/v3 v3.8.1
 	github.com/spf13/cobra v1.1.3-0.20210510231933-4590150168e9
+	golang.org/x/crypto v0.0.0-20210506145944-38f3c27a63bf
 	golang.org/x/sys v0.0.0-20210816074244-15123e1e1f71 // indirect
 )